@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// categoryFlags collects repeated "name=dir" flags defining the directory of completed torrents of each category.
+type categoryFlags map[string]torrent.CategoryConfig
+
+func (c categoryFlags) String() string {
+	names := make([]string, 0, len(c))
+	for name, config := range c {
+		names = append(names, name+"="+config.CompleteDir)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func (c categoryFlags) Set(value string) error {
+	name, dir, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid category %q, expected name=dir", value)
+	}
+
+	c[name] = torrent.CategoryConfig{CompleteDir: dir}
+
+	return nil
+}
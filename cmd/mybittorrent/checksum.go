@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// checksumFlags collects the expected checksums given as algorithm:hex, e.g. sha256:9f86d0...
+type checksumFlags map[string]string
+
+func (f checksumFlags) String() string {
+	sums := make([]string, 0, len(f))
+	for algorithm, sum := range f {
+		sums = append(sums, algorithm+":"+sum)
+	}
+	sort.Strings(sums)
+
+	return strings.Join(sums, ",")
+}
+
+func (f checksumFlags) Set(value string) error {
+	algorithm, sum, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("invalid checksum %q, expected algorithm:hex", value)
+	}
+	algorithm = strings.ToLower(algorithm)
+	if _, ok := torrent.ChecksumAlgorithms[algorithm]; !ok {
+		return fmt.Errorf("unsupported checksum algorithm %q, expected md5, sha1 or sha256", algorithm)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*torrent.ChecksumAlgorithms[algorithm]().Size() {
+		return fmt.Errorf("invalid %s checksum %q", algorithm, sum)
+	}
+
+	f[algorithm] = strings.ToLower(sum)
+
+	return nil
+}
+
+// registerChecksumFlags adds the checksum options of the download command to flags. Returns the function building
+// the options once the flags are parsed.
+func registerChecksumFlags(flags *flag.FlagSet) func() (torrent.ChecksumOptions, error) {
+	algorithms := flags.String("checksums", "", "comma separated checksums written to a manifest once downloaded: md5, sha1, sha256")
+	manifestPath := flags.String("checksum-manifest", "", "file where the checksums are written, <output>.checksums when empty")
+	expected := checksumFlags{}
+	flags.Var(expected, "expect", "expected checksum of the downloaded file as algorithm:hex (repeatable)")
+
+	return func() (torrent.ChecksumOptions, error) {
+		o := torrent.ChecksumOptions{ManifestPath: *manifestPath, Expected: expected}
+		if *algorithms != "" {
+			for _, algorithm := range strings.Split(*algorithms, ",") {
+				algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+				if _, ok := torrent.ChecksumAlgorithms[algorithm]; !ok {
+					return o, fmt.Errorf("unsupported checksum algorithm %q, expected md5, sha1 or sha256", algorithm)
+				}
+				if !slices.Contains(o.Algorithms, algorithm) {
+					o.Algorithms = append(o.Algorithms, algorithm)
+				}
+			}
+		}
+
+		return o, nil
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// Exit codes of the commands. Successful commands, and the ones asked for their help, exit with 0
+const EXIT_FAILURE = 1       // The command failed, its error is printed on the standard error
+const EXIT_USAGE = 2         // The command or its arguments are invalid, the usage is printed on the standard error
+const EXIT_INTERRUPTED = 130 // A download was interrupted by a signal, it resumes when started again
+
+// command is a command of the CLI.
+type command struct {
+	name    string
+	args    string // Arguments of the usage, the options excluded
+	summary string
+	run     func(ctx context.Context, clients *clientFactory, args []string) error
+}
+
+// clientFactory creates the clients of the commands once their flags are parsed, configured by the options of the
+// global flags followed by the ones of the command.
+type clientFactory struct {
+	opts       []torrent.Option
+	encryption torrent.EncryptionPolicy // Of the global --encryption flag, the default of the commands' one
+	clients    []*torrent.Client
+}
+
+// new returns a client configured by the global options and opts.
+func (f *clientFactory) new(opts ...torrent.Option) *torrent.Client {
+	c := torrent.NewClient(append(slices.Clone(f.opts), opts...)...)
+	f.clients = append(f.clients, c)
+
+	return c
+}
+
+// close closes the clients created by f.
+func (f *clientFactory) close() {
+	for _, c := range f.clients {
+		c.Close()
+	}
+}
+
+// commands returns the commands of the CLI, in the order of the help.
+func commands() []command {
+	return []command{
+		{"decode", "[-f <file>] [<bencoded value>]", "Print a bencoded value, given or read from a file or stdin, as JSON.", runDecode},
+		{"info", "<file.torrent|magnet link>", "Print the metainfo of a torrent file or magnet link.", runInfo},
+		{"peers", "<file.torrent|magnet link>", "Print the peers the trackers of a torrent file or magnet link return.", runPeers},
+		{"scrape", "<file.torrent|magnet link>", "Print the seeders, leechers and completed downloads the trackers of a torrent file or magnet link report.", runScrape},
+		{"handshake", "<file.torrent|magnet link> <ip:port>", "Print the peer ID of a peer of a torrent file or magnet link.", runHandshake},
+		{"download_piece", "-o <output> <file.torrent|magnet link> <piece index>", "Download a piece of a torrent file or magnet link.", runDownloadPiece},
+		{"download", "-o <output> <file.torrent|magnet link> | -d <dir> <file.torrent|magnet link>...", "Download torrent files or magnet links, resuming previous downloads to the same outputs.", runDownload},
+		{"stream", "-o <output> <file.torrent|magnet link>", "Download a torrent file or magnet link in order, serving it over HTTP while it downloads.", runStream},
+		{"magnet_parse", "<magnet link>", "Print the tracker and info hash of a magnet link.", runMagnetParse},
+		{"magnet_peers", "<magnet link>", "Print the peers the trackers of a magnet link return.", runMagnetPeers},
+		{"magnet_handshake", "<magnet link>", "Print the peer ID and metadata extension ID of a peer of a magnet link.", runMagnetHandshake},
+		{"magnet_info", "<magnet link>", "Print the metainfo of a magnet link, fetched from its peers.", runMagnetInfo},
+		{"magnet_download_piece", "-o <output> <magnet link> <piece index>", "Download a piece of a magnet link.", runMagnetDownloadPiece},
+		{"magnet_download", "-o <output> <magnet link>", "Download a magnet link, resuming a previous download to the same output.", runMagnetDownload},
+		{"create", "-o <out.torrent> <path>", "Create the torrent of a file or directory.", func(_ context.Context, clients *clientFactory, args []string) error {
+			return runCreate(clients.new(), args)
+		}},
+		{"verify", "-o <file-or-dir> <file.torrent>", "Check a downloaded file against the piece hashes of its torrent.", func(_ context.Context, clients *clientFactory, args []string) error {
+			return runVerify(clients.new(), args)
+		}},
+		{"dht_get_peers", "<info hash>", "Print the peers of an info hash found in the DHT.", runDhtGetPeers},
+		{"daemon", "[file.torrent...]", "Download torrents in the background, controlled through an HTTP API.", func(_ context.Context, clients *clientFactory, args []string) error {
+			return runDaemon(clients.new(), args)
+		}},
+		{"remote", "<list|add|set|pause|resume|rm|limit|stats> [arguments]", "Control a running daemon.", func(_ context.Context, _ *clientFactory, args []string) error {
+			return runRemote(args)
+		}},
+		{"stats", "", "Print the statistics persisted by the daemon.", func(_ context.Context, _ *clientFactory, args []string) error {
+			return runStats(args)
+		}},
+	}
+}
+
+// lookupCommand returns the command named name.
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+// usageError is an invalid invocation of a command, reported along with its usage. It wraps flag.ErrHelp when the
+// help of the command was asked.
+type usageError struct {
+	flags *flag.FlagSet
+	err   error
+}
+
+func (e *usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *usageError) Unwrap() error {
+	return e.err
+}
+
+// newCommandFlags returns the flag set of the command named name. Parse errors are not printed, they are returned as
+// usage errors by parseArgs.
+func newCommandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+
+	return flags
+}
+
+// parseArgs parses the options of a command, which may come before, between or after its arguments. Returns the
+// arguments, failing when there are fewer than minArgs or more than maxArgs, -1 for no limit.
+func parseArgs(flags *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, &usageError{flags: flags, err: err}
+		}
+		rest := flags.Args()
+
+		// The options end at --, the rest are all arguments
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	if len(positional) < minArgs {
+		return nil, usageErrorf(flags, "missing arguments")
+	}
+	if maxArgs >= 0 && len(positional) > maxArgs {
+		return nil, usageErrorf(flags, "unexpected arguments: %s", strings.Join(positional[maxArgs:], " "))
+	}
+
+	return positional, nil
+}
+
+// parseFlags parses the options at the beginning of args, the arguments after them are left in flags.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return &usageError{flags: flags, err: err}
+	}
+
+	return nil
+}
+
+// usageErrorf returns a usage error of the command of flags.
+func usageErrorf(flags *flag.FlagSet, format string, a ...any) error {
+	return &usageError{flags: flags, err: fmt.Errorf(format, a...)}
+}
+
+// printCommandUsage writes the usage of the command of flags to w, with its options.
+func printCommandUsage(w io.Writer, flags *flag.FlagSet) {
+	name, _, _ := strings.Cut(flags.Name(), " ")
+	if cmd, ok := lookupCommand(name); ok {
+		fmt.Fprintf(w, "Usage: mybittorrent [global options] %s [options] %s\n\n%s\n", flags.Name(), cmd.args, cmd.summary)
+	} else {
+		fmt.Fprintf(w, "Usage: mybittorrent [global options] %s [options]\n", flags.Name())
+	}
+
+	hasOptions := false
+	flags.VisitAll(func(*flag.Flag) { hasOptions = true })
+	if hasOptions {
+		fmt.Fprintf(w, "\nOptions:\n")
+		flags.SetOutput(w)
+		flags.PrintDefaults()
+		flags.SetOutput(io.Discard)
+	}
+}
+
+// printUsage writes the usage of the CLI to w: the global options and the commands.
+func printUsage(w io.Writer, global *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: mybittorrent [global options] <command> [options] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "  %-22s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun mybittorrent <command> --help for the usage of a command.\n\nGlobal options:\n")
+	global.SetOutput(w)
+	global.PrintDefaults()
+	global.SetOutput(io.Discard)
+
+	fmt.Fprintf(w, "\nExit codes:\n  0    success\n  %-4d the command failed\n  %-4d invalid command or arguments\n  %-4d download interrupted, it resumes when started again\n",
+		EXIT_FAILURE, EXIT_USAGE, EXIT_INTERRUPTED)
+}
+
+// exitCode reports the error of a command and returns the exit code of the process. Usage errors are printed with the
+// usage of their command on the standard error, the help on the standard output. Other errors are printed on the
+// standard error too, the standard output is kept for the results.
+func exitCode(ctx context.Context, err error) int {
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usageErr) && errors.Is(err, flag.ErrHelp):
+		printCommandUsage(os.Stdout, usageErr.flags)
+		return 0
+	case errors.As(err, &usageErr):
+		fmt.Fprintln(os.Stderr, err)
+		printCommandUsage(os.Stderr, usageErr.flags)
+		return EXIT_USAGE
+	case ctx.Err() != nil:
+		fmt.Fprintln(os.Stderr, "Download interrupted, it resumes when started again")
+		return EXIT_INTERRUPTED
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILURE
+	}
+}
+
+// headerFlags collects the headers of the tracker requests given as "Name: value".
+type headerFlags http.Header
+
+func (f headerFlags) String() string {
+	var headers []string
+	for name, values := range f {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	sort.Strings(headers)
+
+	return strings.Join(headers, ", ")
+}
+
+func (f headerFlags) Set(value string) error {
+	name, headerValue, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid header %q, expected Name: value", value)
+	}
+	http.Header(f).Add(name, strings.TrimSpace(headerValue))
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// daemonConfig is the content of the daemon configuration file. Flags given on the command line take precedence over
+// the values in the file.
+type daemonConfig struct {
+	Listen      string                            `json:"listen,omitempty"`
+	DownloadDir string                            `json:"downloadDir,omitempty"`
+	StateDir    string                            `json:"stateDir,omitempty"`
+	WatchDir    string                            `json:"watchDir,omitempty"`
+	MaxActive   *int                              `json:"maxActive,omitempty"`
+	Categories  map[string]torrent.CategoryConfig `json:"categories,omitempty"` // Overridden by the --category flags
+	GeoIP       []string                          `json:"geoip,omitempty"`      // Overridden by the --geoip flags
+	Bandwidth   torrent.BandwidthSchedule         `json:"bandwidth"`
+}
+
+// loadDaemonConfig reads the JSON configuration file at path
+func loadDaemonConfig(path string) (daemonConfig, error) {
+	var config daemonConfig
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	if err := json.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	if err := config.Bandwidth.Validate(); err != nil {
+		return config, fmt.Errorf("invalid bandwidth schedule in %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// applyConfigValue sets the flag with the given name to value, unless the flag was explicitly given or value is empty.
+func applyConfigValue(flags *flag.FlagSet, name, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	explicit := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			explicit = true
+		}
+	})
+	if explicit {
+		return nil
+	}
+
+	return flags.Set(name, value)
+}
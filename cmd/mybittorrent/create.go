@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// runCreate writes the torrent of a file, or of the files of a directory, to the -o path. Pieces are hashed across the
+// files, in the order of their paths.
+func runCreate(c *torrent.Client, args []string) error {
+	flags := newCommandFlags("create")
+	output := flags.String("o", "", "torrent file to write")
+	announce := flags.String("announce", "", "announce URL of the tracker")
+	pieceLength := flags.Int("piece-length", 0, "length of the pieces in bytes, a power of two of at least 16 KiB, chosen from the size when 0")
+
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return usageErrorf(flags, "missing output flag: -o")
+	}
+	if *pieceLength != 0 && (*pieceLength < torrent.MIN_CREATE_PIECE_LENGTH || *pieceLength&(*pieceLength-1) != 0) {
+		return usageErrorf(flags, "invalid piece length %d, expected a power of two of at least %d", *pieceLength, torrent.MIN_CREATE_PIECE_LENGTH)
+	}
+
+	created, err := c.Create(args[0], *announce, *pieceLength, *output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s\nInfo Hash: %s\nFiles: %d\nLength: %d\nPiece Length: %d\nPieces: %d\n", *output,
+		hex.EncodeToString(created.InfoHash), created.Files, created.Length, created.PieceLength, created.Pieces)
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const DEFAULT_DAEMON_ADDRESS = "127.0.0.1:9091"
+
+// runDaemon parses the daemon command arguments, adds the given torrents and serves the HTTP API until it fails.
+func runDaemon(c *torrent.Client, args []string) error {
+	flags := newCommandFlags("daemon")
+	configPath := flags.String("config", "", "JSON configuration file")
+	address := flags.String("listen", DEFAULT_DAEMON_ADDRESS, "address of the HTTP API")
+	downloadDir := flags.String("d", ".", "directory where torrents are downloaded")
+	pprof := flags.Bool("pprof", false, "expose net/http/pprof endpoints under /debug/pprof/")
+	stateDir := flags.String("state-dir", defaultStateDir(), "directory where the client state is kept")
+	maxActive := flags.Int("max-active", torrent.DEFAULT_MAX_ACTIVE_TORRENTS, "maximum amount of torrents downloading at the same time, 0 for no limit")
+	categories := categoryFlags{}
+	flags.Var(categories, "category", "directory where completed torrents of a category are moved, as name=dir (repeatable)")
+	var geoipPaths geoipFlags
+	flags.Var(&geoipPaths, "geoip", "MaxMind DB file used to locate peers in the statistics (repeatable)")
+	portMapping := flags.Bool("port-mapping", true, "forward the peer port on the router using NAT-PMP or UPnP")
+	gateway := flags.String("gateway", "", "address of the router for NAT-PMP, the default gateway when empty")
+	sessionLimits := registerSessionFlags(flags)
+	watchDir := flags.String("watch-dir", "", "directory where dropped torrent files are added, then moved to its added or failed subdirectory")
+	args, err := parseArgs(flags, args, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	var config daemonConfig
+	if *configPath != "" {
+		var err error
+		config, err = loadDaemonConfig(*configPath)
+		if err != nil {
+			return err
+		}
+
+		configValues := map[string]string{
+			"listen":    config.Listen,
+			"d":         config.DownloadDir,
+			"state-dir": config.StateDir,
+			"watch-dir": config.WatchDir,
+		}
+		if config.MaxActive != nil {
+			configValues["max-active"] = strconv.Itoa(*config.MaxActive)
+		}
+		for name, value := range configValues {
+			if err := applyConfigValue(flags, name, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Databases and categories from the flags replace the ones in the configuration
+	if len(geoipPaths) == 0 {
+		geoipPaths = config.GeoIP
+	}
+	for name, category := range config.Categories {
+		if _, ok := categories[name]; !ok {
+			categories[name] = category
+		}
+	}
+
+	d, err := torrent.NewDaemon(c, torrent.DaemonOptions{
+		DownloadDir: *downloadDir,
+		StateDir:    *stateDir,
+		WatchDir:    *watchDir,
+		MaxActive:   *maxActive,
+		Limits:      sessionLimits(),
+		Categories:  categories,
+		GeoIP:       geoipPaths,
+		Bandwidth:   config.Bandwidth,
+		Pprof:       *pprof,
+		PortMapping: *portMapping,
+		Gateway:     *gateway,
+		Torrents:    args,
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *address)
+	if err != nil {
+		return err
+	}
+
+	// Interrupting the daemon stops the API, and removes the port mappings before exiting
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	fmt.Printf("Daemon listening on %s\n", listener.Addr())
+
+	return d.Serve(ctx, listener)
+}
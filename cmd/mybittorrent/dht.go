@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// runDhtGetPeers prints the peers of the torrent with the given hex info hash found in the DHT, without asking trackers.
+func runDhtGetPeers(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("dht_get_peers")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	infoHash, err := hex.DecodeString(args[0])
+	if err != nil || len(infoHash) != torrent.DHT_ID_LENGTH {
+		return usageErrorf(flags, "invalid info hash: %s", args[0])
+	}
+
+	peers, err := c.DhtPeers(ctx, infoHash)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		fmt.Println(peer)
+	}
+
+	return nil
+}
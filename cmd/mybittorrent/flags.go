@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// encryptionFlag adds the --encryption option of the download commands to flags, overriding the policy defaultPolicy
+// of the global option. The returned policy configures the client of the command once the flags are parsed.
+func encryptionFlag(flags *flag.FlagSet, defaultPolicy torrent.EncryptionPolicy) *torrent.EncryptionPolicy {
+	policy := defaultPolicy
+	flags.Var(&policy, "encryption", "encryption of the peer connections: prefer, require or disable, the global --encryption by default")
+
+	return &policy
+}
+
+// strategyFlag adds the --strategy option of the download commands to flags, defaulting to rarest first. The returned
+// strategy configures the client of the command once the flags are parsed.
+func strategyFlag(flags *flag.FlagSet) *torrent.PieceStrategy {
+	strategy := torrent.STRATEGY_RAREST
+	flags.Var(&strategy, "strategy", "order of the downloaded pieces: rarest first, sequential or random")
+
+	return &strategy
+}
@@ -0,0 +1,16 @@
+package main
+
+import "strings"
+
+// geoipFlags collects repeated flags with the paths of MaxMind DB files.
+type geoipFlags []string
+
+func (g *geoipFlags) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *geoipFlags) Set(value string) error {
+	*g = append(*g, value)
+
+	return nil
+}
@@ -1,268 +1,676 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/binary"
+	"context"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
-)
+	"strings"
+	"syscall"
+	"time"
 
-// buildPeerAddresses uses the peers string returned by the tracker to build a slice of strings containing the peer
-// addresses
-func buildPeerAddresses(peersStr string) []string {
-	// Each peer is represented using 6 bytes. 4 bytes for the IP, and 2 for the port
-	const length = 6
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
 
-	n := len(peersStr) / length
+// runPeers prints the peers of a torrent file or magnet link. With --verbose, each peer is followed by its location
+// when GeoIP databases are given.
+func runPeers(ctx context.Context, clients *clientFactory, args []string) error {
+	return printPeers(ctx, clients, "peers", args)
+}
 
-	peerAddresses := make([]string, 0, n)
+// runMagnetPeers prints the peers of a magnet link, like peers.
+func runMagnetPeers(ctx context.Context, clients *clientFactory, args []string) error {
+	return printPeers(ctx, clients, "magnet_peers", args)
+}
 
-	for i := 0; i < n; i++ {
-		peer := peersStr[i*length : i*length+length]
+// printPeers prints the peers of the torrent file or magnet link given to the command named name.
+func printPeers(ctx context.Context, clients *clientFactory, name string, args []string) error {
+	flags := newCommandFlags(name)
+	verbose := flags.Bool("verbose", false, "show the country and network of every peer")
+	var geoipPaths geoipFlags
+	flags.Var(&geoipPaths, "geoip", "MaxMind DB file used to locate peers, e.g. GeoLite2-Country.mmdb (repeatable)")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
 
-		ipSlice := []byte(peer[:4])
-		portSlice := []byte(peer[4:])
+	geoip, err := torrent.OpenGeoIPDatabases(geoipPaths)
+	if err != nil {
+		return err
+	}
 
-		ip := fmt.Sprintf("%d.%d.%d.%d", ipSlice[0], ipSlice[1], ipSlice[2], ipSlice[3])
-		port := binary.BigEndian.Uint16(portSlice)
+	// The peers of magnet links are announced without their metadata
+	t, err := clients.new().LoadTorrent(args[0])
+	if err != nil {
+		return err
+	}
 
-		peerAddresses = append(peerAddresses, fmt.Sprintf("%s:%d", ip, port))
+	peerAddresses, err := t.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peerAddresses {
+		if *verbose {
+			fmt.Printf("%-21s %s\n", peer, geoip.Locate(peer))
+		} else {
+			fmt.Println(peer)
+		}
 	}
 
-	return peerAddresses
+	return nil
 }
 
-// peersQueryParams builds the query parameters needed to execute the peers request. Returns
-// a string containing the URL encoded query parameters
-func peersQueryParams(t torrent, req *http.Request) (string, error) {
-	left := t.info.length
-	if left == 0 {
-		// When downloading from magnet link, we don't know the file size. Hardcode a value
-		left = 999
-	}
-
-	q := req.URL.Query()
-	q.Add("info_hash", string(t.infoHash))
-	q.Add("peer_id", "kaykos-go-bittorrent")
-	q.Add("port", "6881")
-	q.Add("uploaded", "0")
-	q.Add("downloaded", "0")
-	q.Add("left", strconv.Itoa(left))
-	q.Add("compact", "1")
-
-	return q.Encode(), nil
+// globalFlags holds the options accepted before any command
+type globalFlags struct {
+	profile      profileFlags
+	otlpEndpoint string
+	port         portRange
+	portFallback int
+	wireDump     string
+	wirePayload  int
+	encryption   torrent.EncryptionPolicy
+	peerProxy    string
+	bindAddress  string
+	iface        string
+	ipv6         string
+	userAgent    string
+	headers      headerFlags
+	dnsServer    string
+	dnsTimeout   time.Duration
+	dnsCacheTTL  time.Duration
+	pipeline     int
+	peerTimeout  time.Duration
+	hashFailures int
+	maxPeers     int
+	dht          bool
+	dhtBootstrap string
+	noProgress   bool
+	stats        bool
+	verbose      bool
+	quiet        bool
+	logJSON      bool
+	maxDownload  rateFlag
+	maxUpload    rateFlag
+	peerDownload rateFlag
+	peerUpload   rateFlag
 }
 
-// infoHash bencodes the info map and returns the SHA-1 hash string representation
-func infoHash(info map[string]any) []byte {
-	infoStr := bencodeMap(info)
+// parseGlobalFlags parses the flags at the beginning of args. Returns the options, their flag set and the remaining
+// arguments, starting with the command.
+func parseGlobalFlags(args []string) (globalFlags, *flag.FlagSet, []string, error) {
+	g := globalFlags{
+		port:       portRange{first: torrent.DEFAULT_PORT, last: torrent.DEFAULT_PORT},
+		encryption: torrent.ENCRYPTION_DISABLE,
+		ipv6:       torrent.ANNOUNCE_IPV6_AUTO,
+		headers:    headerFlags{},
+	}
 
-	h := sha1.New()
-	h.Write([]byte(infoStr))
+	flags := newCommandFlags("mybittorrent")
+	g.profile.register(flags)
+	flags.StringVar(&g.otlpEndpoint, "otlp-endpoint", "", "export traces to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	flags.Var(&g.encryption, "encryption", "encryption of the peer connections: prefer, require or disable")
+	flags.StringVar(&g.peerProxy, "peer-proxy", "", "SOCKS5 proxy of the peer connections, as socks5://[user:password@]host:port")
+	flags.StringVar(&g.bindAddress, "bind-address", "", "local IP address of the peer connections and tracker requests")
+	flags.StringVar(&g.iface, "interface", "", "network interface of the peer connections and tracker requests, e.g. a VPN's tun0")
+	flags.StringVar(&g.ipv6, "announce-ipv6", torrent.ANNOUNCE_IPV6_AUTO, "IPv6 address announced to trackers for IPv6 peers to connect to, auto to detect it or none")
+	flags.StringVar(&g.userAgent, "user-agent", tracker.DEFAULT_USER_AGENT, "User-Agent of the tracker requests")
+	flags.Var(g.headers, "tracker-header", "header added to the HTTP tracker requests, as \"Name: value\" (repeatable)")
+	flags.StringVar(&g.dnsServer, "dns-server", "", "resolve tracker and peer hostnames with this DNS server, as host[:port], or DNS-over-HTTPS server, as https://host/dns-query")
+	flags.DurationVar(&g.dnsTimeout, "dns-timeout", torrent.DEFAULT_DNS_TIMEOUT, "timeout of a lookup with --dns-server")
+	flags.DurationVar(&g.dnsCacheTTL, "dns-cache-ttl", torrent.DEFAULT_DNS_CACHE_TTL, "how long addresses resolved with --dns-server are reused")
+	flags.Var(&g.port, "port", "port incoming peers connect to, announced to trackers: a port, a range like 6881-6889 or random")
+	flags.StringVar(&g.wireDump, "wire-dump", "", "record the messages exchanged with peers to this file, as JSON lines")
+	flags.IntVar(&g.wirePayload, "wire-dump-payload", 0, "bytes of the message payloads recorded in the wire dump, hex encoded")
+	flags.IntVar(&g.pipeline, "pipeline-depth", torrent.DEFAULT_PIPELINE_DEPTH, "block requests kept outstanding per peer")
+	flags.DurationVar(&g.peerTimeout, "peer-timeout", torrent.DEFAULT_PEER_TIMEOUT, "time a peer has to answer a block request, send the rest of a message or take a write, 0 for none")
+	flags.IntVar(&g.hashFailures, "max-hash-failures", torrent.DEFAULT_MAX_HASH_FAILURES, "corrupt pieces a peer sends before it's banned for the session, 0 to never ban")
+	flags.IntVar(&g.maxPeers, "max-peers", torrent.DEFAULT_MAX_PEERS, "peers a download is connected to at most")
+	flags.BoolVar(&g.dht, "dht", false, "look for peers in the DHT when the trackers of a torrent can't provide any, or it has none")
+	flags.StringVar(&g.dhtBootstrap, "dht-bootstrap", strings.Join(torrent.DhtBootstrapNodes, ","), "comma separated host:port of the nodes the DHT is joined through")
+	flags.Var(&g.maxDownload, "max-download-rate", "bytes per second downloaded from all the peers, like 500K or 2M, 0 for unlimited")
+	flags.Var(&g.maxUpload, "max-upload-rate", "bytes per second uploaded to all the peers, like 500K or 2M, 0 for unlimited")
+	flags.Var(&g.peerDownload, "max-peer-download-rate", "bytes per second downloaded from each peer, 0 for unlimited")
+	flags.Var(&g.peerUpload, "max-peer-upload-rate", "bytes per second uploaded to each peer, 0 for unlimited")
+	flags.BoolVar(&g.verbose, "verbose", false, "also log the exchanges with the trackers and peers")
+	flags.BoolVar(&g.quiet, "quiet", false, "only log the failures")
+	flags.BoolVar(&g.logJSON, "log-json", false, "log JSON lines with the level, time, peer address and piece index of every record")
+	flags.BoolVar(&g.noProgress, "no-progress", false, "log every downloaded piece instead of drawing a progress bar when the standard error is a terminal")
+	flags.BoolVar(&g.stats, "stats", false, fmt.Sprintf("log the transfer rates, pieces and requests of every peer of the downloads every %s", torrent.METRICS_REPORT_INTERVAL))
+	flags.IntVar(&g.portFallback, "port-fallback", DEFAULT_PORT_FALLBACK, "ports after --port tried in order when it's in use, 0 to always use it")
+	if err := flags.Parse(args); err != nil {
+		return g, flags, nil, err
+	}
+	if g.verbose && g.quiet {
+		return g, flags, nil, errors.New("--verbose and --quiet can't be used together")
+	}
 
-	return h.Sum(nil)
+	return g, flags, flags.Args(), nil
 }
 
-func toHex(b []byte) string {
-	return hex.EncodeToString(b)
+// logLevel returns the lowest level of the logged records chosen by --verbose and --quiet.
+func (g globalFlags) logLevel() slog.Level {
+	switch {
+	case g.verbose:
+		return slog.LevelDebug
+	case g.quiet:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
 }
 
 func main() {
-	command := os.Args[1]
-	//command = "info"
-
-	if command == "decode" {
-		bencodedValue := os.Args[2]
+	global, globalFlags, args, err := parseGlobalFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stdout, globalFlags)
+		return
+	}
+	if err == nil && len(args) == 0 {
+		err = errors.New("missing command")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage(os.Stderr, globalFlags)
+		os.Exit(EXIT_USAGE)
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		printUsage(os.Stderr, globalFlags)
+		os.Exit(EXIT_USAGE)
+	}
+	command := cmd.name
 
-		decoded, _, err := decodeValue(bencodedValue)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	stopProfiling, err := global.profile.start()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EXIT_FAILURE)
+	}
 
-		jsonOutput, _ := json.Marshal(decoded)
-		fmt.Println(string(jsonOutput))
-	} else if command == "info" {
-		file := os.Args[2]
+	var tracer *torrent.Tracer
+	if global.otlpEndpoint != "" {
+		tracer = torrent.StartTracing(global.otlpEndpoint)
+	}
 
-		torrent, err := parseTorrentFile(file)
-		if err != nil {
-			fmt.Println(err)
-			return
+	// Deferred functions don't run on os.Exit, commands exiting with an error call it explicitly
+	stop := func() {
+		if tracer != nil {
+			if err := tracer.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
 		}
+		stopProfiling()
+	}
+	defer stop()
 
-		fmt.Println(torrent.infoStr())
-	} else if command == "peers" {
-		file := os.Args[2]
+	// Context of the network operations of the commands
+	ctx := context.Background()
 
-		torrent, err := parseTorrentFile(file)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	// Interrupting a download stops it cleanly: its progress is saved to resume it later, and the trackers are told it
+	// stopped. Interrupting it again exits right away
+	if command == "download" || command == "magnet_download" || command == "stream" {
+		var stopSignals context.CancelFunc
+		ctx, stopSignals = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		context.AfterFunc(ctx, stopSignals)
+	}
 
-		peerAddresses, err := torrent.peers()
+	// Only the commands using the port probe the ones in use, the others run while they are all taken
+	port := global.port.first
+	if global.dht || usesPort(command) {
+		port, err = global.port.choose(global.portFallback)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(EXIT_FAILURE)
 		}
-		for _, peer := range peerAddresses {
-			fmt.Println(peer)
+		if global.port.first == global.port.last && port != global.port.first {
+			// The standard output is kept for the results of the commands
+			fmt.Fprintf(os.Stderr, "Port %d is in use, using port %d\n", global.port.first, port)
 		}
-	} else if command == "handshake" {
-		file := os.Args[2]
-		peerAddress := os.Args[3]
+	}
 
-		torrent, err := parseTorrentFile(file)
+	// Options of the clients of the commands, reporting the same port to trackers and peers
+	opts := []torrent.Option{torrent.WithLogger(os.Stdout), torrent.WithPort(port), torrent.WithRateLimits(int(global.maxDownload), int(global.maxUpload)),
+		torrent.WithEncryption(global.encryption), torrent.WithPipelineDepth(global.pipeline),
+		torrent.WithPeerTimeout(global.peerTimeout), torrent.WithMaxHashFailures(global.hashFailures), torrent.WithMaxPeers(global.maxPeers),
+		torrent.WithPeerRateLimits(int(global.peerDownload), int(global.peerUpload)), torrent.WithLogLevel(global.logLevel()),
+		torrent.WithJSONLogs(global.logJSON)}
+	if global.wireDump != "" {
+		dump, err := torrent.OpenWireDump(global.wireDump, global.wirePayload)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(EXIT_FAILURE)
 		}
+		opts = append(opts, torrent.WithWireDump(dump))
 
-		peerId, err := torrent.peerHandshake(peerAddress, false)
+		stopBeforeDump := stop
+		stop = func() {
+			stopBeforeDump()
+			dump.Close()
+		}
+	}
+	bindAddress, err := torrent.ResolveBindAddress(global.bindAddress, global.iface)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stop()
+		os.Exit(EXIT_FAILURE)
+	}
+	if bindAddress != nil {
+		opts = append(opts, torrent.WithBindAddress(bindAddress))
+	}
+	announcedIPv6, err := torrent.ResolveAnnouncedIPv6(global.ipv6, bindAddress)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		stop()
+		os.Exit(EXIT_FAILURE)
+	}
+	opts = append(opts, torrent.WithAnnouncedIPv6(announcedIPv6), torrent.WithTrackerHeaders(global.userAgent, http.Header(global.headers)))
+	var resolver *torrent.DnsResolver
+	if global.dnsServer != "" {
+		resolver, err = torrent.NewDnsResolver(global.dnsServer, global.dnsTimeout, global.dnsCacheTTL)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(EXIT_FAILURE)
 		}
-
-		fmt.Printf("Peer ID: %s\n", peerId)
-	} else if command == "download_piece" {
-		flag := os.Args[2]
-		if flag != "-o" {
-			fmt.Println("Missing output flag: '-o'")
-			return
+		opts = append(opts, torrent.WithResolver(resolver))
+	}
+	if global.peerProxy != "" {
+		// The proxy is reached from the bound address too
+		proxy, err := torrent.ParseSocks5Proxy(global.peerProxy, bindAddress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(EXIT_FAILURE)
 		}
-
-		output := os.Args[3]
-		file := os.Args[4]
-		pieceIndex, err := strconv.Atoi(os.Args[5])
+		opts = append(opts, torrent.WithPeerDialer(proxy))
+	}
+	if global.dht || command == "dht_get_peers" {
+		// The DHT uses the UDP port of the announced port, peers reach both on the same port number
+		node, err := torrent.StartDhtNode(bindAddress, port, resolver, strings.Split(global.dhtBootstrap, ","))
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(EXIT_FAILURE)
 		}
+		opts = append(opts, torrent.WithDht(node))
 
-		torrent, err := parseTorrentFile(file)
+		stopBeforeDht := stop
+		stop = func() {
+			stopBeforeDht()
+			node.Close()
+		}
+	}
+	if command == "download" || command == "magnet_download" || command == "daemon" {
+		// Peers connect on the announced port, the downloads work without them when it can't be listened on
+		listener, err := torrent.ListenPeers(bindAddress, port, global.encryption)
 		if err != nil {
-			fmt.Println(err)
-			return
+			fmt.Fprintf(os.Stderr, "Not accepting incoming peers: %s\n", err)
+		} else {
+			opts = append(opts, torrent.WithListener(listener))
+
+			stopBeforeListener := stop
+			stop = func() {
+				stopBeforeListener()
+				listener.Close()
+			}
 		}
+	}
+	if (command == "download" || command == "magnet_download") && !global.noProgress && isTerminal(os.Stderr) {
+		opts = append(opts, torrent.WithProgress(torrent.ProgressBar(os.Stderr)))
+	}
+	if global.stats {
+		opts = append(opts, torrent.WithStatsReport())
+	}
+	if tracer != nil {
+		opts = append(opts, torrent.WithTracing(tracer))
+	}
+	clients := &clientFactory{opts: opts, encryption: global.encryption}
+	stopBeforeClients := stop
+	stop = func() {
+		clients.close()
+		stopBeforeClients()
+	}
 
-		torrent.downloadPieceToFile(output, pieceIndex)
-	} else if command == "download" {
-		flag := os.Args[2]
-		if flag != "-o" {
-			fmt.Println("Missing output flag: '-o'")
-			return
-		}
+	if code := exitCode(ctx, cmd.run(ctx, clients, args[1:])); code != 0 {
+		stop()
+		os.Exit(code)
+	}
+}
 
-		output := os.Args[3]
-		file := os.Args[4]
+// usesPort returns whether the command announces our port to the trackers, listens on it or runs the DHT on it.
+func usesPort(command string) bool {
+	switch command {
+	case "peers", "download_piece", "download", "stream", "magnet_peers", "magnet_handshake", "magnet_info",
+		"magnet_download_piece", "magnet_download", "dht_get_peers", "daemon":
+		return true
+	}
 
-		torrent, err := parseTorrentFile(file)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	return false
+}
 
-		torrent.downloadFile(output)
-	} else if command == "magnet_parse" {
-		magnetLink := os.Args[2]
-		torrent, err := parseMagnetLink(magnetLink)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// runDecode prints the bencoded value given as argument as JSON.
+func runDecode(_ context.Context, _ *clientFactory, args []string) error {
+	flags := newCommandFlags("decode")
+	file := flags.String("f", "", "file the bencoded value is read from, - for stdin")
+	binary := flags.String("binary", "hex", "encoding of the strings that are not UTF-8: hex or base64")
+	args, err := parseArgs(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
 
-		fmt.Printf("Tracker URL: %s\nInfo Hash: %s\n", torrent.announce, toHex(torrent.infoHash))
-	} else if command == "magnet_handshake" {
-		magnetLink := os.Args[2]
-		torrent, err := parseMagnetLink(magnetLink)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	var encode func([]byte) string
+	switch *binary {
+	case "hex":
+		encode = hex.EncodeToString
+	case "base64":
+		encode = base64.StdEncoding.EncodeToString
+	default:
+		return usageErrorf(flags, "invalid binary encoding %q, expected hex or base64", *binary)
+	}
 
-		peerId, peerExtensionId, err := torrent.magnetHandshake()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		fmt.Printf("Peer ID: %s\n", peerId)
-		if peerExtensionId != 0 {
-			fmt.Printf("Peer Metadata Extension ID: %d\n", peerExtensionId)
+	// The value is given as the argument, or read from the file, stdin without either
+	var data []byte
+	switch {
+	case *file != "" && len(args) > 0:
+		return usageErrorf(flags, "a bencoded value and -f are exclusive")
+	case len(args) > 0:
+		data = []byte(args[0])
+	case *file != "" && *file != "-":
+		data, err = os.ReadFile(*file)
+	default:
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
 
-		}
-	} else if command == "magnet_info" {
-		magnetLink := os.Args[2]
-		torrent, err := parseMagnetLink(magnetLink)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	decoded, _, err := bencode.Decode(data)
+	if err != nil {
+		return err
+	}
 
-		err = torrent.magnetInfo()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	jsonOutput, _ := json.Marshal(bencode.JSONValueBinary(decoded, encode))
+	fmt.Println(string(jsonOutput))
 
-		fmt.Println(torrent.infoStr())
-	} else if command == "magnet_download_piece" {
-		flag := os.Args[2]
-		if flag != "-o" {
-			fmt.Println("Missing output flag: '-o'")
-			return
-		}
+	return nil
+}
 
-		output := os.Args[3]
-		magnetLink := os.Args[4]
-		pieceIndex, err := strconv.Atoi(os.Args[5])
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// runInfo prints the metainfo of a torrent file, or of a magnet link fetched from its peers.
+func runInfo(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("info")
+	asJSON := flags.Bool("json", false, "print the metainfo as a JSON document")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
 
-		torrent, err := parseMagnetLink(magnetLink)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		err = torrent.magnetInfo()
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	t, err := c.OpenTorrent(ctx, args[0])
+	if err != nil {
+		return err
+	}
 
-		torrent.downloadPieceToFile(output, pieceIndex)
-	} else if command == "magnet_download" {
-		flag := os.Args[2]
-		if flag != "-o" {
-			fmt.Println("Missing output flag: '-o'")
-			return
-		}
+	return printInfo(t, *asJSON)
+}
 
-		output := os.Args[3]
-		magnetLink := os.Args[4]
+// printInfo prints the metainfo of the torrent, as a JSON document when asJSON is true.
+func printInfo(t torrent.Torrent, asJSON bool) error {
+	if !asJSON {
+		fmt.Println(t.InfoString())
+		return nil
+	}
 
-		torrent, err := parseMagnetLink(magnetLink)
-		if err != nil {
-			fmt.Println(err)
-			return
+	doc, err := t.InfoJSON()
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(doc))
+
+	return nil
+}
+
+// runHandshake prints the peer ID of the peer at the given address, a peer of a torrent file or magnet link.
+func runHandshake(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("handshake")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	t, err := c.LoadTorrent(args[0])
+	if err != nil {
+		return err
+	}
+
+	peerId, err := t.PeerHandshake(ctx, args[1], false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Peer ID: %s\n", peerId)
+
+	return nil
+}
+
+// pieceArgs are the arguments of the commands downloading a single piece.
+type pieceArgs struct {
+	output     string
+	source     string // Torrent file or magnet link
+	pieceIndex int
+	nPeers     int // Peers downloading the blocks of the piece in parallel
+	encryption torrent.EncryptionPolicy
+}
+
+// parsePieceArgs parses the arguments of the command downloading a single piece named name.
+func parsePieceArgs(clients *clientFactory, name string, args []string) (pieceArgs, error) {
+	flags := newCommandFlags(name)
+	output := flags.String("o", "", "file the piece is written to")
+	nPeers := flags.Int("peers", 1, "peers downloading the blocks of the piece in parallel")
+	encryption := encryptionFlag(flags, clients.encryption)
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return pieceArgs{}, err
+	}
+	if *output == "" {
+		return pieceArgs{}, usageErrorf(flags, "missing output flag: -o")
+	}
+	pieceIndex, err := strconv.Atoi(args[1])
+	if err != nil || pieceIndex < 0 {
+		return pieceArgs{}, usageErrorf(flags, "invalid piece index %q", args[1])
+	}
+	if *nPeers < 1 {
+		return pieceArgs{}, usageErrorf(flags, "invalid number of peers %d", *nPeers)
+	}
+
+	return pieceArgs{output: *output, source: args[0], pieceIndex: pieceIndex, nPeers: *nPeers, encryption: *encryption}, nil
+}
+
+// runDownloadPiece downloads a piece of a torrent file or magnet link.
+func runDownloadPiece(ctx context.Context, clients *clientFactory, args []string) error {
+	a, err := parsePieceArgs(clients, "download_piece", args)
+	if err != nil {
+		return err
+	}
+
+	t, err := clients.new(torrent.WithEncryption(a.encryption)).OpenTorrent(ctx, a.source)
+	if err != nil {
+		return err
+	}
+
+	return t.DownloadPieceToFile(ctx, a.output, a.pieceIndex, a.nPeers)
+}
+
+// runDownload downloads a torrent file or magnet link, and checks the checksums of the downloaded file when asked.
+// Several torrents are downloaded at the same time into a directory.
+func runDownload(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("download")
+	output := flags.String("o", "", "file the download is written to, directory of the files of a multi-file torrent")
+	dir := flags.String("d", "", "directory the torrents are downloaded into, when downloading several")
+	strategy := strategyFlag(flags)
+	checksumOptions := registerChecksumFlags(flags)
+	sessionLimits := registerSessionFlags(flags)
+	encryption := encryptionFlag(flags, clients.encryption)
+	args, err := parseArgs(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	c := clients.new(torrent.WithEncryption(*encryption), torrent.WithPieceStrategy(*strategy))
+	checksums, err := checksumOptions()
+	if err != nil {
+		return usageErrorf(flags, "%s", err)
+	}
+
+	if *dir != "" || len(args) > 1 {
+		if *output != "" {
+			return usageErrorf(flags, "-o downloads a single torrent, use -d to download several")
 		}
-		err = torrent.magnetInfo()
-		if err != nil {
-			fmt.Println(err)
-			return
+		if checksums.ManifestPath != "" || len(checksums.Expected) > 0 {
+			return usageErrorf(flags, "-checksum-manifest and -expect are only supported when downloading a single torrent")
+		}
+		if *dir == "" {
+			*dir = "."
 		}
+		return torrent.NewSession(c, *dir, sessionLimits()).DownloadAll(ctx, args, checksums)
+	}
+	if *output == "" {
+		return usageErrorf(flags, "missing output flag: -o")
+	}
 
-		torrent.downloadFile(output)
-	} else {
-		fmt.Println("Unknown command: " + command)
-		os.Exit(1)
+	t, err := c.OpenTorrent(ctx, args[0])
+	if err != nil {
+		return err
 	}
+
+	if err := t.DownloadFile(ctx, *output); err != nil {
+		return err
+	}
+
+	return checksums.Check(t, *output)
+}
+
+// runMagnetParse prints the tracker and the info hash of a magnet link.
+func runMagnetParse(_ context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("magnet_parse")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	t, err := c.ParseMagnetLink(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Tracker URL: %s\nInfo Hash: %s\n", t.AnnounceURL(), hex.EncodeToString(t.InfoHash()))
+	if t.InfoHashV2() != nil {
+		fmt.Printf("Info Hash v2: %s\n", hex.EncodeToString(t.InfoHashV2()))
+	}
+
+	return nil
+}
+
+// runMagnetHandshake prints the peer ID of a peer of a magnet link, and the ID it assigned to the metadata extension.
+func runMagnetHandshake(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("magnet_handshake")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	t, err := c.ParseMagnetLink(args[0])
+	if err != nil {
+		return err
+	}
+
+	peerId, peerExtensionId, err := t.MagnetHandshake(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Peer ID: %s\n", peerId)
+	if peerExtensionId != 0 {
+		fmt.Printf("Peer Metadata Extension ID: %d\n", peerExtensionId)
+	}
+
+	return nil
+}
+
+// runMagnetInfo prints the metainfo of a magnet link, fetched from its peers.
+func runMagnetInfo(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("magnet_info")
+	asJSON := flags.Bool("json", false, "print the metainfo as a JSON document")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	t, err := c.ParseMagnetLink(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := t.MagnetInfo(ctx); err != nil {
+		return err
+	}
+
+	return printInfo(t, *asJSON)
+}
+
+// runMagnetDownloadPiece downloads a piece of a magnet link.
+func runMagnetDownloadPiece(ctx context.Context, clients *clientFactory, args []string) error {
+	a, err := parsePieceArgs(clients, "magnet_download_piece", args)
+	if err != nil {
+		return err
+	}
+
+	t, err := clients.new(torrent.WithEncryption(a.encryption)).ParseMagnetLink(a.source)
+	if err != nil {
+		return err
+	}
+	if err := t.MagnetInfo(ctx); err != nil {
+		return err
+	}
+
+	return t.DownloadPieceToFile(ctx, a.output, a.pieceIndex, a.nPeers)
+}
+
+// runMagnetDownload downloads a magnet link.
+func runMagnetDownload(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("magnet_download")
+	output := flags.String("o", "", "file the download is written to, directory of the files of a multi-file torrent")
+	strategy := strategyFlag(flags)
+	encryption := encryptionFlag(flags, clients.encryption)
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return usageErrorf(flags, "missing output flag: -o")
+	}
+
+	t, err := clients.new(torrent.WithEncryption(*encryption), torrent.WithPieceStrategy(*strategy)).ParseMagnetLink(args[0])
+	if err != nil {
+		return err
+	}
+	if err := t.MagnetInfo(ctx); err != nil {
+		return err
+	}
+
+	return t.DownloadFile(ctx, *output)
 }
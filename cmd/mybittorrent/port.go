@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mathRand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Range of the dynamic ports, where --port random picks from
+const DYNAMIC_PORT_FIRST = 49152
+const DYNAMIC_PORT_LAST = 65535
+
+// Ports following a single configured port tried when it's in use, covering the conventional 6881-6889
+const DEFAULT_PORT_FALLBACK = 8
+
+// portRange is the value of the --port flag: a single port, a range of ports like 6881-6889, or "random" for the
+// dynamic ports. A port of the range is picked at random, skipping the ones already in use.
+type portRange struct {
+	first int
+	last  int
+}
+
+func (r *portRange) String() string {
+	if r.first == r.last {
+		return strconv.Itoa(r.first)
+	}
+
+	return fmt.Sprintf("%d-%d", r.first, r.last)
+}
+
+func (r *portRange) Set(value string) error {
+	if value == "random" {
+		r.first, r.last = DYNAMIC_PORT_FIRST, DYNAMIC_PORT_LAST
+		return nil
+	}
+
+	firstStr, lastStr, isRange := strings.Cut(value, "-")
+	if !isRange {
+		lastStr = firstStr
+	}
+
+	first, err := strconv.Atoi(firstStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	last, err := strconv.Atoi(lastStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return fmt.Errorf("invalid port range %q", value)
+	}
+
+	r.first, r.last = first, last
+
+	return nil
+}
+
+// choose returns a port of the range free for both TCP and UDP, so it can be used by peers and DHT alike. When a
+// single port is taken, the fallback ports following it are tried in order. Without fallback ports, a single port is
+// returned as is, letting the listeners report it if it's taken.
+func (r portRange) choose(fallback int) (int, error) {
+	if r.first == r.last {
+		if fallback <= 0 {
+			return r.first, nil
+		}
+
+		last := min(r.first+fallback, 65535)
+		for port := r.first; port <= last; port++ {
+			if portAvailable(port) {
+				return port, nil
+			}
+		}
+
+		return 0, fmt.Errorf("ports %d to %d are all in use", r.first, last)
+	}
+
+	n := r.last - r.first + 1
+	for _, i := range mathRand.Perm(n) {
+		port := r.first + i
+		if portAvailable(port) {
+			return port, nil
+		}
+	}
+
+	return 0, errors.New("no port available in " + r.String())
+}
+
+// portAvailable checks whether port can be bound for TCP and UDP on all the interfaces.
+func portAvailable(port int) bool {
+	address := net.JoinHostPort("", strconv.Itoa(port))
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profileFlags holds the profiling options accepted before any command.
+type profileFlags struct {
+	cpuProfile string
+	memProfile string
+}
+
+// register defines the profiling flags in the given flag set
+func (p *profileFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&p.cpuProfile, "cpuprofile", "", "write a CPU profile of the command to this file")
+	flags.StringVar(&p.memProfile, "memprofile", "", "write a heap profile to this file when the command finishes")
+}
+
+// start begins the requested profiles. Returns the function that stops them and writes the results, which must be
+// called once the command finishes.
+func (p profileFlags) start() (func(), error) {
+	var cpuFile *os.File
+
+	if p.cpuProfile != "" {
+		f, err := os.Create(p.cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		cpuFile = f
+	}
+
+	stop := func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+
+		if p.memProfile != "" {
+			if err := writeHeapProfile(p.memProfile); err != nil {
+				fmt.Fprintf(os.Stderr, "could not write memory profile: %s\n", err)
+			}
+		}
+	}
+
+	return stop, nil
+}
+
+// writeHeapProfile writes the current heap profile into the given file
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Get up-to-date statistics of the allocations
+	runtime.GC()
+
+	return pprof.WriteHeapProfile(f)
+}
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// isTerminal returns whether f is a terminal, where a progress bar can be redrawn.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// rateFlag is the value of the rate limit flags, in bytes per second. Rates may have a K, M or G suffix, for KiB, MiB
+// and GiB per second. 0 means unlimited.
+type rateFlag int
+
+func (r *rateFlag) String() string {
+	return strconv.Itoa(int(*r))
+}
+
+func (r *rateFlag) Set(value string) error {
+	rate, ok := parseBytes(value)
+	if !ok {
+		return fmt.Errorf("invalid rate %q, expected bytes per second like 500K or 2M", value)
+	}
+	*r = rateFlag(rate)
+
+	return nil
+}
+
+// sizeFlag is the value of the flags of an amount of bytes. Sizes may have a K, M or G suffix, for KiB, MiB and GiB.
+type sizeFlag int
+
+func (s *sizeFlag) String() string {
+	return strconv.Itoa(int(*s))
+}
+
+func (s *sizeFlag) Set(value string) error {
+	size, ok := parseBytes(value)
+	if !ok {
+		return fmt.Errorf("invalid size %q, expected bytes like 500M or 2G", value)
+	}
+	*s = sizeFlag(size)
+
+	return nil
+}
+
+// parseBytes parses an amount of bytes with an optional K, M or G suffix, for KiB, MiB and GiB. Returns false when
+// it's invalid or negative.
+func parseBytes(value string) (int, bool) {
+	number, multiplier := value, 1
+	switch strings.ToUpper(value[len(value)-min(len(value), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return int(n * float64(multiplier)), true
+}
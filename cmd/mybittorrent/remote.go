@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const TRANSMISSION_RPC_PATH = "/transmission/rpc"
+
+// transmissionClient calls the Transmission RPC endpoint of a daemon.
+type transmissionClient struct {
+	url       string
+	client    *http.Client
+	sessionId string
+}
+
+// newTransmissionClient creates a client for the daemon at endpoint, either a "host:port" address or a full URL.
+func newTransmissionClient(endpoint string) *transmissionClient {
+	url := endpoint
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	if !strings.HasSuffix(url, TRANSMISSION_RPC_PATH) {
+		url = strings.TrimSuffix(url, "/") + TRANSMISSION_RPC_PATH
+	}
+
+	return &transmissionClient{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// call executes the RPC method and decodes the response arguments into result, when not nil.
+func (c *transmissionClient) call(method string, arguments any, result any) error {
+	body, err := json.Marshal(map[string]any{"method": method, "arguments": arguments})
+	if err != nil {
+		return err
+	}
+
+	// The first request is rejected with the session ID to use. Retry once with it
+	var res *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(torrent.TRANSMISSION_SESSION_HEADER, c.sessionId)
+
+		res, err = c.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode != http.StatusConflict {
+			break
+		}
+		res.Body.Close()
+		c.sessionId = res.Header.Get(torrent.TRANSMISSION_SESSION_HEADER)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+
+	var rpcRes struct {
+		Result    string          `json:"result"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		return err
+	}
+
+	if rpcRes.Result != "success" {
+		return errors.New(rpcRes.Result)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(rpcRes.Arguments, result)
+}
+
+// parseTorrentRefs converts the arguments of the command of flags into RPC torrent IDs: numbers are IDs, the others
+// hex info hashes. Fails with a usage error on anything else.
+func parseTorrentRefs(flags *flag.FlagSet, args []string) ([]any, error) {
+	ids := make([]any, 0, len(args))
+	for _, arg := range args {
+		if id, err := strconv.Atoi(arg); err == nil && id > 0 {
+			ids = append(ids, id)
+		} else if hash, err := hex.DecodeString(arg); err == nil && len(hash) == sha1.Size {
+			ids = append(ids, arg)
+		} else {
+			return nil, usageErrorf(flags, "invalid torrent %q, expected an ID or a hex info hash", arg)
+		}
+	}
+
+	return ids, nil
+}
+
+// Bounds on the number of arguments of the remote commands, -1 for no limit
+var remoteCommandArgs = map[string][2]int{
+	"list":   {0, 0},
+	"add":    {0, -1},
+	"set":    {0, -1},
+	"pause":  {0, -1},
+	"resume": {0, -1},
+	"rm":     {0, -1},
+	"limit":  {0, 0},
+	"stats":  {0, 0},
+}
+
+// runRemote runs the remote subcommand given in args against a running daemon.
+func runRemote(args []string) error {
+	flags := newCommandFlags("remote")
+	endpoint := flags.String("endpoint", DEFAULT_DAEMON_ADDRESS, "address or URL of the daemon")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		return usageErrorf(flags, "missing remote command: list, add, set, pause, resume, rm, limit or stats")
+	}
+	command := flags.Arg(0)
+	argBounds, ok := remoteCommandArgs[command]
+	if !ok {
+		return usageErrorf(flags, "unknown remote command: %s", command)
+	}
+
+	// The endpoint can also be given after the subcommand
+	commandFlags := newCommandFlags("remote " + command)
+	commandFlags.StringVar(endpoint, "endpoint", *endpoint, "address or URL of the daemon")
+	downloadDir := commandFlags.String("download-dir", "", "directory where the daemon downloads the torrent (add)")
+	deleteData := commandFlags.Bool("delete", false, "also delete the downloaded data (rm)")
+	priority := commandFlags.Int("priority", 0, "queue priority, higher starts first (add, set)")
+	labels := commandFlags.String("labels", "", "comma separated labels of the torrent (add, set)")
+	category := commandFlags.String("category", "", "category of the torrent, which may move it once completed (add, set)")
+	regenerateIdentity := commandFlags.Bool("regenerate-identity", false, "give the torrent a new peer ID and tracker key, used from its next start (set)")
+	downloadLimit := commandFlags.Int("download-limit", 0, "download speed limit in kB/s, 0 for none (limit)")
+	uploadLimit := commandFlags.Int("upload-limit", 0, "upload speed limit in kB/s, 0 for none (limit)")
+	args, err := parseArgs(commandFlags, flags.Args()[1:], argBounds[0], argBounds[1])
+	if err != nil {
+		return err
+	}
+	if *downloadLimit < 0 || *uploadLimit < 0 {
+		return usageErrorf(commandFlags, "invalid speed limit, expected a positive number of kB/s or 0 for none")
+	}
+	// Torrents are selected by ID or info hash, all of them when none is given to pause or resume
+	var ids []any
+	if command == "set" || command == "pause" || command == "resume" || command == "rm" {
+		if ids, err = parseTorrentRefs(commandFlags, args); err != nil {
+			return err
+		}
+	}
+	selection := map[string]any{}
+	if len(ids) > 0 {
+		selection["ids"] = ids
+	}
+
+	c := newTransmissionClient(*endpoint)
+
+	switch command {
+	case "list":
+		return remoteList(c)
+	case "add":
+		arguments := map[string]any{"bandwidthPriority": *priority, "category": *category}
+		if *labels != "" {
+			arguments["labels"] = strings.Split(*labels, ",")
+		}
+		if *downloadDir != "" {
+			arguments["download-dir"] = *downloadDir
+		}
+		if len(args) == 0 {
+			return usageErrorf(commandFlags, "missing torrent files or magnet links to add")
+		}
+		return remoteAdd(c, args, arguments)
+	case "set":
+		if len(ids) == 0 {
+			return usageErrorf(commandFlags, "missing torrents to change")
+		}
+		arguments := map[string]any{"ids": ids}
+		commandFlags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "priority":
+				arguments["bandwidthPriority"] = *priority
+			case "labels":
+				arguments["labels"] = strings.Split(*labels, ",")
+			case "category":
+				arguments["category"] = *category
+			case "regenerate-identity":
+				arguments["regenerate-identity"] = *regenerateIdentity
+			}
+		})
+		if len(arguments) == 1 {
+			return usageErrorf(commandFlags, "missing settings to change: -priority, -labels, -category or -regenerate-identity")
+		}
+		return c.call("torrent-set", arguments, nil)
+	case "pause":
+		return c.call("torrent-stop", selection, nil)
+	case "resume":
+		return c.call("torrent-start", selection, nil)
+	case "rm":
+		if len(ids) == 0 {
+			return usageErrorf(commandFlags, "missing torrents to remove")
+		}
+		return c.call("torrent-remove", map[string]any{"ids": ids, "delete-local-data": *deleteData}, nil)
+	case "limit":
+		arguments := map[string]any{}
+		commandFlags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "download-limit":
+				arguments["speed-limit-down"] = *downloadLimit
+				arguments["speed-limit-down-enabled"] = *downloadLimit > 0
+			case "upload-limit":
+				arguments["speed-limit-up"] = *uploadLimit
+				arguments["speed-limit-up-enabled"] = *uploadLimit > 0
+			}
+		})
+		if len(arguments) == 0 {
+			return remoteLimits(c)
+		}
+		return c.call("session-set", arguments, nil)
+	default: // stats, the other commands were rejected with remoteCommandArgs
+		return remoteStats(c)
+	}
+}
+
+// remoteList prints a line for each torrent of the daemon
+func remoteList(c *transmissionClient) error {
+	var res struct {
+		Torrents []struct {
+			Id           int      `json:"id"`
+			Name         string   `json:"name"`
+			HashString   string   `json:"hashString"`
+			Status       int      `json:"status"`
+			PercentDone  float64  `json:"percentDone"`
+			TotalSize    int      `json:"totalSize"`
+			RateDownload int      `json:"rateDownload"`
+			ErrorString  string   `json:"errorString"`
+			Labels       []string `json:"labels"`
+			Category     string   `json:"category"`
+		} `json:"torrents"`
+	}
+
+	fields := []string{"id", "name", "hashString", "status", "percentDone", "totalSize", "rateDownload", "errorString",
+		"labels", "category"}
+	if err := c.call("torrent-get", map[string]any{"fields": fields}, &res); err != nil {
+		return err
+	}
+
+	fmt.Printf("%-4s %-7s %-12s %-12s %-12s %s\n", "ID", "Done", "Size", "Down", "Status", "Name")
+	for _, t := range res.Torrents {
+		status := "Downloading"
+		switch t.Status {
+		case torrent.TRANSMISSION_STATUS_STOPPED:
+			status = "Stopped"
+		case torrent.TRANSMISSION_STATUS_DOWNLOAD_WAIT:
+			status = "Queued"
+		case torrent.TRANSMISSION_STATUS_SEED:
+			status = "Done"
+		}
+
+		fmt.Printf("%-4d %-7s %-12d %-12s %-12s %s\n", t.Id, fmt.Sprintf("%.1f%%", t.PercentDone*100), t.TotalSize,
+			fmt.Sprintf("%d B/s", t.RateDownload), status, t.Name)
+		if t.Category != "" {
+			fmt.Printf("     Category: %s\n", t.Category)
+		}
+		if len(t.Labels) > 0 {
+			fmt.Printf("     Labels: %s\n", strings.Join(t.Labels, ", "))
+		}
+		if t.ErrorString != "" {
+			fmt.Printf("     Error: %s\n", t.ErrorString)
+		}
+	}
+
+	return nil
+}
+
+// remoteAdd adds torrents to the daemon with the given torrent-add arguments. Torrent files are read locally, so the
+// daemon can run on another host.
+func remoteAdd(c *transmissionClient, sources []string, settings map[string]any) error {
+	for _, source := range sources {
+		arguments := make(map[string]any, len(settings)+1)
+		for k, v := range settings {
+			arguments[k] = v
+		}
+
+		if strings.HasPrefix(source, "magnet:") || strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			arguments["filename"] = source
+		} else {
+			content, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			arguments["metainfo"] = base64.StdEncoding.EncodeToString(content)
+		}
+
+		var res map[string]struct {
+			Id         int    `json:"id"`
+			Name       string `json:"name"`
+			HashString string `json:"hashString"`
+		}
+		if err := c.call("torrent-add", arguments, &res); err != nil {
+			return fmt.Errorf("could not add %s: %w", source, err)
+		}
+
+		if added, ok := res["torrent-added"]; ok {
+			fmt.Printf("Added %d: %s (%s)\n", added.Id, added.Name, added.HashString)
+		} else if duplicate, ok := res["torrent-duplicate"]; ok {
+			fmt.Printf("Already added %d: %s (%s)\n", duplicate.Id, duplicate.Name, duplicate.HashString)
+		}
+	}
+
+	return nil
+}
+
+// remoteLimits prints the speed limits of the daemon
+func remoteLimits(c *transmissionClient) error {
+	var res struct {
+		SpeedLimitDown        int  `json:"speed-limit-down"`
+		SpeedLimitDownEnabled bool `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          int  `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   bool `json:"speed-limit-up-enabled"`
+	}
+	if err := c.call("session-get", map[string]any{}, &res); err != nil {
+		return err
+	}
+
+	for _, l := range []struct {
+		title   string
+		limit   int
+		enabled bool
+	}{{"Download", res.SpeedLimitDown, res.SpeedLimitDownEnabled}, {"Upload", res.SpeedLimitUp, res.SpeedLimitUpEnabled}} {
+		if l.enabled {
+			fmt.Printf("%s limit: %d kB/s\n", l.title, l.limit)
+		} else {
+			fmt.Printf("%s limit: none\n", l.title)
+		}
+	}
+
+	return nil
+}
+
+// remoteStats prints the transfer statistics of the daemon
+func remoteStats(c *transmissionClient) error {
+	type stats struct {
+		UploadedBytes   int `json:"uploadedBytes"`
+		DownloadedBytes int `json:"downloadedBytes"`
+		FilesAdded      int `json:"filesAdded"`
+		SessionCount    int `json:"sessionCount"`
+		SecondsActive   int `json:"secondsActive"`
+	}
+
+	var res struct {
+		ActiveTorrentCount int   `json:"activeTorrentCount"`
+		PausedTorrentCount int   `json:"pausedTorrentCount"`
+		TorrentCount       int   `json:"torrentCount"`
+		DownloadSpeed      int   `json:"downloadSpeed"`
+		UploadSpeed        int   `json:"uploadSpeed"`
+		Current            stats `json:"current-stats"`
+		Cumulative         stats `json:"cumulative-stats"`
+	}
+	if err := c.call("session-stats", map[string]any{}, &res); err != nil {
+		return err
+	}
+
+	fmt.Printf("Torrents: %d (%d active, %d paused)\n", res.TorrentCount, res.ActiveTorrentCount, res.PausedTorrentCount)
+	fmt.Printf("Download speed: %d B/s\nUpload speed: %d B/s\n", res.DownloadSpeed, res.UploadSpeed)
+	for _, s := range []struct {
+		title string
+		stats stats
+	}{{"Current session", res.Current}, {"Total", res.Cumulative}} {
+		fmt.Printf("%s:\n  Downloaded: %d bytes\n  Uploaded: %d bytes\n  Ratio: %.2f\n  Active: %s\n", s.title,
+			s.stats.DownloadedBytes, s.stats.UploadedBytes, torrent.Ratio(s.stats.UploadedBytes, s.stats.DownloadedBytes),
+			time.Duration(s.stats.SecondsActive)*time.Second)
+	}
+
+	return nil
+}
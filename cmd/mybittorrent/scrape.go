@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// runScrape prints the seeders, leechers and completed downloads every tracker of a torrent file or magnet link
+// reports. Trackers that fail are reported and skipped, the command fails when none answers.
+func runScrape(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("scrape")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	c := clients.new()
+
+	// Magnet links are scraped without their metadata
+	t, err := c.LoadTorrent(args[0])
+	if err != nil {
+		return err
+	}
+
+	results, err := t.Scrape(ctx)
+	if err != nil {
+		return err
+	}
+
+	answered := false
+	for _, res := range results {
+		if res.Err != nil {
+			fmt.Printf("%s: %s\n", res.Tracker, res.Err)
+			continue
+		}
+		fmt.Printf("%s: %d seeders, %d leechers, %d completed\n", res.Tracker, res.Response.Seeders, res.Response.Leechers,
+			res.Response.Completed)
+		answered = true
+	}
+
+	if !answered {
+		return fmt.Errorf("%w: no tracker answered the scrape", tracker.ErrFailure)
+	}
+
+	return nil
+}
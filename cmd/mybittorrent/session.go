@@ -0,0 +1,19 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// registerSessionFlags adds the flags of the budgets of a session to flags. Returns the function building the limits
+// once the flags are parsed.
+func registerSessionFlags(flags *flag.FlagSet) func() torrent.SessionLimits {
+	maxPeers := flags.Int("session-max-peers", 0, "peers the torrents are connected to together, 0 for no limit")
+	var maxDisk sizeFlag
+	flags.Var(&maxDisk, "max-disk", "bytes of data the torrents store together, like 500M or 2G, 0 for no limit")
+
+	return func() torrent.SessionLimits {
+		return torrent.SessionLimits{MaxPeers: *maxPeers, MaxDisk: int(maxDisk)}
+	}
+}
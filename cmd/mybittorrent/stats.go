@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// runStats prints the statistics persisted by the daemon
+func runStats(args []string) error {
+	flags := newCommandFlags("stats")
+	stateDir := flags.String("state-dir", defaultStateDir(), "directory where the client state is kept")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	stats, err := torrent.ReadStats(*stateDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(stats.String())
+
+	return nil
+}
+
+// defaultStateDir returns the directory where the client keeps its state by default
+func defaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".mybittorrent"
+	}
+
+	return filepath.Join(dir, "mybittorrent")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// Address the stream command serves the file on unless configured
+const DEFAULT_STREAM_ADDRESS = "127.0.0.1:8888"
+
+// runStream downloads a torrent file or magnet link in the order of the file, serving it over HTTP meanwhile, so
+// media players can play it while it downloads. Keeps serving it once downloaded, until interrupted.
+func runStream(ctx context.Context, clients *clientFactory, args []string) error {
+	flags := newCommandFlags("stream")
+	output := flags.String("o", "", "file the download is written to")
+	address := flags.String("listen", DEFAULT_STREAM_ADDRESS, "address the file is served on, as host:port")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return usageErrorf(flags, "missing output flag: -o")
+	}
+	t, err := clients.new(torrent.WithPieceStrategy(torrent.STRATEGY_SEQUENTIAL)).OpenTorrent(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	return t.Stream(ctx, *output, *address)
+}
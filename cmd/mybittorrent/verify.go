@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// runVerify checks the data of a torrent on disk against its piece hashes, printing the state of every piece and the
+// completion percentage. The data is the file given with -o, or the file named after the torrent when -o is a
+// directory. The files of a multi-file torrent are in the directory given with -o, or in its directory named after the
+// torrent. Fails when a piece is bad or missing.
+func runVerify(c *torrent.Client, args []string) error {
+	flags := newCommandFlags("verify")
+	output := flags.String("o", "", "downloaded file, or directory containing it")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return usageErrorf(flags, "missing output flag: -o")
+	}
+
+	t, err := c.ParseTorrentFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	dataPath, states, err := t.Verify(*output)
+	if err != nil {
+		return err
+	}
+
+	good := 0
+	for i, state := range states {
+		if state == torrent.PIECE_GOOD {
+			good++
+		}
+		fmt.Printf("Piece %d: %s\n", i, state)
+	}
+
+	percent := 100.0
+	if len(states) > 0 {
+		percent = 100 * float64(good) / float64(len(states))
+	}
+	fmt.Printf("%d of %d pieces good, %.1f%% complete\n", good, len(states), percent)
+
+	if good < len(states) {
+		return fmt.Errorf("%s is incomplete: %d pieces bad or missing", dataPath, len(states)-good)
+	}
+
+	return nil
+}
@@ -0,0 +1,396 @@
+// Package bencode decodes and encodes bencoded values, the serialization of torrent files, tracker responses and
+// extension messages. Byte strings are decoded as []byte, integers as int, lists as []any and dictionaries as
+// map[string]any. The encoder accepts these types, along with strings and the other integer, list and dictionary
+// types Marshal lists, and fails on the rest.
+package bencode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Deepest nesting of lists and dictionaries decoded, so hostile input can't exhaust the stack
+const maxDepth = 512
+
+// SyntaxError is the failure to decode invalid bencoded data, with the offset in the data where it was detected.
+type SyntaxError struct {
+	Offset int
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.msg, e.Offset)
+}
+
+func syntaxError(offset int, format string, args ...any) error {
+	return &SyntaxError{Offset: offset, msg: fmt.Sprintf(format, args...)}
+}
+
+// Decode decodes the bencoded value at the start of data into a native Go type. Return value varies according
+// the given value: byte strings are returned as []byte, slices of data that must not be modified. Also returns the
+// number of bytes of the value. Data that isn't strictly bencoded, truncated, overflowing, nested too deeply or with
+// unsorted dictionary keys, fails with a *SyntaxError rather than panicking, so untrusted input can be decoded safely.
+func Decode(data []byte) (any, int, error) {
+	return decodeValueAt(data, 0, 0, nil)
+}
+
+// decodeValueAt decodes the bencoded value at offset of data, nested in depth lists and dictionaries. When spans is
+// not nil, the dictionary decoded at offset records the raw bytes of its values in it, keyed like the values. Returns
+// the offset following the value.
+func decodeValueAt(data []byte, offset, depth int, spans map[string][]byte) (any, int, error) {
+	if offset >= len(data) {
+		return nil, 0, syntaxError(offset, "unexpected end of input")
+	}
+
+	switch data[offset] {
+	case 'i':
+		return decodeIntegerAt(data, offset)
+	case 'l':
+		return decodeListAt(data, offset, depth)
+	case 'd':
+		return decodeDictionaryAt(data, offset, depth, spans)
+	default:
+		return decodeStringAt(data, offset)
+	}
+}
+
+// DecodeString decodes a bencoded string.
+// Strings come as "10:strawberry", the initial number is the length of the encoded string
+func DecodeString(data []byte) ([]byte, int, error) {
+	return decodeStringAt(data, 0)
+}
+
+func decodeStringAt(data []byte, offset int) ([]byte, int, error) {
+	// Actual length of the string to decode, given by the digits before the colon
+	length, colon, err := parseDigits(data, offset, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	if colon >= len(data) || data[colon] != ':' {
+		return nil, 0, syntaxError(colon, "string length not followed by ':'")
+	}
+	if length > len(data)-colon-1 {
+		return nil, 0, syntaxError(offset, "string length %d overruns the input of %d bytes", length, len(data))
+	}
+
+	// The capacity is limited, so appending to the string doesn't overwrite the data following it
+	end := colon + 1 + length
+	return data[colon+1 : end : end], end, nil
+}
+
+// DecodeInteger decodes a bencoded integer.
+// Integers come as "i52e"
+func DecodeInteger(data []byte) (int, int, error) {
+	return decodeIntegerAt(data, 0)
+}
+
+func decodeIntegerAt(data []byte, offset int) (int, int, error) {
+	if offset >= len(data) || data[offset] != 'i' {
+		return 0, 0, syntaxError(offset, "integer doesn't start with 'i'")
+	}
+
+	// Integer part, between the 'i' and the 'e'
+	intVal, end, err := parseDigits(data, offset+1, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end >= len(data) || data[end] != 'e' {
+		return 0, 0, syntaxError(end, "integer not terminated by 'e'")
+	}
+
+	return intVal, end + 1, nil
+}
+
+// parseDigits parses the decimal number at offset of data, of the length of a string or, when signed is true, an
+// integer that may be negative. Leading zeros, and a negative zero, are rejected as bencode has a single form for
+// every number. Returns the offset following the number.
+func parseDigits(data []byte, offset int, signed bool) (int, int, error) {
+	start := offset
+	if signed && offset < len(data) && data[offset] == '-' {
+		offset++
+	}
+	digits := offset
+	for offset < len(data) && data[offset] >= '0' && data[offset] <= '9' {
+		offset++
+	}
+
+	switch {
+	case offset == digits:
+		return 0, 0, syntaxError(digits, "missing digits")
+	case data[digits] == '0' && offset-digits > 1:
+		return 0, 0, syntaxError(digits, "leading zero in %q", data[start:offset])
+	case data[digits] == '0' && digits > start:
+		return 0, 0, syntaxError(start, "negative zero")
+	}
+
+	n, err := strconv.Atoi(string(data[start:offset]))
+	if err != nil {
+		return 0, 0, syntaxError(start, "number %q out of range", data[start:offset])
+	}
+
+	return n, offset, nil
+}
+
+// DecodeList decodes a bencoded list.
+// Lists come in the format: "l<bencoded_elements>e"
+func DecodeList(data []byte) ([]any, int, error) {
+	return decodeListAt(data, 0, 0)
+}
+
+func decodeListAt(data []byte, offset, depth int) ([]any, int, error) {
+	if offset >= len(data) || data[offset] != 'l' {
+		return nil, 0, syntaxError(offset, "list doesn't start with 'l'")
+	}
+	if depth >= maxDepth {
+		return nil, 0, syntaxError(offset, "nesting deeper than %d levels", maxDepth)
+	}
+
+	// Slice of decoded elements, starting after the initial 'l'
+	elements := []any{}
+	offset++
+	for {
+		if offset >= len(data) {
+			return nil, 0, syntaxError(offset, "list not terminated by 'e'")
+		}
+
+		// Found the end of the list
+		if data[offset] == 'e' {
+			break
+		}
+
+		// Decode single element, moving to the following one
+		val, next, err := decodeValueAt(data, offset, depth+1, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		elements = append(elements, val)
+		offset = next
+	}
+
+	// +1 to account for the 'e'
+	return elements, offset + 1, nil
+}
+
+// DecodeDictionary decodes a bencoded dictionary.
+// Dictionaries come as "d<key1><value1>...<keyN><valueN>e"
+func DecodeDictionary(data []byte) (map[string]any, int, error) {
+	return decodeDictionaryAt(data, 0, 0, nil)
+}
+
+// DecodeDictionarySpans decodes a bencoded dictionary, along with the raw bytes of its values, keyed like the
+// values. The raw bytes are slices of data.
+func DecodeDictionarySpans(data []byte) (map[string]any, map[string][]byte, int, error) {
+	spans := map[string][]byte{}
+	elements, n, err := decodeDictionaryAt(data, 0, 0, spans)
+
+	return elements, spans, n, err
+}
+
+func decodeDictionaryAt(data []byte, offset, depth int, spans map[string][]byte) (map[string]any, int, error) {
+	if offset >= len(data) || data[offset] != 'd' {
+		return nil, 0, syntaxError(offset, "dictionary doesn't start with 'd'")
+	}
+	if depth >= maxDepth {
+		return nil, 0, syntaxError(offset, "nesting deeper than %d levels", maxDepth)
+	}
+
+	// Map of decoded elements, starting after the initial 'd'
+	elements := map[string]any{}
+	offset++
+	previous := ""
+	for {
+		if offset >= len(data) {
+			return nil, 0, syntaxError(offset, "dictionary not terminated by 'e'")
+		}
+
+		// Found the end of the dictionary
+		if data[offset] == 'e' {
+			break
+		}
+
+		// Decode single element, its key then its value
+		if data[offset] < '0' || data[offset] > '9' {
+			return nil, 0, syntaxError(offset, "dictionary key is not a string")
+		}
+		key, next, err := decodeStringAt(data, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Keys come sorted and once, so every dictionary has a single encoding
+		if len(elements) > 0 && string(key) <= previous {
+			return nil, 0, syntaxError(offset, "dictionary key %q not sorted after %q", key, previous)
+		}
+		previous = string(key)
+		offset = next
+
+		val, next, err := decodeValueAt(data, offset, depth+1, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if spans != nil {
+			spans[string(key)] = data[offset:next:next]
+		}
+		offset = next
+
+		elements[string(key)] = val
+	}
+
+	// +1 to account for the 'e'
+	return elements, offset + 1, nil
+}
+
+// JSONValue converts a decoded value to be marshaled as JSON, with its byte strings as JSON strings.
+func JSONValue(v any) any {
+	return JSONValueBinary(v, nil)
+}
+
+// JSONValueBinary converts a decoded value to be marshaled as JSON like JSONValue, except for the byte strings, and
+// dictionary keys, that are not valid UTF-8: they are converted with binary, typically to hex or base64, rather than
+// having their invalid bytes replaced. A nil binary converts them like the others.
+func JSONValueBinary(v any, binary func([]byte) string) any {
+	str := func(b []byte) string {
+		if binary != nil && !utf8.Valid(b) {
+			return binary(b)
+		}
+		return string(b)
+	}
+
+	switch v := v.(type) {
+	case []byte:
+		return str(v)
+	case []any:
+		converted := make([]any, len(v))
+		for i, element := range v {
+			converted[i] = JSONValueBinary(element, binary)
+		}
+		return converted
+	case map[string]any:
+		converted := make(map[string]any, len(v))
+		for key, element := range v {
+			converted[str([]byte(key))] = JSONValueBinary(element, binary)
+		}
+		return converted
+	}
+
+	return v
+}
+
+// Marshal returns the bencoding of v. Byte strings are given as []byte or string, integers as any integer type,
+// lists as []any, []string or [][]byte, and dictionaries as map[string]any, map[string]string or map[string]int, so
+// every decoded value round-trips. Fails on other types, and on the values nested in them, naming their path.
+func Marshal(v any) ([]byte, error) {
+	return appendValue(nil, v, "")
+}
+
+// appendValue appends the bencoding of v, found at path, to b.
+func appendValue(b []byte, v any, path string) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return appendString(b, v), nil
+	case string:
+		return appendString(b, []byte(v)), nil
+	case int:
+		return appendInteger(b, int64(v)), nil
+	case int8:
+		return appendInteger(b, int64(v)), nil
+	case int16:
+		return appendInteger(b, int64(v)), nil
+	case int32:
+		return appendInteger(b, int64(v)), nil
+	case int64:
+		return appendInteger(b, v), nil
+	case uint8:
+		return appendInteger(b, int64(v)), nil
+	case uint16:
+		return appendInteger(b, int64(v)), nil
+	case uint32:
+		return appendInteger(b, int64(v)), nil
+	case uint64:
+		b = append(b, 'i')
+		b = strconv.AppendUint(b, v, 10)
+		return append(b, 'e'), nil
+	case uint:
+		b = append(b, 'i')
+		b = strconv.AppendUint(b, uint64(v), 10)
+		return append(b, 'e'), nil
+	case []any:
+		b = append(b, 'l')
+		for i, element := range v {
+			var err error
+			if b, err = appendValue(b, element, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	case []string:
+		b = append(b, 'l')
+		for _, element := range v {
+			b = appendString(b, []byte(element))
+		}
+		return append(b, 'e'), nil
+	case [][]byte:
+		b = append(b, 'l')
+		for _, element := range v {
+			b = appendString(b, element)
+		}
+		return append(b, 'e'), nil
+	case map[string]any:
+		b = append(b, 'd')
+		for _, key := range sortedKeys(v) {
+			var err error
+			b = appendString(b, []byte(key))
+			if b, err = appendValue(b, v[key], path+"."+key); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	case map[string]string:
+		converted := make(map[string]any, len(v))
+		for key, element := range v {
+			converted[key] = element
+		}
+		return appendValue(b, converted, path)
+	case map[string]int:
+		converted := make(map[string]any, len(v))
+		for key, element := range v {
+			converted[key] = element
+		}
+		return appendValue(b, converted, path)
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil, fmt.Errorf("bencode: unsupported type %T at %s", v, strings.TrimPrefix(path, "."))
+}
+
+// appendString appends the bencoded byte string s to b.
+func appendString(b, s []byte) []byte {
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+
+	return append(b, s...)
+}
+
+// appendInteger appends the bencoded integer i to b.
+func appendInteger(b []byte, i int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, i, 10)
+
+	return append(b, 'e')
+}
+
+// sortedKeys returns the keys of a dictionary in lexicographical order, the order of a bencoded dictionary.
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,115 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fuzzCorpus returns the bencoded values FuzzDecode is seeded with: the shapes of torrent files, tracker responses
+// and extension messages, and values at the limits of the decoder.
+func fuzzCorpus() [][]byte {
+	return [][]byte{
+		[]byte("d8:announce23:http://tracker/announce4:infod6:lengthi300000e4:name8:file.bin12:piece lengthi32768e" +
+			"6:pieces20:aaaaaaaaaaaaaaaaaaaaee"),
+		[]byte("d8:completei3e10:incompletei1e8:intervali1800e5:peers12:abcdefghijkle"),
+		[]byte("d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei1234e1:v4:teste"),
+		[]byte("li-9223372036854775808ei9223372036854775807e0:1:xl" + "lld" + "e" + "ee" + "ee"),
+		[]byte(strings.Repeat("l", 600) + strings.Repeat("e", 600)),
+	}
+}
+
+// FuzzDecode checks the decoder fails with a *SyntaxError rather than panicking, and that what it accepts is
+// re-encoded to the same data, its single encoding.
+func FuzzDecode(f *testing.F) {
+	for _, data := range fuzzCorpus() {
+		f.Add(data)
+		// Truncated values fail
+		f.Add(data[:len(data)/2])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, n, err := Decode(data)
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("decoding %q failed with %T: %v", data, err, err)
+			}
+			return
+		}
+		if n <= 0 || n > len(data) {
+			t.Fatalf("decoding %q returned a length of %d", data, n)
+		}
+
+		encoded, err := Marshal(value)
+		if err != nil {
+			t.Fatalf("re-encoding %q: %v", data, err)
+		}
+		if !bytes.Equal(encoded, data[:n]) {
+			t.Fatalf("%q re-encoded as %q", data[:n], encoded)
+		}
+	})
+}
+
+// TestMarshalUnsupported checks Marshal fails on the values it doesn't support, naming where they are, rather than
+// panicking.
+func TestMarshalUnsupported(t *testing.T) {
+	if _, err := Marshal(1.5); err == nil || !strings.Contains(err.Error(), "float64") {
+		t.Errorf("Marshal of a float: %v", err)
+	}
+	if _, err := Marshal([]any{"a", []any{struct{}{}}}); err == nil || !strings.Contains(err.Error(), "[1][0]") {
+		t.Errorf("Marshal of a nested struct: %v", err)
+	}
+	if _, err := Marshal(map[string]any{"info": map[string]any{"length": 1.5}}); err == nil ||
+		!strings.Contains(err.Error(), "info.length") {
+		t.Errorf("Marshal of a nested float: %v", err)
+	}
+
+	encoded, err := Marshal(map[string]any{"b": []any{1, "x"}, "a": []byte("y")})
+	if err != nil || string(encoded) != "d1:a1:y1:bli1e1:xee" {
+		t.Errorf("Marshal returned %q, %v", encoded, err)
+	}
+}
+
+// TestDecodeInvalid checks the data that isn't strictly bencoded is rejected with a *SyntaxError at the offset of the
+// invalid value.
+func TestDecodeInvalid(t *testing.T) {
+	for _, test := range []struct {
+		data   string
+		offset int
+		msg    string
+	}{
+		{data: "i03e", offset: 1, msg: "leading zero"},
+		{data: "i-0e", offset: 1, msg: "negative zero"},
+		{data: "i-03e", offset: 2, msg: "leading zero"},
+		{data: "ie", offset: 1, msg: "missing digits"},
+		{data: "i-e", offset: 2, msg: "missing digits"},
+		{data: "i12", offset: 3, msg: "not terminated by 'e'"},
+		{data: "i1.5e", offset: 2, msg: "not terminated by 'e'"},
+		{data: "i9223372036854775808e", offset: 1, msg: "out of range"},
+		{data: "03:abc", offset: 0, msg: "leading zero"},
+		{data: "5:abc", offset: 0, msg: "overruns the input"},
+		{data: "l1:a9:bce", offset: 4, msg: "overruns the input"},
+		{data: "3abc", offset: 1, msg: "not followed by ':'"},
+		{data: "-1:a", offset: 0, msg: "missing digits"},
+		{data: "li1e", offset: 4, msg: "not terminated by 'e'"},
+		{data: "d1:ai1e", offset: 7, msg: "not terminated by 'e'"},
+		{data: "di1ei2ee", offset: 1, msg: "key is not a string"},
+		{data: "d1:bi1e1:ai2ee", offset: 7, msg: `key "a" not sorted after "b"`},
+		{data: "d1:ai1e1:ai2ee", offset: 7, msg: `key "a" not sorted after "a"`},
+		{data: "d4:infod1:zi0e1:yi0eee", offset: 14, msg: `key "y" not sorted after "z"`},
+		{data: "d1:a", offset: 4, msg: "unexpected end of input"},
+	} {
+		_, _, err := Decode([]byte(test.data))
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Offset != test.offset || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("decoding %q: %v, expected %q at offset %d", test.data, err, test.msg, test.offset)
+		}
+	}
+
+	// Sorted keys compare as bytes, not as text
+	if _, _, err := Decode([]byte("d1:Ai1e1:ai2e2:\xc3\xa9i3ee")); err != nil {
+		t.Errorf("decoding sorted keys: %v", err)
+	}
+}
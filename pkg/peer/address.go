@@ -0,0 +1,93 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Length of a peer in the compact format: the IP address followed by the port in 2 bytes
+const COMPACT_IPV4_LENGTH = 6
+const COMPACT_IPV6_LENGTH = 18
+
+// FormatAddress returns the address of a peer as host:port, with IPv6 hosts between brackets.
+func FormatAddress(ip net.IP, port int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// ParseCompact decodes a list of peers in the compact format, where every peer takes length bytes:
+// COMPACT_IPV4_LENGTH for IPv4 peers and COMPACT_IPV6_LENGTH for IPv6 ones. Trailing bytes are ignored.
+func ParseCompact(peers string, length int) []string {
+	n := len(peers) / length
+	addresses := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		peer := peers[i*length : (i+1)*length]
+		ip := net.IP(peer[:length-2])
+		port := binary.BigEndian.Uint16([]byte(peer[length-2:]))
+
+		addresses = append(addresses, FormatAddress(ip, int(port)))
+	}
+
+	return addresses
+}
+
+// Compact encodes the address of a peer, given as host:port, in the compact format. IPv4 addresses take
+// COMPACT_IPV4_LENGTH bytes, and IPv6 ones COMPACT_IPV6_LENGTH bytes.
+func Compact(address string) ([]byte, error) {
+	ip, port, err := SplitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port)), nil
+}
+
+// NormalizeAddress returns address in the host:port form accepted by the dialers. IPv6 addresses given without
+// brackets, like 2001:db8::1:6881, are bracketed, taking the port from after the last colon.
+func NormalizeAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	i := strings.LastIndex(address, ":")
+	if i == -1 {
+		return address
+	}
+	if ip := net.ParseIP(address[:i]); ip != nil && ip.To4() == nil {
+		return net.JoinHostPort(address[:i], address[i+1:])
+	}
+
+	return address
+}
+
+// SplitAddress parses the address of a peer given as host:port, where host must be an IP address. IPv6 hosts
+// must be between brackets.
+func SplitAddress(address string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid peer address %q: %w", address, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid peer address %q: host is not an IP address", address)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, 0, fmt.Errorf("invalid peer address %q: invalid port", address)
+	}
+
+	return ip, port, nil
+}
@@ -0,0 +1,152 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// Types of the ut_metadata messages, BEP 9
+const METADATA_EXTENSION_REQUEST = 0
+const METADATA_EXTENSION_DATA = 1
+const METADATA_EXTENSION_REJECT = 2
+
+// The metadata is exchanged in pieces of 16 KiB, the last one may be shorter
+const METADATA_PIECE_SIZE = 16_384
+
+// Largest metadata accepted from peers, protects from allocating whatever size a peer announces
+const MAX_METADATA_SIZE = 16 << 20
+
+// ExtensionHandshake is the payload of an extension handshake, BEP 10: the extensions the sender supports, and what it
+// tells about itself and the receiver.
+type ExtensionHandshake struct {
+	Extensions   map[string]int // IDs the sender assigned to the extensions it supports, keyed by name
+	Version      string         // Name and version of the client of the sender, "v", empty when not sent
+	Port         int            // Port the sender listens on, "p", 0 when not sent
+	Requests     int            // Block requests the sender takes outstanding, "reqq", 0 when not sent
+	YourIP       net.IP         // Address of the receiver as the sender sees it, "yourip", nil when not sent
+	MetadataSize int            // Size of the metadata the sender serves, "metadata_size", 0 when not sent
+}
+
+// ParseExtensionHandshake validates the payload of an extension handshake message. The optional values of invalid
+// types or out of range are ignored, except the metadata size.
+func ParseExtensionHandshake(payload []byte) (ExtensionHandshake, error) {
+	if len(payload) == 0 || payload[0] != 0 {
+		return ExtensionHandshake{}, fmt.Errorf("%w: not an extension handshake", ErrInvalidMessage)
+	}
+
+	decoded, _, err := bencode.DecodeDictionary(payload[1:])
+	if err != nil {
+		return ExtensionHandshake{}, fmt.Errorf("%w: extension handshake: %w", ErrInvalidMessage, err)
+	}
+
+	// The "m" key maps the extension names to their IDs
+	m, ok := decoded["m"].(map[string]any)
+	if !ok {
+		return ExtensionHandshake{}, fmt.Errorf("%w: extension handshake without extensions", ErrInvalidMessage)
+	}
+
+	h := ExtensionHandshake{Extensions: make(map[string]int, len(m))}
+	for name, v := range m {
+		id, ok := v.(int)
+		if !ok || id < 0 || id > 255 {
+			return ExtensionHandshake{}, fmt.Errorf("%w: invalid ID for extension %s", ErrInvalidMessage, name)
+		}
+		// ID 0 disables the extension
+		if id != 0 {
+			h.Extensions[name] = id
+		}
+	}
+
+	if v, ok := decoded["v"].([]byte); ok {
+		h.Version = string(v)
+	}
+	if port, ok := decoded["p"].(int); ok && port > 0 && port <= 65535 {
+		h.Port = port
+	}
+	if reqq, ok := decoded["reqq"].(int); ok && reqq > 0 {
+		h.Requests = reqq
+	}
+	if ip, ok := decoded["yourip"].([]byte); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		h.YourIP = net.IP(ip)
+	}
+
+	if size, ok := decoded["metadata_size"].(int); ok {
+		if size <= 0 || size > MAX_METADATA_SIZE {
+			return ExtensionHandshake{}, fmt.Errorf("%w: invalid metadata size %d", ErrInvalidMessage, size)
+		}
+		h.MetadataSize = size
+	}
+
+	return h, nil
+}
+
+// Serialize returns the extension handshake message. Fails when a value can't be bencoded.
+func (h ExtensionHandshake) Serialize() (Message, error) {
+	messagePayload := map[string]any{"m": h.Extensions}
+	if h.Version != "" {
+		messagePayload["v"] = h.Version
+	}
+	if h.Port != 0 {
+		messagePayload["p"] = h.Port
+	}
+	if h.Requests != 0 {
+		messagePayload["reqq"] = h.Requests
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		messagePayload["yourip"] = []byte(ip4)
+	} else if h.YourIP != nil {
+		messagePayload["yourip"] = []byte(h.YourIP.To16())
+	}
+	if h.MetadataSize != 0 {
+		messagePayload["metadata_size"] = h.MetadataSize
+	}
+
+	payload, err := bencode.Marshal(messagePayload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Extended{Id: 0, Payload: payload}.Serialize(), nil
+}
+
+// ParseMetadataMessage validates the payload of a ut_metadata extension message. Returns its type, the metadata piece
+// it refers to and the data, only sent along data messages.
+func ParseMetadataMessage(payload []byte) (int, int, []byte, error) {
+	if len(payload) < 2 {
+		return 0, 0, nil, fmt.Errorf("%w: empty metadata message", ErrInvalidMessage)
+	}
+
+	// The first byte is the extension ID
+	header, usedBytes, err := bencode.DecodeDictionary(payload[1:])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: metadata message: %w", ErrInvalidMessage, err)
+	}
+
+	msgType, ok := header["msg_type"].(int)
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("%w: metadata message without type", ErrInvalidMessage)
+	}
+	piece, ok := header["piece"].(int)
+	if !ok {
+		return 0, 0, nil, fmt.Errorf("%w: metadata message without piece", ErrInvalidMessage)
+	}
+
+	return msgType, piece, payload[1+usedBytes:], nil
+}
+
+// BuildMetadataRequestMessage returns the ut_metadata request of the metadata piece at pieceIndex
+func BuildMetadataRequestMessage(metadataExtensionId int, pieceIndex int) (Message, error) {
+	messagePayload := map[string]any{
+		"msg_type": METADATA_EXTENSION_REQUEST,
+		"piece":    pieceIndex, // Zero-based page index, the metadata is split in pages of METADATA_PIECE_SIZE bytes
+	}
+
+	payload, err := bencode.Marshal(messagePayload)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Extended{Id: metadataExtensionId, Payload: payload}.Serialize(), nil
+}
@@ -0,0 +1,186 @@
+// Package peer implements the peer wire protocol of BitTorrent, BEP 3: the handshake, the framing of the messages and
+// their typed payloads, along with the extension protocol, BEP 10, the metadata exchange, BEP 9, and the compact
+// format of the peer addresses. It only encodes and decodes, the connections are up to the caller.
+package peer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Failures of the messages received from peers
+var ErrUnexpectedMessage = errors.New("unexpected message")
+var ErrInvalidMessage = errors.New("invalid peer message")
+
+// Types of the messages
+const CHOKE = uint8(0)
+const UNCHOKE = uint8(1)
+const INTERESTED = uint8(2)
+const NOT_INTERESTED = uint8(3)
+const HAVE = uint8(4)
+const BITFIELD = uint8(5)
+const REQUEST = uint8(6)
+const PIECE = uint8(7)
+const CANCEL = uint8(8)
+const PORT = uint8(9)
+const EXTENSION_MESSAGE = uint8(20)
+
+// Names of the peer message types, by ID
+var MessageNames = map[uint8]string{
+	CHOKE:             "choke",
+	UNCHOKE:           "unchoke",
+	INTERESTED:        "interested",
+	NOT_INTERESTED:    "not interested",
+	HAVE:              "have",
+	BITFIELD:          "bitfield",
+	REQUEST:           "request",
+	PIECE:             "piece",
+	CANCEL:            "cancel",
+	PORT:              "port",
+	EXTENSION_MESSAGE: "extended",
+}
+
+// Length of the handshake, which starts with the length of the protocol string and the string
+const HANDSHAKE_MESSAGE_LENGTH = 68
+const PROTOCOL_STRING = "BitTorrent protocol"
+
+// Largest message accepted from peers, far above a block or the bitfield of any reasonable torrent. Protects from
+// allocating whatever length a peer announces
+const MAX_MESSAGE_LENGTH = 1 << 20
+
+// Message represents the messages transmitted between peers.
+type Message struct {
+	Length  uint32 // 4 byte integer indicating the length of the message (type + payload)
+	Type    uint8  // 1 byte integer specifies the type of the message
+	Payload []byte
+}
+
+// Bytes returns the byte representation of a Message, used to transmit the message.
+func (m *Message) Bytes() []byte {
+	// Buffer length adds 4 to account for the length prefix
+	bytes := make([]byte, 0, m.Length+4)
+
+	bytes = binary.BigEndian.AppendUint32(bytes, m.Length) // Message length prefix: 4 bytes
+	bytes = append(bytes, m.Type)
+	bytes = append(bytes, m.Payload...)
+
+	return bytes
+}
+
+// ParseMessage builds a Message from a slice of bytes.
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: missing message type", ErrInvalidMessage)
+	}
+
+	payload := b[1:]
+	length := len(payload) + 1
+
+	return &Message{
+		Length:  uint32(length), // Message length is the length of the payload + 1 byte for the message type
+		Type:    b[0],           // Message type is in the first byte
+		Payload: payload,
+	}, nil
+}
+
+// HandshakeResponse is the handshake message received from a peer.
+type HandshakeResponse struct {
+	Reserved []byte
+	InfoHash []byte
+	PeerId   []byte
+}
+
+// ParseHandshake validates the handshake message received from a peer, which must be for the torrent with the given
+// info hash.
+func ParseHandshake(b []byte, infoHash []byte) (HandshakeResponse, error) {
+	if len(b) != HANDSHAKE_MESSAGE_LENGTH || b[0] != byte(len(PROTOCOL_STRING)) || string(b[1:20]) != PROTOCOL_STRING {
+		return HandshakeResponse{}, fmt.Errorf("%w: not a BitTorrent handshake", ErrInvalidMessage)
+	}
+
+	h := HandshakeResponse{
+		Reserved: b[20:28],
+		InfoHash: b[28:48],
+		PeerId:   b[48:68],
+	}
+	if !bytes.Equal(h.InfoHash, infoHash) {
+		return h, fmt.Errorf("%w: handshake for another torrent", ErrInvalidMessage)
+	}
+
+	return h, nil
+}
+
+// SupportsExtensions returns whether the peer set the reserved bit of the extension protocol
+func (h HandshakeResponse) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+// Bitfield holds the pieces a peer has. The first byte holds the pieces 0 to 7, starting at the high bit.
+type Bitfield []byte
+
+// ParseBitfield validates the payload of a bitfield message of a torrent with nPieces pieces.
+func ParseBitfield(payload []byte, nPieces int) (Bitfield, error) {
+	if len(payload) != (nPieces+7)/8 {
+		return nil, fmt.Errorf("%w: bitfield of %d bytes for %d pieces", ErrInvalidMessage, len(payload), nPieces)
+	}
+
+	// The spare bits at the end must be cleared
+	if nPieces%8 != 0 && payload[len(payload)-1]<<(nPieces%8) != 0 {
+		return nil, fmt.Errorf("%w: bitfield spare bits set", ErrInvalidMessage)
+	}
+
+	return Bitfield(payload), nil
+}
+
+// Has returns whether the piece at index is set
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+// Set marks the piece at index, which must be in the bitfield
+func (b Bitfield) Set(index int) {
+	b[index/8] |= 0x80 >> (index % 8)
+}
+
+// BuildHandshakeMessage returns the byte slice needed for handshake
+func BuildHandshakeMessage(peerId, infoHash []byte, supportExtensions bool) []byte {
+	message := make([]byte, 0, HANDSHAKE_MESSAGE_LENGTH)
+
+	message = append(message, byte(len(PROTOCOL_STRING))) // First byte indicates the length of the protocol string
+	message = append(message, []byte(PROTOCOL_STRING)...) // Protocol string (19 bytes)
+	reservedBytes := make([]byte, 8)                      // Eight reserved bytes, set to 0
+	if supportExtensions {
+		// If our client supports extensions, the 20th bit from the right (count starting in 0, from the total 64 reserved bits) is set to 1
+		// This sets the byte to 00010000, which is 16 in decimal
+		reservedBytes[5] = 16
+	}
+
+	message = append(message, reservedBytes...)
+	message = append(message, infoHash...) // 20 bytes for info hash
+	message = append(message, peerId...)   // 20 bytes for random peer id
+
+	return message
+}
+
+// BuildInterestedMessage returns the message telling the peer we want its pieces
+func BuildInterestedMessage() Message {
+	return Message{
+		Length: uint32(1),
+		Type:   INTERESTED,
+	}
+}
+
+// BuildRequestMessage returns the request of a block of blockLength bytes at begin in the piece at pieceIndex
+func BuildRequestMessage(pieceIndex, begin, blockLength int) Message {
+	return BlockRequest{Index: pieceIndex, Begin: begin, Length: blockLength}.Serialize(REQUEST)
+}
+
+// BuildCancelMessage returns the message cancelling the request of a block, with the same payload as the request
+func BuildCancelMessage(pieceIndex, begin, blockLength int) Message {
+	return BlockRequest{Index: pieceIndex, Begin: begin, Length: blockLength}.Serialize(CANCEL)
+}
@@ -0,0 +1,142 @@
+package peer
+
+import (
+	"bytes"
+	"maps"
+	"net"
+	"testing"
+)
+
+// Info hash and peer ID of the handshakes of the fuzz targets
+var fuzzInfoHash = []byte("fuzz-info-hash-20byt")
+var fuzzPeerId = []byte("-FZ0001-fuzzpeer0001")
+
+// FuzzParseMessage checks a message built from any frame serializes back to the same frame, after its length prefix.
+func FuzzParseMessage(f *testing.F) {
+	frames := []Message{
+		BuildInterestedMessage(),
+		Have{Index: 7}.Serialize(),
+		Bitfield{0xff, 0x80}.Serialize(),
+		BuildRequestMessage(1, 16_384, 16_384),
+		Piece{Index: 1, Begin: 0, Block: []byte("block data")}.Serialize(),
+		Extended{Id: 1, Payload: []byte("d8:msg_typei0e5:piecei0ee")}.Serialize(),
+	}
+	for _, m := range frames {
+		frame := m.Bytes()[4:]
+		f.Add(frame)
+		f.Add(frame[:len(frame)/2])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		m, err := ParseMessage(frame)
+		if err != nil {
+			if len(frame) != 0 {
+				t.Fatalf("frame of %d bytes rejected: %v", len(frame), err)
+			}
+			return
+		}
+
+		if int(m.Length) != len(frame) {
+			t.Fatalf("message length %d for a frame of %d bytes", m.Length, len(frame))
+		}
+		if serialized := m.Bytes(); !bytes.Equal(serialized[4:], frame) {
+			t.Fatalf("frame %x serialized as %x", frame, serialized[4:])
+		}
+	})
+}
+
+// FuzzParseBitfield checks the bitfields accepted for a torrent have no piece past its last one.
+func FuzzParseBitfield(f *testing.F) {
+	f.Add([]byte{0xff, 0xc0}, 10)
+	f.Add([]byte{0xff, 0xff}, 16)
+	f.Add([]byte{0xff}, 10)
+	f.Add([]byte{0xff, 0xe0}, 10)
+	f.Add([]byte{}, 0)
+
+	f.Fuzz(func(t *testing.T, payload []byte, nPieces int) {
+		if nPieces < 0 || nPieces > 8*len(payload)+8 {
+			return
+		}
+
+		b, err := ParseBitfield(payload, nPieces)
+		if err != nil {
+			return
+		}
+
+		if len(b) != (nPieces+7)/8 {
+			t.Fatalf("bitfield of %d bytes accepted for %d pieces", len(b), nPieces)
+		}
+		for index := nPieces; index < 8*len(b); index++ {
+			if b.Has(index) {
+				t.Fatalf("bitfield of %d pieces has piece %d", nPieces, index)
+			}
+		}
+	})
+}
+
+// FuzzParseExtensionHandshake checks the extension handshakes accepted serialize back to the same handshake.
+func FuzzParseExtensionHandshake(f *testing.F) {
+	handshakes := []ExtensionHandshake{
+		{Extensions: map[string]int{"ut_metadata": 1, "ut_pex": 2}},
+		{Extensions: map[string]int{"ut_metadata": 3}, Version: "mybittorrent 0001", Port: 6881, Requests: 250,
+			YourIP: net.IPv4(10, 0, 0, 1), MetadataSize: 31_235},
+		{Extensions: map[string]int{}, YourIP: net.ParseIP("2001:db8::1")},
+	}
+	for _, h := range handshakes {
+		m, err := h.Serialize()
+		if err != nil {
+			f.Fatal(err)
+		}
+		payload := m.Payload
+		f.Add(payload)
+		f.Add(payload[:len(payload)/2])
+	}
+	f.Add([]byte{0})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		h, err := ParseExtensionHandshake(payload)
+		if err != nil {
+			return
+		}
+
+		m, err := h.Serialize()
+		if err != nil {
+			t.Fatalf("handshake %+v not serialized: %v", h, err)
+		}
+		reparsed, err := ParseExtensionHandshake(m.Payload)
+		if err != nil {
+			t.Fatalf("serialized handshake rejected: %v", err)
+		}
+		if !maps.Equal(reparsed.Extensions, h.Extensions) || reparsed.Version != h.Version || reparsed.Port != h.Port ||
+			reparsed.Requests != h.Requests || !reparsed.YourIP.Equal(h.YourIP) || reparsed.MetadataSize != h.MetadataSize {
+			t.Fatalf("handshake %+v serialized as %+v", h, reparsed)
+		}
+	})
+}
+
+// FuzzParseHandshake checks the handshakes accepted are for the expected torrent, with the peer ID they carry.
+func FuzzParseHandshake(f *testing.F) {
+	for _, extensions := range []bool{true, false} {
+		handshake := BuildHandshakeMessage(fuzzPeerId, fuzzInfoHash, extensions)
+		f.Add(handshake)
+		f.Add(handshake[:HANDSHAKE_MESSAGE_LENGTH-1])
+		f.Add(handshake[:20])
+	}
+	f.Add(BuildHandshakeMessage(fuzzPeerId, bytes.Repeat([]byte{1}, 20), true))
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		h, err := ParseHandshake(message, fuzzInfoHash)
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal(h.InfoHash, fuzzInfoHash) {
+			t.Fatalf("handshake for info hash %x accepted", h.InfoHash)
+		}
+		rebuilt := BuildHandshakeMessage(h.PeerId, h.InfoHash, h.SupportsExtensions())
+		if !bytes.Equal(rebuilt[:20], message[:20]) || !bytes.Equal(rebuilt[28:], message[28:]) {
+			t.Fatalf("handshake %x rebuilt as %x", message, rebuilt)
+		}
+	})
+}
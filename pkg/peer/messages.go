@@ -0,0 +1,178 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Typed payloads of the peer messages. Each is parsed from a Message, validating its type and length before
+// reading it, and serialized back into one.
+
+// Have announces a piece the sender got.
+type Have struct {
+	Index int
+}
+
+// BlockRequest is the payload of request and cancel messages: a block of a piece.
+type BlockRequest struct {
+	Index  int
+	Begin  int // Offset of the block in the piece
+	Length int
+}
+
+// Piece carries a block of a piece.
+type Piece struct {
+	Index int
+	Begin int // Offset of the block in the piece
+	Block []byte
+}
+
+// Port announces the UDP port of the DHT node of the sender.
+type Port struct {
+	Port int
+}
+
+// Extended is a message of an extension, BEP 10. ID 0 is the extension handshake, the others are the IDs the
+// receiver assigned to its extensions.
+type Extended struct {
+	Id      int
+	Payload []byte // Bencoded dictionary, possibly followed by data
+}
+
+// checkPayload returns an error unless m is of type mType, with a payload of length bytes, or at least length bytes
+// when exact is false.
+func checkPayload(m *Message, mType uint8, length int, exact bool) error {
+	name := MessageNames[mType]
+	if m.Type != mType {
+		return fmt.Errorf("%w: expected a %s message, received type %d", ErrUnexpectedMessage, name, m.Type)
+	}
+	if len(m.Payload) < length || (exact && len(m.Payload) != length) {
+		return fmt.Errorf("%w: %s message of %d bytes", ErrInvalidMessage, name, len(m.Payload))
+	}
+
+	return nil
+}
+
+// ParseHave validates a have message.
+func ParseHave(m *Message) (Have, error) {
+	if err := checkPayload(m, HAVE, 4, true); err != nil {
+		return Have{}, err
+	}
+
+	return Have{Index: int(binary.BigEndian.Uint32(m.Payload))}, nil
+}
+
+// Serialize returns the have message.
+func (h Have) Serialize() Message {
+	return Message{
+		Length:  5,
+		Type:    HAVE,
+		Payload: binary.BigEndian.AppendUint32(nil, uint32(h.Index)),
+	}
+}
+
+// Serialize returns the bitfield message advertising the pieces set in b.
+func (b Bitfield) Serialize() Message {
+	return Message{
+		Length:  uint32(len(b)) + 1,
+		Type:    BITFIELD,
+		Payload: b,
+	}
+}
+
+// ParseBlockRequest validates a request or cancel message.
+func ParseBlockRequest(m *Message) (BlockRequest, error) {
+	mType := REQUEST
+	if m.Type == CANCEL {
+		mType = CANCEL
+	}
+	if err := checkPayload(m, mType, 12, true); err != nil {
+		return BlockRequest{}, err
+	}
+
+	return BlockRequest{
+		Index:  int(binary.BigEndian.Uint32(m.Payload[0:4])),
+		Begin:  int(binary.BigEndian.Uint32(m.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(m.Payload[8:12])),
+	}, nil
+}
+
+// Serialize returns the message of type mType, REQUEST or CANCEL, for the block.
+func (r BlockRequest) Serialize(mType uint8) Message {
+	// 12 bytes payload: 3 4-byte integers
+	payload := make([]byte, 0, 12)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(r.Index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(r.Begin))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(r.Length))
+
+	return Message{
+		Length:  13, // Payload length + 1 byte for mType
+		Type:    mType,
+		Payload: payload,
+	}
+}
+
+// ParsePiece validates a piece message. The block shares the memory of the payload.
+func ParsePiece(m *Message) (Piece, error) {
+	if err := checkPayload(m, PIECE, 8, false); err != nil {
+		return Piece{}, err
+	}
+
+	return Piece{
+		Index: int(binary.BigEndian.Uint32(m.Payload[0:4])),
+		Begin: int(binary.BigEndian.Uint32(m.Payload[4:8])),
+		Block: m.Payload[8:],
+	}, nil
+}
+
+// Serialize returns the piece message carrying the block.
+func (p Piece) Serialize() Message {
+	payload := make([]byte, 0, 8+len(p.Block))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(p.Index))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(p.Begin))
+	payload = append(payload, p.Block...)
+
+	return Message{
+		Length:  uint32(len(payload)) + 1,
+		Type:    PIECE,
+		Payload: payload,
+	}
+}
+
+// ParsePort validates a port message.
+func ParsePort(m *Message) (Port, error) {
+	if err := checkPayload(m, PORT, 2, true); err != nil {
+		return Port{}, err
+	}
+
+	return Port{Port: int(binary.BigEndian.Uint16(m.Payload))}, nil
+}
+
+// Serialize returns the port message.
+func (p Port) Serialize() Message {
+	return Message{
+		Length:  3,
+		Type:    PORT,
+		Payload: binary.BigEndian.AppendUint16(nil, uint16(p.Port)),
+	}
+}
+
+// ParseExtended validates an extension message. The payload shares the memory of the message.
+func ParseExtended(m *Message) (Extended, error) {
+	if err := checkPayload(m, EXTENSION_MESSAGE, 1, false); err != nil {
+		return Extended{}, err
+	}
+
+	return Extended{Id: int(m.Payload[0]), Payload: m.Payload[1:]}, nil
+}
+
+// Serialize returns the extension message.
+func (e Extended) Serialize() Message {
+	payload := append([]byte{byte(e.Id)}, e.Payload...)
+
+	return Message{
+		Length:  uint32(len(payload)) + 1,
+		Type:    EXTENSION_MESSAGE,
+		Payload: payload,
+	}
+}
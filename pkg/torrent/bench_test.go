@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// Size of the pieces used by the benchmarks, a common choice for torrents of a few GiB
+const BENCH_PIECE_LENGTH = 262_144
+
+// Number of pieces of the torrent decoded and encoded by the benchmarks, its pieces string is close to 200 KiB
+const BENCH_TORRENT_PIECES = 10_000
+
+// Number of pieces checked at once by the verification benchmark
+const BENCH_VERIFIED_PIECES = 64
+
+// benchTorrent returns the bencoded metainfo of a torrent with BENCH_TORRENT_PIECES pieces, and its decoded form.
+func benchTorrent(b *testing.B) ([]byte, map[string]any) {
+	pieces := make([]byte, BENCH_TORRENT_PIECES*sha1.Size)
+	rand.Read(pieces)
+
+	metainfo := map[string]any{
+		"announce":   "http://127.0.0.1:8000/announce",
+		"created by": "mybittorrent",
+		"info": map[string]any{
+			"name":         "bench.bin",
+			"length":       BENCH_TORRENT_PIECES * BENCH_PIECE_LENGTH,
+			"piece length": BENCH_PIECE_LENGTH,
+			"pieces":       string(pieces),
+		},
+	}
+
+	encoded, err := bencode.Marshal(metainfo)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return encoded, metainfo
+}
+
+// BenchmarkDecodeTorrent measures decoding the metainfo of a large torrent.
+func BenchmarkDecodeTorrent(b *testing.B) {
+	data, _ := benchTorrent(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := bencode.Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeTorrent measures encoding the metainfo of a large torrent.
+func BenchmarkEncodeTorrent(b *testing.B) {
+	encoded, metainfo := benchTorrent(b)
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := bencode.Marshal(metainfo); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkVerifyPiece measures the hash check done on every downloaded piece.
+func BenchmarkVerifyPiece(b *testing.B) {
+	piece := make([]byte, BENCH_PIECE_LENGTH)
+	rand.Read(piece)
+	expected := sha1.Sum(piece)
+	b.SetBytes(BENCH_PIECE_LENGTH)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !bytes.Equal(sha1Hasher.hash(piece), expected[:]) {
+			b.Fatal(ErrHashMismatch)
+		}
+	}
+}
+
+// BenchmarkVerifyPieces measures checking the pieces of a torrent already on disk, hashed on every core.
+func BenchmarkVerifyPieces(b *testing.B) {
+	encoded, _ := benchTorrent(b)
+	t, err := parseTorrent(encoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	data := make([]byte, BENCH_PIECE_LENGTH)
+	indexes := make([]int, BENCH_VERIFIED_PIECES)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	b.SetBytes(BENCH_VERIFIED_PIECES * BENCH_PIECE_LENGTH)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		t.verifyPieces(indexes, func(int) ([]byte, error) { return data, nil })
+	}
+}
+
+// BenchmarkPieceTransfer measures downloading a piece from a seeder over a TCP connection on the loopback interface,
+// from the dial to the last block.
+func BenchmarkPieceTransfer(b *testing.B) {
+	h, err := newHarness(4*BENCH_PIECE_LENGTH, BENCH_PIECE_LENGTH)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go h.serveSeeder(listener, SEEDER_NORMAL)
+
+	t, err := h.torrent()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	dialer := &tcpDialer{}
+	b.SetBytes(BENCH_PIECE_LENGTH)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn, closer, err := newPeerConnection(ctx, dialer, listener.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := t.handshake(ctx, conn, false); err != nil {
+			closer()
+			b.Fatal(err)
+		}
+
+		pieceIndex := i % (t.info.nPieces - 1)
+		data, err := t.getPieceFromPeer(ctx, conn, pieceIndex, true)
+		closer()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(data) != BENCH_PIECE_LENGTH {
+			b.Fatalf("received %d bytes of piece %d", len(data), pieceIndex)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// ResolveBindAddress returns the local address the connections of the client are bound to, given either as an IP
+// address or as the name of a network interface, like a VPN's tun0. The first IPv4 address of the interface is
+// preferred. Returns nil when neither is given.
+func ResolveBindAddress(address, interfaceName string) (net.IP, error) {
+	if address != "" && interfaceName != "" {
+		return nil, fmt.Errorf("--bind-address and --interface can't be used together")
+	}
+
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", address)
+		}
+		return ip, nil
+	}
+
+	if interfaceName == "" {
+		return nil, nil
+	}
+
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", interfaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", interfaceName, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0], nil
+	}
+
+	return nil, fmt.Errorf("interface %s has no usable address", interfaceName)
+}
+
+// Values of --announce-ipv6 other than an IPv6 address
+const ANNOUNCE_IPV6_AUTO = "auto" // The bind address when it's a global IPv6 one, the first of the interfaces otherwise
+const ANNOUNCE_IPV6_NONE = "none" // No IPv6 address is announced
+
+// ResolveAnnouncedIPv6 returns the IPv6 address announced to trackers, so IPv6 peers can connect to us, BEP 7. It's
+// given as an address, ANNOUNCE_IPV6_AUTO or ANNOUNCE_IPV6_NONE. Returns nil when there is none.
+func ResolveAnnouncedIPv6(value string, bind net.IP) (net.IP, error) {
+	switch value {
+	case ANNOUNCE_IPV6_NONE:
+		return nil, nil
+	case ANNOUNCE_IPV6_AUTO:
+	default:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", value)
+		}
+		return ip, nil
+	}
+
+	if bind != nil {
+		if isGlobalIPv6(bind) {
+			return bind, nil
+		}
+		// Connections bound to an IPv4 address can't reach IPv6 peers
+		if !bind.IsUnspecified() {
+			return nil, nil
+		}
+	}
+
+	// Interfaces that can't be listed have no address to announce
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && isGlobalIPv6(ipNet.IP) {
+			return ipNet.IP, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// isGlobalIPv6 reports whether ip is an IPv6 address reachable from the internet.
+func isGlobalIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// WithAnnouncedIPv6 makes the torrents announce ip to the trackers, along with the address they see the requests from.
+func WithAnnouncedIPv6(ip net.IP) Option {
+	return func(c *Client) {
+		c.announcedIPv6 = ip
+	}
+}
+
+// WithBindAddress makes the client open its peer connections and tracker requests from the local address ip.
+func WithBindAddress(ip net.IP) Option {
+	return func(c *Client) {
+		c.bindAddress = ip
+		c.dialer, c.tracker, c.webClient = newNetworkTransport(c.bindAddress, c.resolver)
+	}
+}
+
+// newNetworkTransport creates the peer dialer, HTTP and UDP tracker clients and web seed client connecting from the local
+// address ip, any when nil, and resolving hostnames with resolver, the system's when nil.
+func newNetworkTransport(ip net.IP, resolver *DnsResolver) (PeerDialer, tracker.Client, *http.Client) {
+	dialer := net.Dialer{}
+	if ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	dial := dialer.DialContext
+	if resolver != nil {
+		dial = resolver.dialContext(dialer.DialContext)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+
+	return &tcpDialer{dialer: dialer, resolver: resolver}, tracker.NewSchemeTracker(transport, dial), &http.Client{Transport: transport}
+}
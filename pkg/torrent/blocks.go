@@ -0,0 +1,233 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Length of the blocks requested from the peers, the last block of a piece may be shorter
+const BLOCK_SIZE = 16_384
+
+// blockQueue splits a piece into blocks, handed to several peers downloading them in parallel. Blocks a peer fails to
+// deliver are put back for the others. The piece is reassembled as the blocks arrive.
+type blockQueue struct {
+	pieceIndex int
+
+	mu       sync.Mutex
+	data     []byte
+	pending  []int         // Offsets of the blocks waiting for a peer
+	missing  int           // Blocks not delivered yet
+	changed  chan struct{} // Closed and replaced when a block is put back or delivered
+	complete chan struct{} // Closed once every block is delivered
+}
+
+// newBlockQueue returns the queue of the blocks of the piece at pieceIndex, of pieceLength bytes.
+func newBlockQueue(pieceIndex, pieceLength int) *blockQueue {
+	q := &blockQueue{
+		pieceIndex: pieceIndex,
+		data:       make([]byte, pieceLength),
+		changed:    make(chan struct{}),
+		complete:   make(chan struct{}),
+	}
+	for begin := 0; begin < pieceLength; begin += BLOCK_SIZE {
+		q.pending = append(q.pending, begin)
+	}
+	q.missing = len(q.pending)
+
+	return q
+}
+
+// tryTake returns the offset and length of a pending block, or false when none is pending.
+func (q *blockQueue) tryTake() (int, int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return 0, 0, false
+	}
+	begin := q.pending[0]
+	q.pending = q.pending[1:]
+
+	return begin, min(BLOCK_SIZE, len(q.data)-begin), true
+}
+
+// wait blocks until a block is put back or delivered. Returns false once the piece is complete, or ctx is done.
+func (q *blockQueue) wait(ctx context.Context) bool {
+	q.mu.Lock()
+	changed := q.changed
+	q.mu.Unlock()
+
+	select {
+	case <-changed:
+		return q.missingBlocks() > 0
+	case <-q.complete:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// put gives up the block at begin, for another peer.
+func (q *blockQueue) put(begin int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, begin)
+	q.notifyLocked()
+}
+
+// deliver copies the block at begin into the piece.
+func (q *blockQueue) deliver(begin int, block []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	copy(q.data[begin:], block)
+	q.missing--
+	if q.missing == 0 {
+		close(q.complete)
+	}
+	q.notifyLocked()
+}
+
+// missingBlocks returns the number of blocks not delivered yet.
+func (q *blockQueue) missingBlocks() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.missing
+}
+
+// notifyLocked wakes up the waiting peers. Must be called holding the lock.
+func (q *blockQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// downloadBlocks downloads blocks of the queue from the peer of conn, which exchanged the initial messages, keeping up
+// to the pipeline depth of the client requested, at most the requests the peer takes outstanding. Returns once the piece is complete. The blocks still requested when
+// the peer fails, or chokes us, are put back on the queue.
+func (t Torrent) downloadBlocks(ctx context.Context, conn *peerConnection, q *blockQueue) error {
+	if !conn.available.Has(q.pieceIndex) {
+		return fmt.Errorf("peer doesn't have piece %d", q.pieceIndex)
+	}
+
+	depth := conn.requestDepth(t.getClient().pipelineDepth)
+	outstanding := map[int]int{} // Length of the requested blocks, keyed by offset
+	defer func() {
+		for begin := range outstanding {
+			q.put(begin)
+		}
+	}()
+
+	for {
+		for len(outstanding) < depth {
+			begin, blockLength, ok := q.tryTake()
+			if !ok {
+				break
+			}
+			outstanding[begin] = blockLength
+			if _, err := conn.sendMessage(ctx, peer.BuildRequestMessage(q.pieceIndex, begin, blockLength)); err != nil {
+				return err
+			}
+		}
+
+		// Waits for the blocks of the other peers once none is left to request
+		if len(outstanding) == 0 {
+			if !q.wait(ctx) {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		message, err := conn.receiveMessage(ctx, t.info.nPieces, peer.PIECE, peer.CHOKE)
+		if err != nil {
+			return err
+		}
+		if message.Type == peer.CHOKE {
+			// A choking peer drops our requests, the other peers take them
+			return unexpectedMessageError(peer.PIECE, message.Type)
+		}
+
+		piece, err := peer.ParsePiece(message)
+		if err != nil {
+			return err
+		}
+		if piece.Index != q.pieceIndex {
+			return fmt.Errorf("%w: piece message doesn't match the requested piece", peer.ErrInvalidMessage)
+		}
+		blockLength, ok := outstanding[piece.Begin]
+		if !ok || len(piece.Block) != blockLength {
+			return fmt.Errorf("%w: piece message doesn't match a requested block", peer.ErrInvalidMessage)
+		}
+		delete(outstanding, piece.Begin)
+		q.deliver(piece.Begin, piece.Block)
+	}
+}
+
+// downloadPieceFromPeers downloads the piece at pieceIndex from up to n peers of the torrent at once, each of them
+// downloading a share of its blocks. Returns the reassembled piece, not verified yet.
+func (t Torrent) downloadPieceFromPeers(ctx context.Context, pieceIndex, n int) ([]byte, error) {
+	c := t.getClient()
+
+	peers, err := t.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	working := t.dialWorkingSet(ctx, c.deadPeers.filter(peers), n)
+	defer func() {
+		for _, peer := range working {
+			peer.closer()
+		}
+	}()
+	if len(working) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: no peer completed the handshake", ErrNoPeers)
+	}
+
+	// Cancelled once the piece is complete, before the connections are closed, so the peers still waiting stop quietly
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := newBlockQueue(pieceIndex, t.info.pieceLengthAt(pieceIndex))
+	errs := make(chan error, len(working))
+	for _, peer := range working {
+		go func() {
+			err := t.exchangeInterest(ctx, peer.conn)
+			if err == nil {
+				err = t.downloadBlocks(ctx, peer.conn, q)
+			}
+			if err != nil && ctx.Err() == nil {
+				err = &PieceError{Piece: pieceIndex, Peer: peer.address, Err: err}
+				c.log.Warn(err.Error(), "peer", peer.address, "piece", pieceIndex)
+			}
+			errs <- err
+		}()
+	}
+
+	// The piece is complete once every block is delivered, the peers still waiting for blocks then stop
+	var failures []error
+	for range working {
+		select {
+		case err := <-errs:
+			if err != nil {
+				failures = append(failures, err)
+			}
+		case <-q.complete:
+			return q.data, nil
+		}
+	}
+
+	select {
+	case <-q.complete:
+		return q.data, nil
+	default:
+		return nil, errors.Join(failures...)
+	}
+}
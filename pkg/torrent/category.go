@@ -0,0 +1,139 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CategoryConfig holds the settings of a torrent category.
+type CategoryConfig struct {
+	// Directory where the data of completed torrents of the category is moved to. Left in place when empty
+	CompleteDir string `json:"completeDir,omitempty"`
+}
+
+// normalizeLabels trims the labels, dropping empty and repeated ones. Labels can't contain commas, as in Transmission.
+func normalizeLabels(labels []string) ([]string, error) {
+	normalized := make([]string, 0, len(labels))
+	seen := map[string]bool{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || seen[label] {
+			continue
+		}
+		if strings.Contains(label, ",") {
+			return nil, fmt.Errorf("invalid label %q, labels can't contain commas", label)
+		}
+
+		seen[label] = true
+		normalized = append(normalized, label)
+	}
+
+	return normalized, nil
+}
+
+// setLabels replaces the labels and category of the torrent. A nil labels or category leaves the value untouched.
+// Setting the category of a completed torrent moves its data to the directory of the category.
+func (s *Session) setLabels(hash string, labels []string, category *string) error {
+	var err error
+	if labels != nil {
+		labels, err = normalizeLabels(labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	st, ok := s.torrents[hash]
+	if ok {
+		if labels != nil {
+			st.labels = labels
+		}
+		if category != nil {
+			st.category = strings.TrimSpace(*category)
+		}
+	}
+	completed := ok && st.status == STATUS_COMPLETED
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+
+	if completed && category != nil {
+		return s.moveCompleted(st)
+	}
+
+	return nil
+}
+
+// moveCompleted moves the data of a completed torrent to the directory of its category, if it has one.
+func (s *Session) moveCompleted(st *SessionTorrent) error {
+	s.mu.Lock()
+	config, ok := s.categories[st.category]
+	src, err := st.dataPath()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !ok || config.CompleteDir == "" {
+		return nil
+	}
+
+	dst := filepath.Join(config.CompleteDir, filepath.Base(src))
+	if dst == src {
+		return nil
+	}
+
+	if err := os.MkdirAll(config.CompleteDir, 0755); err != nil {
+		return err
+	}
+	if err := moveFile(src, dst); err != nil {
+		return fmt.Errorf("could not move %s to %s: %w", src, config.CompleteDir, err)
+	}
+
+	s.mu.Lock()
+	st.downloadDir = config.CompleteDir
+	t := st.t
+	s.mu.Unlock()
+
+	t.publish(Event{Type: EVENT_MOVED, Path: dst})
+
+	return nil
+}
+
+// moveFile renames src to dst, copying the file when they are on different file systems.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Hash functions available for the checksums of downloaded files, by name
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// computeChecksums hashes the file at path with the given algorithms, reading it once. Returns the hex encoded sums
+// keyed by algorithm.
+func computeChecksums(path string, algorithms []string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		h := ChecksumAlgorithms[algorithm]()
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		sums[algorithm] = toHex(h.Sum(nil))
+	}
+
+	return sums, nil
+}
+
+// writeChecksumManifest writes the sums of the file at path to ManifestPath, in the BSD tag format checked by
+// sha256sum -c and shasum -c.
+func writeChecksumManifest(manifestPath, path string, sums map[string]string) error {
+	algorithms := make([]string, 0, len(sums))
+	for algorithm := range sums {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+
+	var b strings.Builder
+	for _, algorithm := range algorithms {
+		fmt.Fprintf(&b, "%s (%s) = %s\n", strings.ToUpper(algorithm), filepath.Base(path), sums[algorithm])
+	}
+
+	return os.WriteFile(manifestPath, []byte(b.String()), 0660)
+}
+
+// ChecksumOptions are the checks of the downloaded file requested by the download command.
+type ChecksumOptions struct {
+	Algorithms   []string          // Checksums written to the manifest
+	ManifestPath string            // <output>.checksums when empty
+	Expected     map[string]string // Checksums the file must have, keyed by algorithm
+}
+
+// Check computes the checksums of the file downloaded at outputPath, writes the manifest if requested, and compares
+// them to the expected ones. The md5sum of the metainfo, when present, is expected unless another one is given.
+func (o ChecksumOptions) Check(t Torrent, outputPath string) error {
+	expected := maps.Clone(o.Expected)
+	if _, ok := expected["md5"]; !ok && t.info.md5sum != "" {
+		expected["md5"] = strings.ToLower(t.info.md5sum)
+	}
+
+	algorithms := slices.Clone(o.Algorithms)
+	for algorithm := range expected {
+		if !slices.Contains(algorithms, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil
+	}
+
+	if t.info.files != nil {
+		return errors.New("checksums are only computed for single file torrents")
+	}
+
+	// Unfinished downloads keep their resume file
+	_, resumeErr := os.Stat(outputPath + RESUME_SUFFIX)
+	stat, err := os.Stat(outputPath)
+	if err != nil || stat.Size() != int64(t.info.length) || resumeErr == nil {
+		return errors.New("download did not complete, checksums not computed")
+	}
+
+	sums, err := computeChecksums(outputPath, algorithms)
+	if err != nil {
+		return err
+	}
+
+	if len(o.Algorithms) > 0 {
+		manifestPath := o.ManifestPath
+		if manifestPath == "" {
+			manifestPath = outputPath + ".checksums"
+		}
+		manifestSums := make(map[string]string, len(o.Algorithms))
+		for _, algorithm := range o.Algorithms {
+			manifestSums[algorithm] = sums[algorithm]
+		}
+		if err := writeChecksumManifest(manifestPath, outputPath, manifestSums); err != nil {
+			return err
+		}
+		t.getClient().log.Info(fmt.Sprintf("Wrote checksums to %s", manifestPath))
+	}
+
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		want, ok := expected[algorithm]
+		if !ok {
+			continue
+		}
+		if sums[algorithm] != want {
+			return fmt.Errorf("%s checksum mismatch: expected %s, got %s", algorithm, want, sums[algorithm])
+		}
+		t.getClient().log.Info(fmt.Sprintf("%s checksum OK", algorithm))
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+// Package torrent downloads and seeds BitTorrent torrents. A Client, configured by its options, creates the Torrents
+// of torrent files and magnet links, which download their data from the peers found through the trackers, the DHT
+// and the peer exchange. A Session downloads several torrents sharing the peer and disk budgets of the client, and a
+// Daemon keeps a session running behind an HTTP API.
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// Port announced to the trackers unless configured
+const DEFAULT_PORT = 6881
+
+// Block requests kept outstanding per peer unless configured
+const DEFAULT_PIPELINE_DEPTH = 5
+
+// Time a peer has to answer a block request, send the rest of a message or take a write unless configured
+const DEFAULT_PEER_TIMEOUT = 30 * time.Second
+
+// Client holds the settings shared by the torrents it creates: how they reach peers and trackers, how they identify
+// themselves, how fast they transfer, where they store the data and where they report progress.
+type Client struct {
+	port            int
+	bindAddress     net.IP       // Local address of the connections, any address when nil
+	announcedIPv6   net.IP       // IPv6 address announced to the trackers, none when nil
+	resolver        *DnsResolver // Resolves the hostnames of trackers and peers, the system's resolver when nil
+	peerId          []byte       // Sent to trackers and peers, generated once per client unless configured
+	trackerKey      string       // Sent to trackers as the key parameter by the torrents without a key of their own
+	userAgent       string       // User-Agent of the tracker requests, tracker.DEFAULT_USER_AGENT when empty
+	trackerHeaders  http.Header  // Added to the tracker requests
+	downloadLimiter *rateLimiter
+	uploadLimiter   *rateLimiter
+	peerRates       [2]int // Bytes per second downloaded from and uploaded to every peer, unlimited when 0
+	storage         Storage
+	logger          io.Writer    // Receives the logs, the standard error when nil
+	logLevel        slog.Level   // Records below it are not logged
+	jsonLogs        bool         // Whether the logs are JSON lines rather than plain lines
+	tracer          *Tracer      // Traces the downloads, none when nil
+	log             *slog.Logger // Logs the progress of the downloads and the exchanges with trackers and peers
+	dialer          PeerDialer
+	webClient       *http.Client // Downloads the pieces of the web seeds
+	tracker         tracker.Client
+	encryption      EncryptionPolicy
+	deadPeers       *deadPeers             // Peers that failed, shared by the torrents so they are not redialed too soon
+	hashers         map[string]pieceHasher // Hash the pieces, by algorithm
+	hashes          *hashPool              // Verifies the pieces downloaded by the torrents
+	maxHashFailures int                    // Corrupt pieces a peer sends before it's banned, never banned when 0
+	pipelineDepth   int                    // Block requests kept outstanding per peer
+	peerTimeout     time.Duration          // Time a peer has to answer a request, send a message or take a write, none when 0
+	clock           clock                  // Times the peer timeouts and the re-announces of the downloads
+	maxPeers        int                    // Peers a download is connected to at most
+	strategy        PieceStrategy          // Order in which the pieces of the downloads are assigned to the peers
+	wireDump        *WireDump              // Records the messages exchanged with peers, none when nil
+	dht             *DhtNode               // Finds peers when the trackers can't, only trackers are used when nil
+	listener        *PeerListener          // Hands the peers connecting to us to the downloads, none connect when nil
+	onProgress      func(Progress)         // Receives the progress of the downloads, pieces are logged one by one when nil
+	statsReport     bool                   // Whether the downloads log the transfer statistics of their peers
+	hooks           []Hook
+}
+
+// Option configures a client.
+type Option func(*Client)
+
+// NewClient creates a client with the default settings, changed by the given options.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		port:            DEFAULT_PORT,
+		downloadLimiter: newRateLimiter(0, realClock),
+		uploadLimiter:   newRateLimiter(0, realClock),
+		storage:         diskStorage{},
+		dialer:          defaultPeerDialer,
+		webClient:       &http.Client{},
+		tracker:         defaultTrackerClient,
+		encryption:      ENCRYPTION_DISABLE,
+		deadPeers:       newDeadPeers(realClock),
+		hashers:         map[string]pieceHasher{HASH_SHA1: sha1Hasher, HASH_SHA256: sha256Hasher},
+		hashes:          newHashPool(runtime.GOMAXPROCS(0)),
+		maxHashFailures: DEFAULT_MAX_HASH_FAILURES,
+		pipelineDepth:   DEFAULT_PIPELINE_DEPTH,
+		peerTimeout:     DEFAULT_PEER_TIMEOUT,
+		clock:           realClock,
+		maxPeers:        DEFAULT_MAX_PEERS,
+		strategy:        STRATEGY_RAREST,
+		peerId:          newPeerId(),
+		trackerKey:      newTrackerKey(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.log = newClientLogger(c)
+	if c.listener != nil {
+		c.listener.setEncryption(c.encryption)
+	}
+
+	return c
+}
+
+// Close stops the hash workers of the client. The downloads of its torrents fail once it's closed.
+func (c *Client) Close() error {
+	c.hashes.close()
+	return nil
+}
+
+// WithPort sets the port announced to the trackers.
+func WithPort(port int) Option {
+	return func(c *Client) {
+		c.port = port
+	}
+}
+
+// WithPeerId sets the 20 bytes peer ID sent to trackers and peers.
+func WithPeerId(peerId []byte) Option {
+	return func(c *Client) {
+		c.peerId = peerId
+	}
+}
+
+// WithRateLimits limits the bytes per second downloaded and uploaded by the client's torrents together. 0 means
+// unlimited.
+func WithRateLimits(download, upload int) Option {
+	return func(c *Client) {
+		c.downloadLimiter = newRateLimiter(download, realClock)
+		c.uploadLimiter = newRateLimiter(upload, realClock)
+	}
+}
+
+// WithPeerRateLimits limits the bytes per second downloaded from and uploaded to every peer, on top of the limits of
+// the client. 0 means unlimited.
+func WithPeerRateLimits(download, upload int) Option {
+	return func(c *Client) {
+		c.peerRates = [2]int{download, upload}
+	}
+}
+
+// peerLimiters returns the limiters of a new peer connection: its own when per-peer limits are set, limited by the
+// ones of the client too.
+func (c *Client) peerLimiters() (*rateLimiter, *rateLimiter) {
+	return c.downloadLimiter.child(c.peerRates[0]), c.uploadLimiter.child(c.peerRates[1])
+}
+
+// WithStorage sets where the downloaded data is written, the local file system by default.
+func WithStorage(s Storage) Option {
+	return func(c *Client) {
+		c.storage = s
+	}
+}
+
+// WithLogger sets where the logs are written, the standard error by default.
+func WithLogger(w io.Writer) Option {
+	return func(c *Client) {
+		c.logger = w
+	}
+}
+
+// WithPeerDialer sets how connections to peers are opened.
+func WithPeerDialer(dialer PeerDialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// WithTracker sets where the peers of the torrents are found.
+func WithTracker(trackerClient tracker.Client) Option {
+	return func(c *Client) {
+		c.tracker = trackerClient
+	}
+}
+
+// WithTrackerHeaders sets the User-Agent of the tracker requests, tracker.DEFAULT_USER_AGENT when empty, and headers added to
+// them, like the cookies of private trackers.
+func WithTrackerHeaders(userAgent string, headers http.Header) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+		c.trackerHeaders = headers
+	}
+}
+
+// WithPipelineDepth sets how many block requests are kept outstanding per peer. Deeper pipelines keep high latency
+// links busy.
+func WithPipelineDepth(depth int) Option {
+	return func(c *Client) {
+		c.pipelineDepth = depth
+	}
+}
+
+// WithPeerTimeout sets how long a peer has to answer a block request, send the rest of a message or take a write,
+// before its connection fails with errPeerTimeout. 0 waits as long as the peer isn't idle.
+func WithPeerTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.peerTimeout = timeout
+	}
+}
+
+// withClock sets the clock timing the peer timeouts and the re-announces of the downloads, simulated to run them
+// without waiting for real time to pass.
+func withClock(clock clock) Option {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// WithEncryption sets whether the connections to peers are encrypted.
+func WithEncryption(policy EncryptionPolicy) Option {
+	return func(c *Client) {
+		c.encryption = policy
+	}
+}
+
+// announcedPeerId returns the peer ID the torrent sends to trackers, the one of its handshakes.
+func (t Torrent) announcedPeerId() string {
+	return string(t.localPeerId())
+}
+
+// newTrackerKey returns a random key, 4 bytes hex encoded, kept for the lifetime of the client.
+func newTrackerKey() string {
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return ""
+	}
+
+	return toHex(key)
+}
+
+// announcedKey returns the key the torrent sends to trackers: its own if it has one, or the client's. Trackers
+// recognize the announces of a client by it when its address changes.
+func (t Torrent) announcedKey() string {
+	if t.key != "" {
+		return t.key
+	}
+
+	return t.getClient().trackerKey
+}
+
+// ParseTorrentFile creates a torrent of the client from the given filename.
+func (c *Client) ParseTorrentFile(filename string) (Torrent, error) {
+	t, err := parseTorrentFile(filename)
+	t.client = c
+
+	return t, err
+}
+
+// parseTorrent creates a torrent of the client from the bencoded content of a torrent file.
+func (c *Client) parseTorrent(fileContent []byte) (Torrent, error) {
+	t, err := parseTorrent(fileContent)
+	t.client = c
+
+	return t, err
+}
+
+// ParseMagnetLink creates a torrent of the client from a magnet link.
+func (c *Client) ParseMagnetLink(link string) (Torrent, error) {
+	t, err := parseMagnetLink(link)
+	t.client = c
+
+	return t, err
+}
+
+// LoadTorrent creates a torrent of the client from a magnet link or a torrent file path. Metadata for magnet links is
+// not fetched.
+func (c *Client) LoadTorrent(source string) (Torrent, error) {
+	t, err := loadTorrent(source)
+	t.client = c
+
+	return t, err
+}
+
+// OpenTorrent creates a torrent of the client from a magnet link or a torrent file path. The metadata of magnet links
+// is fetched from their peers.
+func (c *Client) OpenTorrent(ctx context.Context, source string) (Torrent, error) {
+	t, err := c.LoadTorrent(source)
+	if err != nil || t.info.pieces != nil {
+		return t, err
+	}
+
+	return t, t.MagnetInfo(ctx)
+}
+
+// Storage writes the downloaded data.
+type Storage interface {
+	// OpenData opens the data at path of a torrent, creating it, for its pieces of pieceLength bytes to be written at
+	// their offsets. The data is made of the files of layout, concatenated in order.
+	OpenData(path string, layout []DataFile, pieceLength int) (DataStore, error)
+	// WriteFile writes the file at path, holding data.
+	WriteFile(path string, data []byte) (int, error)
+}
+
+// DataStore is the data of a download, as if its files were concatenated.
+type DataStore interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// diskStorage writes the downloaded data to the local file system.
+type diskStorage struct{}
+
+// OpenData opens the files of the torrent at path, written through their journal.
+func (diskStorage) OpenData(path string, layout []DataFile, pieceLength int) (DataStore, error) {
+	return openJournaledData(path, layout, pieceLength)
+}
+
+// WriteFile creates the file at path, along with its parent directories, and writes data to it. The write goes
+// through the journal of the file, removed once the data is fsynced.
+func (diskStorage) WriteFile(path string, data []byte) (int, error) {
+	// Create subfolder if path has it
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return 0, fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	journal, err := openWriteJournal(path)
+	if err != nil {
+		return 0, err
+	}
+	defer journal.file.Close()
+
+	written := journalRange{offset: 0, length: len(data)}
+	if err := journal.record(JOURNAL_WRITE, written); err != nil {
+		return 0, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, err := file.Write(data)
+	if err != nil {
+		return n, err
+	}
+	if err := file.Sync(); err != nil {
+		return n, err
+	}
+
+	if err := journal.record(JOURNAL_SYNC, written); err != nil {
+		return n, err
+	}
+
+	return n, journal.remove()
+}
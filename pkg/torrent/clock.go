@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock tells the time and schedules timers. The daemon, the event bus and the rate limiters go through it, so their
+// timing logic can run against a simulated clock instead of waiting for real time to pass.
+type clock interface {
+	now() time.Time
+	// newTimer returns a channel receiving the time once d elapsed, and the function to stop the timer
+	newTimer(d time.Duration) (<-chan time.Time, func())
+	// newTicker returns a channel receiving the time every d, and the function to stop the ticker. Ticks are dropped
+	// while the receiver is late, as with time.Ticker
+	newTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// systemClock is the clock of the operating system.
+type systemClock struct{}
+
+// Clock used unless a simulated one is given
+var realClock clock = systemClock{}
+
+func (systemClock) now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) newTimer(d time.Duration) (<-chan time.Time, func()) {
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }
+}
+
+func (systemClock) newTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// clockTimeout returns ctx canceled once d elapsed on clock, with context.DeadlineExceeded as its cause. The context
+// has a deadline on the system clock only, a nil clock meaning the system clock.
+func clockTimeout(ctx context.Context, clock clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if clock == nil || clock == realClock {
+		return context.WithTimeout(ctx, d)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	expired, stop := clock.newTimer(d)
+	go func() {
+		defer stop()
+
+		select {
+		case <-expired:
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// simClock is a clock whose time only moves when advanced, firing the timers due in order. Simulations use it to run
+// timeouts deterministically and without sleeping.
+type simClock struct {
+	mu      sync.Mutex
+	changed *sync.Cond // Signaled when timers are added or removed
+	current time.Time
+	timers  []*simTimer
+}
+
+// simTimer is a timer or ticker of a simClock.
+type simTimer struct {
+	at     time.Time
+	period time.Duration // Interval of tickers, 0 for timers
+	c      chan time.Time
+}
+
+func newSimClock(start time.Time) *simClock {
+	c := &simClock{current: start}
+	c.changed = sync.NewCond(&c.mu)
+
+	return c
+}
+
+func (c *simClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.current
+}
+
+func (c *simClock) newTimer(d time.Duration) (<-chan time.Time, func()) {
+	return c.add(d, 0)
+}
+
+func (c *simClock) newTicker(d time.Duration) (<-chan time.Time, func()) {
+	return c.add(d, d)
+}
+
+// add registers a timer firing after d, and then every period if not 0.
+func (c *simClock) add(d, period time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &simTimer{at: c.current.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		t.c <- c.current
+		return t.c, func() {}
+	}
+
+	c.timers = append(c.timers, t)
+	c.changed.Broadcast()
+
+	return t.c, func() { c.remove(t) }
+}
+
+func (c *simClock) remove(t *simTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// advance moves the time forward by d, firing the timers due meanwhile in chronological order.
+func (c *simClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.current.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(target) {
+			break
+		}
+
+		t := c.timers[0]
+		c.current = t.at
+		select {
+		case t.c <- t.at:
+		default:
+		}
+
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			c.timers = c.timers[1:]
+			c.changed.Broadcast()
+		}
+	}
+
+	c.current = target
+}
+
+// next returns the time until the earliest pending timer, or false if there's none.
+func (c *simClock) next() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+
+	earliest := c.timers[0].at
+	for _, t := range c.timers[1:] {
+		if t.at.Before(earliest) {
+			earliest = t.at
+		}
+	}
+
+	return earliest.Sub(c.current), true
+}
+
+// waitTimers blocks until at least n timers are pending, meaning the goroutines being simulated are waiting on the
+// clock. Returns false if that doesn't happen before the real time timeout.
+func (c *simClock) waitTimers(n int, timeout time.Duration) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		c.mu.Lock()
+		expired = true
+		c.changed.Broadcast()
+		c.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) < n && !expired {
+		c.changed.Wait()
+	}
+
+	return len(c.timers) >= n
+}
@@ -0,0 +1,207 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// Bounds of the piece length chosen for created torrents, and the number of pieces it aims for
+const MIN_CREATE_PIECE_LENGTH = 16_384
+const MAX_CREATE_PIECE_LENGTH = 16 << 20
+const CREATE_TARGET_PIECES = 1500
+
+// Written in the "created by" field of created torrents
+const CREATED_BY = "mybittorrent"
+
+// CreatedTorrent describes a torrent written by Create.
+type CreatedTorrent struct {
+	InfoHash    []byte
+	Files       int
+	Length      int
+	PieceLength int
+	Pieces      int
+}
+
+// Create writes the torrent of a file, or of the files of a directory, at root to output, announced to the tracker at
+// announce unless empty. Pieces are hashed across the files, in the order of their paths, with pieces of pieceLength
+// bytes, chosen from the size when 0.
+func (c *Client) Create(root, announce string, pieceLength int, output string) (CreatedTorrent, error) {
+	root = filepath.Clean(root)
+	stat, err := os.Stat(root)
+	if err != nil {
+		return CreatedTorrent{}, err
+	}
+
+	files, err := listCreatedFiles(root, stat)
+	if err != nil {
+		return CreatedTorrent{}, err
+	}
+	total := 0
+	for _, f := range files {
+		total += f.length
+	}
+	if total == 0 {
+		return CreatedTorrent{}, fmt.Errorf("%s has no data", root)
+	}
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+
+	pieces, err := hashCreatedFiles(c.hashers[HASH_SHA1], files, pieceLength)
+	if err != nil {
+		return CreatedTorrent{}, err
+	}
+
+	info := map[string]any{
+		"name":         filepath.Base(root),
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if stat.IsDir() {
+		fileList := make([]any, len(files))
+		for i, f := range files {
+			path := make([]any, len(f.parts))
+			for j, part := range f.parts {
+				path[j] = part
+			}
+			fileList[i] = map[string]any{"length": f.length, "path": path}
+		}
+		info["files"] = fileList
+	} else {
+		info["length"] = total
+	}
+
+	metainfo := map[string]any{
+		"info":          info,
+		"created by":    CREATED_BY,
+		"creation date": int(time.Now().Unix()),
+	}
+	if announce != "" {
+		metainfo["announce"] = announce
+	}
+
+	content, err := bencode.Marshal(metainfo)
+	if err != nil {
+		return CreatedTorrent{}, err
+	}
+	hash, err := infoHash(info)
+	if err != nil {
+		return CreatedTorrent{}, err
+	}
+	tmpPath := output + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0660); err != nil {
+		return CreatedTorrent{}, err
+	}
+	if err := os.Rename(tmpPath, output); err != nil {
+		return CreatedTorrent{}, err
+	}
+
+	return CreatedTorrent{
+		InfoHash:    hash,
+		Files:       len(files),
+		Length:      total,
+		PieceLength: pieceLength,
+		Pieces:      len(pieces) / 20,
+	}, nil
+}
+
+// createdFile is a file of a torrent being created.
+type createdFile struct {
+	path   string   // Location on disk
+	parts  []string // Path in the torrent, relative to its root
+	length int
+}
+
+// listCreatedFiles returns the regular files of the torrent rooted at root, in the order of their paths. A file
+// root is the single file of its torrent.
+func listCreatedFiles(root string, stat fs.FileInfo) ([]createdFile, error) {
+	if !stat.IsDir() {
+		return []createdFile{{path: root, length: int(stat.Size())}}, nil
+	}
+
+	var files []createdFile
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createdFile{
+			path:   path,
+			parts:  strings.Split(filepath.ToSlash(relative), "/"),
+			length: int(fileInfo.Size()),
+		})
+
+		return nil
+	})
+
+	return files, err
+}
+
+// choosePieceLength returns the smallest power of two piece length splitting total bytes in at most
+// CREATE_TARGET_PIECES pieces, within the bounds of created torrents.
+func choosePieceLength(total int) int {
+	length := MIN_CREATE_PIECE_LENGTH
+	for length < MAX_CREATE_PIECE_LENGTH && total/length > CREATE_TARGET_PIECES {
+		length *= 2
+	}
+
+	return length
+}
+
+// hashCreatedFiles hashes the data of the files, concatenated in order, in pieces of pieceLength bytes. Returns the
+// concatenated piece hashes.
+func hashCreatedFiles(hasher pieceHasher, files []createdFile, pieceLength int) (string, error) {
+	var pieces strings.Builder
+	piece := make([]byte, 0, pieceLength)
+
+	for _, f := range files {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return "", err
+		}
+
+		for {
+			n, err := io.ReadFull(file, piece[len(piece):pieceLength])
+			piece = piece[:len(piece)+n]
+			if len(piece) == pieceLength {
+				pieces.Write(hasher.hash(piece))
+				piece = piece[:0]
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return "", err
+			}
+		}
+		file.Close()
+	}
+
+	// The last piece is shorter than the others
+	if len(piece) > 0 {
+		pieces.Write(hasher.hash(piece))
+	}
+
+	return pieces.String(), nil
+}
@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestCreateRoundTrip creates the torrents of a file and of a directory, and checks they are read back and their data
+// is verified, then rejected once changed.
+func TestCreateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "data")
+	contents := map[string][]byte{
+		"a.txt":             bytes.Repeat([]byte("a"), 40_000),
+		"nested/b.bin":      bytes.Repeat([]byte{0, 1, 2}, 9_000),
+		"nested/deeper/c":   []byte("short file across a piece boundary"),
+		"nested/empty.file": {},
+	}
+	for name, content := range contents {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		path      string
+		length    int
+		filePaths []string
+		changed   string // File changed to fail the verification
+	}{
+		{"single file", filepath.Join(root, "a.txt"), 40_000, []string{"a.txt"}, filepath.Join(root, "a.txt")},
+		{"directory", root, 40_000 + 27_000 + 34,
+			[]string{"a.txt", "nested/b.bin", "nested/deeper/c", "nested/empty.file"}, filepath.Join(root, "nested", "deeper", "c")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := NewClient()
+			torrentPath := filepath.Join(t.TempDir(), "created.torrent")
+			if _, err := c.Create(test.path, "", 0, torrentPath); err != nil {
+				t.Fatal(err)
+			}
+
+			created, err := c.OpenTorrent(context.Background(), torrentPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.info.length != test.length || created.info.name != filepath.Base(test.path) {
+				t.Fatalf("info of %d bytes named %s, expected %d bytes named %s", created.info.length, created.info.name,
+					test.length, filepath.Base(test.path))
+			}
+			var paths []string
+			for _, f := range created.info.fileDocuments() {
+				paths = append(paths, f.Path)
+			}
+			if !slices.Equal(paths, test.filePaths) {
+				t.Fatalf("files %v, expected %v", paths, test.filePaths)
+			}
+
+			verified := func(output string) bool {
+				_, states, err := created.Verify(output)
+				return err == nil && !slices.ContainsFunc(states, func(state string) bool { return state != PIECE_GOOD })
+			}
+
+			// Verify finds the data of a directory torrent in the directory, or in the one containing it
+			for _, output := range []string{test.path, filepath.Dir(test.path)} {
+				if !verified(output) {
+					t.Fatalf("data at %s not verified", output)
+				}
+			}
+
+			original, err := os.ReadFile(test.changed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.WriteFile(test.changed, original, 0660) })
+			changed := bytes.Clone(original)
+			changed[len(changed)-1]++
+			if err := os.WriteFile(test.changed, changed, 0660); err != nil {
+				t.Fatal(err)
+			}
+			if verified(test.path) {
+				t.Fatal("changed data verified")
+			}
+		})
+	}
+}
+
+// TestParseFileList checks the paths of the files of a multi-file torrent stay inside its directory.
+func TestParseFileList(t *testing.T) {
+	for _, path := range [][]any{
+		{[]byte("..")},
+		{[]byte("a"), []byte(".")},
+		{[]byte("a/b")},
+		{[]byte("")},
+		{},
+	} {
+		fileList := []any{map[string]any{"length": 1, "path": path}}
+		if _, err := parseFileList(fileList); err == nil {
+			t.Errorf("path %q accepted", path)
+		}
+	}
+
+	files, err := parseFileList([]any{map[string]any{"length": 3, "path": []any{[]byte("dir"), []byte("file")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !slices.Equal(files[0].path, []string{"dir", "file"}) || files[0].length != 3 {
+		t.Fatalf("files %+v", files)
+	}
+}
@@ -0,0 +1,293 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"time"
+)
+
+// Daemon is a long-lived process downloading the torrents of a session and exposing its activity over HTTP. Its
+// state is guarded by the lock of the session.
+type Daemon struct {
+	*Session
+	pprof     bool        // Whether the profiling endpoints are exposed
+	stats     *statsStore // Statistics persisted across sessions
+	bandwidth *bandwidthScheduler
+	geoip     GeoIPDatabases
+	startedAt time.Time
+
+	trackers      map[string]*trackerHealth // Result of the last announces, keyed by tracker URL
+	peerCountries map[string]int            // Peer connections of the session by country, when GeoIP is enabled
+	peerNetworks  map[string]int            // Peer connections of the session by autonomous system
+	listenAddress string                    // Address of the API listener, empty until bound
+
+	watchDir    string // Torrent files dropped in it are added, none when empty
+	portMapping bool   // Whether the peer port is forwarded on the router
+	gateway     string // Address of the router for NAT-PMP, the default gateway when empty
+}
+
+// DaemonOptions are the settings of a daemon, besides the ones of its client.
+type DaemonOptions struct {
+	DownloadDir string
+	StateDir    string // Where the statistics and the identities are kept
+	WatchDir    string // Torrent files dropped in it are added, then moved to its added or failed subdirectory
+	MaxActive   int    // Torrents downloading at the same time, no limit when 0
+	Limits      SessionLimits
+	Categories  map[string]CategoryConfig // Directories where the completed torrents of each category are moved
+	GeoIP       []string                  // MaxMind DB files locating the peers in the statistics
+	Bandwidth   BandwidthSchedule
+	Pprof       bool     // Whether the net/http/pprof endpoints are exposed under /debug/pprof/
+	PortMapping bool     // Whether the peer port is forwarded on the router using NAT-PMP or UPnP
+	Gateway     string   // Address of the router for NAT-PMP, the default gateway when empty
+	Torrents    []string // Torrent files and magnet links added once started
+}
+
+func newDaemon(c *Client, downloadDir string) *Daemon {
+	return &Daemon{
+		Session:       newSession(c, downloadDir),
+		bandwidth:     newBandwidthScheduler(c.downloadLimiter, c.uploadLimiter),
+		startedAt:     time.Now(),
+		trackers:      map[string]*trackerHealth{},
+		peerCountries: map[string]int{},
+		peerNetworks:  map[string]int{},
+	}
+}
+
+// NewDaemon starts a daemon downloading with the client c, configured by o, and adds its torrents. Its API is served
+// by Serve.
+func NewDaemon(c *Client, o DaemonOptions) (*Daemon, error) {
+	stats, err := openStatsStore(o.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	stats.startSession()
+
+	identities, err := openIdentityStore(o.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	geoip, err := OpenGeoIPDatabases(o.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+
+	d := newDaemon(c, o.DownloadDir)
+	d.geoip = geoip
+	d.pprof = o.Pprof
+	d.maxActive = o.MaxActive
+	d.setLimits(o.Limits)
+	for name, category := range o.Categories {
+		d.categories[name] = category
+	}
+	d.stats = stats
+	d.identities = identities
+	d.watchDir, d.portMapping, d.gateway = o.WatchDir, o.PortMapping, o.Gateway
+	d.events.observe(d.track)
+
+	// Without a schedule, the limits of the client apply as configured
+	if !o.Bandwidth.empty() {
+		if err := d.bandwidth.set(o.Bandwidth); err != nil {
+			return nil, err
+		}
+	}
+
+	d.events.observe(stats.record)
+
+	go d.watchStalled(context.Background())
+
+	for _, source := range o.Torrents {
+		t, err := loadTorrent(source)
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s: %w", source, err)
+		}
+
+		if _, err := d.AddTorrent(t, AddOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// Serve serves the API of the daemon on listener, watches its directory and maps the peer port, until ctx is done.
+// The port mappings are removed before returning.
+func (d *Daemon) Serve(ctx context.Context, listener net.Listener) error {
+	d.mu.Lock()
+	d.listenAddress = listener.Addr().String()
+	d.mu.Unlock()
+
+	// The API stops once ctx is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	context.AfterFunc(ctx, func() { listener.Close() })
+
+	// The statistics are flushed a last time once the API stopped
+	if d.stats != nil {
+		statsDone := make(chan struct{})
+		go func() {
+			d.stats.run(ctx, d.client.log)
+			close(statsDone)
+		}()
+		defer func() {
+			cancel()
+			<-statsDone
+		}()
+	}
+
+	if d.watchDir != "" {
+		if err := os.MkdirAll(d.watchDir, 0755); err != nil {
+			return err
+		}
+		go newDirWatcher(d, d.watchDir).run(ctx)
+	}
+
+	portMappingDone := make(chan struct{})
+	if d.portMapping {
+		go func() {
+			d.keepPortMapped(ctx, d.client.port, d.gateway)
+			close(portMappingDone)
+		}()
+	} else {
+		close(portMappingDone)
+	}
+
+	err := http.Serve(listener, d.handler())
+	if ctx.Err() != nil {
+		<-portMappingDone
+		return nil
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// loadTorrent creates a torrent from a magnet link or a torrent file path. Metadata for magnet links is not fetched.
+func loadTorrent(source string) (Torrent, error) {
+	if strings.HasPrefix(source, "magnet:") {
+		return parseMagnetLink(source)
+	}
+
+	return parseTorrentFile(source)
+}
+
+// track keeps the health of the trackers and the locations of the peers updated with the published events, along
+// with the state of the torrents of the session.
+func (d *Daemon) track(e Event) {
+	// Peers are located before locking, the session lock is not needed to read the databases
+	var location PeerLocation
+	located := e.Type == EVENT_PEER_CONNECTED && len(d.geoip) > 0
+	if located {
+		location = d.geoip.Locate(e.Peer)
+	}
+
+	d.mu.Lock()
+	if e.Type == EVENT_TRACKER_ANNOUNCE || e.Type == EVENT_TRACKER_ERROR {
+		d.recordTracker(e)
+	}
+	if located {
+		d.recordPeerLocation(location)
+	}
+	d.mu.Unlock()
+
+	d.Session.track(e)
+}
+
+// handler returns the HTTP handler exposing the daemon API.
+func (d *Daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /events", d.events)
+	mux.Handle("/transmission/rpc", newTransmissionRPC(d))
+	mux.HandleFunc("GET /healthz", d.serveHealth)
+	mux.HandleFunc("GET /readyz", d.serveReadiness)
+	mux.HandleFunc("GET /stats", d.serveStats)
+	mux.HandleFunc("GET /bandwidth", d.serveBandwidth)
+	mux.HandleFunc("PUT /bandwidth", d.updateBandwidth)
+
+	if d.pprof {
+		registerPprof(mux)
+	}
+
+	return mux
+}
+
+// recordPeerLocation accounts a connection to a peer at the given location. Must be called holding the session lock.
+func (d *Daemon) recordPeerLocation(location PeerLocation) {
+	country := location.Country
+	if country == "" {
+		country = "unknown"
+	}
+	d.peerCountries[country]++
+
+	network := "unknown"
+	if location.ASN != 0 {
+		network = strings.TrimSpace(fmt.Sprintf("AS%d %s", location.ASN, location.Organization))
+	}
+	d.peerNetworks[network]++
+}
+
+// serveStats responds with the cumulative and current session statistics. With GeoIP enabled, it includes the peer
+// connections of the session by country and by network.
+func (d *Daemon) serveStats(w http.ResponseWriter, r *http.Request) {
+	cumulative, session := d.stats.totals()
+	response := map[string]any{
+		"cumulative": cumulative,
+		"session":    session,
+	}
+
+	if len(d.geoip) > 0 {
+		d.mu.Lock()
+		response["peers"] = map[string]any{
+			"countries": maps.Clone(d.peerCountries),
+			"networks":  maps.Clone(d.peerNetworks),
+		}
+		d.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveBandwidth responds with the bandwidth schedule and the limits currently in effect
+func (d *Daemon) serveBandwidth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedule": d.bandwidth.get(),
+		"current":  d.bandwidth.current(),
+	})
+}
+
+// updateBandwidth replaces the bandwidth schedule with the one in the request body
+func (d *Daemon) updateBandwidth(w http.ResponseWriter, r *http.Request) {
+	var schedule BandwidthSchedule
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := d.bandwidth.set(schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.serveBandwidth(w, r)
+}
+
+// registerPprof exposes the net/http/pprof endpoints under /debug/pprof/ in the given mux.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
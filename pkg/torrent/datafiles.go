@@ -0,0 +1,217 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// torrentFile is a file of a multi-file torrent.
+type torrentFile struct {
+	path   []string // Path of the file relative to the directory of the torrent
+	length int
+}
+
+// parseFileList returns the files of the decoded files list of a multi-file torrent, in their order in the data.
+func parseFileList(fileList []any) ([]torrentFile, error) {
+	if len(fileList) == 0 {
+		return nil, errors.New("info: empty files list")
+	}
+
+	files := make([]torrentFile, len(fileList))
+	for i, entry := range fileList {
+		entry, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("info: invalid file %d", i)
+		}
+		length, ok := entry["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("info: missing or invalid length of file %d", i)
+		}
+		parts, ok := entry["path"].([]any)
+		if !ok || len(parts) == 0 {
+			return nil, fmt.Errorf("info: missing or invalid path of file %d", i)
+		}
+
+		path := make([]string, len(parts))
+		for j, part := range parts {
+			name, ok := part.([]byte)
+			if !ok || !validFileName(string(name)) {
+				return nil, fmt.Errorf("info: invalid path of file %d", i)
+			}
+			path[j] = string(name)
+		}
+		files[i] = torrentFile{path: path, length: length}
+	}
+
+	return files, nil
+}
+
+// validFileName reports whether name is a single path component, so the paths of the files stay inside the directory
+// of the torrent.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// insideDir reports whether path is inside the directory dir, and not dir itself.
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// dataFiles reads and writes the data of a torrent on disk, as if its files were concatenated. A single-file torrent
+// has one file, at the path of the data, and the files of a multi-file torrent are in the directory at the path.
+type dataFiles struct {
+	files   []*os.File // Nil for the files missing on disk, when opened for reading
+	offsets []int64    // Offset of every file in the data
+	lengths []int64
+}
+
+// DataFile is one of the files holding the data of a torrent.
+type DataFile struct {
+	Path   string
+	Length int
+}
+
+// dataLayout returns the files of the torrent whose data is at path, in their order in the data.
+func (i info) dataLayout(path string) []DataFile {
+	if i.files == nil {
+		return []DataFile{{Path: path, Length: i.length}}
+	}
+
+	files := make([]DataFile, len(i.files))
+	for j, f := range i.files {
+		files[j] = DataFile{Path: filepath.Join(append([]string{path}, f.path...)...), Length: f.length}
+	}
+
+	return files
+}
+
+// openDataFiles opens the files of the data of a torrent, laid out by layout. With create, the files and their
+// directories are created, and the files preallocated to their length. Without, the files are opened for reading and
+// the missing ones read as empty.
+func openDataFiles(layout []DataFile, create bool) (*dataFiles, error) {
+	d := &dataFiles{
+		files:   make([]*os.File, len(layout)),
+		offsets: make([]int64, len(layout)),
+		lengths: make([]int64, len(layout)),
+	}
+
+	offset := int64(0)
+	for j, f := range layout {
+		d.offsets[j], d.lengths[j] = offset, int64(f.Length)
+		offset += int64(f.Length)
+
+		file, err := openDataFile(f.Path, int64(f.Length), create)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.files[j] = file
+	}
+
+	return d, nil
+}
+
+// openDataFile opens the file at path of a torrent, creating it with length bytes with create. Returns a nil file
+// when it's missing and not created.
+func openDataFile(path string, length int64, create bool) (*os.File, error) {
+	if !create {
+		file, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return file, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		return nil, err
+	}
+	// Preallocated, so the pieces can be written at their offsets in any order
+	if err := preallocate(file, length); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// span calls f with every file overlapping the len(p) bytes of the data at offset, the part of p in the file and its
+// offset in the file. Stops at the first error, or at the first file f doesn't completely read or write.
+func (d *dataFiles) span(p []byte, offset int64, f func(file *os.File, p []byte, offset int64) (int, error)) (int, error) {
+	n := 0
+	for j, start := range d.offsets {
+		if len(p) == n {
+			break
+		}
+		at := offset + int64(n) - start
+		if at >= d.lengths[j] {
+			continue
+		}
+
+		part := p[n:min(len(p), n+int(d.lengths[j]-at))]
+		if d.files[j] == nil {
+			return n, io.EOF
+		}
+		written, err := f(d.files[j], part, at)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		if written < len(part) {
+			return n, io.EOF
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes of the data at offset. Fails with io.EOF when a file is missing or shorter than its length.
+func (d *dataFiles) ReadAt(p []byte, offset int64) (int, error) {
+	return d.span(p, offset, (*os.File).ReadAt)
+}
+
+// WriteAt writes p to the data at offset.
+func (d *dataFiles) WriteAt(p []byte, offset int64) (int, error) {
+	return d.span(p, offset, (*os.File).WriteAt)
+}
+
+// Sync flushes the files to the disk.
+func (d *dataFiles) Sync() error {
+	for _, file := range d.files {
+		if file == nil {
+			continue
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the files. Returns the first error.
+func (d *dataFiles) Close() error {
+	var err error
+	for _, file := range d.files {
+		if file == nil {
+			continue
+		}
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"sync"
+	"time"
+)
+
+// Wait before redialing a peer after its first failure, doubled on every further failure up to the maximum
+const PEER_BACKOFF_INITIAL = 30 * time.Second
+const PEER_BACKOFF_MAX = 30 * time.Minute
+
+// Time after its last failure when a peer is forgotten, giving it a clean slate
+const PEER_BACKOFF_EXPIRY = 2 * time.Hour
+
+// deadPeers remembers the peers that failed to connect or misbehaved, so they are not redialed on every announce
+// returning them. A failed peer is skipped until its backoff elapses. A banned peer is skipped for good, the other peers
+// of its host are not, as they may be other clients behind the same NAT.
+type deadPeers struct {
+	mu     sync.Mutex
+	clock  clock
+	peers  map[string]*deadPeer
+	banned map[string]bool // Addresses of the banned peers
+}
+
+// deadPeer is the failure record of a peer.
+type deadPeer struct {
+	failures int
+	failedAt time.Time
+	retryAt  time.Time
+}
+
+func newDeadPeers(clock clock) *deadPeers {
+	return &deadPeers{clock: clock, peers: map[string]*deadPeer{}, banned: map[string]bool{}}
+}
+
+// failed records a failure of the peer at address, extending its backoff.
+func (d *deadPeers) failed(address string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.now()
+	d.expire(now)
+
+	peer, ok := d.peers[address]
+	if !ok {
+		peer = &deadPeer{}
+		d.peers[address] = peer
+	}
+
+	backoff := PEER_BACKOFF_INITIAL
+	for i := 0; i < peer.failures && backoff < PEER_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	peer.failures++
+	peer.failedAt = now
+	peer.retryAt = now.Add(min(backoff, PEER_BACKOFF_MAX))
+}
+
+// succeeded forgets the failures of the peer at address.
+func (d *deadPeers) succeeded(address string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.peers, address)
+}
+
+// ban stops the peer at address from being dialed again.
+func (d *deadPeers) ban(address string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.banned[address] = true
+}
+
+// isBanned reports whether the peer at address was banned.
+func (d *deadPeers) isBanned(address string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.banned[address]
+}
+
+// ready reports whether the peer at address can be dialed, which is when it never failed or its backoff elapsed, and
+// it isn't banned.
+func (d *deadPeers) ready(address string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.banned[address] {
+		return false
+	}
+
+	now := d.clock.now()
+	d.expire(now)
+
+	peer, ok := d.peers[address]
+
+	return !ok || !now.Before(peer.retryAt)
+}
+
+// filter returns the addresses of the peers ready to be dialed, in the same order.
+func (d *deadPeers) filter(addresses []string) []string {
+	ready := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		if d.ready(address) {
+			ready = append(ready, address)
+		}
+	}
+
+	return ready
+}
+
+// expire forgets the peers whose last failure is older than PEER_BACKOFF_EXPIRY. d.mu must be held.
+func (d *deadPeers) expire(now time.Time) {
+	for address, peer := range d.peers {
+		if now.Sub(peer.failedAt) >= PEER_BACKOFF_EXPIRY {
+			delete(d.peers, address)
+		}
+	}
+}
@@ -0,0 +1,705 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Nodes kept per bucket of the routing table, and returned by find_node and get_peers queries
+const DHT_K = 8
+
+// Queries sent in parallel during a lookup
+const DHT_ALPHA = 3
+
+// Wait for the response to a query before moving on to other nodes
+const DHT_QUERY_TIMEOUT = 2 * time.Second
+
+// Duration of a lookup unless the context ends it sooner
+const DHT_LOOKUP_TIMEOUT = 20 * time.Second
+
+// Tokens handed out by get_peers are accepted by announce_peer for twice this duration
+const DHT_TOKEN_ROTATION = 5 * time.Minute
+
+// How long the peers announced to the node are returned by its get_peers responses
+const DHT_PEER_EXPIRY = 30 * time.Minute
+
+// Length of the node IDs and info hashes, and of the compact node info: ID, IPv4 and port
+const DHT_ID_LENGTH = 20
+const DHT_COMPACT_NODE_LENGTH = DHT_ID_LENGTH + peer.COMPACT_IPV4_LENGTH
+
+// KRPC error code of malformed queries, and of queries with an unknown method
+const KRPC_ERROR_PROTOCOL = 203
+const KRPC_ERROR_METHOD = 204
+
+// Nodes of the mainline DHT the routing table is bootstrapped from
+var DhtBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// dhtContact is a node of the DHT: its ID and address.
+type dhtContact struct {
+	id   string
+	addr *net.UDPAddr
+}
+
+// dhtDistance returns the XOR distance between two IDs, compared as big endian numbers.
+func dhtDistance(a, b string) []byte {
+	d := make([]byte, DHT_ID_LENGTH)
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+
+	return d
+}
+
+// routingTable holds the known nodes of the DHT in buckets by the length of the prefix their ID shares with the node's
+// own ID, BEP 5. Full buckets keep their oldest nodes, which are the most likely to stay online.
+type routingTable struct {
+	mu      sync.Mutex
+	self    string
+	buckets [DHT_ID_LENGTH*8 + 1][]dhtContact
+}
+
+// bucket returns the index of the bucket of id.
+func (rt *routingTable) bucket(id string) int {
+	for i := 0; i < DHT_ID_LENGTH; i++ {
+		if x := rt.self[i] ^ id[i]; x != 0 {
+			prefix := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				prefix++
+			}
+			return prefix
+		}
+	}
+
+	return DHT_ID_LENGTH * 8
+}
+
+// add records a node that responded, or refreshes it when already known.
+func (rt *routingTable) add(node dhtContact) {
+	if len(node.id) != DHT_ID_LENGTH || node.id == rt.self {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucket(node.id)
+	for i, known := range rt.buckets[b] {
+		if known.id == node.id {
+			rt.buckets[b][i] = node
+			return
+		}
+	}
+	if len(rt.buckets[b]) < DHT_K {
+		rt.buckets[b] = append(rt.buckets[b], node)
+	}
+}
+
+// closest returns up to n known nodes, the closest to target first.
+func (rt *routingTable) closest(target string, n int) []dhtContact {
+	rt.mu.Lock()
+	var nodes []dhtContact
+	for _, bucket := range rt.buckets {
+		nodes = append(nodes, bucket...)
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(nodes, target)
+
+	return nodes[:min(n, len(nodes))]
+}
+
+// size returns the number of known nodes.
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket)
+	}
+
+	return n
+}
+
+// sortByDistance sorts nodes by their distance to target, the closest first.
+func sortByDistance(nodes []dhtContact, target string) {
+	slices.SortFunc(nodes, func(a, b dhtContact) int {
+		return bytes.Compare(dhtDistance(a.id, target), dhtDistance(b.id, target))
+	})
+}
+
+// DhtNode is a node of the mainline DHT, BEP 5. It finds the peers of torrents without trackers, through iterative
+// get_peers lookups, and announces itself as their peer. It answers the queries of the other nodes too, as nodes not
+// answering are dropped from the routing tables. Messages are KRPC: bencoded dictionaries over UDP.
+type DhtNode struct {
+	id       string
+	conn     *net.UDPConn
+	table    *routingTable
+	resolver *DnsResolver // Resolves the bootstrap nodes, the system's resolver when nil
+	clock    clock
+
+	bootstrapped chan struct{} // Closed once the routing table is bootstrapped
+	closed       chan struct{}
+
+	mu          sync.Mutex
+	transaction uint16
+	pending     map[string]chan map[string]any  // Responses awaited by the queries, by transaction ID
+	tokens      map[string]map[string]dhtToken  // Tokens of the last lookup of each info hash, by node address
+	announced   map[string]map[string]time.Time // Peers announced to the node by info hash, with their expiry
+	secrets     [2][]byte                       // Current and previous secrets of the tokens handed out
+	rotated     time.Time
+}
+
+// dhtToken is the token a node returned for a get_peers query, required to announce to it.
+type dhtToken struct {
+	node  dhtContact
+	token string
+}
+
+// StartDhtNode opens the socket of a DHT node on port of ip, any address when nil, or on a random port when port is in
+// use, and starts answering queries. The routing table is filled from the bootstrap nodes, as host:port, in the
+// background.
+func StartDhtNode(ip net.IP, port int, resolver *DnsResolver, bootstrap []string) (*DhtNode, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open DHT socket: %w", err)
+	}
+
+	id := make([]byte, DHT_ID_LENGTH)
+	rand.Read(id)
+
+	d := &DhtNode{
+		id:           string(id),
+		conn:         conn,
+		table:        &routingTable{self: string(id)},
+		resolver:     resolver,
+		clock:        realClock,
+		pending:      map[string]chan map[string]any{},
+		tokens:       map[string]map[string]dhtToken{},
+		announced:    map[string]map[string]time.Time{},
+		bootstrapped: make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	d.rotateSecrets()
+
+	go d.serve()
+
+	go func() {
+		defer close(d.bootstrapped)
+		d.bootstrap(context.Background(), bootstrap)
+	}()
+
+	return d, nil
+}
+
+// WithDht makes the torrents of the client look for peers in the DHT through d when their trackers can't provide any.
+func WithDht(d *DhtNode) Option {
+	return func(c *Client) {
+		c.dht = d
+	}
+}
+
+// Close stops answering queries and closes the socket.
+func (d *DhtNode) Close() error {
+	select {
+	case <-d.closed:
+		return nil
+	default:
+	}
+	close(d.closed)
+
+	return d.conn.Close()
+}
+
+// bootstrap queries the bootstrap nodes for the nodes closest to the node's own ID, then looks them up to fill the
+// routing table.
+func (d *DhtNode) bootstrap(ctx context.Context, nodes []string) {
+	ctx, cancel := context.WithTimeout(ctx, DHT_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			addr, err := d.resolve(ctx, node)
+			if err != nil {
+				return
+			}
+			d.query(ctx, addr, "find_node", map[string]any{"target": d.id})
+		}()
+	}
+	wg.Wait()
+
+	d.lookup(ctx, d.id, "find_node")
+}
+
+// resolve returns the UDP address of a node given as host:port.
+func (d *DhtNode) resolve(ctx context.Context, address string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	var ips []net.IP
+	if d.resolver != nil {
+		ips, err = d.resolver.lookup(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s has no IPv4 address", host)
+}
+
+// DhtPeers looks up the peers of the torrent with infoHash in the DHT node of c. Fails when c has no DHT node.
+func (c *Client) DhtPeers(ctx context.Context, infoHash []byte) ([]string, error) {
+	if c.dht == nil {
+		return nil, fmt.Errorf("%w: the DHT is disabled", ErrDhtFailure)
+	}
+
+	return c.dht.getPeers(ctx, infoHash)
+}
+
+// getPeers looks up the peers of the torrent with infoHash: the nodes closest to it are queried until none closer is
+// found, collecting the peers they know. The tokens of the queried nodes are kept for announcePeer.
+func (d *DhtNode) getPeers(ctx context.Context, infoHash []byte) ([]string, error) {
+	select {
+	case <-d.bootstrapped:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, DHT_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	if d.table.size() == 0 {
+		return nil, fmt.Errorf("%w: no DHT node reachable", ErrDhtFailure)
+	}
+
+	peers, tokens := d.lookup(lookupCtx, string(infoHash), "get_peers")
+
+	d.mu.Lock()
+	d.tokens[string(infoHash)] = tokens
+	d.mu.Unlock()
+
+	if len(peers) == 0 {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: no peer found in the DHT", ErrNoPeers)
+	}
+
+	return peers, nil
+}
+
+// announcePeer announces the torrent with infoHash to the closest nodes of its last lookup, as downloaded on port.
+func (d *DhtNode) announcePeer(ctx context.Context, infoHash []byte, port int) {
+	d.mu.Lock()
+	tokens := d.tokens[string(infoHash)]
+	d.mu.Unlock()
+
+	nodes := make([]dhtContact, 0, len(tokens))
+	for _, t := range tokens {
+		nodes = append(nodes, t.node)
+	}
+	sortByDistance(nodes, string(infoHash))
+
+	var wg sync.WaitGroup
+	for _, node := range nodes[:min(DHT_K, len(nodes))] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			args := map[string]any{
+				"info_hash": string(infoHash),
+				"port":      port,
+				"token":     tokens[node.addr.String()].token,
+			}
+			d.query(ctx, node.addr, "announce_peer", args)
+		}()
+	}
+	wg.Wait()
+}
+
+// lookup runs an iterative find_node or get_peers lookup of target: the DHT_ALPHA closest nodes not queried yet are
+// queried in parallel, adding the nodes they return, until the DHT_K closest known nodes have all been queried. Returns
+// the peers found by get_peers, and the tokens of the nodes that answered.
+func (d *DhtNode) lookup(ctx context.Context, target string, method string) ([]string, map[string]dhtToken) {
+	candidates := d.table.closest(target, DHT_K)
+	seen := map[string]bool{}
+	for _, node := range candidates {
+		seen[node.addr.String()] = true
+	}
+	queried := map[string]bool{}
+
+	var peers []string
+	found := map[string]bool{}
+	tokens := map[string]dhtToken{}
+
+	type answer struct {
+		node     dhtContact
+		response map[string]any
+	}
+
+	for ctx.Err() == nil {
+		var next []dhtContact
+		for _, node := range candidates[:min(DHT_K, len(candidates))] {
+			if !queried[node.addr.String()] && len(next) < DHT_ALPHA {
+				next = append(next, node)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(next))
+		for _, node := range next {
+			queried[node.addr.String()] = true
+			go func() {
+				key := "info_hash"
+				if method == "find_node" {
+					key = "target"
+				}
+				response, err := d.query(ctx, node.addr, method, map[string]any{key: target})
+				if err != nil {
+					response = nil
+				}
+				answers <- answer{node: node, response: response}
+			}()
+		}
+
+		for range next {
+			a := <-answers
+			if a.response == nil {
+				// Unresponsive nodes are not returned by the lookup
+				candidates = slices.DeleteFunc(candidates, func(c dhtContact) bool { return c.addr.String() == a.node.addr.String() })
+				continue
+			}
+
+			if token, ok := a.response["token"].([]byte); ok {
+				tokens[a.node.addr.String()] = dhtToken{node: a.node, token: string(token)}
+			}
+			if values, ok := a.response["values"].([]any); ok {
+				for _, value := range values {
+					value, ok := value.([]byte)
+					if !ok || len(value) != peer.COMPACT_IPV4_LENGTH {
+						continue
+					}
+					for _, peer := range peer.ParseCompact(string(value), peer.COMPACT_IPV4_LENGTH) {
+						if !found[peer] {
+							found[peer] = true
+							peers = append(peers, peer)
+						}
+					}
+				}
+			}
+			if nodes, ok := a.response["nodes"].([]byte); ok {
+				for _, node := range parseCompactNodes(string(nodes)) {
+					if !seen[node.addr.String()] {
+						seen[node.addr.String()] = true
+						candidates = append(candidates, node)
+					}
+				}
+			}
+		}
+
+		sortByDistance(candidates, target)
+	}
+
+	return peers, tokens
+}
+
+// query sends a query to the node at addr and waits for its response, for DHT_QUERY_TIMEOUT at most. The node is added
+// to the routing table when it responds. Returns the response dictionary.
+func (d *DhtNode) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]any) (map[string]any, error) {
+	args["id"] = d.id
+
+	d.mu.Lock()
+	d.transaction++
+	transactionId := string(binary.BigEndian.AppendUint16(nil, d.transaction))
+	responses := make(chan map[string]any, 1)
+	d.pending[transactionId] = responses
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transactionId)
+		d.mu.Unlock()
+	}()
+
+	message, err := bencode.Marshal(map[string]any{"t": transactionId, "y": "q", "q": method, "a": args})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDhtFailure, err)
+	}
+	if _, err := d.conn.WriteToUDP(message, addr); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDhtFailure, err)
+	}
+
+	timeout := time.NewTimer(DHT_QUERY_TIMEOUT)
+	defer timeout.Stop()
+
+	select {
+	case message := <-responses:
+		if krpcString(message, "y") == "e" {
+			return nil, fmt.Errorf("%w: %s answered %s with error %v", ErrDhtFailure, addr, method, message["e"])
+		}
+
+		response, ok := message["r"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid response from %s", ErrDhtFailure, addr)
+		}
+		if id := krpcString(response, "id"); id != "" {
+			d.table.add(dhtContact{id: id, addr: addr})
+		}
+
+		return response, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("%w: %s did not answer %s", ErrDhtFailure, addr, method)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// serve reads the messages arriving at the socket until it's closed. Responses are delivered to the queries awaiting
+// them, and queries are answered.
+func (d *DhtNode) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		// The decoded strings are slices of the message, which must outlive the buffer
+		message, _, err := bencode.DecodeDictionary(bytes.Clone(buffer[:n]))
+		if err != nil {
+			continue
+		}
+		transactionId := krpcString(message, "t")
+
+		switch krpcString(message, "y") {
+		case "r", "e":
+			d.mu.Lock()
+			responses, ok := d.pending[transactionId]
+			d.mu.Unlock()
+			if ok {
+				select {
+				case responses <- message:
+				default:
+				}
+			}
+		case "q":
+			response := d.answer(message, addr)
+			response["t"] = transactionId
+			if encoded, err := bencode.Marshal(response); err == nil {
+				d.conn.WriteToUDP(encoded, addr)
+			}
+		}
+	}
+}
+
+// answer handles a query of the node at addr: ping, find_node, get_peers or announce_peer. Returns the response or
+// error message, without its transaction ID.
+func (d *DhtNode) answer(message map[string]any, addr *net.UDPAddr) map[string]any {
+	krpcError := func(code int, text string) map[string]any {
+		return map[string]any{"y": "e", "e": []any{code, text}}
+	}
+
+	method := krpcString(message, "q")
+	args, ok := message["a"].(map[string]any)
+	if !ok {
+		return krpcError(KRPC_ERROR_PROTOCOL, "missing arguments")
+	}
+	id := krpcString(args, "id")
+	if len(id) != DHT_ID_LENGTH {
+		return krpcError(KRPC_ERROR_PROTOCOL, "invalid id")
+	}
+
+	response := map[string]any{"id": d.id}
+	switch method {
+	case "ping":
+	case "find_node":
+		target := krpcString(args, "target")
+		if len(target) != DHT_ID_LENGTH {
+			return krpcError(KRPC_ERROR_PROTOCOL, "invalid target")
+		}
+		response["nodes"] = compactNodes(d.table.closest(target, DHT_K))
+	case "get_peers":
+		infoHash := krpcString(args, "info_hash")
+		if len(infoHash) != DHT_ID_LENGTH {
+			return krpcError(KRPC_ERROR_PROTOCOL, "invalid info_hash")
+		}
+		response["token"] = d.token(addr.IP, 0)
+		if values := d.storedPeers(infoHash); len(values) > 0 {
+			response["values"] = values
+		} else {
+			response["nodes"] = compactNodes(d.table.closest(infoHash, DHT_K))
+		}
+	case "announce_peer":
+		infoHash := krpcString(args, "info_hash")
+		token := krpcString(args, "token")
+		port, _ := args["port"].(int)
+		if implied, _ := args["implied_port"].(int); implied == 1 {
+			port = addr.Port
+		}
+		if len(infoHash) != DHT_ID_LENGTH || port <= 0 || port > 65535 {
+			return krpcError(KRPC_ERROR_PROTOCOL, "invalid announce")
+		}
+		if token != d.token(addr.IP, 0) && token != d.token(addr.IP, 1) {
+			return krpcError(KRPC_ERROR_PROTOCOL, "bad token")
+		}
+		d.storePeer(infoHash, peer.FormatAddress(addr.IP, port))
+	default:
+		return krpcError(KRPC_ERROR_METHOD, "method unknown")
+	}
+
+	d.table.add(dhtContact{id: id, addr: addr})
+
+	return map[string]any{"y": "r", "r": response}
+}
+
+// token returns the token handed out to ip with the current secret, 0, or the previous one, 1.
+func (d *DhtNode) token(ip net.IP, secret int) string {
+	d.rotateSecrets()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h := sha1.New()
+	h.Write(d.secrets[secret])
+	h.Write(ip.To16())
+
+	return string(h.Sum(nil)[:8])
+}
+
+// rotateSecrets replaces the secret of the tokens every DHT_TOKEN_ROTATION, keeping the previous one valid.
+func (d *DhtNode) rotateSecrets() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.now()
+	if d.secrets[0] != nil && now.Sub(d.rotated) < DHT_TOKEN_ROTATION {
+		return
+	}
+
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	d.secrets[1] = d.secrets[0]
+	d.secrets[0] = secret
+	d.rotated = now
+}
+
+// storePeer records a peer announced for infoHash.
+func (d *DhtNode) storePeer(infoHash, peer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.announced[infoHash] == nil {
+		d.announced[infoHash] = map[string]time.Time{}
+	}
+	d.announced[infoHash][peer] = d.clock.now().Add(DHT_PEER_EXPIRY)
+}
+
+// storedPeers returns the unexpired peers announced for infoHash, in the compact format.
+func (d *DhtNode) storedPeers(infoHash string) []any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.now()
+	var values []any
+	for address, expiry := range d.announced[infoHash] {
+		if now.After(expiry) {
+			delete(d.announced[infoHash], address)
+			continue
+		}
+		if compact, err := peer.Compact(address); err == nil && len(compact) == peer.COMPACT_IPV4_LENGTH {
+			values = append(values, string(compact))
+		}
+	}
+
+	return values
+}
+
+// krpcString returns the string value of key in a KRPC dictionary, empty when missing or not a string.
+func krpcString(m map[string]any, key string) string {
+	value, _ := m[key].([]byte)
+
+	return string(value)
+}
+
+// parseCompactNodes parses the compact node info of find_node and get_peers responses. Trailing bytes are ignored.
+func parseCompactNodes(nodes string) []dhtContact {
+	var contacts []dhtContact
+	for i := 0; i+DHT_COMPACT_NODE_LENGTH <= len(nodes); i += DHT_COMPACT_NODE_LENGTH {
+		node := nodes[i : i+DHT_COMPACT_NODE_LENGTH]
+		ip := net.IP([]byte(node[DHT_ID_LENGTH : DHT_ID_LENGTH+4]))
+		port := binary.BigEndian.Uint16([]byte(node[DHT_ID_LENGTH+4:]))
+		if port == 0 {
+			continue
+		}
+
+		contacts = append(contacts, dhtContact{id: node[:DHT_ID_LENGTH], addr: &net.UDPAddr{IP: ip, Port: int(port)}})
+	}
+
+	return contacts
+}
+
+// compactNodes encodes nodes in the compact node info format. IPv6 nodes are left out.
+func compactNodes(nodes []dhtContact) string {
+	var b []byte
+	for _, node := range nodes {
+		ip := node.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		b = append(b, node.id...)
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, uint16(node.addr.Port))
+	}
+
+	return string(b)
+}
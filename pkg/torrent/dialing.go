@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Peers a download connects to first, its peer pool dials more of them on every refill
+const WORKING_SET_SIZE = 5
+
+// Delay between the starts of the dials to candidate peers, a failed dial starts the next one at once
+const PEER_DIAL_STAGGER = 250 * time.Millisecond
+
+// Dials to candidate peers in progress at the same time
+const PEER_DIAL_CONCURRENCY = 8
+
+// workingPeer is a connection of the working set of a download, which completed the handshake. Pieces are downloaded
+// from it one at a time.
+type workingPeer struct {
+	address string
+	conn    *peerConnection
+	closer  func()
+}
+
+// extendedHandshake sends the handshake to the peer of conn, followed by the extension handshake advertising peer
+// exchange, unless the torrent is private, when the peer supports extensions.
+func (t Torrent) extendedHandshake(ctx context.Context, conn *peerConnection) error {
+	res, err := t.handshake(ctx, conn, true)
+	if err != nil {
+		return err
+	}
+	if !res.SupportsExtensions() {
+		return nil
+	}
+
+	extensionHandshake, err := t.getClient().buildExtensionHandshakeMessage(conn, t.downloadExtensions())
+	if err != nil {
+		return err
+	}
+	_, err = conn.sendMessage(ctx, extensionHandshake)
+	return err
+}
+
+// dialWorkingSet connects and handshakes with candidate peers concurrently, in the given order, and returns the
+// first n peers completing the handshake. Dials are started PEER_DIAL_STAGGER apart, so a slow peer doesn't hold
+// back the others, and the dials still running when n peers are ready are cancelled.
+func (t Torrent) dialWorkingSet(ctx context.Context, candidates []string, n int) []*workingPeer {
+	c := t.getClient()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		peer *workingPeer
+		err  error
+	}
+	results := make(chan dialResult)
+
+	dial := func(address string) {
+		handshakeCtx, handshakeSpan := c.tracer.startSpan(ctx, "peer.handshake")
+		handshakeSpan.setAttribute("peer.address", address)
+
+		conn, closer, err := t.connect(handshakeCtx, address)
+		if err == nil {
+			err = t.extendedHandshake(handshakeCtx, conn)
+			if err != nil {
+				closer()
+				if ctx.Err() == nil {
+					c.deadPeers.failed(address)
+				}
+			}
+		}
+		handshakeSpan.end(err)
+
+		results <- dialResult{peer: &workingPeer{address: address, conn: conn, closer: closer}, err: err}
+	}
+
+	working := make([]*workingPeer, 0, n)
+	started, pending := 0, 0
+	start := func() {
+		go dial(candidates[started])
+		started++
+		pending++
+	}
+
+	for pending > 0 || (started < len(candidates) && len(working) < n && ctx.Err() == nil) {
+		canStart := started < len(candidates) && pending < PEER_DIAL_CONCURRENCY && len(working) < n &&
+			ctx.Err() == nil
+		if pending == 0 && canStart {
+			start()
+			continue
+		}
+
+		var stagger <-chan time.Time
+		stopStagger := func() {}
+		if canStart {
+			timer := time.NewTimer(PEER_DIAL_STAGGER)
+			stagger, stopStagger = timer.C, func() { timer.Stop() }
+		}
+
+		select {
+		case <-stagger:
+			start()
+		case r := <-results:
+			stopStagger()
+			pending--
+			if r.err != nil {
+				if ctx.Err() == nil {
+					c.log.Warn(r.err.Error(), "peer", r.peer.address)
+				}
+				if started < len(candidates) && len(working) < n && ctx.Err() == nil {
+					start()
+				}
+				continue
+			}
+
+			if len(working) == n {
+				r.peer.closer()
+				continue
+			}
+			working = append(working, r.peer)
+			if len(working) == n {
+				cancel()
+			}
+		}
+	}
+
+	return working
+}
+
+// firstPeer runs attempt on the candidate peers concurrently, in the given order, and returns once an attempt
+// succeeds. Attempts are started PEER_DIAL_STAGGER apart, or at once when one fails, and the ones still running are
+// cancelled after the first success. Returns the errors of every attempt when none succeeds.
+func (t Torrent) firstPeer(ctx context.Context, candidates []string, attempt func(ctx context.Context, address string) error) error {
+	if len(candidates) == 0 {
+		return ErrNoPeers
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Buffered, so the attempts still running when one succeeds don't block
+	results := make(chan error, len(candidates))
+	started, pending := 0, 0
+	start := func() {
+		address := candidates[started]
+		go func() {
+			results <- attempt(ctx, address)
+		}()
+		started++
+		pending++
+	}
+
+	var failures []error
+	for pending > 0 || started < len(candidates) {
+		canStart := started < len(candidates) && pending < PEER_DIAL_CONCURRENCY
+		if pending == 0 {
+			start()
+			continue
+		}
+
+		var stagger <-chan time.Time
+		stopStagger := func() {}
+		if canStart {
+			timer := time.NewTimer(PEER_DIAL_STAGGER)
+			stagger, stopStagger = timer.C, func() { timer.Stop() }
+		}
+
+		select {
+		case <-stagger:
+			start()
+		case err := <-results:
+			stopStagger()
+			pending--
+			if err == nil {
+				return nil
+			}
+			failures = append(failures, err)
+			if canStart {
+				start()
+			}
+		case <-ctx.Done():
+			stopStagger()
+			return ctx.Err()
+		}
+	}
+
+	return errors.Join(failures...)
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Kinds of failures of the client. Errors returned while talking to trackers and peers wrap one of these, so callers
+// can tell them apart with errors.Is.
+var ErrHashMismatch = errors.New("piece hash mismatch")
+var ErrPeerChoked = errors.New("peer choked the connection")
+var ErrMetadataRejected = errors.New("metadata request rejected")
+var ErrNoPeers = errors.New("no peers available")
+var ErrVetoed = errors.New("vetoed by hook")
+var ErrEncryptionFailed = errors.New("encryption handshake failed")
+var ErrPeerBackoff = errors.New("peer failed recently, backing off")
+var ErrPeerBanned = errors.New("peer banned for sending corrupt pieces")
+var ErrProxyFailure = errors.New("proxy failure")
+var ErrDhtFailure = errors.New("DHT failure")
+var ErrPieceSettled = errors.New("piece delivered by another peer")
+var ErrPeerIdle = errors.New("peer idle")
+var ErrPeerTimeout = errors.New("peer timed out")
+var ErrIncomplete = errors.New("download incomplete")
+var ErrPieceFailed = errors.New("piece failed on every attempt")
+var ErrDiskFailure = errors.New("disk failure")
+var ErrDiskBudget = errors.New("over the disk budget")
+var ErrUnsafePath = errors.New("path outside the download directory")
+var ErrClientClosed = errors.New("client closed")
+
+// PieceError is the failure to download a piece from a peer.
+type PieceError struct {
+	Piece int    // Index of the piece
+	Peer  string // Address of the peer
+	Err   error
+}
+
+func (e *PieceError) Error() string {
+	return fmt.Sprintf("piece %d from %s: %s", e.Piece, e.Peer, e.Err)
+}
+
+func (e *PieceError) Unwrap() error {
+	return e.Err
+}
+
+// unexpectedMessageError returns the error for a message of type received while waiting for one of type expected.
+func unexpectedMessageError(expected, received uint8) error {
+	if received == peer.CHOKE {
+		return ErrPeerChoked
+	}
+
+	return fmt.Errorf("%w: expected type %d, received %d", peer.ErrUnexpectedMessage, expected, received)
+}
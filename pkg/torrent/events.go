@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types published while torrents are being processed
+const EVENT_ADDED = "added"
+const EVENT_PIECE_COMPLETE = "piece-complete"
+const EVENT_HASH_FAIL = "hash-fail"
+const EVENT_COMPLETED = "completed"
+const EVENT_TRACKER_ERROR = "tracker-error"
+const EVENT_TRACKER_ANNOUNCE = "tracker-announce"
+const EVENT_MOVED = "moved"
+const EVENT_PEER_CONNECTED = "peer-connected"
+const EVENT_PEER_BANNED = "peer-banned"
+const EVENT_BLOCK_UPLOADED = "block-uploaded"
+
+// Amount of events buffered per subscriber before new events are dropped for it
+const EVENT_SUBSCRIBER_BUFFER = 64
+
+// Event represents something that happened to a torrent or one of its peers.
+type Event struct {
+	Type     string    `json:"type"`
+	InfoHash string    `json:"infoHash"`
+	Name     string    `json:"name,omitempty"`
+	Piece    *int      `json:"piece,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Tracker  string    `json:"tracker,omitempty"`
+	Path     string    `json:"path,omitempty"`  // New location of the data of a moved torrent
+	Bytes    int       `json:"bytes,omitempty"` // Size of the data involved, like the length of a completed piece
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventBus fans out published events to all the current subscribers.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+	observers   []func(Event) // Called synchronously on every publish
+	clock       clock         // Timestamps the events
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: map[chan Event]struct{}{},
+		clock:       realClock,
+	}
+}
+
+// subscribe registers a new subscriber. Returns the channel where events are delivered and the function to
+// unsubscribe, which closes the channel.
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, EVENT_SUBSCRIBER_BUFFER)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// observe registers a function called with every event before publish returns. Unlike subscribers, observers never
+// miss events, so they must be fast and must not publish events themselves.
+func (b *eventBus) observe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.observers = append(b.observers, fn)
+}
+
+// now returns the time used to timestamp the events, the real time for a nil bus.
+func (b *eventBus) now() time.Time {
+	if b == nil {
+		return realClock.now()
+	}
+
+	return b.clock.now()
+}
+
+// publish delivers the event to every subscriber. Publishing never blocks: subscribers that are not keeping up
+// miss the event. A nil bus discards all events, so torrents without a bus can publish unconditionally.
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = b.clock.now()
+	}
+
+	b.mu.Lock()
+	observers := b.observers
+	b.mu.Unlock()
+
+	for _, fn := range observers {
+		fn(e)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams the published events to the client using Server-Sent Events. Each event is sent with its type as
+// the SSE event name and its JSON representation as data.
+func (b *eventBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := b.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comment lines keep idle connections from being closed by proxies
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// publish sends an event about the torrent to the hooks of its client, then to its event bus, if any. Returns the error
+// of the hook vetoing the event, which is then not delivered to the bus.
+func (t Torrent) publish(e Event) error {
+	e.InfoHash = toHex(t.infoHash)
+	e.Name = t.info.name
+	e.Time = t.events.now()
+
+	if err := t.getClient().runHooks(e); err != nil {
+		return err
+	}
+
+	t.events.publish(e)
+
+	return nil
+}
@@ -0,0 +1,372 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+// Marker preceding the metadata section, at the end of MaxMind DB files
+const MMDB_METADATA_MARKER = "\xab\xcd\xefMaxMind.com"
+
+// Null bytes separating the search tree from the data section
+const MMDB_DATA_SEPARATOR = 16
+
+// Data types of the MaxMind DB format
+const MMDB_POINTER = 1
+const MMDB_STRING = 2
+const MMDB_DOUBLE = 3
+const MMDB_BYTES = 4
+const MMDB_UINT16 = 5
+const MMDB_UINT32 = 6
+const MMDB_MAP = 7
+const MMDB_INT32 = 8
+const MMDB_UINT64 = 9
+const MMDB_UINT128 = 10
+const MMDB_ARRAY = 11
+const MMDB_BOOLEAN = 14
+const MMDB_FLOAT = 15
+
+// Depth of nested maps and arrays accepted in a record, deeper data means a corrupted file
+const MMDB_MAX_DEPTH = 32
+
+// PeerLocation is where a peer is connecting from, according to the GeoIP databases.
+type PeerLocation struct {
+	Country      string `json:"country,omitempty"`      // ISO 3166-1 alpha-2 code
+	ASN          int    `json:"asn,omitempty"`          // Autonomous system number
+	Organization string `json:"organization,omitempty"` // Organization owning the autonomous system
+}
+
+// String formats the location as "country ASn organization", with "-" for the unknown parts.
+func (l PeerLocation) String() string {
+	country, asn := "-", "-"
+	if l.Country != "" {
+		country = l.Country
+	}
+	if l.ASN != 0 {
+		asn = fmt.Sprintf("AS%d", l.ASN)
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s %s %s", country, asn, l.Organization))
+}
+
+// mmdb is a MaxMind DB file loaded in memory, like GeoLite2-Country or GeoLite2-ASN.
+type mmdb struct {
+	path       string
+	tree       []byte
+	data       []byte
+	nodeCount  int
+	recordSize int
+	ipVersion  int
+	ipv4Start  int // Node where the IPv4 addresses start in IPv6 trees
+}
+
+// openMMDB loads and validates the MaxMind DB file at path.
+func openMMDB(path string) (*mmdb, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	markerStart := bytes.LastIndex(content, []byte(MMDB_METADATA_MARKER))
+	if markerStart == -1 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+
+	metadataStart := markerStart + len(MMDB_METADATA_MARKER)
+	metadata, _, err := decodeMMDBValue(content[metadataStart:], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid metadata: %w", path, err)
+	}
+	fields, ok := metadata.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+
+	nodeCount, _ := fields["node_count"].(uint64)
+	recordSize, _ := fields["record_size"].(uint64)
+	ipVersion, _ := fields["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("%s: unsupported IP version %d", path, ipVersion)
+	}
+
+	treeSize := int(nodeCount) * int(recordSize) / 4
+	if nodeCount == 0 || treeSize+MMDB_DATA_SEPARATOR > markerStart {
+		return nil, fmt.Errorf("%s: search tree exceeds the file", path)
+	}
+
+	db := &mmdb{
+		path:       path,
+		tree:       content[:treeSize],
+		data:       content[treeSize+MMDB_DATA_SEPARATOR : markerStart],
+		nodeCount:  int(nodeCount),
+		recordSize: int(recordSize),
+		ipVersion:  int(ipVersion),
+	}
+
+	// IPv4 addresses are stored as IPv6 ones starting with 96 zero bits
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+
+	return db, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of node in the search tree.
+func (db *mmdb) readRecord(node, bit int) int {
+	b := db.tree[node*db.recordSize/4:]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		if bit == 0 {
+			return int(b[3]&0xf0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0f)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		return int(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record of the network containing ip, or false if the database has none.
+func (db *mmdb) lookup(ip net.IP) (map[string]any, bool, error) {
+	node := 0
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, false, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := int(ip[i/8]>>(7-i%8)) & 1
+		node = db.readRecord(node, bit)
+	}
+
+	if node == db.nodeCount {
+		return nil, false, nil
+	}
+	if node < db.nodeCount {
+		return nil, false, fmt.Errorf("%s: search tree deeper than the address", db.path)
+	}
+
+	offset := node - db.nodeCount - MMDB_DATA_SEPARATOR
+	if offset < 0 || offset >= len(db.data) {
+		return nil, false, fmt.Errorf("%s: record outside the data section", db.path)
+	}
+
+	value, _, err := decodeMMDBValue(db.data, offset, 0)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", db.path, err)
+	}
+	record, ok := value.(map[string]any)
+
+	return record, ok, nil
+}
+
+// decodeMMDBValue decodes the value of the MaxMind DB data section data starting at offset. Returns the value and the
+// offset following it. Pointers are resolved relative to the start of data.
+func decodeMMDBValue(data []byte, offset, depth int) (any, int, error) {
+	if depth > MMDB_MAX_DEPTH {
+		return nil, 0, errors.New("data nested too deep")
+	}
+
+	next := func(n int) ([]byte, error) {
+		if n < 0 || offset+n > len(data) {
+			return nil, errors.New("value exceeds the data section")
+		}
+		b := data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+
+	control, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	dataType := int(control[0] >> 5)
+
+	if dataType == MMDB_POINTER {
+		pointerSize := int(control[0]>>3)&0x3 + 1
+		b, err := next(pointerSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var pointer int
+		if pointerSize < 4 {
+			pointer = int(control[0] & 0x7)
+		}
+		for _, v := range b {
+			pointer = pointer<<8 | int(v)
+		}
+		pointer += []int{0, 2048, 526336, 0}[pointerSize-1]
+
+		// The pointed value is decoded in place, decoding continues after the pointer
+		value, _, err := decodeMMDBValue(data, pointer, depth+1)
+		return value, offset, err
+	}
+
+	if dataType == 0 {
+		extended, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		dataType = 7 + int(extended[0])
+	}
+
+	size := int(control[0] & 0x1f)
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		extra := 0
+		for _, v := range b {
+			extra = extra<<8 | int(v)
+		}
+		size = []int{29, 285, 65821}[size-29] + extra
+	}
+
+	switch dataType {
+	case MMDB_STRING:
+		b, err := next(size)
+		return string(b), offset, err
+	case MMDB_BYTES:
+		b, err := next(size)
+		return bytes.Clone(b), offset, err
+	case MMDB_DOUBLE, MMDB_FLOAT:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+		}
+		if size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+		}
+		return nil, 0, fmt.Errorf("invalid float size %d", size)
+	case MMDB_UINT16, MMDB_UINT32, MMDB_INT32, MMDB_UINT64, MMDB_UINT128:
+		b, err := next(size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size > 8 {
+			// 128 bits integers don't fit, they are not used by the GeoIP databases
+			return bytes.Clone(b), offset, nil
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if dataType == MMDB_INT32 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	case MMDB_BOOLEAN:
+		return size != 0, offset, nil
+	case MMDB_MAP:
+		m := make(map[string]any, min(size, len(data)))
+		for i := 0; i < size; i++ {
+			key, keyEnd, err := decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+
+			value, valueEnd, err := decodeMMDBValue(data, keyEnd, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyStr] = value
+			offset = valueEnd
+		}
+		return m, offset, nil
+	case MMDB_ARRAY:
+		a := make([]any, 0, min(size, len(data)))
+		for i := 0; i < size; i++ {
+			value, valueEnd, err := decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = valueEnd
+		}
+		return a, offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", dataType)
+}
+
+// GeoIPDatabases locates peers using MaxMind DB files. Country and ASN data are usually shipped in separate files,
+// the location of a peer merges the records of every file.
+type GeoIPDatabases []*mmdb
+
+// OpenGeoIPDatabases loads the MaxMind DB files at the given paths.
+func OpenGeoIPDatabases(paths []string) (GeoIPDatabases, error) {
+	dbs := make(GeoIPDatabases, 0, len(paths))
+	for _, path := range paths {
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+
+	return dbs, nil
+}
+
+// Locate returns the location of the peer at address, given as host:port or as a bare IP. Lookup failures leave the
+// location empty, as the location is only informative.
+func (dbs GeoIPDatabases) Locate(address string) PeerLocation {
+	var location PeerLocation
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return location
+	}
+
+	for _, db := range dbs {
+		record, ok, err := db.lookup(ip)
+		if err != nil || !ok {
+			continue
+		}
+
+		// City databases also have the country, the registered one is the fallback for anonymous networks
+		for _, key := range []string{"country", "registered_country"} {
+			if country, ok := record[key].(map[string]any); ok && location.Country == "" {
+				location.Country, _ = country["iso_code"].(string)
+			}
+		}
+		if asn, ok := record["autonomous_system_number"].(uint64); ok {
+			location.ASN = int(asn)
+		}
+		if organization, ok := record["autonomous_system_organization"].(string); ok {
+			location.Organization = organization
+		}
+	}
+
+	return location
+}
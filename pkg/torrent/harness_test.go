@@ -0,0 +1,936 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// Behaviours of the scripted seeders of the harness
+const SEEDER_NORMAL = "normal"
+const SEEDER_CORRUPT = "corrupt"        // Sends blocks with altered data, failing the hash check
+const SEEDER_CHOKE = "choke"            // Chokes the client instead of unchoking it
+const SEEDER_SLOW = "slow"              // Delays every block
+const SEEDER_TRUNCATE = "truncate"      // Closes the connection in the middle of the first block
+const SEEDER_SILENT = "silent"          // Never answers the handshake
+const SEEDER_ENCRYPTED = "encrypted"    // Requires Message Stream Encryption
+const SEEDER_EVEN = "even"              // Only has the even pieces, advertised by its bitfield
+const SEEDER_ODD = "odd"                // Only has the odd pieces, advertised by have messages
+const SEEDER_PEX = "pex"                // Only has the even pieces, and tells about the hidden seeders through peer exchange
+const SEEDER_HIDDEN = "hidden"          // Left out of the tracker responses
+const SEEDER_STALL = "stall"            // Only answers the requests of the first piece asked, then stops sending blocks
+const SEEDER_RECHOKE = "rechoke"        // Chokes the client after its first block, and unchokes it when interested again
+const SEEDER_INBOUND = "inbound"        // Left out of the tracker responses, connects to the client instead
+const SEEDER_LATE = "late"              // Left out of the response to the started announce, returned by the next ones
+const SEEDER_NO_METADATA = "nometadata" // Rejects the metadata requests
+const SEEDER_CHATTY = "chatty"          // Unchokes the client before its bitfield, and interleaves other messages with the blocks
+
+const HARNESS_SLOW_BLOCK_DELAY = 20 * time.Millisecond
+const HARNESS_METADATA_EXTENSION_ID = 3
+
+// Block requests the seeders take outstanding, advertised in their extension handshake below the pipeline depth
+const HARNESS_REQUEST_QUEUE = 2
+const HARNESS_SCENARIO_TIMEOUT = 30 * time.Second
+
+// Address the client listens on for the inbound seeders, which connect again after this delay until it accepts them
+const HARNESS_CLIENT_ADDRESS = "10.0.0.100:6881"
+const HARNESS_REDIAL_DELAY = 10 * time.Millisecond
+
+// harness is a hermetic swarm to run the download pipelines against: an embedded HTTP tracker on the loopback
+// interface, and scripted seeders listening on an in-memory network.
+type harness struct {
+	data          []byte
+	pieceLength   int
+	info          map[string]any
+	pieceLayers   map[string]any // Piece layers of the torrent file of a v2 torrent
+	infoHash      []byte
+	infoHashV2    []byte // SHA-256 of the info dictionary of a v2 or hybrid torrent
+	network       *memNetwork
+	seeders       []net.Listener
+	behaviours    []string // Behaviour of each seeder
+	tracker       net.Listener
+	inboundServed atomic.Bool   // Whether an inbound seeder sent blocks to the client
+	identified    atomic.Bool   // Whether the client sent its version and request queue in an extension handshake
+	interval      int           // Announce interval returned by the tracker, in seconds
+	dictPeers     bool          // Whether the tracker returns a list of peer dictionaries instead of the compact string
+	stalls        chan *memConn // Receives the connections of the seeders holding back a piece, when not nil
+
+	mu        sync.Mutex
+	announces []url.Values // Query of each announce received by the tracker
+	serving   int          // Connections that sent blocks to the client
+}
+
+// newHarness creates a swarm sharing size bytes of random data, with one seeder for each of the given behaviours.
+func newHarness(size, pieceLength int, behaviours ...string) (*harness, error) {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	var pieces strings.Builder
+	for begin := 0; begin < size; begin += pieceLength {
+		h := sha1.Sum(data[begin:min(begin+pieceLength, size)])
+		pieces.Write(h[:])
+	}
+
+	h := &harness{
+		data:        data,
+		pieceLength: pieceLength,
+		info: map[string]any{
+			"length":       size,
+			"name":         "harness.bin",
+			"piece length": pieceLength,
+			"pieces":       pieces.String(),
+		},
+		network:  newMemNetwork(),
+		interval: 60,
+	}
+	h.infoHash = h.v1InfoHash()
+
+	for i, behaviour := range behaviours {
+		seeder, err := h.network.listen(fmt.Sprintf("10.0.0.%d:6881", i+1))
+		if err != nil {
+			return nil, err
+		}
+		h.seeders = append(h.seeders, seeder)
+		h.behaviours = append(h.behaviours, behaviour)
+		go h.serveSeeder(seeder, behaviour)
+	}
+
+	tracker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	h.tracker = tracker
+	go http.Serve(tracker, http.HandlerFunc(h.serveAnnounce))
+
+	return h, nil
+}
+
+// close stops the tracker and the seeders
+func (h *harness) close() {
+	h.tracker.Close()
+	for _, seeder := range h.seeders {
+		seeder.Close()
+	}
+}
+
+// announceURL returns the announce URL of the embedded tracker
+func (h *harness) announceURL() string {
+	return "http://" + h.tracker.Addr().String() + "/announce"
+}
+
+// client returns a client connecting to the scripted seeders, configured by the given options.
+func (h *harness) client(opts ...Option) *Client {
+	return NewClient(append([]Option{WithPeerDialer(h.network)}, opts...)...)
+}
+
+// torrentFile returns the content of the torrent file of the swarm.
+func (h *harness) torrentFile() []byte {
+	torrentDict := map[string]any{
+		"announce": h.announceURL(),
+		"info":     h.info,
+	}
+	if h.pieceLayers != nil {
+		torrentDict["piece layers"] = h.pieceLayers
+	}
+
+	return bencoded(torrentDict)
+}
+
+// torrent returns the torrent of the swarm parsed from its torrent file, connecting to the scripted seeders.
+func (h *harness) torrent(opts ...Option) (Torrent, error) {
+	return h.client(opts...).parseTorrent(h.torrentFile())
+}
+
+// useV2 turns the torrent of the swarm into a v2 one, BEP 52, identified by its truncated v2 info hash, or a hybrid one
+// also holding the v1 pieces, identified by its v1 info hash.
+func (h *harness) useV2(hybrid bool) {
+	zero := make([]byte, sha256.Size)
+	blockLeaves := h.pieceLength / MERKLE_BLOCK_SIZE
+	var layer [][]byte
+	for begin := 0; begin < len(h.data); begin += h.pieceLength {
+		var blocks [][]byte
+		for block := begin; block < min(begin+h.pieceLength, len(h.data)); block += MERKLE_BLOCK_SIZE {
+			sum := sha256.Sum256(h.data[block:min(block+MERKLE_BLOCK_SIZE, begin+h.pieceLength, len(h.data))])
+			blocks = append(blocks, sum[:])
+		}
+		if len(h.data) <= h.pieceLength {
+			blockLeaves = nextPowerOfTwo(len(blocks))
+		}
+		layer = append(layer, merkleRoot(sha256Hasher, blocks, blockLeaves, zero))
+	}
+	piecesRoot := merkleRoot(sha256Hasher, layer, nextPowerOfTwo(len(layer)), merkleRoot(sha256Hasher, nil, blockLeaves, zero))
+
+	h.info["meta version"] = 2
+	h.info["file tree"] = map[string]any{
+		h.info["name"].(string): map[string]any{"": map[string]any{"length": len(h.data), "pieces root": piecesRoot}},
+	}
+	if len(layer) > 1 {
+		h.pieceLayers = map[string]any{string(piecesRoot): bytes.Join(layer, nil)}
+	}
+	if !hybrid {
+		delete(h.info, "length")
+		delete(h.info, "pieces")
+	}
+
+	sum := sha256.Sum256(bencoded(h.info))
+	h.infoHashV2 = sum[:]
+	h.infoHash = h.v1InfoHash()
+	if !hybrid {
+		h.infoHash = h.infoHashV2[:20]
+	}
+}
+
+// useFiles turns the torrent of the swarm into a multi-file one: a file ending inside the second piece, an empty file
+// and a file holding the rest of the data, in subdirectories.
+func (h *harness) useFiles() {
+	first := min(h.pieceLength+1_000, len(h.data))
+	file := func(length int, path ...any) map[string]any {
+		return map[string]any{"length": length, "path": path}
+	}
+
+	delete(h.info, "length")
+	h.info["files"] = []any{
+		file(first, "first.bin"),
+		file(0, "sub", "empty"),
+		file(len(h.data)-first, "sub", "dir", "last.bin"),
+	}
+	h.infoHash = h.v1InfoHash()
+}
+
+// v1InfoHash returns the SHA-1 info hash of the torrent of the swarm.
+func (h *harness) v1InfoHash() []byte {
+	sum := sha1.Sum(bencoded(h.info))
+
+	return sum[:]
+}
+
+// bencoded returns the bencoding of v, built by the harness out of supported types.
+func bencoded(v map[string]any) []byte {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// magnet returns the torrent of the swarm parsed from its magnet link, connecting to the scripted seeders. The link of
+// a v2 or hybrid torrent has its v2 info hash too.
+func (h *harness) magnet(opts ...Option) (Torrent, error) {
+	link := fmt.Sprintf("magnet:?xt=urn:btih:%s&dn=%s&tr=%s", toHex(h.infoHash), h.info["name"], url.QueryEscape(h.announceURL()))
+	if h.infoHashV2 != nil {
+		link += "&xt=urn:btmh:1220" + toHex(h.infoHashV2)
+	}
+
+	return h.client(opts...).ParseMagnetLink(link)
+}
+
+// serveAnnounce responds to announces of the swarm torrent with the compact addresses of the seeders, except the hidden
+// ones. The events of the announces are recorded.
+func (h *harness) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("info_hash") != string(h.infoHash) {
+		w.Write(bencoded(map[string]any{"failure reason": "unknown torrent"}))
+		return
+	}
+
+	announceEvent := r.URL.Query().Get("event")
+	h.mu.Lock()
+	h.announces = append(h.announces, r.URL.Query())
+	h.mu.Unlock()
+
+	var peers bytes.Buffer
+	var peerDicts []any
+	for i, seeder := range h.seeders {
+		switch h.behaviours[i] {
+		case SEEDER_HIDDEN, SEEDER_INBOUND:
+			continue
+		case SEEDER_LATE:
+			if announceEvent == tracker.ANNOUNCE_STARTED {
+				continue
+			}
+		}
+		compact, _ := peer.Compact(seeder.Addr().String())
+		peers.Write(compact)
+
+		ip, port, _ := peer.SplitAddress(seeder.Addr().String())
+		peerDicts = append(peerDicts, map[string]any{"ip": ip.String(), "port": port, "peer id": "-HN0001-000000000000"})
+	}
+
+	var response any = peers.String()
+	if h.dictPeers {
+		response = peerDicts
+	}
+	w.Write(bencoded(map[string]any{"interval": h.interval, "peers": response}))
+}
+
+// announced returns the queries of the announces received by the tracker so far.
+func (h *harness) announced() []url.Values {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return slices.Clone(h.announces)
+}
+
+// stalled reports the connection of a seeder holding back a piece, unless the stalls aren't followed.
+func (h *harness) stalled(conn net.Conn) {
+	mc, ok := conn.(*memConn)
+	if !ok || h.stalls == nil {
+		return
+	}
+
+	select {
+	case h.stalls <- mc:
+	default:
+	}
+}
+
+// moveClockOnStalls moves clock forward by d every time a seeder stalls, once the client waits for the blocks held
+// back, until ctx is done. The client times out the stalled requests and announces again in simulated time.
+func (h *harness) moveClockOnStalls(ctx context.Context, clock *simClock, d time.Duration) {
+	for {
+		select {
+		case conn := <-h.stalls:
+			if conn.peer.waitReading(SIMULATION_WAIT_TIMEOUT) {
+				clock.advance(d)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serveSeeder accepts the connections to a scripted seeder until its listener is closed.
+func (h *harness) serveSeeder(listener net.Listener, behaviour string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go h.serveConnection(conn, behaviour)
+	}
+}
+
+// serveConnection runs the seeder side of a connection until the client disconnects or the behaviour ends it.
+func (h *harness) serveConnection(conn net.Conn, behaviour string) {
+	defer conn.Close()
+
+	// Seeders are not affected by the limits of the client
+	pc := &peerConnection{
+		peerAddress:     "harness",
+		connection:      conn,
+		downloadLimiter: newRateLimiter(0, realClock),
+		uploadLimiter:   newRateLimiter(0, realClock),
+	}
+	ctx := context.Background()
+
+	if behaviour == SEEDER_ENCRYPTED {
+		if _, err := pc.acceptEncryption(ctx, [][]byte{h.infoHash}, ENCRYPTION_REQUIRE); err != nil {
+			return
+		}
+	}
+
+	peerId := []byte("-HN0001-harnesspeer1")
+	if behaviour == SEEDER_INBOUND {
+		// The inbound seeder starts the handshake
+		if _, err := pc.sendBytes(ctx, peer.BuildHandshakeMessage(peerId, h.infoHash, true)); err != nil {
+			return
+		}
+		if _, err := pc.receiveBytes(ctx, peer.HANDSHAKE_MESSAGE_LENGTH); err != nil {
+			return
+		}
+	} else {
+		handshake, err := pc.receiveBytes(ctx, peer.HANDSHAKE_MESSAGE_LENGTH)
+		if err != nil || !bytes.Equal(handshake[28:48], h.infoHash) {
+			return
+		}
+
+		if behaviour == SEEDER_SILENT {
+			// Hold the connection until the client gives up
+			io.Copy(io.Discard, conn)
+			return
+		}
+
+		if _, err := pc.sendBytes(ctx, peer.BuildHandshakeMessage(peerId, h.infoHash, true)); err != nil {
+			return
+		}
+	}
+
+	// Every seeder has all the pieces, except the partial ones
+	nPieces := (len(h.data) + h.pieceLength - 1) / h.pieceLength
+	has := func(index int) bool {
+		return (behaviour != SEEDER_EVEN && behaviour != SEEDER_PEX || index%2 == 0) && (behaviour != SEEDER_ODD || index%2 == 1)
+	}
+	if behaviour == SEEDER_CHATTY {
+		if _, err := pc.sendMessage(ctx, peer.Message{Length: 1, Type: peer.UNCHOKE}); err != nil {
+			return
+		}
+	}
+	if behaviour == SEEDER_ODD {
+		for i := 1; i < nPieces; i += 2 {
+			if _, err := pc.sendMessage(ctx, peer.Have{Index: i}.Serialize()); err != nil {
+				return
+			}
+		}
+	} else {
+		bitfield := make(peer.Bitfield, (nPieces+7)/8)
+		for i := 0; i < nPieces; i++ {
+			if has(i) {
+				bitfield.Set(i)
+			}
+		}
+		if _, err := pc.sendMessage(ctx, bitfield.Serialize()); err != nil {
+			return
+		}
+	}
+
+	// ID the client assigned to the metadata extension in its extension handshake
+	clientMetadataId := 0
+	firstPiece := -1
+	stalled := map[int]bool{}       // Pieces held back by a stalling seeder
+	served := false                 // Whether the connection sent blocks
+	choking, choked := false, false // Whether the client is choked now, and whether it was ever
+
+	for {
+		message, err := pc.receivePeerMessage(ctx)
+		if err != nil {
+			return
+		}
+
+		var reply *peer.Message
+		switch message.Type {
+		case peer.INTERESTED:
+			reply = &peer.Message{Length: 1, Type: peer.UNCHOKE}
+			if behaviour == SEEDER_CHOKE {
+				reply.Type = peer.CHOKE
+			}
+			choking = false
+		case peer.REQUEST:
+			// Requests received while choking are dropped
+			if choking {
+				continue
+			}
+
+			request, err := peer.ParseBlockRequest(message)
+			if err != nil {
+				return
+			}
+			index, begin, length := request.Index, request.Begin, request.Length
+
+			// Requesting a piece the seeder doesn't have is a protocol violation
+			if !has(index) {
+				return
+			}
+			if behaviour == SEEDER_INBOUND {
+				h.inboundServed.Store(true)
+			}
+			if !served {
+				served = true
+				h.mu.Lock()
+				h.serving++
+				h.mu.Unlock()
+			}
+
+			if firstPiece == -1 {
+				firstPiece = index
+			}
+			if behaviour == SEEDER_STALL && index != firstPiece {
+				if !stalled[index] {
+					stalled[index] = true
+					h.stalled(conn)
+				}
+				continue
+			}
+
+			offset := index*h.pieceLength + begin
+			block := append([]byte{}, h.data[offset:offset+length]...)
+			switch behaviour {
+			case SEEDER_CORRUPT:
+				block[0] ^= 0xff
+			case SEEDER_SLOW:
+				time.Sleep(HARNESS_SLOW_BLOCK_DELAY)
+			}
+
+			piece := peer.Piece{Index: index, Begin: begin, Block: block}.Serialize()
+			reply = &piece
+
+			if behaviour == SEEDER_CHATTY {
+				chatter := []peer.Message{peer.Have{Index: index}.Serialize(), peer.Port{Port: 6881}.Serialize(),
+					{Length: 1, Type: peer.UNCHOKE}, {Length: 1, Type: peer.NOT_INTERESTED}}
+				for _, message := range chatter {
+					if _, err := pc.sendMessage(ctx, message); err != nil {
+						return
+					}
+				}
+				if err := pc.sendKeepAlive(ctx); err != nil {
+					return
+				}
+			}
+
+			if behaviour == SEEDER_TRUNCATE {
+				raw := reply.Bytes()
+				pc.sendBytes(ctx, raw[:len(raw)/2])
+				return
+			}
+			if behaviour == SEEDER_RECHOKE && !choked {
+				if _, err := pc.sendMessage(ctx, *reply); err != nil {
+					return
+				}
+				reply = &peer.Message{Length: 1, Type: peer.CHOKE}
+				choking, choked = true, true
+			}
+		case peer.EXTENSION_MESSAGE:
+			reply = h.extensionReply(message.Payload, &clientMetadataId)
+			if behaviour == SEEDER_NO_METADATA && message.Payload[0] == HARNESS_METADATA_EXTENSION_ID {
+				reply = h.metadataReject(message.Payload, clientMetadataId)
+			}
+
+			// The hidden seeders are told about once the client advertised peer exchange
+			if behaviour == SEEDER_PEX && reply != nil && message.Payload[0] == 0 {
+				if _, err := pc.sendMessage(ctx, *reply); err != nil {
+					return
+				}
+				reply = h.pexMessage(message.Payload)
+			}
+		}
+
+		if reply == nil {
+			continue
+		}
+		if _, err := pc.sendMessage(ctx, *reply); err != nil {
+			return
+		}
+	}
+}
+
+// dialClient connects an inbound seeder to the client listening at address, until ctx is done. The client only
+// accepts it while downloading, it's dialed again until then.
+func (h *harness) dialClient(ctx context.Context, address string) {
+	for ctx.Err() == nil {
+		conn, err := h.network.DialPeer(ctx, address)
+		if err == nil {
+			h.serveConnection(conn, SEEDER_INBOUND)
+		}
+
+		select {
+		case <-time.After(HARNESS_REDIAL_DELAY):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// extensionReply returns the response to an extension message: the extension handshake, or the requested piece of the
+// metadata. Returns nil for other messages. The metadata extension ID of the client is read from its handshake.
+func (h *harness) extensionReply(payload []byte, clientMetadataId *int) *peer.Message {
+	var response []byte
+	metadata := bencoded(h.info)
+
+	switch payload[0] {
+	case 0:
+		handshake, err := peer.ParseExtensionHandshake(payload)
+		if err != nil {
+			return nil
+		}
+		*clientMetadataId = handshake.Extensions["ut_metadata"]
+		if handshake.Version == CLIENT_VERSION && handshake.Requests > 0 {
+			h.identified.Store(true)
+		}
+
+		response = append([]byte{0}, bencoded(map[string]any{
+			"m":             map[string]any{"ut_metadata": HARNESS_METADATA_EXTENSION_ID},
+			"metadata_size": len(metadata),
+			"v":             "harness",
+			"reqq":          HARNESS_REQUEST_QUEUE,
+		})...)
+	case HARNESS_METADATA_EXTENSION_ID:
+		_, piece, _, err := peer.ParseMetadataMessage(payload)
+		if err != nil || piece < 0 || piece*peer.METADATA_PIECE_SIZE >= len(metadata) {
+			return nil
+		}
+
+		response = append([]byte{byte(*clientMetadataId)}, bencoded(map[string]any{
+			"msg_type":   peer.METADATA_EXTENSION_DATA,
+			"piece":      piece,
+			"total_size": len(metadata),
+		})...)
+		response = append(response, metadata[piece*peer.METADATA_PIECE_SIZE:min((piece+1)*peer.METADATA_PIECE_SIZE, len(metadata))]...)
+	default:
+		return nil
+	}
+
+	return &peer.Message{Length: uint32(len(response) + 1), Type: peer.EXTENSION_MESSAGE, Payload: response}
+}
+
+// metadataReject returns the rejection of the metadata request of payload, sent with the metadata extension ID of the
+// client. Returns nil for invalid requests.
+func (h *harness) metadataReject(payload []byte, clientMetadataId int) *peer.Message {
+	_, piece, _, err := peer.ParseMetadataMessage(payload)
+	if err != nil {
+		return nil
+	}
+
+	response := append([]byte{byte(clientMetadataId)}, bencoded(map[string]any{
+		"msg_type": peer.METADATA_EXTENSION_REJECT,
+		"piece":    piece,
+	})...)
+
+	return &peer.Message{Length: uint32(len(response) + 1), Type: peer.EXTENSION_MESSAGE, Payload: response}
+}
+
+// pexMessage returns the peer exchange message adding the hidden seeders, sent with the ut_pex ID of the client
+// extension handshake. Returns nil when the client doesn't support peer exchange.
+func (h *harness) pexMessage(handshake []byte) *peer.Message {
+	parsed, err := peer.ParseExtensionHandshake(handshake)
+	if err != nil || parsed.Extensions["ut_pex"] == 0 {
+		return nil
+	}
+
+	var added bytes.Buffer
+	for i, seeder := range h.seeders {
+		if h.behaviours[i] == SEEDER_HIDDEN {
+			peer, _ := peer.Compact(seeder.Addr().String())
+			added.Write(peer)
+		}
+	}
+
+	payload := append([]byte{byte(parsed.Extensions["ut_pex"])}, bencoded(map[string]any{"added": added.String()})...)
+
+	return &peer.Message{Length: uint32(len(payload) + 1), Type: peer.EXTENSION_MESSAGE, Payload: payload}
+}
+
+// harnessScenario is a download run against a harness swarm, along with its expected outcome.
+type harnessScenario struct {
+	name        string
+	seeders     []string
+	magnet      bool          // Whether the torrent metadata is fetched from the seeders first
+	complete    bool          // Whether the download is expected to get every piece
+	options     []Option      // Options of the client
+	pieceLength int           // Length of the pieces of the torrent, 32 KiB when 0
+	size        int           // Length of the torrent data, five pieces and a shorter one when 0
+	interval    int           // Announce interval returned by the tracker in seconds, 60 when 0
+	dictPeers   bool          // Whether the tracker returns peer dictionaries instead of compact peers
+	meta        string        // Structures of the torrent, BEP 52: "v2" or "hybrid", v1 when empty
+	multiFile   bool          // Whether the data is split across files, in a directory
+	banned      int           // Seeders expected to be banned for sending corrupt pieces
+	stall       time.Duration // Simulated time passing whenever a seeder stalls, the client then runs on a simulated clock
+	err         error         // Error the download is expected to fail with, any when nil
+}
+
+var harnessScenarios = []harnessScenario{
+	{name: "download", seeders: []string{SEEDER_NORMAL, SEEDER_NORMAL}, complete: true},
+	{name: "magnet download", seeders: []string{SEEDER_NORMAL}, magnet: true, complete: true},
+	{name: "metadata rejected", seeders: []string{SEEDER_NO_METADATA, SEEDER_NORMAL}, magnet: true, complete: true},
+	// Over 16 KiB of piece hashes, the metadata is fetched in several pieces
+	{name: "large metadata", seeders: []string{SEEDER_NORMAL}, magnet: true, complete: true, pieceLength: 128},
+	{name: "whole pieces", seeders: []string{SEEDER_NORMAL}, complete: true, size: 4 * 32_768},
+	{name: "slow peer", seeders: []string{SEEDER_SLOW}, complete: true},
+	{name: "hash failure", seeders: []string{SEEDER_CORRUPT}},
+	// The corrupt seeder is banned at its first corrupt piece, the other one delivers every piece
+	{name: "banned peer", seeders: []string{SEEDER_CORRUPT, SEEDER_NORMAL}, complete: true, banned: 1,
+		options: []Option{WithMaxHashFailures(1)}},
+	// The single piece fails on every seeder
+	{name: "unrecoverable piece", seeders: []string{SEEDER_CORRUPT, SEEDER_CORRUPT, SEEDER_CORRUPT}, pieceLength: 262_144,
+		err: ErrPieceFailed},
+	{name: "choked", seeders: []string{SEEDER_CHOKE}},
+	{name: "truncated block", seeders: []string{SEEDER_TRUNCATE}},
+	{name: "partial seeders", seeders: []string{SEEDER_EVEN, SEEDER_ODD}, complete: true},
+	{name: "choked mid-piece", seeders: []string{SEEDER_RECHOKE}, complete: true},
+	{name: "interleaved messages", seeders: []string{SEEDER_CHATTY}, complete: true},
+	{name: "stalling peer", seeders: []string{SEEDER_NORMAL, SEEDER_STALL}, complete: true},
+	// The stalled piece is put back once the seeder times out, no peer is left to deliver it
+	{name: "peer timeout", seeders: []string{SEEDER_STALL}, options: []Option{WithPeerTimeout(time.Second)},
+		stall: time.Second},
+	{name: "inbound peer", seeders: []string{SEEDER_SLOW, SEEDER_INBOUND}, complete: true},
+	// The stalling seeder only delivers a piece, the others come from the seeder returned by the next announce
+	{name: "tracker re-announce", seeders: []string{SEEDER_STALL, SEEDER_LATE}, complete: true, interval: 1,
+		stall: time.Second},
+	{name: "dictionary peers", seeders: []string{SEEDER_NORMAL}, complete: true, dictPeers: true},
+	{name: "peer exchange", seeders: []string{SEEDER_PEX, SEEDER_HIDDEN}, complete: true},
+	{name: "vetoed piece", seeders: []string{SEEDER_NORMAL}, options: []Option{WithHook(vetoFirstPiece)}},
+	{name: "encrypted peer", seeders: []string{SEEDER_ENCRYPTED}, complete: true,
+		options: []Option{WithEncryption(ENCRYPTION_PREFER)}},
+	{name: "plaintext fallback", seeders: []string{SEEDER_NORMAL}, complete: true,
+		options: []Option{WithEncryption(ENCRYPTION_PREFER)}},
+	{name: "v2 torrent", seeders: []string{SEEDER_NORMAL, SEEDER_NORMAL}, complete: true, meta: "v2"},
+	// A single piece is hashed as the whole file, padded to the next power of two blocks rather than a whole piece
+	{name: "v2 single piece", seeders: []string{SEEDER_NORMAL}, complete: true, meta: "v2", size: 3*MERKLE_BLOCK_SIZE + 100,
+		pieceLength: 8 * MERKLE_BLOCK_SIZE},
+	{name: "v2 hash failure", seeders: []string{SEEDER_CORRUPT}, meta: "v2"},
+	{name: "hybrid torrent", seeders: []string{SEEDER_NORMAL}, complete: true, meta: "hybrid"},
+	{name: "hybrid magnet", seeders: []string{SEEDER_NORMAL}, magnet: true, complete: true, meta: "hybrid"},
+	{name: "multi-file torrent", seeders: []string{SEEDER_NORMAL, SEEDER_NORMAL}, complete: true, multiFile: true},
+	{name: "multi-file magnet", seeders: []string{SEEDER_NORMAL}, magnet: true, complete: true, multiFile: true},
+	{name: "encryption required", seeders: []string{SEEDER_NORMAL}, options: []Option{WithEncryption(ENCRYPTION_REQUIRE)}},
+}
+
+// vetoFirstPiece is a hook discarding the first piece of the torrent.
+func vetoFirstPiece(e Event) error {
+	if e.Type == EVENT_PIECE_COMPLETE && *e.Piece == 0 {
+		return errors.New("piece 0 is not wanted")
+	}
+
+	return nil
+}
+
+// run downloads the harness torrent into dir and checks the outcome is the expected one.
+func (s harnessScenario) run(dir string) error {
+	pieceLength := s.pieceLength
+	if pieceLength == 0 {
+		pieceLength = 32_768
+	}
+
+	// The last piece is shorter than the others, unless the scenario sets the size
+	size := s.size
+	if size == 0 {
+		size = 5*32_768 + 1_000
+	}
+	h, err := newHarness(size, pieceLength, s.seeders...)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+	if s.interval > 0 {
+		h.interval = s.interval
+	}
+	h.dictPeers = s.dictPeers
+	if s.meta != "" {
+		h.useV2(s.meta == "hybrid")
+	}
+	if s.multiFile {
+		h.useFiles()
+	}
+
+	// Inbound seeders connect to the listener of the client
+	options := s.options
+	inbound := slices.Contains(s.seeders, SEEDER_INBOUND)
+	if inbound {
+		listener, err := h.network.listen(HARNESS_CLIENT_ADDRESS)
+		if err != nil {
+			return err
+		}
+		l := newPeerListener(listener, ENCRYPTION_DISABLE)
+		defer l.Close()
+		options = append(slices.Clip(options), WithListener(l))
+	}
+
+	// The timeouts and re-announces are due once the stalling seeders held back a piece for the simulated time
+	var clock *simClock
+	if s.stall > 0 {
+		clock = newSimClock(simulationEpoch)
+		h.stalls = make(chan *memConn, len(s.seeders))
+		options = append(slices.Clip(options), withClock(clock))
+	}
+
+	t, err := h.torrent(options...)
+	if s.magnet {
+		t, err = h.magnet(options...)
+	}
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	completed, piecesDone, hashFails, bans := false, 0, 0, 0
+	t.events = newEventBus()
+	t.events.observe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch e.Type {
+		case EVENT_COMPLETED:
+			completed = true
+		case EVENT_PIECE_COMPLETE:
+			piecesDone++
+		case EVENT_HASH_FAIL:
+			hashFails++
+		case EVENT_PEER_BANNED:
+			bans++
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), HARNESS_SCENARIO_TIMEOUT)
+	defer cancel()
+
+	if inbound {
+		go h.dialClient(ctx, HARNESS_CLIENT_ADDRESS)
+	}
+	if clock != nil {
+		go h.moveClockOnStalls(ctx, clock, s.stall)
+	}
+
+	if s.magnet {
+		if err := t.MagnetInfo(ctx); err != nil {
+			return fmt.Errorf("could not fetch metadata: %w", err)
+		}
+		if !bytes.Equal(h.v1InfoHash(), t.infoHash) || t.info.length != len(h.data) {
+			return errors.New("fetched metadata doesn't match the torrent")
+		}
+	}
+
+	outputPath := filepath.Join(dir, strings.ReplaceAll(s.name, " ", "-"))
+	downloadErr := t.DownloadFile(ctx, outputPath)
+
+	if ctx.Err() != nil {
+		return errors.New("download did not finish in time")
+	}
+	if s.complete && downloadErr != nil {
+		return fmt.Errorf("download failed: %w", downloadErr)
+	}
+	if !s.complete && downloadErr == nil {
+		return errors.New("expected the download to fail")
+	}
+	if s.err != nil && !errors.Is(downloadErr, s.err) {
+		return fmt.Errorf("expected the download to fail with %q, got %v", s.err, downloadErr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Failing downloads are detected by the missing pieces
+	if s.complete && !completed {
+		return errors.New("download did not complete")
+	}
+	if !s.complete && piecesDone == t.info.nPieces {
+		return errors.New("expected pieces to fail")
+	}
+	if s.complete {
+		var content []byte
+		for _, file := range t.info.dataLayout(outputPath) {
+			fileContent, err := os.ReadFile(file.Path)
+			if err != nil {
+				return err
+			}
+			content = append(content, fileContent...)
+		}
+		if !bytes.Equal(content, h.data) {
+			return errors.New("downloaded data doesn't match the torrent")
+		}
+	}
+	if slices.Contains(s.seeders, SEEDER_CORRUPT) && hashFails == 0 {
+		return errors.New("expected hash failures")
+	}
+	if bans != s.banned {
+		return fmt.Errorf("expected %d banned peers, got %d", s.banned, bans)
+	}
+	if s.complete && !h.identified.Load() {
+		return errors.New("expected the client to send its version and request queue")
+	}
+	if inbound && !h.inboundServed.Load() {
+		return errors.New("expected the inbound peer to send pieces")
+	}
+
+	// The download starts with the started announce and ends with the stopped one, right after completed when it got
+	// every piece. Magnet links are announced without event to fetch the metadata first
+	announces := h.announced()
+	var events []string
+	for _, query := range announces {
+		events = append(events, query.Get("event"))
+	}
+	if started := slices.Index(events, tracker.ANNOUNCE_STARTED); started > 0 {
+		// The length is unknown until the metadata is fetched
+		for _, query := range announces[:started] {
+			if left := query.Get("left"); left != "0" {
+				return fmt.Errorf("announce before the metadata reported %s bytes left", left)
+			}
+		}
+		announces, events = announces[started:], events[started:]
+	}
+	if len(events) < 2 || events[0] != tracker.ANNOUNCE_STARTED || events[len(events)-1] != tracker.ANNOUNCE_STOPPED {
+		return fmt.Errorf("unexpected announce events %q", events)
+	}
+	if s.complete && events[len(events)-2] != tracker.ANNOUNCE_COMPLETED {
+		return fmt.Errorf("expected the completed announce, got events %q", events)
+	}
+
+	// The started announce has everything left, the completed one nothing, having downloaded the whole torrent at least
+	if left := announces[0].Get("left"); left != strconv.Itoa(len(h.data)) {
+		return fmt.Errorf("started announce reported %s bytes left", left)
+	}
+	if s.complete {
+		completedAnnounce := announces[len(announces)-2]
+		downloaded, _ := strconv.Atoi(completedAnnounce.Get("downloaded"))
+		if left := completedAnnounce.Get("left"); left != "0" || downloaded < len(h.data) {
+			return fmt.Errorf("completed announce reported %d bytes downloaded and %s left", downloaded, left)
+		}
+	}
+
+	return nil
+}
+
+// splitPiece downloads a piece of 16 blocks from three seeders at once, and checks it's reassembled from the blocks
+// of several of them.
+func splitPiece(dir string) error {
+	h, err := newHarness(262_144, 262_144, SEEDER_SLOW, SEEDER_SLOW, SEEDER_SLOW)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	t, err := h.torrent()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HARNESS_SCENARIO_TIMEOUT)
+	defer cancel()
+
+	outputPath := filepath.Join(dir, "split-piece")
+	if err := t.DownloadPieceToFile(ctx, outputPath, 0, 3); err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, h.data) {
+		return errors.New("downloaded piece doesn't match the torrent")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.serving < 2 {
+		return fmt.Errorf("expected several seeders to send blocks, %d did", h.serving)
+	}
+
+	return nil
+}
+
+// TestDownloadScenarios runs the download of every harness scenario against its in-process swarm.
+func TestDownloadScenarios(t *testing.T) {
+	for _, s := range harnessScenarios {
+		t.Run(s.name, func(t *testing.T) {
+			if err := s.run(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestSplitPiece checks a piece downloaded from several seeders at once is reassembled from their blocks.
+func TestSplitPiece(t *testing.T) {
+	if err := splitPiece(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,240 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"runtime"
+	"sync"
+)
+
+// Hash functions of the pieces: SHA-1 for v1 and hybrid torrents, SHA-256 for the merkle trees of v2 ones
+const HASH_SHA1 = "sha1"
+const HASH_SHA256 = "sha256"
+
+// pieceHasher computes the hashes pieces are checked against. The standard library implementations are used unless
+// faster ones, e.g. using SIMD instructions, are plugged in with withPieceHasher.
+type pieceHasher interface {
+	// algorithm is the hash function implemented, HASH_SHA1 or HASH_SHA256
+	algorithm() string
+	hash(data []byte) []byte
+}
+
+// stdHasher hashes pieces with a hash function of the standard library.
+type stdHasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (h stdHasher) algorithm() string {
+	return h.name
+}
+
+func (h stdHasher) hash(data []byte) []byte {
+	digest := h.newHash()
+	digest.Write(data)
+
+	return digest.Sum(nil)
+}
+
+// Hashers of the standard library, used by the client unless configured
+var sha1Hasher pieceHasher = stdHasher{name: HASH_SHA1, newHash: sha1.New}
+var sha256Hasher pieceHasher = stdHasher{name: HASH_SHA256, newHash: sha256.New}
+
+// withPieceHasher sets how the client hashes the pieces with the algorithm of h.
+func withPieceHasher(h pieceHasher) Option {
+	return func(c *Client) {
+		c.hashers[h.algorithm()] = h
+	}
+}
+
+// hashAlgorithm returns the hash function of the pieces of the torrent: SHA-256 for the merkle trees of v2 torrents
+// that are not hybrid, SHA-1 otherwise.
+func (i info) hashAlgorithm() string {
+	if i.merkle {
+		return HASH_SHA256
+	}
+
+	return HASH_SHA1
+}
+
+// verifyPieces checks the pieces at the given indexes against their hashes in the torrent, hashing independent pieces
+// on every core. read returns the data of a piece, nil when it's missing. Returns whether each piece matches, in the
+// order of indexes, or the first read error.
+func (t Torrent) verifyPieces(indexes []int, read func(index int) ([]byte, error)) ([]bool, error) {
+	valid := make([]bool, len(indexes))
+
+	jobs := make(chan int)
+	var errOnce sync.Once
+	var readErr error
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < min(runtime.GOMAXPROCS(0), len(indexes)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				data, err := read(indexes[i])
+				if err != nil {
+					errOnce.Do(func() { readErr = err })
+					continue
+				}
+
+				valid[i] = data != nil && bytes.Equal(t.pieceHash(indexes[i], data), t.info.pieces[indexes[i]])
+			}
+		}()
+	}
+
+	for i := range indexes {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return valid, readErr
+}
+
+// Corrupt pieces a peer sends before it's banned for the session, unless configured
+const DEFAULT_MAX_HASH_FAILURES = 3
+
+// WithMaxHashFailures sets how many corrupt pieces a peer sends before it's banned for the session. 0 never bans.
+func WithMaxHashFailures(n int) Option {
+	return func(c *Client) {
+		c.maxHashFailures = n
+	}
+}
+
+// hashPool verifies the pieces downloaded by the network workers of a client's torrents on a bounded number of hash
+// workers, so the network workers go on downloading while the pieces they handed over are hashed. It counts the pieces
+// failing verification per peer host, and bans the peers reaching the maxHashFailures of the client.
+type hashPool struct {
+	workers int
+	jobs    chan hashJob
+	start   sync.Once
+	done    chan struct{} // Closed once the pool is closed, stopping the workers
+
+	closing sync.RWMutex // Held by the submits, so none hands a piece over once the pool is closed
+	closed  bool
+
+	mu       sync.Mutex
+	failures map[string]int // Pieces failing verification by peer address
+}
+
+// hashJob is a downloaded piece waiting for a hash worker.
+type hashJob struct {
+	t        Torrent
+	index    int
+	data     []byte
+	peer     string           // Address of the peer the piece came from
+	verified func(valid bool) // Called by the hash worker with whether the piece matches its hash
+}
+
+// newHashPool returns a pool of the given number of hash workers, started on the first submitted piece. As many pieces
+// wait for a worker before submit blocks.
+func newHashPool(workers int) *hashPool {
+	return &hashPool{workers: workers, jobs: make(chan hashJob, workers), done: make(chan struct{}), failures: map[string]int{}}
+}
+
+// close stops the hash workers once they verified the pieces already submitted. The pieces submitted afterwards fail
+// with errClientClosed.
+func (p *hashPool) close() {
+	p.closing.Lock()
+	defer p.closing.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+}
+
+// submit hands the piece at index of t, downloaded from peer, over to the hash workers, blocking while the pool is
+// full. verified is called by a hash worker with whether the piece matches its hash. Fails when ctx is done first, or
+// the pool is closed.
+func (p *hashPool) submit(ctx context.Context, t Torrent, index int, data []byte, peer string, verified func(valid bool)) error {
+	p.closing.RLock()
+	defer p.closing.RUnlock()
+	if p.closed {
+		return ErrClientClosed
+	}
+
+	p.start.Do(func() {
+		for w := 0; w < p.workers; w++ {
+			go p.work()
+		}
+	})
+
+	select {
+	case p.jobs <- hashJob{t: t, index: index, data: data, peer: peer, verified: verified}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// verify checks the piece at index of t, downloaded from peer, on a hash worker and returns whether it matches its
+// hash. Fails when ctx is done before a worker took it, or the pool is closed.
+func (p *hashPool) verify(ctx context.Context, t Torrent, index int, data []byte, peer string) (bool, error) {
+	result := make(chan bool, 1)
+	if err := p.submit(ctx, t, index, data, peer, func(valid bool) { result <- valid }); err != nil {
+		return false, err
+	}
+
+	return <-result, nil
+}
+
+// work verifies the submitted pieces until the pool is closed, and the pieces submitted before it was.
+func (p *hashPool) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			p.check(job)
+		case <-p.done:
+			for {
+				select {
+				case job := <-p.jobs:
+					p.check(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// check verifies the piece of job, and hands the result to its verified function.
+func (p *hashPool) check(job hashJob) {
+	valid := bytes.Equal(job.t.pieceHash(job.index, job.data), job.t.info.pieces[job.index])
+	if !valid {
+		p.failed(job.t, job.peer)
+	}
+	job.verified(valid)
+}
+
+// failed counts a corrupt piece of t from the peer at address, banning the peer when it reaches the maxHashFailures of
+// the client.
+func (p *hashPool) failed(t Torrent, address string) {
+	c := t.getClient()
+
+	p.mu.Lock()
+	p.failures[address]++
+	failures := p.failures[address]
+	p.mu.Unlock()
+
+	if c.maxHashFailures > 0 && failures == c.maxHashFailures {
+		c.deadPeers.ban(address)
+		c.log.Warn(fmt.Sprintf("Banned peer %s for the session after %d corrupt pieces", address, failures), "peer", address)
+		t.publish(Event{Type: EVENT_PEER_BANNED, Peer: address})
+	}
+}
+
+// hashFailures returns how many pieces from the peer at address failed verification.
+func (p *hashPool) hashFailures(address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.failures[address]
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// countingHasher is a pieceHasher counting the data it hashes.
+type countingHasher struct {
+	pieceHasher
+	hashed atomic.Int32
+}
+
+func (h *countingHasher) hash(data []byte) []byte {
+	h.hashed.Add(1)
+	return h.pieceHasher.hash(data)
+}
+
+// TestPieceHasherSelection checks the pieces are hashed with the hasher of the client for the meta version of their
+// torrent: SHA-1 for v1 and hybrid torrents, SHA-256 for v2 ones.
+func TestPieceHasherSelection(t *testing.T) {
+	for _, meta := range []string{"v1", "hybrid", "v2"} {
+		t.Run(meta, func(t *testing.T) {
+			h, err := newHarness(5*32_768+1_000, 32_768)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.close()
+			if meta != "v1" {
+				h.useV2(meta == "hybrid")
+			}
+
+			sha1Counter := &countingHasher{pieceHasher: sha1Hasher}
+			sha256Counter := &countingHasher{pieceHasher: sha256Hasher}
+			tor, err := h.torrent(withPieceHasher(sha1Counter), withPieceHasher(sha256Counter))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tor.info.nPieces; i++ {
+				begin := i * tor.info.pieceLength
+				if !bytes.Equal(tor.pieceHash(i, h.data[begin:begin+tor.info.pieceLengthAt(i)]), tor.info.pieces[i]) {
+					t.Fatalf("piece %d doesn't match its hash", i)
+				}
+			}
+
+			used, unused := sha1Counter, sha256Counter
+			if meta == "v2" {
+				used, unused = sha256Counter, sha1Counter
+			}
+			if used.hashed.Load() == 0 || unused.hashed.Load() != 0 {
+				t.Fatalf("%d hashes with the hasher of the torrent, %d with the other one", used.hashed.Load(), unused.hashed.Load())
+			}
+		})
+	}
+}
+
+// TestClientClose checks closing a client stops its hash workers, after they verified the pieces already submitted.
+func TestClientClose(t *testing.T) {
+	h, err := newHarness(2*32_768, 32_768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+
+	tor, err := h.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tor.getClient()
+	valid, err := c.hashes.verify(context.Background(), tor, 0, h.data[:32_768], "peer")
+	if err != nil || !valid {
+		t.Fatalf("piece verified as %t: %v", valid, err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.hashes.verify(context.Background(), tor, 1, h.data[32_768:], "peer"); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("piece verified by a closed client: %v", err)
+	}
+}
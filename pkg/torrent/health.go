@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Status values of the health checks
+const CHECK_OK = "ok"
+const CHECK_ERROR = "error"
+const CHECK_UNKNOWN = "unknown"
+const CHECK_DISABLED = "disabled"
+
+// healthCheck is the result of checking one of the daemon dependencies.
+type healthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Required checks make the daemon not ready when failing
+	Required bool `json:"required"`
+}
+
+// trackerHealth holds the result of the last announces to a tracker.
+type trackerHealth struct {
+	LastAnnounce time.Time `json:"lastAnnounce,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastErrorAt  time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// reachable returns whether the last announce to the tracker succeeded
+func (h trackerHealth) reachable() bool {
+	return !h.LastAnnounce.IsZero() && h.LastAnnounce.After(h.LastErrorAt)
+}
+
+// recordTracker updates the health of the tracker of the event. Must be called holding the session lock.
+func (d *Daemon) recordTracker(e Event) {
+	h, ok := d.trackers[e.Tracker]
+	if !ok {
+		h = &trackerHealth{}
+		d.trackers[e.Tracker] = h
+	}
+
+	if e.Type == EVENT_TRACKER_ANNOUNCE {
+		h.LastAnnounce = e.Time
+	} else {
+		h.LastError = e.Error
+		h.LastErrorAt = e.Time
+	}
+}
+
+// checkListener verifies the API listener is bound.
+func (d *Daemon) checkListener() healthCheck {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.listenAddress == "" {
+		return healthCheck{Status: CHECK_ERROR, Detail: "not listening", Required: true}
+	}
+
+	return healthCheck{Status: CHECK_OK, Detail: d.listenAddress, Required: true}
+}
+
+// checkDisk verifies files can be created in the download directory.
+func (d *Daemon) checkDisk() healthCheck {
+	f, err := os.CreateTemp(d.downloadDir, ".healthcheck-*")
+	if err != nil {
+		return healthCheck{Status: CHECK_ERROR, Detail: err.Error(), Required: true}
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+
+	return healthCheck{Status: CHECK_OK, Detail: d.downloadDir, Required: true}
+}
+
+// checkTrackers reports whether the trackers contacted so far are reachable. It fails only when all of them are
+// failing, since torrents can keep downloading from known peers meanwhile.
+func (d *Daemon) checkTrackers() (healthCheck, map[string]trackerHealth) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	trackers := make(map[string]trackerHealth, len(d.trackers))
+	reachable := 0
+	for url, h := range d.trackers {
+		trackers[url] = *h
+		if h.reachable() {
+			reachable++
+		}
+	}
+
+	switch {
+	case len(trackers) == 0:
+		return healthCheck{Status: CHECK_UNKNOWN, Detail: "no tracker contacted yet"}, trackers
+	case reachable == 0:
+		return healthCheck{Status: CHECK_ERROR, Detail: "no tracker reachable"}, trackers
+	default:
+		return healthCheck{Status: CHECK_OK}, trackers
+	}
+}
+
+// checkDht reports the state of the DHT node of the client: disabled, bootstrapping, or the size of its routing table.
+// Downloads only fall back on the DHT, a node knowing no other node doesn't make the daemon not ready.
+func (c *Client) checkDht() healthCheck {
+	if c.dht == nil {
+		return healthCheck{Status: CHECK_DISABLED, Detail: "DHT is disabled, enabled with --dht"}
+	}
+
+	select {
+	case <-c.dht.bootstrapped:
+	default:
+		return healthCheck{Status: CHECK_UNKNOWN, Detail: "bootstrapping"}
+	}
+
+	nodes := c.dht.table.size()
+	if nodes == 0 {
+		return healthCheck{Status: CHECK_ERROR, Detail: "no node in the routing table"}
+	}
+
+	return healthCheck{Status: CHECK_OK, Detail: fmt.Sprintf("%d nodes in the routing table", nodes)}
+}
+
+// serveHealth responds whether the daemon is alive. Serving the request is proof enough.
+func (d *Daemon) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": CHECK_OK})
+}
+
+// serveReadiness responds with the result of every health check. The status code is 503 when a required check fails.
+func (d *Daemon) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	trackersCheck, trackers := d.checkTrackers()
+
+	checks := map[string]healthCheck{
+		"listener": d.checkListener(),
+		"disk":     d.checkDisk(),
+		"trackers": trackersCheck,
+		"dht":      d.client.checkDht(),
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Required && check.Status != CHECK_OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   status,
+		"checks":   checks,
+		"trackers": trackers,
+	})
+}
@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestReadinessDht checks the readiness of the daemon reports its DHT node disabled, then bootstrapping, then with the
+// size of its routing table, without the DHT making the daemon not ready.
+func TestReadinessDht(t *testing.T) {
+	d := newDaemon(NewClient(), t.TempDir())
+	d.listenAddress = "127.0.0.1:0"
+
+	readiness := func() healthCheck {
+		t.Helper()
+		w := httptest.NewRecorder()
+		d.serveReadiness(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("readiness status %d: %s", w.Code, w.Body)
+		}
+
+		var response struct {
+			Checks map[string]healthCheck `json:"checks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		return response.Checks["dht"]
+	}
+
+	if check := readiness(); check.Status != CHECK_DISABLED {
+		t.Fatalf("DHT check %+v without a node", check)
+	}
+
+	node, err := StartDhtNode(net.IPv4(127, 0, 0, 1), 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	d.client = NewClient(WithDht(node))
+	<-node.bootstrapped
+
+	if check := readiness(); check.Status != CHECK_ERROR {
+		t.Fatalf("DHT check %+v with an empty routing table", check)
+	}
+
+	node.table.add(dhtContact{id: "other-node-id-20byte", addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}})
+	if check := readiness(); check.Status != CHECK_OK || check.Detail != "1 nodes in the routing table" {
+		t.Fatalf("DHT check %+v with a node", check)
+	}
+}
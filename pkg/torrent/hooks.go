@@ -0,0 +1,39 @@
+package torrent
+
+import "fmt"
+
+// Hook is called with the events of the torrents of a client, before they are delivered to the event bus. Hooks run
+// synchronously in the goroutine publishing the event, so slow work like sending notifications should be handed off.
+//
+// The EVENT_ADDED, EVENT_PEER_CONNECTED and EVENT_PIECE_COMPLETE events are published before their action takes
+// effect: a hook returning an error vetoes the action, and the event is not delivered. Errors returned for any other
+// event are ignored.
+type Hook func(e Event) error
+
+// Events whose action is cancelled when a hook returns an error
+var vetoableEvents = map[string]bool{
+	EVENT_ADDED:          true, // The torrent is not added
+	EVENT_PEER_CONNECTED: true, // The connection is closed before the handshake
+	EVENT_PIECE_COMPLETE: true, // The verified piece is discarded
+}
+
+// WithHook registers a hook called with the events of the client's torrents. Hooks are called in the order they
+// are registered.
+func WithHook(h Hook) Option {
+	return func(c *Client) {
+		c.hooks = append(c.hooks, h)
+	}
+}
+
+// runHooks calls the hooks of the client with e. Returns the error of the first hook vetoing the event, in which case
+// the following hooks are not called.
+func (c *Client) runHooks(e Event) error {
+	for _, h := range c.hooks {
+		err := h(e)
+		if err != nil && vetoableEvents[e.Type] {
+			return fmt.Errorf("%w: %s: %w", ErrVetoed, e.Type, err)
+		}
+	}
+
+	return nil
+}
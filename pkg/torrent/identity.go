@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const IDENTITIES_FILE_NAME = "identities.json"
+
+// Prefix of the generated peer IDs, in the Azureus style: client code and version between dashes
+const PEER_ID_PREFIX = "-MB0001-"
+
+// Name and version of the client, sent to the peers in the extension handshake
+const CLIENT_VERSION = "mybittorrent 0001"
+
+// torrentIdentity is how the client identifies itself to the trackers and peers of a torrent. It's kept across
+// restarts, so trackers can correlate the sessions of the torrent instead of resetting its statistics.
+type torrentIdentity struct {
+	PeerId string `json:"peerId"` // 20 bytes peer ID, hex encoded
+	Key    string `json:"key"`    // Sent to trackers as the key parameter, proving the announces come from the same client
+}
+
+// newPeerId generates a 20 bytes peer ID: PEER_ID_PREFIX followed by random characters, printable so trackers and
+// peers show it as is.
+func newPeerId() []byte {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	random := make([]byte, 20-len(PEER_ID_PREFIX))
+	rand.Read(random)
+	peerId := []byte(PEER_ID_PREFIX)
+	for _, b := range random {
+		peerId = append(peerId, alphabet[int(b)%len(alphabet)])
+	}
+
+	return peerId
+}
+
+// newTorrentIdentity generates a random peer ID and key.
+func newTorrentIdentity() (*torrentIdentity, error) {
+	key := make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &torrentIdentity{PeerId: toHex(newPeerId()), Key: toHex(key)}, nil
+}
+
+// apply makes the torrent use the identity in its announces and handshakes.
+func (id *torrentIdentity) apply(t *Torrent) error {
+	peerId, err := hex.DecodeString(id.PeerId)
+	if err != nil || len(peerId) != 20 {
+		return fmt.Errorf("invalid peer ID %q", id.PeerId)
+	}
+
+	t.peerId = peerId
+	t.key = id.Key
+
+	return nil
+}
+
+// identityStore keeps the identity of every torrent in a JSON file of the state directory.
+type identityStore struct {
+	path string
+
+	mu         sync.Mutex
+	identities map[string]*torrentIdentity // Keyed by hex info hash
+}
+
+// openIdentityStore loads the identities kept in stateDir. A missing file results in no identities.
+func openIdentityStore(stateDir string) (*identityStore, error) {
+	s := &identityStore{
+		path:       filepath.Join(stateDir, IDENTITIES_FILE_NAME),
+		identities: map[string]*torrentIdentity{},
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &s.identities); err != nil {
+			return nil, fmt.Errorf("corrupted identities file %s: %w", s.path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// get returns the identity of the torrent with the given hex info hash, generating and saving one the first time.
+func (s *identityStore) get(hash string) (*torrentIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.identities[hash]; ok {
+		return id, nil
+	}
+
+	return s.generateLocked(hash)
+}
+
+// regenerate replaces the identity of the torrent with the given hex info hash by a new one.
+func (s *identityStore) regenerate(hash string) (*torrentIdentity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.generateLocked(hash)
+}
+
+// generateLocked generates and saves the identity of a torrent. Must be called holding the store lock.
+func (s *identityStore) generateLocked(hash string) (*torrentIdentity, error) {
+	id, err := newTorrentIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	previous, existed := s.identities[hash]
+	s.identities[hash] = id
+	if err := s.saveLocked(); err != nil {
+		if existed {
+			s.identities[hash] = previous
+		} else {
+			delete(s.identities, hash)
+		}
+		return nil, err
+	}
+
+	return id, nil
+}
+
+// saveLocked writes the identities to the store file. Must be called holding the store lock.
+func (s *identityStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.identities, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0770); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// regenerateIdentity gives a new peer ID and key to the torrent with the given hex info hash. Running downloads keep
+// the previous identity until they are restarted.
+func (s *Session) regenerateIdentity(hash string) error {
+	s.mu.Lock()
+	_, ok := s.torrents[hash]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+	if s.identities == nil {
+		return errors.New("torrent identities are not persisted")
+	}
+
+	id, err := s.identities.regenerate(hash)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.torrents[hash]; ok {
+		return id.apply(&st.t)
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Suffix of the journal kept next to a file while it's written
+const JOURNAL_SUFFIX = ".journal"
+
+// Kinds of journal records: data about to be written to a range, and data of a range written and fsynced
+const JOURNAL_WRITE = "write"
+const JOURNAL_SYNC = "sync"
+
+// writeJournal is the write-ahead journal of a data file. A range is recorded before its data is written, and again
+// once the data is fsynced, so after a crash the ranges whose data may be torn are known.
+type writeJournal struct {
+	file *os.File
+}
+
+// journalRange is a range of bytes of a data file.
+type journalRange struct {
+	offset int
+	length int
+}
+
+// overlaps reports whether the ranges share at least a byte.
+func (r journalRange) overlaps(other journalRange) bool {
+	return r.offset < other.offset+other.length && other.offset < r.offset+r.length
+}
+
+// contains reports whether other is entirely inside r.
+func (r journalRange) contains(other journalRange) bool {
+	return r.offset <= other.offset && other.offset+other.length <= r.offset+r.length
+}
+
+// openWriteJournal opens the journal of the data file at dataPath, appending to the existing records.
+func openWriteJournal(dataPath string) (*writeJournal, error) {
+	file, err := os.OpenFile(dataPath+JOURNAL_SUFFIX, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writeJournal{file: file}, nil
+}
+
+// record appends a record for each range and fsyncs the journal, so it's on disk before the data it describes.
+func (j *writeJournal) record(kind string, ranges ...journalRange) error {
+	for _, r := range ranges {
+		if _, err := fmt.Fprintf(j.file, "%s %d %d\n", kind, r.offset, r.length); err != nil {
+			return err
+		}
+	}
+
+	return j.file.Sync()
+}
+
+// remove deletes the journal, once its data file is complete and fsynced.
+func (j *writeJournal) remove() error {
+	j.file.Close()
+
+	return os.Remove(j.file.Name())
+}
+
+// journaledData is the data of a download on disk written through its journal. The pieces a write touches are
+// recorded before it, and recorded as fsynced on sync. The journal is removed once the data is closed, every write
+// being fsynced then, so it's only left by a crash.
+type journaledData struct {
+	data        *dataFiles
+	journal     *writeJournal
+	pieceLength int
+
+	mu    sync.Mutex
+	dirty []journalRange // Pieces written since the last sync
+}
+
+// openJournaledData opens the data files at path of the torrent with info, creating them, and their journal.
+func openJournaledData(path string, layout []DataFile, pieceLength int) (*journaledData, error) {
+	data, err := openDataFiles(layout, true)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := openWriteJournal(path)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	return &journaledData{data: data, journal: journal, pieceLength: pieceLength}, nil
+}
+
+func (d *journaledData) ReadAt(p []byte, offset int64) (int, error) {
+	return d.data.ReadAt(p, offset)
+}
+
+// WriteAt records the pieces p is written to, unless they were since the last sync, then writes it.
+func (d *journaledData) WriteAt(p []byte, offset int64) (int, error) {
+	// Whole pieces are recorded, so the blocks of a piece take a single record
+	first := int(offset) / d.pieceLength * d.pieceLength
+	written := journalRange{offset: first, length: int(offset) + len(p) - first}
+	written.length = (written.length + d.pieceLength - 1) / d.pieceLength * d.pieceLength
+
+	d.mu.Lock()
+	recorded := slices.ContainsFunc(d.dirty, func(r journalRange) bool { return r.contains(written) })
+	if !recorded {
+		if err := d.journal.record(JOURNAL_WRITE, written); err != nil {
+			d.mu.Unlock()
+			return 0, err
+		}
+		d.dirty = append(d.dirty, written)
+	}
+	d.mu.Unlock()
+
+	return d.data.WriteAt(p, offset)
+}
+
+// Sync fsyncs the data, then records the pieces written since the last sync as fsynced.
+func (d *journaledData) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.data.Sync(); err != nil {
+		return err
+	}
+	if len(d.dirty) == 0 {
+		return nil
+	}
+	if err := d.journal.record(JOURNAL_SYNC, d.dirty...); err != nil {
+		return err
+	}
+	d.dirty = nil
+
+	return nil
+}
+
+// Close fsyncs the data and closes it, removing the journal.
+func (d *journaledData) Close() error {
+	if err := d.Sync(); err != nil {
+		d.journal.file.Close()
+		d.data.Close()
+		return err
+	}
+	if err := d.data.Close(); err != nil {
+		d.journal.file.Close()
+		return err
+	}
+
+	return d.journal.remove()
+}
+
+// readWriteJournal returns the ranges of the data file at dataPath recorded as fsynced, and the ones that may not have
+// been completely written. Returns false when the file has no journal. A torn last record is ignored, as its write
+// didn't start.
+func readWriteJournal(dataPath string) ([]journalRange, []journalRange, bool, error) {
+	content, err := os.ReadFile(dataPath + JOURNAL_SUFFIX)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var synced, uncertain []journalRange
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var kind string
+		var r journalRange
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %d %d", &kind, &r.offset, &r.length); err != nil {
+			break
+		}
+
+		switch kind {
+		case JOURNAL_WRITE:
+			// The data of the range is being replaced, what was synced there can't be trusted anymore
+			synced = removeRanges(synced, r.overlaps)
+			uncertain = append(uncertain, r)
+		case JOURNAL_SYNC:
+			uncertain = removeRanges(uncertain, r.contains)
+			synced = append(synced, r)
+		}
+	}
+
+	return synced, uncertain, true, nil
+}
+
+// removeRanges returns the ranges for which matches is false.
+func removeRanges(ranges []journalRange, matches func(journalRange) bool) []journalRange {
+	kept := ranges[:0]
+	for _, r := range ranges {
+		if !matches(r) {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept
+}
+
+// recoverJournal checks the data left at outputPath by a download interrupted while writing it. Pieces in ranges
+// the journal recorded as fsynced are trusted, and only the pieces of the uncertain ranges are hashed. Returns whether
+// every piece is on disk, in which case the journal is removed. Files without a journal are not checked.
+func (t Torrent) recoverJournal(outputPath string) (bool, error) {
+	if t.info.pieces == nil {
+		return false, nil
+	}
+
+	synced, uncertain, ok, err := readWriteJournal(outputPath)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	file, err := openDataFiles(t.info.dataLayout(outputPath), false)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	pieceRange := func(i int) journalRange {
+		return journalRange{offset: i * t.info.pieceLength, length: t.info.pieceLengthAt(i)}
+	}
+
+	var unchecked []int
+	for i := range t.info.pieces {
+		trusted := false
+		for _, r := range synced {
+			trusted = trusted || r.contains(pieceRange(i))
+		}
+		for _, r := range uncertain {
+			trusted = trusted && !r.overlaps(pieceRange(i))
+		}
+		if !trusted {
+			unchecked = append(unchecked, i)
+		}
+	}
+
+	valid, err := t.verifyPieces(unchecked, func(i int) ([]byte, error) {
+		piece := pieceRange(i)
+		data := make([]byte, piece.length)
+		if _, err := file.ReadAt(data, int64(piece.offset)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return data, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, ok := range valid {
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, os.Remove(outputPath + JOURNAL_SUFFIX)
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// TestRecoverJournal checks a download interrupted while writing its data is found complete when every piece made it
+// to the disk, and downloaded again otherwise.
+func TestRecoverJournal(t *testing.T) {
+	h, err := newHarness(5*32_768+1_000, 32_768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	tor, err := h.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		synced   bool // Whether the pieces are fsynced before the crash
+		torn     bool // Whether a piece is changed after it's written
+		complete bool
+	}{
+		{"synced", true, false, true},
+		{"written", false, false, true},
+		{"torn piece", false, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			outputPath := filepath.Join(t.TempDir(), "data.bin")
+			data, err := openJournaledData(outputPath, tor.info.dataLayout(outputPath), tor.info.pieceLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tor.info.nPieces; i++ {
+				begin := i * tor.info.pieceLength
+				if _, err := data.WriteAt(h.data[begin:begin+tor.info.pieceLengthAt(i)], int64(begin)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.synced {
+				if err := data.Sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.torn {
+				if _, err := data.WriteAt([]byte{h.data[40_000] + 1}, 40_000); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Crashing leaves the journal
+			data.data.Close()
+			data.journal.file.Close()
+
+			complete, err := tor.recoverJournal(outputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if complete != test.complete {
+				t.Fatalf("recovered as complete: %t, expected %t", complete, test.complete)
+			}
+			_, err = os.Stat(outputPath + JOURNAL_SUFFIX)
+			if removed := errors.Is(err, fs.ErrNotExist); removed != test.complete {
+				t.Fatalf("journal removed: %t, expected %t", removed, test.complete)
+			}
+		})
+	}
+}
+
+// countingStorage is a storage counting the writes to the data it opens on the disk.
+type countingStorage struct {
+	diskStorage
+	writes atomic.Int32
+}
+
+// countingData is data opened by a countingStorage.
+type countingData struct {
+	DataStore
+	s *countingStorage
+}
+
+func (s *countingStorage) OpenData(path string, layout []DataFile, pieceLength int) (DataStore, error) {
+	data, err := s.diskStorage.OpenData(path, layout, pieceLength)
+	return countingData{DataStore: data, s: s}, err
+}
+
+func (d countingData) WriteAt(p []byte, offset int64) (int, error) {
+	d.s.writes.Add(1)
+	return d.DataStore.WriteAt(p, offset)
+}
+
+// TestStorageOption checks a download writes its data through the storage of its client, and leaves no journal once
+// complete.
+func TestStorageOption(t *testing.T) {
+	h, err := newHarness(5*32_768+1_000, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	storage := &countingStorage{}
+	tor, err := h.torrent(WithStorage(storage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "data.bin")
+	ctx, cancel := context.WithTimeout(context.Background(), HARNESS_SCENARIO_TIMEOUT)
+	defer cancel()
+	if err := tor.DownloadFile(ctx, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if writes := storage.writes.Load(); writes < int32(tor.info.nPieces) {
+		t.Fatalf("%d writes through the storage for %d pieces", writes, tor.info.nPieces)
+	}
+	if _, err := os.Stat(outputPath + JOURNAL_SUFFIX); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("journal left after the download: %v", err)
+	}
+}
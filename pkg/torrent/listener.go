@@ -0,0 +1,251 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Time an inbound peer has to complete the handshakes
+const PEER_ACCEPT_TIMEOUT = 10 * time.Second
+
+// PeerListener accepts the connections of peers on the port announced to the trackers. Peers asking for a torrent
+// being downloaded are handed to its download once the handshake is done, the others are disconnected.
+type PeerListener struct {
+	listener net.Listener
+
+	mu         sync.Mutex
+	encryption EncryptionPolicy           // Whether inbound peers may, or must, use Message Stream Encryption
+	downloads  map[string]inboundDownload // Keyed by info hash
+}
+
+// inboundDownload is a download accepting inbound peers.
+type inboundDownload struct {
+	t     Torrent
+	peers chan<- *workingPeer // Receives the peers that completed the handshake
+	done  <-chan struct{}     // Closed when the download stops accepting peers
+}
+
+// ListenPeers listens for peers on the TCP port of the local address ip. All the addresses, IPv4 and IPv6, are
+// listened on when ip is nil or unspecified, 0.0.0.0 included.
+func ListenPeers(ip net.IP, port int, policy EncryptionPolicy) (*PeerListener, error) {
+	host := ""
+	if ip != nil && !ip.IsUnspecified() {
+		host = ip.String()
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	return newPeerListener(listener, policy), nil
+}
+
+// newPeerListener accepts the peers connecting to listener, until it's closed.
+func newPeerListener(listener net.Listener, policy EncryptionPolicy) *PeerListener {
+	l := &PeerListener{
+		listener:   listener,
+		encryption: policy,
+		downloads:  map[string]inboundDownload{},
+	}
+	go l.serve()
+
+	return l
+}
+
+// WithListener sets the listener handing inbound peers to the downloads. It accepts the peers with the encryption
+// policy of the client.
+func WithListener(l *PeerListener) Option {
+	return func(c *Client) {
+		c.listener = l
+	}
+}
+
+// setEncryption sets whether the peers accepted from now on may, or must, use Message Stream Encryption.
+func (l *PeerListener) setEncryption(policy EncryptionPolicy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.encryption = policy
+}
+
+// EncryptionPolicy returns whether inbound peers may, or must, use Message Stream Encryption.
+func (l *PeerListener) encryptionPolicy() EncryptionPolicy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.encryption
+}
+
+// Close stops accepting peers. Peers already handed to downloads stay connected.
+func (l *PeerListener) Close() error {
+	return l.listener.Close()
+}
+
+// register hands the peers asking for the torrent t to peers, until done is closed or the returned function is
+// called.
+func (l *PeerListener) register(t Torrent, peers chan<- *workingPeer, done <-chan struct{}) func() {
+	key := string(t.infoHash)
+
+	l.mu.Lock()
+	l.downloads[key] = inboundDownload{t: t, peers: peers, done: done}
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if l.downloads[key].peers == peers {
+			delete(l.downloads, key)
+		}
+	}
+}
+
+// lookup returns the download of the torrent with the given info hash.
+func (l *PeerListener) lookup(infoHash []byte) (inboundDownload, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	d, ok := l.downloads[string(infoHash)]
+
+	return d, ok
+}
+
+// infoHashes returns the info hashes of the downloads accepting peers.
+func (l *PeerListener) infoHashes() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hashes := make([][]byte, 0, len(l.downloads))
+	for _, d := range l.downloads {
+		hashes = append(hashes, d.t.infoHash)
+	}
+
+	return hashes
+}
+
+// serve accepts connections until the listener is closed.
+func (l *PeerListener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go l.accept(conn)
+	}
+}
+
+// accept runs the handshakes of an inbound connection and hands the peer to the download of its torrent. The
+// connection is closed when the handshakes fail, the peer is banned, or no download takes it.
+func (l *PeerListener) accept(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_ACCEPT_TIMEOUT)
+	defer cancel()
+
+	address := conn.RemoteAddr().String()
+	pc := &peerConnection{
+		peerAddress: address,
+		connection:  conn,
+	}
+
+	d, err := l.handshake(ctx, pc)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	c := d.t.getClient()
+	if c.deadPeers.isBanned(address) {
+		c.log.Debug(fmt.Sprintf("Refused banned peer %s", address), "peer", address)
+		conn.Close()
+		return
+	}
+	c.log.Info(fmt.Sprintf("Peer %s connected to us", address), "peer", address)
+	if err := d.t.publish(Event{Type: EVENT_PEER_CONNECTED, Peer: address}); err != nil {
+		conn.Close()
+		return
+	}
+
+	peer := &workingPeer{address: address, conn: pc, closer: func() { conn.Close() }}
+	select {
+	case d.peers <- peer:
+	case <-d.done:
+		conn.Close()
+	}
+}
+
+// handshake answers the handshake of an inbound peer, after the encryption handshake when the peer starts one.
+// Returns the download of the torrent the peer asked for. The connection takes the rate limits and wire dump of its
+// client, and the extension handshake, advertising peer exchange unless the torrent is private, is sent when the peer
+// supports extensions.
+func (l *PeerListener) handshake(ctx context.Context, pc *peerConnection) (inboundDownload, error) {
+	// Plaintext handshakes start with the protocol string, encryption handshakes with a public key. The bytes read to
+	// tell them apart are read again by the handshakes
+	prefix, err := pc.receiveBytes(ctx, 1+len(peer.PROTOCOL_STRING))
+	if err != nil {
+		return inboundDownload{}, err
+	}
+	pc.connection = &encryptedConn{Conn: pc.connection, pending: prefix}
+
+	var encryptedHash []byte
+	policy := l.encryptionPolicy()
+	plaintext := prefix[0] == byte(len(peer.PROTOCOL_STRING)) && string(prefix[1:]) == peer.PROTOCOL_STRING
+	switch {
+	case plaintext && policy == ENCRYPTION_REQUIRE:
+		return inboundDownload{}, fmt.Errorf("%w: plaintext peer %s", ErrEncryptionFailed, pc.peerAddress)
+	case !plaintext && policy == ENCRYPTION_DISABLE:
+		return inboundDownload{}, fmt.Errorf("%w: not a BitTorrent handshake", peer.ErrInvalidMessage)
+	case !plaintext:
+		encryptedHash, err = pc.acceptEncryption(ctx, l.infoHashes(), policy)
+		if err != nil {
+			return inboundDownload{}, err
+		}
+	}
+
+	message, err := pc.receiveBytes(ctx, peer.HANDSHAKE_MESSAGE_LENGTH)
+	if err != nil {
+		return inboundDownload{}, err
+	}
+	if encryptedHash != nil && !bytes.Equal(message[28:48], encryptedHash) {
+		return inboundDownload{}, fmt.Errorf("%w: handshake for another torrent", peer.ErrInvalidMessage)
+	}
+	d, ok := l.lookup(message[28:48])
+	if !ok {
+		return inboundDownload{}, fmt.Errorf("%w: handshake for an unknown torrent", peer.ErrInvalidMessage)
+	}
+	res, err := peer.ParseHandshake(message, d.t.infoHash)
+	if err != nil {
+		return inboundDownload{}, err
+	}
+
+	c := d.t.getClient()
+	pc.downloadLimiter, pc.uploadLimiter = c.peerLimiters()
+	pc.dump = c.wireDump
+	pc.timeout, pc.clock = c.peerTimeout, c.clock
+	pc.dump.record(pc.peerAddress, WIRE_RECEIVED, "handshake", nil, len(message), message, nil)
+
+	reply := peer.BuildHandshakeMessage(d.t.localPeerId(), d.t.infoHash, true)
+	if _, err := pc.sendBytes(ctx, reply); err != nil {
+		return inboundDownload{}, err
+	}
+	pc.dump.record(pc.peerAddress, WIRE_SENT, "handshake", nil, len(reply), reply, nil)
+
+	if res.SupportsExtensions() {
+		extensionHandshake, err := c.buildExtensionHandshakeMessage(pc, d.t.downloadExtensions())
+		if err != nil {
+			return inboundDownload{}, err
+		}
+		if _, err := pc.sendMessage(ctx, extensionHandshake); err != nil {
+			return inboundDownload{}, err
+		}
+	}
+
+	return d, nil
+}
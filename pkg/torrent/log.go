@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logWriter writes to the logger of its client, the standard error when it has none.
+type logWriter struct {
+	c *Client
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	if w.c.logger != nil {
+		return w.c.logger.Write(p)
+	}
+
+	return os.Stderr.Write(p)
+}
+
+// plainHandler writes the message of every record on its own line, as the commands always printed them. The debug
+// records are followed by their attributes, the messages of the others already tell them. Records below level are
+// dropped.
+type plainHandler struct {
+	w     io.Writer
+	level slog.Leveler
+}
+
+func (h plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h plainHandler) Handle(_ context.Context, r slog.Record) error {
+	line := r.Message
+	if r.Level < slog.LevelInfo {
+		r.Attrs(func(a slog.Attr) bool {
+			line += " " + a.String()
+			return true
+		})
+	}
+
+	_, err := fmt.Fprintln(h.w, line)
+	return err
+}
+
+func (h plainHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h plainHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// newClientLogger returns the logger of c, writing plain lines or JSON lines with the level and attributes of every
+// record, as configured.
+func newClientLogger(c *Client) *slog.Logger {
+	w := logWriter{c: c}
+	if c.jsonLogs {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: c.logLevel}))
+	}
+
+	return slog.New(plainHandler{w: w, level: c.logLevel})
+}
+
+// WithLogLevel sets the lowest level of the logged records: slog.LevelDebug adds the details of the exchanges with
+// trackers and peers, slog.LevelWarn only keeps the failures.
+func WithLogLevel(level slog.Level) Option {
+	return func(c *Client) {
+		c.logLevel = level
+	}
+}
+
+// WithJSONLogs logs JSON lines instead of plain lines, with the level, time and attributes of every record, like the
+// address of the peer and the index of the piece.
+func WithJSONLogs(json bool) Option {
+	return func(c *Client) {
+		c.jsonLogs = json
+	}
+}
+
+// logPiece logs a record about a single piece, at the debug level when the progress of the downloads is reported
+// otherwise.
+func (c *Client) logPiece(msg string, args ...any) {
+	if c.onProgress == nil {
+		c.log.Info(msg, args...)
+	} else {
+		c.log.Debug(msg, args...)
+	}
+}
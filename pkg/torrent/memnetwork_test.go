@@ -0,0 +1,229 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// memNetwork is an in-memory network of peers. Listeners are registered by address, and dialing an address connects
+// to its listener through a synchronous pipe, without opening sockets.
+type memNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{listeners: map[string]*memListener{}}
+}
+
+// listen registers a listener accepting the connections to address.
+func (n *memNetwork) listen(address string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.listeners[address]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+
+	l := &memListener{
+		network: n,
+		address: memAddr(address),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[address] = l
+
+	return l, nil
+}
+
+// DialPeer connects to the listener at address, waiting for it to accept the connection.
+func (n *memNetwork) DialPeer(ctx context.Context, address string) (net.Conn, error) {
+	n.mu.Lock()
+	l, ok := n.listeners[address]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+
+	// Both ends buffer their writes like sockets, so peers can send while the other side is sending too
+	client, server := net.Pipe()
+	clientEnd, serverEnd := newMemConn(client), newMemConn(server)
+	serverEnd.peer = clientEnd
+	select {
+	case l.conns <- serverEnd:
+		return clientEnd, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// memListener accepts the connections dialed to its address in a memNetwork.
+type memListener struct {
+	network *memNetwork
+	address memAddr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.address))
+		l.network.mu.Unlock()
+	})
+
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.address
+}
+
+// memConn buffers the writes to an end of a memNetwork pipe. Writes are queued and return at once, as sockets buffer
+// the data sent, for handshakes where both peers send before reading, like Message Stream Encryption, and for
+// pipelined requests sent while the peer is sending pieces.
+type memConn struct {
+	net.Conn
+	peer    *memConn // End of the dialer, for the end accepted by a listener
+	mu      sync.Mutex
+	queue   [][]byte
+	err     error         // Error of the last queued write
+	pending chan struct{} // Signals data was queued
+	closing chan struct{} // Closed when the connection is closed, after the queue is sent
+	once    sync.Once
+
+	readMu  sync.Mutex
+	read    *sync.Cond // Signaled when a read starts
+	reading bool       // Whether a read is in progress
+}
+
+func newMemConn(conn net.Conn) *memConn {
+	c := &memConn{Conn: conn, pending: make(chan struct{}, 1), closing: make(chan struct{})}
+	c.read = sync.NewCond(&c.readMu)
+	go c.flush()
+
+	return c
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	c.reading = true
+	c.read.Broadcast()
+	c.readMu.Unlock()
+
+	defer func() {
+		c.readMu.Lock()
+		c.reading = false
+		c.readMu.Unlock()
+	}()
+
+	return c.Conn.Read(b)
+}
+
+// waitReading blocks until a read of the connection is in progress, meaning its owner waits for the other end to
+// send. Returns false if that doesn't happen before the real time timeout.
+func (c *memConn) waitReading(timeout time.Duration) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		c.readMu.Lock()
+		expired = true
+		c.read.Broadcast()
+		c.readMu.Unlock()
+	})
+	defer timer.Stop()
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for !c.reading && !expired {
+		c.read.Wait()
+	}
+
+	return c.reading
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.queue = append(c.queue, append([]byte{}, b...))
+
+	select {
+	case c.pending <- struct{}{}:
+	default:
+	}
+
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.closing)
+	})
+
+	return nil
+}
+
+// flush writes the queued data to the pipe, and closes it once the connection is closed and the queue is empty.
+func (c *memConn) flush() {
+	defer c.Conn.Close()
+
+	for {
+		c.mu.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.mu.Unlock()
+
+		for _, b := range queue {
+			if _, err := c.Conn.Write(b); err != nil {
+				c.mu.Lock()
+				c.err = err
+				c.mu.Unlock()
+				return
+			}
+		}
+
+		select {
+		case <-c.pending:
+		case <-c.closing:
+			c.mu.Lock()
+			empty := len(c.queue) == 0
+			c.mu.Unlock()
+			if empty {
+				return
+			}
+		}
+	}
+}
+
+// memAddr is the address of a listener in a memNetwork.
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,443 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// A keep-alive is sent to peers after this long without sending them anything, so they don't drop the connection
+const KEEP_ALIVE_INTERVAL = 100 * time.Second
+
+// Connections with peers that sent nothing for this long are dropped
+const PEER_IDLE_TIMEOUT = 2 * time.Minute
+
+// Downloads wait this long for a peer that chokes us to unchoke us again, before giving up on it
+const CHOKED_TIMEOUT = time.Minute
+
+// peerConnection represents the TCP connection with a peer.
+type peerConnection struct {
+	peerAddress     string
+	connection      net.Conn
+	downloadLimiter *rateLimiter            // Limits the bytes read, unlimited when nil
+	uploadLimiter   *rateLimiter            // Limits the bytes written, unlimited when nil
+	dump            *WireDump               // Records the messages exchanged, none when nil
+	available       peer.Bitfield           // Pieces the peer advertised through its bitfield and have messages
+	handshake       peer.ExtensionHandshake // Extension handshake of the peer: its extensions, version and request queue
+	onPeers         func([]string)          // Receives the peers learned through peer exchange, ignored when nil
+	onHave          func(int)               // Receives the index of the pieces the peer announces through have messages, ignored when nil
+	upload          *uploadPeer             // Serves the requests of the peer, which are ignored when nil
+	metrics         *peerMetrics            // Counts the transfers with the peer, none when nil
+	timeout         time.Duration           // Time the peer has to send the rest of a message or take a write, none when 0
+	clock           clock                   // Times the timeout, the real clock when nil
+	unchoked        bool                    // Whether the peer accepts our requests, false until it unchokes us
+	cancelled       map[[2]int]int          // Lengths of the blocks requested then cancelled, keyed by piece index and offset
+	lastSent        time.Time               // When bytes were last written, to send keep-alives
+	lastReceived    time.Time               // When bytes were last read, to drop silent peers
+}
+
+// newPeerConnection establishes a connection with the given peerAddress using dialer. Returns the connection and the
+// closer function to terminate the coneection.
+func newPeerConnection(ctx context.Context, dialer PeerDialer, peerAddress string) (*peerConnection, func(), error) {
+	peerAddress = peer.NormalizeAddress(peerAddress)
+
+	// Open connection using peer address
+	conn, err := dialer.DialPeer(ctx, peerAddress)
+	closer := func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	if err != nil {
+		return nil, closer, err
+	}
+
+	return &peerConnection{
+		peerAddress: peerAddress,
+		connection:  conn,
+	}, closer, nil
+}
+
+// withContext runs op, which reads or writes the connection, applying the deadline of ctx to the connection and
+// interrupting op when ctx is done. Returns the cause of the end of ctx if it ended before op.
+func (pc *peerConnection) withContext(ctx context.Context, op func() error) error {
+	// A zero deadline, when ctx has none, clears the one set by a previous operation
+	deadline, _ := ctx.Deadline()
+	pc.connection.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		pc.connection.SetDeadline(time.Now())
+	})
+
+	err := op()
+	if !stop() {
+		return context.Cause(ctx)
+	}
+
+	return err
+}
+
+// receiveBytes reads the specified number of bytes from the peer connection and returns the slice of bytes read.
+// While waiting, a keep-alive is sent every KEEP_ALIVE_INTERVAL without other messages sent, the choking decisions of
+// the uploader are sent when the peer is served, and the read fails once the peer is silent for PEER_IDLE_TIMEOUT.
+func (pc *peerConnection) receiveBytes(ctx context.Context, size int) ([]byte, error) {
+	return pc.receiveBytesWithin(ctx, size, 0)
+}
+
+// receiveBytesWithin reads like receiveBytes, failing with errPeerTimeout when the bytes take longer than timeout to
+// arrive once the rate limit allows them. No timeout applies when it's 0.
+func (pc *peerConnection) receiveBytesWithin(ctx context.Context, size int, timeout time.Duration) ([]byte, error) {
+	if err := pc.downloadLimiter.wait(ctx, size); err != nil {
+		return nil, err
+	}
+	readCtx, cancel := peerTimeoutContext(ctx, pc.clock, timeout)
+	defer cancel()
+	buf, err := pc.readBytes(readCtx, size)
+
+	return buf, peerTimeoutError(ctx, err, timeout)
+}
+
+// readBytes reads size bytes, sending keep-alives and failing on idle peers like receiveBytes, without rate limit.
+func (pc *peerConnection) readBytes(ctx context.Context, size int) ([]byte, error) {
+	buf := make([]byte, size)
+
+	// Idle times count from the first read
+	now := time.Now()
+	if pc.lastReceived.IsZero() {
+		pc.lastReceived = now
+	}
+	if pc.lastSent.IsZero() {
+		pc.lastSent = now
+	}
+
+	read := 0
+	for read < size {
+		now := time.Now()
+		if now.Sub(pc.lastReceived) >= PEER_IDLE_TIMEOUT {
+			return nil, fmt.Errorf("%w: nothing received for %s", ErrPeerIdle, now.Sub(pc.lastReceived).Round(time.Second))
+		}
+		if now.Sub(pc.lastSent) >= KEEP_ALIVE_INTERVAL {
+			if err := pc.sendKeepAlive(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if pc.upload != nil {
+			if err := pc.upload.sync(ctx, pc); err != nil {
+				return nil, err
+			}
+		}
+
+		// The read is interrupted when the next keep-alive is due or the peer becomes idle, and resumed where it stopped
+		deadline := pc.lastSent.Add(KEEP_ALIVE_INTERVAL)
+		if idle := pc.lastReceived.Add(PEER_IDLE_TIMEOUT); idle.Before(deadline) {
+			deadline = idle
+		}
+		if ctxDeadline, ok := ctx.Deadline(); ok {
+			if !now.Before(ctxDeadline) {
+				return nil, context.DeadlineExceeded
+			}
+			if ctxDeadline.Before(deadline) {
+				deadline = ctxDeadline
+			}
+		}
+
+		err := pc.withContext(ctx, func() error {
+			pc.connection.SetReadDeadline(deadline)
+			// ctx may have ended before the read deadline was set, when interrupting the read has no effect
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			// Likewise for a choking decision, the read is interrupted to send it
+			if pc.upload != nil && pc.upload.due() {
+				return os.ErrDeadlineExceeded
+			}
+
+			n, err := io.ReadFull(pc.connection, buf[read:])
+			if n > 0 {
+				read += n
+				pc.lastReceived = time.Now()
+			}
+			return err
+		})
+		if err != nil && (!errors.Is(err, os.ErrDeadlineExceeded) || ctx.Err() != nil) {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// sendKeepAlive sends a keep-alive message, a zero length without type nor payload.
+func (pc *peerConnection) sendKeepAlive(ctx context.Context) error {
+	if _, err := pc.sendBytes(ctx, make([]byte, 4)); err != nil {
+		return err
+	}
+	pc.dump.record(pc.peerAddress, WIRE_SENT, "keep-alive", nil, 0, nil, nil)
+
+	return nil
+}
+
+// receivePeerMessage reads from the peer connection and builds a new peer.Message. Keep-alive messages are skipped, and
+// so are the messages about our uploads when the peer is served, which are handled first.
+func (pc *peerConnection) receivePeerMessage(ctx context.Context) (*peer.Message, error) {
+	for {
+		// Read only 4 bytes to figure out message length
+		buf, err := pc.receiveBytes(ctx, 4)
+		if err != nil {
+			return nil, err
+		}
+
+		msgLength := binary.BigEndian.Uint32(buf)
+		if msgLength == 0 {
+			// Keep-alive, without type nor payload
+			pc.dump.record(pc.peerAddress, WIRE_RECEIVED, "keep-alive", nil, 0, nil, nil)
+			continue
+		}
+		if msgLength > peer.MAX_MESSAGE_LENGTH {
+			err := fmt.Errorf("%w: length %d exceeds the maximum of %d", peer.ErrInvalidMessage, msgLength, peer.MAX_MESSAGE_LENGTH)
+			pc.dump.record(pc.peerAddress, WIRE_RECEIVED, "unknown", nil, int(msgLength), nil, err)
+			return nil, err
+		}
+
+		// Build the message buffer, using the known length. Once its length is received, the peer has the timeout of
+		// the connection to send the rest
+		msgBuf, err := pc.receiveBytesWithin(ctx, int(msgLength), pc.timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := peer.ParseMessage(msgBuf)
+		if err != nil {
+			pc.dump.record(pc.peerAddress, WIRE_RECEIVED, "unknown", nil, int(msgLength), msgBuf, err)
+			return nil, err
+		}
+		pc.dump.recordMessage(pc.peerAddress, WIRE_RECEIVED, message)
+
+		if pc.upload != nil {
+			handled, err := pc.upload.handle(ctx, pc, message)
+			if err != nil {
+				return nil, err
+			}
+			if handled {
+				continue
+			}
+		}
+
+		return message, nil
+	}
+}
+
+// sendBytes writes bytes into the peer connection. The write fails with errPeerTimeout when it takes longer than the
+// timeout of the connection, once the rate limit allows it.
+func (pc *peerConnection) sendBytes(ctx context.Context, message []byte) (int, error) {
+	if err := pc.uploadLimiter.wait(ctx, len(message)); err != nil {
+		return 0, err
+	}
+
+	writeCtx, cancel := peerTimeoutContext(ctx, pc.clock, pc.timeout)
+	defer cancel()
+	var n int
+	err := pc.withContext(writeCtx, func() error {
+		var err error
+		n, err = pc.connection.Write(message)
+		return err
+	})
+	if n > 0 {
+		pc.lastSent = time.Now()
+	}
+
+	return n, peerTimeoutError(ctx, err, pc.timeout)
+}
+
+// now returns the time on the clock of the connection.
+func (pc *peerConnection) now() time.Time {
+	if pc.clock == nil {
+		return realClock.now()
+	}
+
+	return pc.clock.now()
+}
+
+// peerTimeoutContext returns ctx bounded by timeout on clock, unless it's 0.
+func peerTimeoutContext(ctx context.Context, clock clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+
+	return clockTimeout(ctx, clock, timeout)
+}
+
+// peerTimeoutError returns errPeerTimeout for err when it's the expiry of timeout, rather than of ctx, the context of
+// the operation before the timeout applied.
+func peerTimeoutError(ctx context.Context, err error, timeout time.Duration) error {
+	if err != nil && timeout > 0 && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: nothing for %s", ErrPeerTimeout, timeout)
+	}
+
+	return err
+}
+
+// sendMessage writes a message into the peer connection.
+func (pc *peerConnection) sendMessage(ctx context.Context, message peer.Message) (int, error) {
+	n, err := pc.sendBytes(ctx, message.Bytes())
+	if err == nil {
+		pc.dump.recordMessage(pc.peerAddress, WIRE_SENT, &message)
+	}
+
+	return n, err
+}
+
+// recordHave marks the piece announced by a have message of the peer as available, in a torrent with nPieces pieces.
+func (pc *peerConnection) recordHave(message *peer.Message, nPieces int) error {
+	have, err := peer.ParseHave(message)
+	if err != nil {
+		return err
+	}
+	index := have.Index
+	if index >= nPieces {
+		return fmt.Errorf("%w: have message for piece %d of %d", peer.ErrInvalidMessage, index, nPieces)
+	}
+
+	if len(pc.available) != (nPieces+7)/8 {
+		pc.available = make(peer.Bitfield, (nPieces+7)/8)
+	}
+	if pc.available.Has(index) {
+		return nil
+	}
+	pc.available.Set(index)
+	if pc.onHave != nil {
+		pc.onHave(index)
+	}
+
+	return nil
+}
+
+// recordBitfield marks the pieces of a bitfield message of the peer as available, in a torrent with nPieces pieces.
+// A bitfield comes first, though one received later adds its pieces to the ones announced by have messages.
+func (pc *peerConnection) recordBitfield(message *peer.Message, nPieces int) error {
+	pieces, err := peer.ParseBitfield(message.Payload, nPieces)
+	if err != nil {
+		return err
+	}
+
+	if len(pc.available) != (nPieces+7)/8 {
+		pc.available = make(peer.Bitfield, (nPieces+7)/8)
+	}
+	for index := 0; index < nPieces; index++ {
+		if !pieces.Has(index) || pc.available.Has(index) {
+			continue
+		}
+		pc.available.Set(index)
+		if pc.onHave != nil {
+			pc.onHave(index)
+		}
+	}
+
+	return nil
+}
+
+// receiveMessage receives the next message of one of the wanted types, from a peer of a torrent with nPieces pieces.
+// The messages of other types are dispatched as they arrive: have and bitfield messages update the pieces of the
+// peer, extension messages its extensions and peer exchange, choke and unchoke messages whether it accepts our
+// requests. Messages about our uploads to a peer that isn't served, and the ones of unknown types, are ignored.
+func (pc *peerConnection) receiveMessage(ctx context.Context, nPieces int, wanted ...uint8) (*peer.Message, error) {
+	for {
+		message, err := pc.receivePeerMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(wanted, message.Type) {
+			return message, nil
+		}
+
+		switch message.Type {
+		case peer.HAVE:
+			err = pc.recordHave(message, nPieces)
+		case peer.BITFIELD:
+			err = pc.recordBitfield(message, nPieces)
+		case peer.EXTENSION_MESSAGE:
+			err = pc.handleExtensionMessage(message)
+		case peer.CHOKE:
+			pc.unchoked = false
+		case peer.UNCHOKE:
+			pc.unchoked = true
+		case peer.REQUEST, peer.CANCEL:
+			_, err = peer.ParseBlockRequest(message)
+		case peer.PORT:
+			_, err = peer.ParsePort(message)
+		case peer.PIECE:
+			// Blocks of requests given up on, by a previous piece download
+			_, err = peer.ParsePiece(message)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// cancelRequest cancels the request of a block, and records it so the block is ignored if the peer already sent it.
+func (pc *peerConnection) cancelRequest(ctx context.Context, pieceIndex, begin, blockLength int) error {
+	if _, err := pc.sendMessage(ctx, peer.BuildCancelMessage(pieceIndex, begin, blockLength)); err != nil {
+		return err
+	}
+
+	if pc.cancelled == nil {
+		pc.cancelled = map[[2]int]int{}
+	}
+	pc.cancelled[[2]int{pieceIndex, begin}] = blockLength
+
+	return nil
+}
+
+// wasCancelled returns whether the block of a piece message is one whose request was cancelled, forgetting the cancel
+// as the block can only arrive once.
+func (pc *peerConnection) wasCancelled(piece peer.Piece) bool {
+	key := [2]int{piece.Index, piece.Begin}
+	blockLength, ok := pc.cancelled[key]
+	if !ok || len(piece.Block) != blockLength {
+		return false
+	}
+	delete(pc.cancelled, key)
+
+	return true
+}
+
+// ID the peers use to send us ut_metadata messages, assigned in our extension handshake
+const METADATA_EXTENSION_ID = 123
+
+// Block requests a peer may keep outstanding, advertised in our extension handshake. They are served as they arrive
+const REQUEST_QUEUE_LENGTH = 250
+
+// requestDepth returns the block requests to keep outstanding with the peer: depth, at most the reqq the peer
+// advertised in its extension handshake, and at least one.
+func (pc *peerConnection) requestDepth(depth int) int {
+	if pc.handshake.Requests > 0 {
+		depth = min(depth, pc.handshake.Requests)
+	}
+
+	return max(depth, 1)
+}
+
+// buildExtensionHandshakeMessage returns the extension handshake sent to the peer of pc, advertising the given
+// extensions along the version of the client, the port it listens on when it accepts peers, the requests it takes
+// outstanding and the address of the peer as we see it.
+func (c *Client) buildExtensionHandshakeMessage(pc *peerConnection, extensions map[string]int) (peer.Message, error) {
+	h := peer.ExtensionHandshake{Extensions: extensions, Version: CLIENT_VERSION, Requests: REQUEST_QUEUE_LENGTH}
+	if c.listener != nil {
+		h.Port = c.port
+	}
+	if host, _, err := net.SplitHostPort(pc.peerAddress); err == nil {
+		h.YourIP = net.ParseIP(host)
+	}
+
+	return h.Serialize()
+}
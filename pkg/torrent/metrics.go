@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the transfer statistics of the peers are logged with --stats
+const METRICS_REPORT_INTERVAL = 10 * time.Second
+
+// peerMetrics counts the transfers with a peer of a download, or a web seed. A nil metrics ignores the updates, as
+// the connections outside of a download have nothing to count.
+type peerMetrics struct {
+	downloaded  atomic.Int64 // Bytes of the blocks received from the peer
+	uploaded    atomic.Int64 // Bytes of the blocks sent to the peer
+	pieces      atomic.Int64 // Verified pieces the peer delivered
+	served      atomic.Int64 // Blocks sent to the peer
+	outstanding atomic.Int64 // Blocks requested from the peer and not received yet
+	client      atomic.Value // Name and version of the client of the peer, from its extension handshake
+}
+
+// received counts a block of n bytes received from the peer.
+func (m *peerMetrics) received(n int) {
+	if m != nil {
+		m.downloaded.Add(int64(n))
+	}
+}
+
+// sent counts a block of n bytes sent to the peer.
+func (m *peerMetrics) sent(n int) {
+	if m != nil {
+		m.uploaded.Add(int64(n))
+		m.served.Add(1)
+	}
+}
+
+// delivered counts a verified piece the peer delivered.
+func (m *peerMetrics) delivered() {
+	if m != nil {
+		m.pieces.Add(1)
+	}
+}
+
+// requesting records the blocks requested from the peer and not received yet.
+func (m *peerMetrics) requesting(n int) {
+	if m != nil {
+		m.outstanding.Store(int64(n))
+	}
+}
+
+// identify records the name and version of the client of the peer.
+func (m *peerMetrics) identify(client string) {
+	if m != nil {
+		m.client.Store(client)
+	}
+}
+
+// downloadedBytes returns the bytes of the blocks received from the peer.
+func (m *peerMetrics) downloadedBytes() int64 {
+	if m == nil {
+		return 0
+	}
+
+	return m.downloaded.Load()
+}
+
+// peerStats is a snapshot of the metrics of a peer, with its transfer rates since the previous report.
+type peerStats struct {
+	address      string
+	client       string // Empty when the peer didn't tell
+	downloaded   int64
+	uploaded     int64
+	pieces       int64
+	served       int64
+	outstanding  int64
+	downloadRate float64 // Bytes per second
+	uploadRate   float64 // Bytes per second
+}
+
+// metricsRegistry holds the metrics of the peers connected to a download. The uploader reads them to choke the peers,
+// and they are logged every METRICS_REPORT_INTERVAL with --stats.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	peers      map[string]*peerMetrics // Keyed by address
+	reported   map[string]peerStats    // Metrics of the previous report, the rates are computed from, keyed by address
+	reportedAt time.Time
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		peers:      map[string]*peerMetrics{},
+		reported:   map[string]peerStats{},
+		reportedAt: time.Now(),
+	}
+}
+
+// WithStatsReport makes the downloads log the transfer statistics of their peers every METRICS_REPORT_INTERVAL.
+func WithStatsReport() Option {
+	return func(c *Client) {
+		c.statsReport = true
+	}
+}
+
+// peer returns the metrics of the peer at address, created when it joins the download. Returns nil on a nil registry.
+func (r *metricsRegistry) peer(address string) *peerMetrics {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.peers[address]
+	if !ok {
+		m = &peerMetrics{}
+		r.peers[address] = m
+	}
+
+	return m
+}
+
+// remove forgets the metrics of the peer at address, which left the download.
+func (r *metricsRegistry) remove(address string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.peers, address)
+	delete(r.reported, address)
+}
+
+// snapshot returns the metrics of the peers sorted by address, with their rates since the previous snapshot taken at
+// its start, the first one counting from the creation of the registry.
+func (r *metricsRegistry) snapshot(now time.Time) []peerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := now.Sub(r.reportedAt).Seconds()
+	r.reportedAt = now
+
+	stats := make([]peerStats, 0, len(r.peers))
+	reported := make(map[string]peerStats, len(r.peers))
+	for address, m := range r.peers {
+		s := peerStats{
+			address:     address,
+			downloaded:  m.downloaded.Load(),
+			uploaded:    m.uploaded.Load(),
+			pieces:      m.pieces.Load(),
+			served:      m.served.Load(),
+			outstanding: m.outstanding.Load(),
+		}
+		s.client, _ = m.client.Load().(string)
+		if elapsed > 0 {
+			previous := r.reported[address]
+			s.downloadRate = float64(s.downloaded-previous.downloaded) / elapsed
+			s.uploadRate = float64(s.uploaded-previous.uploaded) / elapsed
+		}
+		stats = append(stats, s)
+		reported[address] = s
+	}
+	r.reported = reported
+	sort.Slice(stats, func(i, j int) bool { return stats[i].address < stats[j].address })
+
+	return stats
+}
+
+// report logs a line per peer with its metrics and rates since the previous report, then the rates of the whole
+// swarm.
+func (r *metricsRegistry) report(log *slog.Logger, now time.Time) {
+	var downloadRate, uploadRate float64
+	stats := r.snapshot(now)
+	for _, s := range stats {
+		peer := s.address
+		if s.client != "" {
+			peer = fmt.Sprintf("%s (%q)", s.address, s.client)
+		}
+		log.Info(fmt.Sprintf("Peer %s: %s/s down, %s/s up, %d pieces delivered, %d blocks served, %d requests outstanding",
+			peer, formatBytes(int(s.downloadRate)), formatBytes(int(s.uploadRate)), s.pieces, s.served, s.outstanding),
+			"peer", s.address)
+		downloadRate += s.downloadRate
+		uploadRate += s.uploadRate
+	}
+
+	log.Info(fmt.Sprintf("Swarm: %s/s down, %s/s up, %d peers", formatBytes(int(downloadRate)), formatBytes(int(uploadRate)), len(stats)),
+		"peers", len(stats))
+}
@@ -0,0 +1,356 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Policies for the encryption of the peer connections
+const ENCRYPTION_PREFER EncryptionPolicy = "prefer"   // Try encrypting, fall back to plaintext
+const ENCRYPTION_REQUIRE EncryptionPolicy = "require" // Refuse unencrypted peers
+const ENCRYPTION_DISABLE EncryptionPolicy = "disable" // Only plaintext connections
+
+// Parameters of the Diffie-Hellman exchange of Message Stream Encryption
+const MSE_PRIME = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF" +
+	"9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563"
+const MSE_GENERATOR = 2
+const MSE_KEY_LENGTH = 96
+const MSE_PRIVATE_KEY_BITS = 160
+
+// Maximum length of the random paddings of the handshake
+const MSE_MAX_PADDING = 512
+
+// Bytes of the RC4 key streams dropped before encrypting
+const MSE_RC4_DISCARD = 1024
+
+// Methods offered in crypto_provide and chosen in crypto_select
+const MSE_CRYPTO_PLAINTEXT = uint32(1)
+const MSE_CRYPTO_RC4 = uint32(2)
+
+// Time allowed to the encryption handshake, so peers ignoring it don't delay the plaintext fallback
+const MSE_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var msePrime, _ = new(big.Int).SetString(MSE_PRIME, 16)
+
+// Verification constant, 8 zero bytes
+var mseVC = make([]byte, 8)
+
+// EncryptionPolicy controls whether peer connections are encrypted with Message Stream Encryption. It's the value of
+// the --encryption flag.
+type EncryptionPolicy string
+
+func (p *EncryptionPolicy) String() string {
+	return string(*p)
+}
+
+func (p *EncryptionPolicy) Set(value string) error {
+	switch policy := EncryptionPolicy(value); policy {
+	case ENCRYPTION_PREFER, ENCRYPTION_REQUIRE, ENCRYPTION_DISABLE:
+		*p = policy
+		return nil
+	}
+
+	return fmt.Errorf("invalid encryption policy %q, expected prefer, require or disable", value)
+}
+
+// acceptsPlaintext reports whether peers starting with a plaintext handshake are accepted.
+func (p EncryptionPolicy) acceptsPlaintext() bool {
+	return p != ENCRYPTION_REQUIRE
+}
+
+// encryptedConn encrypts and decrypts the data of a connection with the RC4 streams negotiated by the handshake. Nil
+// ciphers leave the data in plaintext, for peers selecting plaintext after sending an initial payload.
+type encryptedConn struct {
+	net.Conn
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+	pending []byte // Data received during the handshake, already decrypted
+}
+
+func (c *encryptedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *encryptedConn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+
+	return c.Conn.Write(encrypted)
+}
+
+// mseHash is the SHA-1 hash of the concatenation of parts.
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 stream for one direction of the connection, from the shared secret and the info hash.
+func mseCipher(name string, secret, infoHash []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+
+	discard := make([]byte, MSE_RC4_DISCARD)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher
+}
+
+// mseKeyPair generates the private key and the public key to send to the peer.
+func mseKeyPair() (*big.Int, []byte, error) {
+	private, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), MSE_PRIVATE_KEY_BITS))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public := new(big.Int).Exp(big.NewInt(MSE_GENERATOR), private, msePrime)
+
+	return private, public.FillBytes(make([]byte, MSE_KEY_LENGTH)), nil
+}
+
+// mseSecret computes the secret shared with the peer from its public key.
+func mseSecret(private *big.Int, peerPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peerPublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(msePrime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("%w: invalid public key", ErrEncryptionFailed)
+	}
+
+	return new(big.Int).Exp(y, private, msePrime).FillBytes(make([]byte, MSE_KEY_LENGTH)), nil
+}
+
+// msePadding returns up to MSE_MAX_PADDING random bytes.
+func msePadding() []byte {
+	n, _ := rand.Int(rand.Reader, big.NewInt(MSE_MAX_PADDING+1))
+	padding := make([]byte, n.Int64())
+	rand.Read(padding)
+
+	return padding
+}
+
+// xorBytes returns the byte by byte xor of a and b, which have the same length.
+func xorBytes(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+// receiveUntil reads from the peer until the data ends with marker, reading at most limit bytes before it.
+func (pc *peerConnection) receiveUntil(ctx context.Context, marker []byte, limit int) error {
+	window := make([]byte, 0, limit+len(marker))
+	for len(window) < limit+len(marker) {
+		b, err := pc.receiveBytes(ctx, 1)
+		if err != nil {
+			return err
+		}
+
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: could not synchronize with the peer", ErrEncryptionFailed)
+}
+
+// encrypt runs the Message Stream Encryption handshake as the initiator of the connection, asking for RC4 encryption
+// of the rest of the connection. infoHash is the torrent being downloaded from the peer.
+func (pc *peerConnection) encrypt(ctx context.Context, infoHash []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, MSE_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return err
+	}
+
+	if _, err := pc.sendBytes(ctx, append(public, msePadding()...)); err != nil {
+		return err
+	}
+
+	peerPublic, err := pc.receiveBytes(ctx, MSE_KEY_LENGTH)
+	if err != nil {
+		return err
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return err
+	}
+
+	encrypt := mseCipher("keyA", secret, infoHash)
+	decrypt := mseCipher("keyB", secret, infoHash)
+
+	// Offer RC4 without padding nor initial payload, the BitTorrent handshake follows encrypted
+	offer := append([]byte{}, mseVC...)
+	offer = binary.BigEndian.AppendUint32(offer, MSE_CRYPTO_RC4)
+	offer = binary.BigEndian.AppendUint16(offer, 0) // Length of PadC
+	offer = binary.BigEndian.AppendUint16(offer, 0) // Length of IA
+	encrypt.XORKeyStream(offer, offer)
+
+	message := mseHash([]byte("req1"), secret)
+	message = append(message, xorBytes(mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret))...)
+	message = append(message, offer...)
+	if _, err := pc.sendBytes(ctx, message); err != nil {
+		return err
+	}
+
+	// The answer starts after the padding of the peer, with the verification constant encrypted
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+	if err := pc.receiveUntil(ctx, encryptedVC, MSE_MAX_PADDING); err != nil {
+		return err
+	}
+
+	answer, err := pc.receiveBytes(ctx, 6)
+	if err != nil {
+		return err
+	}
+	decrypt.XORKeyStream(answer, answer)
+
+	if selected := binary.BigEndian.Uint32(answer[:4]); selected != MSE_CRYPTO_RC4 {
+		return fmt.Errorf("%w: peer selected crypto method %d", ErrEncryptionFailed, selected)
+	}
+	paddingLength := int(binary.BigEndian.Uint16(answer[4:6]))
+	if paddingLength > MSE_MAX_PADDING {
+		return fmt.Errorf("%w: padding too long", ErrEncryptionFailed)
+	}
+	padding, err := pc.receiveBytes(ctx, paddingLength)
+	if err != nil {
+		return err
+	}
+	decrypt.XORKeyStream(padding, padding)
+
+	pc.connection = &encryptedConn{Conn: pc.connection, encrypt: encrypt, decrypt: decrypt}
+
+	return nil
+}
+
+// acceptEncryption runs the Message Stream Encryption handshake as the receiver of the connection, for a torrent among
+// infoHashes. The peer must have sent its public key, which plaintext BitTorrent handshakes can't be confused with.
+// Returns the info hash the peer asked for. Plaintext is selected when the peer offers it and policy allows it.
+func (pc *peerConnection) acceptEncryption(ctx context.Context, infoHashes [][]byte, policy EncryptionPolicy) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, MSE_HANDSHAKE_TIMEOUT)
+	defer cancel()
+
+	peerPublic, err := pc.receiveBytes(ctx, MSE_KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := mseSecret(private, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := pc.sendBytes(ctx, append(public, msePadding()...)); err != nil {
+		return nil, err
+	}
+
+	// The request starts after the padding of the peer
+	if err := pc.receiveUntil(ctx, mseHash([]byte("req1"), secret), MSE_MAX_PADDING); err != nil {
+		return nil, err
+	}
+
+	obfuscatedHash, err := pc.receiveBytes(ctx, sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	var infoHash []byte
+	req3 := mseHash([]byte("req3"), secret)
+	for _, candidate := range infoHashes {
+		if bytes.Equal(obfuscatedHash, xorBytes(mseHash([]byte("req2"), candidate), req3)) {
+			infoHash = candidate
+		}
+	}
+	if infoHash == nil {
+		return nil, fmt.Errorf("%w: unknown torrent", ErrEncryptionFailed)
+	}
+
+	encrypt := mseCipher("keyB", secret, infoHash)
+	decrypt := mseCipher("keyA", secret, infoHash)
+
+	offer, err := pc.receiveBytes(ctx, 14)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(offer, offer)
+	if !bytes.Equal(offer[:8], mseVC) {
+		return nil, fmt.Errorf("%w: invalid verification constant", ErrEncryptionFailed)
+	}
+	provided := binary.BigEndian.Uint32(offer[8:12])
+
+	// Skip the padding, and read the initial payload, which is the beginning of the stream
+	paddingLength := int(binary.BigEndian.Uint16(offer[12:14]))
+	if paddingLength > MSE_MAX_PADDING {
+		return nil, fmt.Errorf("%w: padding too long", ErrEncryptionFailed)
+	}
+	rest, err := pc.receiveBytes(ctx, paddingLength+2)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	initialPayload, err := pc.receiveBytes(ctx, int(binary.BigEndian.Uint16(rest[paddingLength:])))
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	var selected uint32
+	switch {
+	case provided&MSE_CRYPTO_RC4 != 0 && policy != ENCRYPTION_DISABLE:
+		selected = MSE_CRYPTO_RC4
+	case provided&MSE_CRYPTO_PLAINTEXT != 0 && policy.acceptsPlaintext():
+		selected = MSE_CRYPTO_PLAINTEXT
+	default:
+		return nil, fmt.Errorf("%w: no acceptable crypto method offered", ErrEncryptionFailed)
+	}
+
+	answer := append([]byte{}, mseVC...)
+	answer = binary.BigEndian.AppendUint32(answer, selected)
+	answer = binary.BigEndian.AppendUint16(answer, 0) // Length of PadD
+	encrypt.XORKeyStream(answer, answer)
+	if _, err := pc.sendBytes(ctx, answer); err != nil {
+		return nil, err
+	}
+
+	if selected == MSE_CRYPTO_RC4 {
+		pc.connection = &encryptedConn{Conn: pc.connection, encrypt: encrypt, decrypt: decrypt, pending: initialPayload}
+	} else if len(initialPayload) > 0 {
+		pc.connection = &encryptedConn{Conn: pc.connection, pending: initialPayload}
+	}
+
+	return infoHash, nil
+}
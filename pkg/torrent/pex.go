@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"fmt"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// ID the peers use to send us ut_pex messages, assigned in our extension handshake
+const PEX_EXTENSION_ID = 1
+
+// downloadExtensions returns the extensions advertised to the peers of the downloads: peer exchange, BEP 11, unless the
+// torrent is private, BEP 27.
+func (t Torrent) downloadExtensions() map[string]int {
+	if t.info.private {
+		return map[string]int{}
+	}
+
+	return map[string]int{"ut_pex": PEX_EXTENSION_ID}
+}
+
+// parsePexMessage validates the payload of a ut_pex extension message. Returns the addresses of the peers it added,
+// IPv4 and IPv6. Dropped peers are ignored, their connections fail on their own.
+func parsePexMessage(payload []byte) ([]string, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("%w: empty peer exchange message", peer.ErrInvalidMessage)
+	}
+
+	// The first byte is the extension ID
+	decoded, _, err := bencode.DecodeDictionary(payload[1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: peer exchange message: %w", peer.ErrInvalidMessage, err)
+	}
+
+	var peers []string
+	if added, ok := decoded["added"].([]byte); ok {
+		peers = append(peers, peer.ParseCompact(string(added), peer.COMPACT_IPV4_LENGTH)...)
+	}
+	if added6, ok := decoded["added6"].([]byte); ok {
+		peers = append(peers, peer.ParseCompact(string(added6), peer.COMPACT_IPV6_LENGTH)...)
+	}
+
+	return peers, nil
+}
+
+// handleExtensionMessage processes an extension message received during a download: the extension handshake of the
+// peer, keeping its extensions and what it told about itself, and peer exchange messages, handing the added peers to
+// onPeers. Messages of other extensions are ignored.
+func (pc *peerConnection) handleExtensionMessage(message *peer.Message) error {
+	extended, err := peer.ParseExtended(message)
+	if err != nil {
+		return err
+	}
+
+	switch extended.Id {
+	case 0:
+		handshake, err := peer.ParseExtensionHandshake(message.Payload)
+		if err != nil {
+			return err
+		}
+		pc.handshake = handshake
+		pc.metrics.identify(handshake.Version)
+	case PEX_EXTENSION_ID:
+		peers, err := parsePexMessage(message.Payload)
+		if err != nil {
+			return err
+		}
+		if pc.onPeers != nil && len(peers) > 0 {
+			pc.onPeers(peers)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package torrent
+
+import (
+	"container/list"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Bytes of verified pieces kept in memory, to serve uploads without reading them back from the disk
+const PIECE_CACHE_SIZE = 16 * 1024 * 1024
+
+// Verified pieces waiting to be written to the disk before writePiece blocks
+const WRITE_BEHIND_PIECES = 16
+
+// pieceStore reads and writes the pieces of a torrent in its data files. Verified pieces are written behind by a
+// goroutine, in the order they are queued, and stay readable from memory meanwhile. The pieces written or read last are
+// kept in an LRU cache of PIECE_CACHE_SIZE bytes. The first failed write fails every later write, and the sync.
+type pieceStore struct {
+	file        DataStore
+	pieceLength int
+	written     func(index int) // Called once a piece is written to the file, may be nil
+
+	mu      sync.Mutex
+	changed *sync.Cond            // Signaled when a piece is queued or written, and on close
+	queue   []cachedPiece         // Pieces waiting to be written with their data, in order
+	pending map[int][]byte        // Data of the queued pieces, and of the one being written, the last queued one
+	cache   *list.List            // Cached pieces, the most recently used first
+	entries map[int]*list.Element // Cached pieces by index
+	cached  int                   // Bytes of the cached pieces
+	err     error                 // Why a write failed
+	closed  bool                  // Whether the store is closed, the writer returning once the queue is empty
+	done    chan struct{}         // Closed once the writer goroutine returned
+}
+
+// cachedPiece is a piece in the cache or the write queue of a pieceStore.
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+// openPieceStore opens the data at path of a torrent with info in storage, creating it. written is called with the
+// index of every piece once it's written to the data.
+func openPieceStore(storage Storage, path string, info info, written func(index int)) (*pieceStore, error) {
+	file, err := storage.OpenData(path, info.dataLayout(path), info.pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &pieceStore{
+		file:        file,
+		pieceLength: info.pieceLength,
+		written:     written,
+		pending:     map[int][]byte{},
+		cache:       list.New(),
+		entries:     map[int]*list.Element{},
+		done:        make(chan struct{}),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	go s.writeBehind()
+
+	return s, nil
+}
+
+// readAt reads len(p) bytes of the file at offset, bypassing the cache and the pieces waiting to be written.
+func (s *pieceStore) readAt(p []byte, offset int64) (int, error) {
+	return s.file.ReadAt(p, offset)
+}
+
+// writeAt writes p to the file at offset, synchronously and bypassing the cache.
+func (s *pieceStore) writeAt(p []byte, offset int64) (int, error) {
+	return s.file.WriteAt(p, offset)
+}
+
+// readPiece returns the data of the verified piece at index, of length bytes: from memory when it's waiting to be
+// written or cached, from the file otherwise. The returned data must not be modified.
+func (s *pieceStore) readPiece(index, length int) ([]byte, error) {
+	s.mu.Lock()
+	if data, ok := s.pending[index]; ok {
+		s.mu.Unlock()
+		return data, nil
+	}
+	if e, ok := s.entries[index]; ok {
+		s.cache.MoveToFront(e)
+		s.mu.Unlock()
+		return e.Value.(*cachedPiece).data, nil
+	}
+	s.mu.Unlock()
+
+	data := make([]byte, length)
+	if _, err := s.file.ReadAt(data, int64(index*s.pieceLength)); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cacheLocked(index, data)
+
+	return data, nil
+}
+
+// writePiece queues the verified piece at index to be written to the file, blocking while WRITE_BEHIND_PIECES pieces
+// are already waiting. Fails with errDiskFailure once a write failed.
+func (s *pieceStore) writePiece(index int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) >= WRITE_BEHIND_PIECES && s.err == nil && !s.closed {
+		s.changed.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return fmt.Errorf("%w: piece store closed", ErrDiskFailure)
+	}
+
+	s.queue = append(s.queue, cachedPiece{index: index, data: data})
+	s.pending[index] = data
+	s.cacheLocked(index, data)
+	s.changed.Broadcast()
+
+	return nil
+}
+
+// cacheLocked puts the piece at index first in the cache, evicting the least recently used pieces over
+// PIECE_CACHE_SIZE. Must be called holding the lock.
+func (s *pieceStore) cacheLocked(index int, data []byte) {
+	if e, ok := s.entries[index]; ok {
+		s.cached -= len(e.Value.(*cachedPiece).data)
+		s.cache.Remove(e)
+	}
+	s.entries[index] = s.cache.PushFront(&cachedPiece{index: index, data: data})
+	s.cached += len(data)
+
+	for s.cached > PIECE_CACHE_SIZE && s.cache.Len() > 1 {
+		oldest := s.cache.Remove(s.cache.Back()).(*cachedPiece)
+		delete(s.entries, oldest.index)
+		s.cached -= len(oldest.data)
+	}
+}
+
+// writeBehind writes the queued pieces to the file until the store is closed and the queue empty.
+func (s *pieceStore) writeBehind() {
+	defer close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for len(s.queue) == 0 && !s.closed {
+			s.changed.Wait()
+		}
+		if len(s.queue) == 0 {
+			return
+		}
+
+		// A piece queued again is written again, with the data it was queued with each time
+		index, data := s.queue[0].index, s.queue[0].data
+		failed := s.err != nil
+		s.mu.Unlock()
+
+		// Once a write failed, the rest of the queue is dropped
+		var err error
+		if !failed {
+			_, err = s.file.WriteAt(data, int64(index*s.pieceLength))
+		}
+
+		s.mu.Lock()
+		s.queue = s.queue[1:]
+		if !slices.ContainsFunc(s.queue, func(queued cachedPiece) bool { return queued.index == index }) {
+			delete(s.pending, index)
+		}
+		if err != nil && s.err == nil {
+			s.err = fmt.Errorf("%w: piece %d: %w", ErrDiskFailure, index, err)
+		}
+		s.changed.Broadcast()
+
+		if err == nil && !failed && s.written != nil {
+			s.mu.Unlock()
+			s.written(index)
+			s.mu.Lock()
+		}
+	}
+}
+
+// flush waits for the queued pieces to be written. Returns the error of a failed write.
+func (s *pieceStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) > 0 {
+		s.changed.Wait()
+	}
+
+	return s.err
+}
+
+// sync writes the queued pieces, then flushes the file to the disk.
+func (s *pieceStore) sync() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", ErrDiskFailure, err)
+	}
+
+	return nil
+}
+
+// close writes the queued pieces and closes the file.
+func (s *pieceStore) close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.changed.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+
+	return s.file.Close()
+}
@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// blockingStorage is a storage whose data holds its writes until released, recording their lengths.
+type blockingStorage struct {
+	diskStorage
+	release chan struct{}
+
+	mu      sync.Mutex
+	lengths []int
+}
+
+// blockingData is data opened by a blockingStorage.
+type blockingData struct {
+	DataStore
+	s *blockingStorage
+}
+
+func (s *blockingStorage) OpenData(path string, layout []DataFile, pieceLength int) (DataStore, error) {
+	data, err := s.diskStorage.OpenData(path, layout, pieceLength)
+	return blockingData{DataStore: data, s: s}, err
+}
+
+func (d blockingData) WriteAt(p []byte, offset int64) (int, error) {
+	<-d.s.release
+	d.s.mu.Lock()
+	d.s.lengths = append(d.s.lengths, len(p))
+	d.s.mu.Unlock()
+
+	return d.DataStore.WriteAt(p, offset)
+}
+
+// TestPieceStoreQueuedTwice checks a piece queued again before its first write is written with its data both times,
+// the last data queued being the one kept.
+func TestPieceStoreQueuedTwice(t *testing.T) {
+	const pieceLength = 16_384
+	storage := &blockingStorage{release: make(chan struct{})}
+	written := make(chan int, 4)
+	i := info{length: 2 * pieceLength, pieceLength: pieceLength, nPieces: 2}
+
+	store, err := openPieceStore(storage, filepath.Join(t.TempDir(), "data.bin"), i, func(index int) { written <- index })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	// The writer holds the first piece while the second one is queued twice
+	first, second := bytes.Repeat([]byte{1}, pieceLength), bytes.Repeat([]byte{2}, pieceLength)
+	for _, queued := range []struct {
+		index int
+		data  []byte
+	}{{0, first}, {1, first}, {1, second}} {
+		if err := store.writePiece(queued.index, queued.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(storage.release)
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range storage.lengths {
+		if length != pieceLength {
+			t.Fatalf("write of %d bytes, expected whole pieces: %v", length, storage.lengths)
+		}
+	}
+	if len(storage.lengths) != 3 || len(written) != 3 {
+		t.Fatalf("%d writes and %d written pieces for 3 queued pieces", len(storage.lengths), len(written))
+	}
+
+	data := make([]byte, pieceLength)
+	if _, err := store.readAt(data, pieceLength); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, second) {
+		t.Fatal("piece queued twice holds the data queued first")
+	}
+}
@@ -0,0 +1,176 @@
+package torrent
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Peers a download is connected to at most, unless configured
+const DEFAULT_MAX_PEERS = 30
+
+// How often a download dials more peers while it's below its peer limit
+const PEER_POOL_REFILL_INTERVAL = 10 * time.Second
+
+// peerPool tracks the peers of a download: the candidates learned from the trackers and peer exchange, the ones being
+// dialed and the ones connected, at most max of them at once. A connection that dies leaves the pool, and its peer is
+// dialed again once its backoff elapses.
+type peerPool struct {
+	max    int
+	dead   *deadPeers
+	budget *peerBudget // Shared with the other downloads of the session, unlimited when nil
+
+	mu         sync.Mutex
+	candidates []string        // Known peers, in the order they were learned
+	known      map[string]bool // Addresses of the candidates
+	dialing    map[string]bool
+	connected  map[string]bool
+}
+
+// newPeerPool returns a pool of up to max peers, and up to what's left of budget, dialing only the peers dead is not
+// backing off.
+func newPeerPool(max int, dead *deadPeers, budget *peerBudget) *peerPool {
+	return &peerPool{
+		max:       max,
+		dead:      dead,
+		budget:    budget,
+		known:     map[string]bool{},
+		dialing:   map[string]bool{},
+		connected: map[string]bool{},
+	}
+}
+
+// WithMaxPeers sets how many peers a download is connected to at most.
+func WithMaxPeers(n int) Option {
+	return func(c *Client) {
+		c.maxPeers = n
+	}
+}
+
+// add records peers as candidates. Returns how many were not known yet.
+func (p *peerPool) add(peers []string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	added := 0
+	for _, peer := range peers {
+		if !p.known[peer] {
+			p.known[peer] = true
+			p.candidates = append(p.candidates, peer)
+			added++
+		}
+	}
+
+	return added
+}
+
+// reserve returns the candidates to dial to fill the pool, the first ready ones not connected or being dialed. They
+// count against the limit until released.
+func (p *peerPool) reserve() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	free := min(p.max-len(p.connected), p.budget.free()) - len(p.dialing)
+	var reserved []string
+	for _, peer := range p.candidates {
+		if len(reserved) >= free {
+			break
+		}
+		if p.connected[peer] || p.dialing[peer] || !p.dead.ready(peer) {
+			continue
+		}
+		p.dialing[peer] = true
+		reserved = append(reserved, peer)
+	}
+
+	return reserved
+}
+
+// release ends the dials of reserved peers. The ones that connected are to be joined.
+func (p *peerPool) release(reserved []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, peer := range reserved {
+		delete(p.dialing, peer)
+	}
+}
+
+// join records a connected peer, dialed or inbound. Returns false when the pool is full or the peer is already
+// connected, the connection is then to be closed.
+func (p *peerPool) join(address string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.connected[address] || len(p.connected) >= p.max || !p.budget.take() {
+		return false
+	}
+	p.connected[address] = true
+
+	return true
+}
+
+// leave records the connection to a peer died.
+func (p *peerPool) leave(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.connected[address] {
+		delete(p.connected, address)
+		p.budget.give()
+	}
+}
+
+// peerBudget is the amount of peers the downloads of a session are connected to at most together. A nil budget is
+// unlimited.
+type peerBudget struct {
+	max int
+
+	mu   sync.Mutex
+	used int
+}
+
+func newPeerBudget(max int) *peerBudget {
+	return &peerBudget{max: max}
+}
+
+// free returns how many more peers can be connected.
+func (b *peerBudget) free() int {
+	if b == nil {
+		return math.MaxInt
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.max - b.used
+}
+
+// take accounts a connected peer. Returns false when the budget is spent.
+func (b *peerBudget) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used >= b.max {
+		return false
+	}
+	b.used++
+
+	return true
+}
+
+// give returns the slot of a peer that disconnected.
+func (b *peerBudget) give() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used--
+}
@@ -0,0 +1,459 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Lifetime requested for the port mappings, they are renewed when half of it has elapsed
+const PORT_MAPPING_LIFETIME = time.Hour
+
+// Time allowed to find a router supporting NAT-PMP or UPnP, and to remove the mappings on shutdown
+const PORT_MAPPING_TIMEOUT = 3 * time.Second
+
+const PORT_MAPPING_DESCRIPTION = "mybittorrent"
+
+const NATPMP_PORT = 5351
+const NATPMP_OPCODE_UDP = 1
+const NATPMP_OPCODE_TCP = 2
+const NATPMP_RETRY_DELAY = 250 * time.Millisecond // Doubled on every retry
+const NATPMP_RETRIES = 4
+
+const SSDP_ADDRESS = "239.255.255.250:1900"
+const UPNP_GATEWAY_DEVICE = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+// Protocols mapped on the router: TCP for peers, UDP for DHT and uTP
+var portMappingProtocols = []string{"TCP", "UDP"}
+
+// portMapper forwards ports of the router to this host.
+type portMapper interface {
+	// mapPort forwards the external port to the same local port for the given lifetime. Returns the external port
+	// assigned by the router, which may differ from the requested one.
+	mapPort(ctx context.Context, protocol string, port int, lifetime time.Duration) (int, error)
+	unmapPort(ctx context.Context, protocol string, port int) error
+	name() string
+}
+
+// discoverPortMapper finds a way to forward ports on the router, trying NAT-PMP first and UPnP IGD second. gateway is
+// the address of the router, the default route is used when empty.
+func discoverPortMapper(ctx context.Context, gateway string) (portMapper, error) {
+	ctx, cancel := context.WithTimeout(ctx, PORT_MAPPING_TIMEOUT)
+	defer cancel()
+
+	var errs []error
+
+	if gateway == "" {
+		var err error
+		gateway, err = defaultGateway()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if gateway != "" {
+		natpmp := &natpmpMapper{gateway: net.JoinHostPort(gateway, fmt.Sprint(NATPMP_PORT))}
+		err := natpmp.probe(ctx)
+		if err == nil {
+			return natpmp, nil
+		}
+		errs = append(errs, fmt.Errorf("NAT-PMP: %w", err))
+	}
+
+	upnp, err := discoverUPnP(ctx)
+	if err == nil {
+		return upnp, nil
+	}
+	errs = append(errs, fmt.Errorf("UPnP: %w", err))
+
+	return nil, errors.Join(errs...)
+}
+
+// defaultGateway returns the address of the router of the default route, read from the Linux routing table.
+func defaultGateway() (string, error) {
+	content, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", fmt.Errorf("could not find the default gateway: %w", err)
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		// The gateway is a little endian hexadecimal IPv4 address
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+
+		return net.IPv4(b[3], b[2], b[1], b[0]).String(), nil
+	}
+
+	return "", errors.New("no default gateway")
+}
+
+// keepPortMapped forwards port on the router and renews the mappings before they expire, until ctx is done. The
+// mappings are removed before returning.
+func (d *Daemon) keepPortMapped(ctx context.Context, port int, gateway string) {
+	mapper, err := discoverPortMapper(ctx, gateway)
+	if err != nil {
+		d.client.log.Warn(fmt.Sprintf("Port mapping unavailable: %s", err))
+		return
+	}
+
+	mapped := map[string]bool{}
+	for {
+		for _, protocol := range portMappingProtocols {
+			external, err := mapper.mapPort(ctx, protocol, port, PORT_MAPPING_LIFETIME)
+			if err != nil {
+				if ctx.Err() == nil {
+					d.client.log.Warn(fmt.Sprintf("Could not map %s port %d using %s: %s", protocol, port, mapper.name(), err))
+				}
+				continue
+			}
+
+			if !mapped[protocol] {
+				d.client.log.Info(fmt.Sprintf("Mapped %s port %d to external port %d using %s", protocol, port, external, mapper.name()))
+			}
+			mapped[protocol] = true
+		}
+
+		timer, stop := d.clock.newTimer(PORT_MAPPING_LIFETIME / 2)
+		select {
+		case <-timer:
+		case <-ctx.Done():
+			stop()
+
+			// ctx is done, the mappings are removed with a context of their own
+			cleanupCtx, cancel := context.WithTimeout(context.Background(), PORT_MAPPING_TIMEOUT)
+			defer cancel()
+			for protocol := range mapped {
+				if err := mapper.unmapPort(cleanupCtx, protocol, port); err != nil {
+					d.client.log.Warn(fmt.Sprintf("Could not unmap %s port %d: %s", protocol, port, err))
+				}
+			}
+			return
+		}
+	}
+}
+
+// natpmpMapper maps ports using NAT-PMP (RFC 6886).
+type natpmpMapper struct {
+	gateway string // Address of the NAT-PMP server of the router, as host:port
+}
+
+func (m *natpmpMapper) name() string {
+	return "NAT-PMP"
+}
+
+// probe checks the router answers NAT-PMP requests, asking for its external address.
+func (m *natpmpMapper) probe(ctx context.Context) error {
+	_, err := m.request(ctx, []byte{0, 0}, 12)
+	return err
+}
+
+func (m *natpmpMapper) mapPort(ctx context.Context, protocol string, port int, lifetime time.Duration) (int, error) {
+	return m.requestMapping(ctx, protocol, port, port, lifetime)
+}
+
+func (m *natpmpMapper) unmapPort(ctx context.Context, protocol string, port int) error {
+	// A mapping is deleted by requesting it with a lifetime and external port of 0
+	_, err := m.requestMapping(ctx, protocol, port, 0, 0)
+	return err
+}
+
+// requestMapping sends a mapping request, returning the external port assigned by the router.
+func (m *natpmpMapper) requestMapping(ctx context.Context, protocol string, port, external int, lifetime time.Duration) (int, error) {
+	opcode := byte(NATPMP_OPCODE_TCP)
+	if protocol == "UDP" {
+		opcode = NATPMP_OPCODE_UDP
+	}
+
+	req := []byte{0, opcode, 0, 0}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	req = binary.BigEndian.AppendUint16(req, uint16(external))
+	req = binary.BigEndian.AppendUint32(req, uint32(lifetime.Seconds()))
+
+	res, err := m.request(ctx, req, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint16(res[10:12])), nil
+}
+
+// request sends a NAT-PMP request, retrying with increasing delays while the router doesn't answer. Returns the
+// response, of the given length, once its result code is checked.
+func (m *natpmpMapper) request(ctx context.Context, req []byte, responseLength int) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res := make([]byte, 16)
+	delay := NATPMP_RETRY_DELAY
+	for i := 0; i < NATPMP_RETRIES && ctx.Err() == nil; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(delay)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		delay *= 2
+
+		n, err := conn.Read(res)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Responses echo the opcode of the request plus 128
+		if n < responseLength || res[0] != 0 || res[1] != req[1]+128 {
+			return nil, errors.New("invalid response")
+		}
+		if result := binary.BigEndian.Uint16(res[2:4]); result != 0 {
+			return nil, fmt.Errorf("request refused with result code %d", result)
+		}
+
+		return res[:n], nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return nil, errors.New("no response from the router")
+}
+
+// upnpMapper maps ports using the WANIPConnection or WANPPPConnection service of an UPnP Internet Gateway Device.
+type upnpMapper struct {
+	controlURL  string
+	serviceType string
+	localIP     string // Address of this host in the network of the router
+	client      *http.Client
+}
+
+func (m *upnpMapper) name() string {
+	return "UPnP"
+}
+
+// upnpDevice is a device of the UPnP description document, along with its embedded devices.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// discoverUPnP searches the local network for an Internet Gateway Device, and reads its description to find the
+// service mapping ports.
+func discoverUPnP(ctx context.Context) (*upnpMapper, error) {
+	location, err := searchSSDP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: PORT_MAPPING_TIMEOUT}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&description); err != nil {
+		return nil, fmt.Errorf("invalid device description: %w", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if description.URLBase != "" {
+		if base, err = url.Parse(description.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	devices := []upnpDevice{description.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+
+		for _, service := range device.Services {
+			if !strings.Contains(service.ServiceType, ":WANIPConnection:") &&
+				!strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+				continue
+			}
+
+			controlURL, err := base.Parse(service.ControlURL)
+			if err != nil {
+				return nil, err
+			}
+
+			localIP, err := localAddressTowards(controlURL.Host)
+			if err != nil {
+				return nil, err
+			}
+
+			return &upnpMapper{
+				controlURL:  controlURL.String(),
+				serviceType: service.ServiceType,
+				localIP:     localIP,
+				client:      client,
+			}, nil
+		}
+	}
+
+	return nil, errors.New("gateway has no WAN connection service")
+}
+
+// searchSSDP multicasts an SSDP search for Internet Gateway Devices, returning the location of the description of the
+// first one answering.
+func searchSSDP(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	group, err := net.ResolveUDPAddr("udp4", SSDP_ADDRESS)
+	if err != nil {
+		return "", err
+	}
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDP_ADDRESS + "\r\n" +
+		"ST: " + UPNP_GATEWAY_DEVICE + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), group); err != nil {
+		return "", err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", errors.New("no gateway answered the search")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// Answers are HTTP responses sent over UDP
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// localAddressTowards returns the local IP address used to reach host, given as host:port.
+func localAddressTowards(host string) (string, error) {
+	// Connecting an UDP socket sends nothing, it only selects the route
+	conn, err := net.Dial("udp", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func (m *upnpMapper) mapPort(ctx context.Context, protocol string, port int, lifetime time.Duration) (int, error) {
+	err := m.call(ctx, "AddPortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", fmt.Sprint(port),
+		"NewProtocol", protocol,
+		"NewInternalPort", fmt.Sprint(port),
+		"NewInternalClient", m.localIP,
+		"NewEnabled", "1",
+		"NewPortMappingDescription", PORT_MAPPING_DESCRIPTION,
+		"NewLeaseDuration", fmt.Sprint(int(lifetime.Seconds())),
+	})
+
+	return port, err
+}
+
+func (m *upnpMapper) unmapPort(ctx context.Context, protocol string, port int) error {
+	return m.call(ctx, "DeletePortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", fmt.Sprint(port),
+		"NewProtocol", protocol,
+	})
+}
+
+// call invokes an action of the port mapping service with the given arguments, as name and value pairs.
+func (m *upnpMapper) call(ctx context.Context, action string, arguments []string) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.serviceType)
+	for i := 0; i < len(arguments); i += 2 {
+		fmt.Fprintf(&body, "<%s>", arguments[i])
+		xml.EscapeText(&body, []byte(arguments[i+1]))
+		fmt.Fprintf(&body, "</%s>", arguments[i])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.controlURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.serviceType, action))
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	// Failed actions are answered with a SOAP fault and an error status
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", action, res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// preallocate sizes file to length bytes and reserves its blocks on the disk with fallocate, so a disk without the free
+// space fails the download before it starts, and the pieces written at their offsets don't fragment the file. The data
+// already written is kept. File systems without fallocate get a sparse file.
+func preallocate(file *os.File, length int64) error {
+	if err := file.Truncate(length); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	switch {
+	case err == nil, errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOSYS):
+		return nil
+	case errors.Is(err, syscall.ENOSPC):
+		return fmt.Errorf("%w: not enough free space for %d bytes", ErrDiskFailure, length)
+	}
+
+	return fmt.Errorf("%w: %w", ErrDiskFailure, err)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package torrent
+
+import "os"
+
+// preallocate sizes file to length bytes, as a sparse file whose blocks are allocated as the pieces are written. The
+// data already written is kept.
+func preallocate(file *os.File, length int64) error {
+	return file.Truncate(length)
+}
@@ -0,0 +1,221 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The progress is reported at most this often while blocks arrive, and on every verified piece
+const PROGRESS_INTERVAL = 250 * time.Millisecond
+
+// Transfer rates are averaged over this window
+const PROGRESS_RATE_WINDOW = 5 * time.Second
+
+// Width of the progress bar rendered in terminals, in characters
+const PROGRESS_BAR_WIDTH = 30
+
+// Progress is the state of a download, reported to the progress callback of its client.
+type Progress struct {
+	Name        string             `json:"name"`
+	Bytes       int                `json:"bytes"` // Length of the verified pieces, including the ones of previous attempts
+	Total       int                `json:"total"`
+	Pieces      int                `json:"pieces"` // Verified pieces, including the ones of previous attempts
+	TotalPieces int                `json:"totalPieces"`
+	Rate        float64            `json:"rate"`          // Bytes per second received from all the peers
+	PeerRates   map[string]float64 `json:"peerRates"`     // Bytes per second received from each peer, keyed by address
+	ETA         time.Duration      `json:"eta,omitempty"` // Time left at the current rate, unknown when 0
+}
+
+// progressSample is an amount of bytes received from a peer.
+type progressSample struct {
+	at    time.Time
+	peer  string
+	bytes int
+}
+
+// progressTracker follows the progress of a download, updated by the peer workers as blocks arrive and pieces are
+// verified. A nil tracker ignores the updates, so downloads without a progress callback can update it unconditionally.
+type progressTracker struct {
+	report func(Progress)
+	clock  clock
+
+	mu         sync.Mutex
+	state      Progress
+	started    time.Time
+	samples    []progressSample // Received in the last PROGRESS_RATE_WINDOW, oldest first
+	lastReport time.Time
+}
+
+// newProgressTracker returns the tracker of the download of t, reporting to the progress callback of its client.
+// Returns nil when the client has none.
+func newProgressTracker(t Torrent) *progressTracker {
+	report := t.getClient().onProgress
+	if report == nil {
+		return nil
+	}
+
+	return &progressTracker{
+		report: report,
+		clock:  realClock,
+		state: Progress{
+			Name:        t.info.name,
+			Total:       t.info.length,
+			TotalPieces: t.info.nPieces,
+		},
+		started: realClock.now(),
+	}
+}
+
+// restored counts the pieces kept from a previous attempt, of length bytes in total.
+func (p *progressTracker) restored(pieces, length int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.state.Pieces += pieces
+	p.state.Bytes += length
+	p.mu.Unlock()
+
+	p.publish(true)
+}
+
+// received counts a block of n bytes received from peer.
+func (p *progressTracker) received(peer string, n int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.samples = append(p.samples, progressSample{at: p.clock.now(), peer: peer, bytes: n})
+	p.mu.Unlock()
+
+	p.publish(false)
+}
+
+// verified counts a piece of length bytes that passed the hash check.
+func (p *progressTracker) verified(length int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.state.Pieces++
+	p.state.Bytes += length
+	p.mu.Unlock()
+
+	p.publish(true)
+}
+
+// publish reports the progress, unless it was reported less than PROGRESS_INTERVAL ago and force is false.
+func (p *progressTracker) publish(force bool) {
+	p.mu.Lock()
+	now := p.clock.now()
+	if !force && now.Sub(p.lastReport) < PROGRESS_INTERVAL {
+		p.mu.Unlock()
+		return
+	}
+	p.lastReport = now
+	state := p.snapshotLocked(now)
+	p.mu.Unlock()
+
+	p.report(state)
+}
+
+// snapshotLocked returns the progress with the rates of the samples in the window ending at now, dropping the older
+// samples. Must be called holding the lock.
+func (p *progressTracker) snapshotLocked(now time.Time) Progress {
+	windowStart := now.Add(-PROGRESS_RATE_WINDOW)
+	first := 0
+	for first < len(p.samples) && p.samples[first].at.Before(windowStart) {
+		first++
+	}
+	p.samples = p.samples[first:]
+
+	// Downloads younger than the window are averaged over their duration
+	window := min(now.Sub(p.started), PROGRESS_RATE_WINDOW).Seconds()
+	if window <= 0 {
+		window = PROGRESS_INTERVAL.Seconds()
+	}
+
+	state := p.state
+	state.Rate = 0
+	state.PeerRates = map[string]float64{}
+	for _, s := range p.samples {
+		state.Rate += float64(s.bytes) / window
+		state.PeerRates[s.peer] += float64(s.bytes) / window
+	}
+	state.ETA = 0
+	if state.Rate > 0 {
+		state.ETA = time.Duration(float64(state.Total-state.Bytes) / state.Rate * float64(time.Second))
+	}
+
+	return state
+}
+
+// WithProgress sets the callback receiving the progress of the downloads. Pieces are no longer logged one by one.
+func WithProgress(report func(Progress)) Option {
+	return func(c *Client) {
+		c.onProgress = report
+	}
+}
+
+// ProgressBar returns a progress callback drawing a bar on w, redrawn in place on every report. The line is ended
+// once every piece is verified.
+func ProgressBar(w io.Writer) func(Progress) {
+	var mu sync.Mutex
+
+	return func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fraction := 1.0
+		if p.Total > 0 {
+			fraction = float64(p.Bytes) / float64(p.Total)
+		}
+		filled := int(fraction * PROGRESS_BAR_WIDTH)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled)
+
+		eta := "--:--"
+		if p.ETA > 0 {
+			eta = formatEta(p.ETA)
+		}
+
+		line := fmt.Sprintf("[%s] %5.1f%% %s / %s %s/s ETA %s, %d peers", bar, 100*fraction, formatBytes(p.Bytes),
+			formatBytes(p.Total), formatBytes(int(p.Rate)), eta, len(p.PeerRates))
+		// Clears what's left of a longer previous line
+		fmt.Fprintf(w, "\r%s\033[K", line)
+		if p.Pieces == p.TotalPieces {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatBytes returns n with a binary unit, like 1.5 MiB.
+func formatBytes(n int) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value, unit := float64(n), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatEta returns d as minutes and seconds, with hours when it's that long.
+func formatEta(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Downloads without completed pieces for this long are stalled, and stop counting as active
+const STALL_TIMEOUT = 5 * time.Minute
+const STALL_CHECK_INTERVAL = 30 * time.Second
+
+// queueOrder sorts torrents in the order they are started: higher priority first, then the oldest.
+func queueOrder(torrents []*SessionTorrent) {
+	sort.SliceStable(torrents, func(i, j int) bool {
+		if torrents[i].priority != torrents[j].priority {
+			return torrents[i].priority > torrents[j].priority
+		}
+
+		return torrents[i].id < torrents[j].id
+	})
+}
+
+// schedule starts queued torrents while there are free slots.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scheduleLocked()
+}
+
+// scheduleLocked starts queued torrents while there are free slots. Stalled torrents don't take a slot, so a dead
+// swarm doesn't block the queue. Must be called holding the session lock.
+func (s *Session) scheduleLocked() {
+	active := 0
+	queued := make([]*SessionTorrent, 0)
+	for _, st := range s.torrents {
+		switch st.status {
+		case STATUS_DOWNLOADING, STATUS_METADATA:
+			active++
+		case STATUS_QUEUED:
+			queued = append(queued, st)
+		}
+	}
+
+	queueOrder(queued)
+
+	for _, st := range queued {
+		if s.maxActive > 0 && active >= s.maxActive {
+			break
+		}
+		// A torrent resumed before its previous download exited is started once it did, not to download twice
+		if !st.exited() {
+			continue
+		}
+
+		s.startLocked(st)
+		active++
+	}
+}
+
+// queuePosition returns the position of the torrent in the queue, starting at 0. Returns -1 if it is not queued.
+func (s *Session) queuePosition(st *SessionTorrent) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st.status != STATUS_QUEUED {
+		return -1
+	}
+
+	queued := make([]*SessionTorrent, 0)
+	for _, other := range s.torrents {
+		if other.status == STATUS_QUEUED {
+			queued = append(queued, other)
+		}
+	}
+	queueOrder(queued)
+
+	for i, other := range queued {
+		if other == st {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// setPriority changes the priority of the torrent, which may start if it moves ahead in the queue.
+func (s *Session) setPriority(hash string, priority int) error {
+	s.mu.Lock()
+	st, ok := s.torrents[hash]
+	if ok {
+		st.priority = priority
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+
+	s.schedule()
+
+	return nil
+}
+
+// watchStalled periodically marks downloads without progress as stalled, freeing their slot, until ctx is done.
+func (s *Session) watchStalled(ctx context.Context) {
+	ticker, stop := s.clock.newTicker(STALL_CHECK_INTERVAL)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker:
+			// Ticks may be late, check against the current time
+			now := s.clock.now()
+			s.mu.Lock()
+			for _, st := range s.torrents {
+				if st.status == STATUS_DOWNLOADING && now.Sub(st.lastProgress) > STALL_TIMEOUT {
+					st.status = STATUS_STALLED
+				}
+			}
+			s.mu.Unlock()
+
+			s.schedule()
+		}
+	}
+}
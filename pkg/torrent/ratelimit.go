@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the amount of bytes transferred per second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int     // Bytes per second, 0 means unlimited
+	tokens float64 // Bytes that can be transferred right away
+	last   time.Time
+	clock  clock
+	parent *rateLimiter // Limits the transfers too, like the global limit above a per-peer one, none when nil
+}
+
+func newRateLimiter(rate int, clock clock) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   clock.now(),
+		clock:  clock,
+	}
+}
+
+// setRate changes the amount of bytes per second allowed. 0 removes the limit.
+func (l *rateLimiter) setRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+	l.last = l.clock.now()
+}
+
+// getRate returns the amount of bytes per second allowed, 0 when unlimited
+func (l *rateLimiter) getRate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// child returns a limiter of rate bytes per second whose transfers are limited by l too. Returns l when rate is 0, as
+// the child would add no limit.
+func (l *rateLimiter) child(rate int) *rateLimiter {
+	if rate == 0 {
+		return l
+	}
+
+	child := newRateLimiter(rate, l.clock)
+	child.parent = l
+
+	return child
+}
+
+// wait blocks until n bytes can be transferred by l and its parents, or ctx is done. Transfers larger than the bucket
+// are allowed once the bucket is full, going into debt that following transfers pay for.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	for ; l != nil; l = l.parent {
+		if err := l.take(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// take blocks until n bytes can be transferred by l alone, or ctx is done.
+func (l *rateLimiter) take(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.rate == 0 {
+			l.mu.Unlock()
+			return nil
+		}
+
+		// Refill the bucket with the tokens accumulated since the last call, up to one second worth of data
+		now := l.clock.now()
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+		l.last = now
+
+		needed := min(float64(n), float64(l.rate))
+		if l.tokens >= needed {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((needed - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+
+		timer, stop := l.clock.newTimer(delay)
+		select {
+		case <-ctx.Done():
+			stop()
+			return ctx.Err()
+		case <-timer:
+		}
+	}
+}
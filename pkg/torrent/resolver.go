@@ -0,0 +1,218 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of a lookup, including the retries of the Go resolver, unless configured
+const DEFAULT_DNS_TIMEOUT = 5 * time.Second
+
+// How long resolved addresses are reused unless configured. The Go resolver doesn't expose the TTL of the records
+const DEFAULT_DNS_CACHE_TTL = 5 * time.Minute
+
+// Media type of the DNS messages exchanged with DNS-over-HTTPS servers, RFC 8484
+const DNS_MESSAGE_MEDIA_TYPE = "application/dns-message"
+
+// DnsResolver resolves the hostnames of trackers and peers with a configured server instead of the system's resolver,
+// for networks where it blocks or poisons tracker domains. Successful lookups are cached.
+type DnsResolver struct {
+	resolver *net.Resolver
+	timeout  time.Duration
+	ttl      time.Duration
+	clock    clock
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+}
+
+// resolvedHost is a cached lookup.
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewDnsResolver creates a resolver querying server: a DNS server as host[:port], port 53 by default, or the URL of
+// a DNS-over-HTTPS server like https://cloudflare-dns.com/dns-query. http:// URLs are accepted for local DoH proxies.
+func NewDnsResolver(server string, timeout, ttl time.Duration) (*DnsResolver, error) {
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://") {
+		if _, err := url.Parse(server); err != nil {
+			return nil, fmt.Errorf("invalid DNS-over-HTTPS server %q: %w", server, err)
+		}
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: server, client: http.DefaultClient}, nil
+		}
+	} else {
+		address := server
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			address = net.JoinHostPort(server, "53")
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q", server)
+		}
+		dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}
+	}
+
+	return &DnsResolver{
+		resolver: &net.Resolver{PreferGo: true, Dial: dial},
+		timeout:  timeout,
+		ttl:      ttl,
+		clock:    realClock,
+		cache:    map[string]resolvedHost{},
+	}, nil
+}
+
+// lookup returns the IP addresses of host. IP addresses are returned as is.
+func (r *DnsResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	r.mu.Lock()
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && r.clock.now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %w", host, err)
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	r.mu.Lock()
+	r.cache[host] = resolvedHost{ips: ips, expires: r.clock.now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return ips, nil
+}
+
+// dialContext returns a dial function resolving the host of the address with the resolver, then connecting to its
+// addresses in order with dial until one succeeds.
+func (r *DnsResolver) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var errs []error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+
+		return nil, errors.Join(errs...)
+	}
+}
+
+// WithResolver makes the client resolve the hostnames of its trackers and peers with r.
+func WithResolver(r *DnsResolver) Option {
+	return func(c *Client) {
+		c.resolver = r
+		c.dialer, c.tracker, c.webClient = newNetworkTransport(c.bindAddress, c.resolver)
+	}
+}
+
+// dohConn carries the DNS messages of the Go resolver to a DNS-over-HTTPS server. It's a stream connection, so the
+// resolver frames every query with its 2 bytes length. Each query is posted once complete, and its framed response is
+// read back.
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	query    bytes.Buffer
+	response bytes.Buffer
+	deadline time.Time
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+
+	framed := c.query.Bytes()
+	if len(framed) < 2 || len(framed) < 2+int(binary.BigEndian.Uint16(framed)) {
+		return len(b), nil
+	}
+	message := framed[2 : 2+int(binary.BigEndian.Uint16(framed))]
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(message))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", DNS_MESSAGE_MEDIA_TYPE)
+	req.Header.Set("Accept", DNS_MESSAGE_MEDIA_TYPE)
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("DNS-over-HTTPS server responded %s", res.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+
+	c.query.Reset()
+	c.response.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+	c.response.Write(answer)
+
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return c.response.Read(b)
+}
+
+func (c *dohConn) Close() error                     { return nil }
+func (c *dohConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error    { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,265 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Suffix of the state kept next to the output file of an unfinished download
+const RESUME_SUFFIX = ".resume"
+
+// resumeState is the progress of a download, as persisted in its resume file.
+type resumeState struct {
+	InfoHash string      `json:"infoHash"`          // Hex info hash of the torrent being downloaded
+	Pieces   string      `json:"pieces"`            // Bitfield of the verified pieces in the output file, hex encoded
+	Partial  map[int]int `json:"partial,omitempty"` // Bytes of the blocks written at the start of unverified pieces
+}
+
+// resumeFile tracks the pieces of a download written to its output file as they arrive, so an interrupted download
+// only fetches what's missing when started again. Verified pieces are saved to the resume file as they complete.
+type resumeFile struct {
+	path  string      // Resume file
+	store *pieceStore // Output file, written at the offsets of the pieces
+
+	mu      sync.Mutex
+	state   resumeState
+	pieces  peer.Bitfield
+	partial map[int]int
+}
+
+// openResume opens the output file of the torrent at outputPath, and the progress of a previous download of the
+// torrent to it. The progress of another torrent is discarded.
+func (t Torrent) openResume(outputPath string) (*resumeFile, error) {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0770); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	// Streaming readers wait for the pieces to be written, not only verified
+	store, err := openPieceStore(t.getClient().storage, outputPath, t.info, t.verified.done)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &resumeFile{
+		path:    outputPath + RESUME_SUFFIX,
+		store:   store,
+		state:   resumeState{InfoHash: toHex(t.infoHash)},
+		pieces:  make(peer.Bitfield, (t.info.nPieces+7)/8),
+		partial: map[int]int{},
+	}
+
+	content, err := os.ReadFile(r.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+
+	var previous resumeState
+	if err := json.Unmarshal(content, &previous); err != nil || previous.InfoHash != r.state.InfoHash {
+		// Unreadable or left by another torrent, the download starts over
+		return r, nil
+	}
+	if pieces, err := hex.DecodeString(previous.Pieces); err == nil && len(pieces) == len(r.pieces) {
+		r.pieces = pieces
+	}
+	for index, length := range previous.Partial {
+		if index >= 0 && index < t.info.nPieces && length > 0 {
+			r.partial[index] = length
+		}
+	}
+
+	return r, nil
+}
+
+// restore checks the pieces the resume file marks as verified against their hashes, as the output file may have been
+// changed or not flushed since. Invalid pieces are downloaded again. Returns the number of restored pieces.
+func (r *resumeFile) restore(t Torrent) (int, error) {
+	var marked []int
+	for i := 0; i < t.info.nPieces; i++ {
+		if r.pieces.Has(i) {
+			marked = append(marked, i)
+		}
+	}
+
+	valid, err := t.verifyPieces(marked, func(i int) ([]byte, error) {
+		data := make([]byte, t.info.pieceLengthAt(i))
+		if _, err := r.store.readAt(data, int64(i*t.info.pieceLength)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return data, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	restored := 0
+	for i, ok := range valid {
+		if ok {
+			restored++
+			continue
+		}
+
+		r.pieces[marked[i]/8] &^= 0x80 >> (marked[i] % 8)
+	}
+
+	return restored, nil
+}
+
+// has returns whether the piece at index was restored or completed.
+func (r *resumeFile) has(index int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.pieces.Has(index)
+}
+
+// verifiedPieces returns a copy of the bitfield of the pieces restored or completed, nil when there is none yet.
+func (r *resumeFile) verifiedPieces() peer.Bitfield {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, b := range r.pieces {
+		if b != 0 {
+			return slices.Clone(r.pieces)
+		}
+	}
+
+	return nil
+}
+
+// prefix returns the blocks at the start of the piece at index written by a previous attempt, to be completed.
+func (r *resumeFile) prefix(t Torrent, index int) []byte {
+	r.mu.Lock()
+	length := r.partial[index]
+	r.mu.Unlock()
+
+	if length == 0 {
+		return nil
+	}
+
+	prefix := make([]byte, min(length, t.info.pieceLengthAt(index)))
+	if _, err := r.store.readAt(prefix, int64(index*t.info.pieceLength)); err != nil {
+		return nil
+	}
+
+	return prefix
+}
+
+// readBlock returns length bytes of the piece at index, starting at begin, to be uploaded. The piece is read from the
+// output file unless the store holds it in memory.
+// Returns nil when the piece isn't verified yet.
+func (r *resumeFile) readBlock(t Torrent, index, begin, length int) ([]byte, error) {
+	if !r.has(index) {
+		return nil, nil
+	}
+
+	piece, err := r.store.readPiece(index, t.info.pieceLengthAt(index))
+	if err != nil {
+		return nil, err
+	}
+
+	return piece[begin : begin+length], nil
+}
+
+// writeBlock writes a downloaded block of the piece at index to the output file, extending the prefix of the piece.
+func (r *resumeFile) writeBlock(t Torrent, index, begin int, block []byte) {
+	if _, err := r.store.writeAt(block, int64(index*t.info.pieceLength+begin)); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.partial[index] == begin {
+		r.partial[index] = begin + len(block)
+	}
+}
+
+// writePiece queues the verified piece at index to be written to the output file, over the blocks written as they
+// arrived. Fails when a previous write failed.
+func (r *resumeFile) writePiece(t Torrent, index int, piece []byte) error {
+	return r.store.writePiece(index, piece)
+}
+
+// discard forgets the blocks written for the piece at index, after it failed verification.
+func (r *resumeFile) discard(index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.partial, index)
+}
+
+// complete marks the piece at index as verified and saves the progress.
+func (r *resumeFile) complete(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pieces.Set(index)
+	delete(r.partial, index)
+
+	return r.saveLocked()
+}
+
+// save writes the progress to the resume file.
+func (r *resumeFile) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.saveLocked()
+}
+
+// saveLocked writes the progress to the resume file. Must be called holding the lock.
+func (r *resumeFile) saveLocked() error {
+	r.state.Pieces = toHex(r.pieces)
+	r.state.Partial = r.partial
+
+	content, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := r.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, r.path)
+}
+
+// sync writes the queued pieces, and flushes the output file to the disk.
+func (r *resumeFile) sync() error {
+	return r.store.sync()
+}
+
+// close writes the queued pieces and closes the output file. The resume file is removed when the download finished, and
+// kept otherwise.
+func (r *resumeFile) close(finished bool) error {
+	r.store.close()
+
+	if finished {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
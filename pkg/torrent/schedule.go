@@ -0,0 +1,212 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the bandwidth schedule is re-evaluated
+const BANDWIDTH_SCHEDULE_INTERVAL = time.Minute
+
+// bandwidthLimits holds transfer rates in bytes per second. 0 means unlimited.
+type bandwidthLimits struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+// bandwidthRule applies its limits during a time-of-day window, e.g. from "09:00" to "18:00". Windows where To is
+// before From span midnight.
+type bandwidthRule struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"` // Days the rule applies to ("mon", "tue"...), every day when empty
+	bandwidthLimits
+}
+
+// BandwidthSchedule holds the limits applied to the rate limiters of a client. The first rule matching the current time
+// wins, and the default limits apply when none does. An empty schedule leaves the limits of the client as configured.
+type BandwidthSchedule struct {
+	Default bandwidthLimits `json:"default"`
+	Rules   []bandwidthRule `json:"rules,omitempty"`
+}
+
+// parseTimeOfDay parses a "HH:MM" string. Returns the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// empty reports whether the schedule has neither rules nor default limits.
+func (s BandwidthSchedule) empty() bool {
+	return len(s.Rules) == 0 && s.Default == bandwidthLimits{}
+}
+
+// Validate checks every rule of the schedule is well formed.
+func (s BandwidthSchedule) Validate() error {
+	if s.Default.Download < 0 || s.Default.Upload < 0 {
+		return fmt.Errorf("rates can't be negative")
+	}
+
+	for i, rule := range s.Rules {
+		if _, err := parseTimeOfDay(rule.From); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if _, err := parseTimeOfDay(rule.To); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rule.Download < 0 || rule.Upload < 0 {
+			return fmt.Errorf("rule %d: rates can't be negative", i)
+		}
+
+		for _, day := range rule.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("rule %d: invalid day %q", i, day)
+			}
+		}
+	}
+
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// matches returns whether the rule applies at the given time. The rule must be valid.
+func (r bandwidthRule) matches(t time.Time) bool {
+	from, _ := parseTimeOfDay(r.From)
+	to, _ := parseTimeOfDay(r.To)
+	now := t.Hour()*60 + t.Minute()
+
+	day := t.Weekday()
+	if from > to && now < to {
+		// Early hours of a window spanning midnight belong to the window started the day before
+		day = (day + 6) % 7
+	}
+
+	if len(r.Days) > 0 {
+		found := false
+		for _, d := range r.Days {
+			if weekdays[strings.ToLower(d)] == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if from <= to {
+		return now >= from && now < to
+	}
+
+	return now >= from || now < to
+}
+
+// limitsAt returns the limits that apply at the given time.
+func (s BandwidthSchedule) limitsAt(t time.Time) bandwidthLimits {
+	for _, rule := range s.Rules {
+		if rule.matches(t) {
+			return rule.bandwidthLimits
+		}
+	}
+
+	return s.Default
+}
+
+// bandwidthScheduler applies a bandwidth schedule to the rate limiters of a client. The schedule is only evaluated
+// periodically once a non-empty one is set.
+type bandwidthScheduler struct {
+	download *rateLimiter
+	upload   *rateLimiter
+	base     bandwidthLimits // Rates of the limiters as configured, restored when the schedule is emptied
+
+	mu       sync.Mutex
+	schedule BandwidthSchedule
+	started  bool // Whether the periodic evaluation runs
+}
+
+// newBandwidthScheduler returns a scheduler of the download and upload limiters, with an empty schedule.
+func newBandwidthScheduler(download, upload *rateLimiter) *bandwidthScheduler {
+	return &bandwidthScheduler{
+		download: download,
+		upload:   upload,
+		base:     bandwidthLimits{Download: download.getRate(), Upload: upload.getRate()},
+	}
+}
+
+// set replaces the schedule and applies it right away. The periodic evaluation starts with the first non-empty
+// schedule.
+func (s *bandwidthScheduler) set(schedule BandwidthSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.schedule = schedule
+	start := !s.started && !schedule.empty()
+	s.started = s.started || start
+	s.mu.Unlock()
+
+	s.apply(time.Now())
+	if start {
+		go s.run(context.Background())
+	}
+
+	return nil
+}
+
+// get returns the current schedule
+func (s *bandwidthScheduler) get() BandwidthSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.schedule
+}
+
+// apply sets the rates of the limiters to the limits in effect at the given time, the configured ones without a
+// schedule.
+func (s *bandwidthScheduler) apply(t time.Time) {
+	schedule := s.get()
+	limits := s.base
+	if !schedule.empty() {
+		limits = schedule.limitsAt(t)
+	}
+
+	s.download.setRate(limits.Download)
+	s.upload.setRate(limits.Upload)
+}
+
+// current returns the limits in effect.
+func (s *bandwidthScheduler) current() bandwidthLimits {
+	return bandwidthLimits{Download: s.download.getRate(), Upload: s.upload.getRate()}
+}
+
+// run applies the schedule periodically until ctx is done.
+func (s *bandwidthScheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(BANDWIDTH_SCHEDULE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.apply(now)
+		}
+	}
+}
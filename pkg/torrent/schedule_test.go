@@ -0,0 +1,31 @@
+package torrent
+
+import "testing"
+
+// TestBandwidthScheduler checks an empty schedule leaves the configured rates of the limiters, a schedule drives them,
+// and emptying it restores the configured rates.
+func TestBandwidthScheduler(t *testing.T) {
+	c := NewClient(WithRateLimits(1_000, 2_000))
+	s := newBandwidthScheduler(c.downloadLimiter, c.uploadLimiter)
+
+	if err := s.set(BandwidthSchedule{}); err != nil {
+		t.Fatal(err)
+	}
+	if current := s.current(); current != (bandwidthLimits{Download: 1_000, Upload: 2_000}) {
+		t.Fatalf("empty schedule changed the limits to %+v", current)
+	}
+
+	if err := s.set(BandwidthSchedule{Default: bandwidthLimits{Download: 500}}); err != nil {
+		t.Fatal(err)
+	}
+	if rate := c.downloadLimiter.getRate(); rate != 500 {
+		t.Fatalf("scheduled download rate of the client is %d", rate)
+	}
+
+	if err := s.set(BandwidthSchedule{}); err != nil {
+		t.Fatal(err)
+	}
+	if current := s.current(); current != (bandwidthLimits{Download: 1_000, Upload: 2_000}) {
+		t.Fatalf("emptied schedule left the limits at %+v", current)
+	}
+}
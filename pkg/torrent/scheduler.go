@@ -0,0 +1,626 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Attempts at a piece, by different peers, before the download fails
+const MAX_PIECE_ATTEMPTS = 3
+
+// pieceResult is the outcome of a piece taken from the work queue by a peer worker: its verified data, or the error
+// for which it's given up.
+type pieceResult struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// pieceQueue holds the pieces waiting for a peer worker. Workers take the pieces their peer has, in the order of the
+// strategy of the queue, and put back the ones their peer failed to deliver. Once no piece is pending, idle workers take the pieces being downloaded by other
+// workers too, the endgame, so the last pieces don't wait on slow peers: the first worker delivering a piece settles
+// it, and the others stop downloading it. Pieces failing MAX_PIECE_ATTEMPTS times are given up.
+type pieceQueue struct {
+	strategy PieceStrategy
+
+	mu           sync.Mutex
+	pending      []int
+	availability []int               // Connected peers having each piece, counted from their bitfields and have messages
+	inFlight     map[int]*takenPiece // Pieces taken and not settled, which may be put back
+	failures     map[int]int         // Failed attempts of each piece
+	changed      chan struct{}       // Closed and replaced when a piece is put back or settled
+}
+
+// takenPiece is a piece being downloaded by one or more workers.
+type takenPiece struct {
+	workers int
+	settled chan struct{} // Closed once a worker delivered the piece
+}
+
+// newPieceQueue returns the queue of the given pieces of a torrent with nPieces pieces, taken in the order of strategy.
+func newPieceQueue(pieces []int, nPieces int, strategy PieceStrategy) *pieceQueue {
+	return &pieceQueue{
+		strategy:     strategy,
+		pending:      orderPieces(pieces, strategy),
+		availability: make([]int, nPieces),
+		inFlight:     map[int]*takenPiece{},
+		failures:     map[int]int{},
+		changed:      make(chan struct{}),
+	}
+}
+
+// addPeer counts the pieces of a peer that connected, advertised by available.
+func (q *pieceQueue) addPeer(available peer.Bitfield) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for index := range q.availability {
+		if available.Has(index) {
+			q.availability[index]++
+		}
+	}
+}
+
+// removePeer stops counting the pieces of a peer that disconnected, advertised by available.
+func (q *pieceQueue) removePeer(available peer.Bitfield) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for index := range q.availability {
+		if available.Has(index) {
+			q.availability[index]--
+		}
+	}
+}
+
+// have counts the piece at index, announced by a have message of a connected peer.
+func (q *pieceQueue) have(index int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if index >= 0 && index < len(q.availability) {
+		q.availability[index]++
+	}
+}
+
+// nextLocked returns the position in pending of the piece available has that the strategy picks: the lowest index
+// when sequential, the one the fewest peers have when rarest, the first one otherwise. Returns -1 when available has
+// no pending piece. Must be called holding the lock.
+func (q *pieceQueue) nextLocked(available peer.Bitfield) int {
+	next := -1
+	for i, index := range q.pending {
+		if !available.Has(index) {
+			continue
+		}
+		switch {
+		case next == -1:
+			next = i
+		case q.strategy == STRATEGY_SEQUENTIAL && index < q.pending[next]:
+			next = i
+		case q.strategy == STRATEGY_RAREST && q.availability[index] < q.availability[q.pending[next]]:
+			next = i
+		}
+		if q.strategy == STRATEGY_RANDOM {
+			break
+		}
+	}
+
+	return next
+}
+
+// take returns the pending piece that available has picked by the strategy, waiting for pieces to be put back while
+// others are being downloaded. When no piece is pending, returns the piece available has with the fewest workers, to be downloaded
+// along them. The returned channel is closed once another worker settles the piece. Returns false when no piece the
+// peer has can become pending, or done is closed.
+func (q *pieceQueue) take(ctx context.Context, available peer.Bitfield, done <-chan struct{}) (int, <-chan struct{}, bool) {
+	for {
+		q.mu.Lock()
+		if i := q.nextLocked(available); i != -1 {
+			index := q.pending[i]
+			q.pending = slices.Delete(q.pending, i, i+1)
+			taken := &takenPiece{workers: 1, settled: make(chan struct{})}
+			q.inFlight[index] = taken
+			q.mu.Unlock()
+			return index, taken.settled, true
+		}
+
+		if len(q.pending) == 0 {
+			endgame, fewest := 0, 0
+			for index, taken := range q.inFlight {
+				if available.Has(index) && (fewest == 0 || taken.workers < fewest || taken.workers == fewest && index < endgame) {
+					endgame, fewest = index, taken.workers
+				}
+			}
+			if fewest > 0 {
+				taken := q.inFlight[endgame]
+				taken.workers++
+				q.mu.Unlock()
+				return endgame, taken.settled, true
+			}
+		}
+
+		if len(q.inFlight) == 0 {
+			q.mu.Unlock()
+			return 0, nil, false
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-done:
+			return 0, nil, false
+		case <-ctx.Done():
+			return 0, nil, false
+		}
+	}
+}
+
+// endgame returns whether no piece is pending, the workers then take the pieces being downloaded by others.
+func (q *pieceQueue) endgame() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending) == 0
+}
+
+// put gives up a piece that was taken, after a failed attempt. It's put back for another worker, unless other workers
+// are downloading it. Returns true when the piece failed MAX_PIECE_ATTEMPTS times and no worker is left on it, it's
+// then removed from the queue for good.
+func (q *pieceQueue) put(index int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	taken, ok := q.inFlight[index]
+	if !ok {
+		// Settled by another worker meanwhile
+		return false
+	}
+
+	q.failures[index]++
+	taken.workers--
+	exhausted := false
+	if taken.workers == 0 {
+		delete(q.inFlight, index)
+		if q.failures[index] >= MAX_PIECE_ATTEMPTS {
+			exhausted = true
+		} else {
+			q.pending = append(q.pending, index)
+		}
+	}
+	q.notifyLocked()
+
+	return exhausted
+}
+
+// attempts returns the failed attempts of a piece.
+func (q *pieceQueue) attempts(index int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.failures[index]
+}
+
+// settle removes a piece that was taken from the queue for good, once downloaded or given up, and stops the other
+// workers downloading it. Returns false when another worker settled it first, the piece is then discarded.
+func (q *pieceQueue) settle(index int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	taken, ok := q.inFlight[index]
+	if !ok {
+		return false
+	}
+
+	close(taken.settled)
+	delete(q.inFlight, index)
+	q.notifyLocked()
+
+	return true
+}
+
+// notifyLocked wakes up the waiting workers. Must be called holding the lock.
+func (q *pieceQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// pieceWorker downloads the pieces of the queue its peer advertised, one at a time, and hands them to the hash pool of
+// the client, downloading the next one while a piece is verified. Verified pieces are sent to results. A piece the peer
+// fails to deliver is put back on the queue for the other workers, and the worker stops, as its connection is unusable
+// or the peer sends corrupted data. A piece failing its last attempt is sent to results with errPieceFailed. A piece
+// delivered by another worker first is left for the next one. The worker also stops once done is closed, or when none
+// of the remaining pieces is available from its peer.
+func (t Torrent) pieceWorker(ctx context.Context, peer *workingPeer, resume *resumeFile, queue *pieceQueue, results chan<- pieceResult, done <-chan struct{}) {
+	c := t.getClient()
+
+	if err := t.exchangeInterest(ctx, peer.conn); err != nil {
+		if ctx.Err() == nil {
+			c.deadPeers.failed(peer.address)
+			c.log.Warn(fmt.Sprintf("peer %s: %s", peer.address, err), "peer", peer.address)
+		}
+		return
+	}
+
+	// The pieces of the peer count in the availability of the rarest first strategy while it's connected
+	queue.addPeer(peer.conn.available)
+	peer.conn.onHave = queue.have
+	defer func() { queue.removePeer(peer.conn.available) }()
+	defer peer.conn.upload.leave()
+
+	// report settles a piece downloaded and verified, or puts it back after a failed attempt. Returns false when the
+	// worker must stop
+	report := func(pieceIndex int, data []byte, err error) bool {
+		// Vetoed pieces are not wanted, no other peer is asked. Neither is one when the disk fails, the download stops
+		if err == nil || errors.Is(err, ErrVetoed) || errors.Is(err, ErrDiskFailure) {
+			if queue.settle(pieceIndex) {
+				select {
+				case results <- pieceResult{index: pieceIndex, data: data, err: err}:
+				case <-done:
+				}
+			}
+			return true
+		}
+
+		if queue.put(pieceIndex) {
+			err = fmt.Errorf("%w: piece %d after %d attempts, the last one: %w", ErrPieceFailed, pieceIndex, queue.attempts(pieceIndex), err)
+			select {
+			case results <- pieceResult{index: pieceIndex, err: err}:
+			case <-done:
+			}
+		}
+		return false
+	}
+
+	// One piece of the worker is verified at a time, the worker waits for it before leaving so its result is reported.
+	// The connection of a peer banned meanwhile is closed then
+	var hashing sync.WaitGroup
+	var stopped atomic.Bool
+	defer func() {
+		hashing.Wait()
+		if c.deadPeers.isBanned(peer.address) {
+			peer.closer()
+		}
+	}()
+
+	for !stopped.Load() {
+		// The endgame would hand the worker the piece it's verifying again
+		if queue.endgame() {
+			hashing.Wait()
+		}
+		pieceIndex, settled, ok := queue.take(ctx, peer.conn.available, done)
+		if !ok {
+			return
+		}
+
+		data, err := t.downloadPiece(ctx, peer, resume, pieceIndex, settled)
+		if errors.Is(err, ErrPieceSettled) {
+			continue
+		}
+		if err != nil {
+			report(pieceIndex, nil, err)
+			return
+		}
+
+		hashing.Wait()
+		hashing.Add(1)
+		err = c.hashes.submit(ctx, t, pieceIndex, data, peer.address, func(valid bool) {
+			defer hashing.Done()
+			data, err := t.completePiece(ctx, peer, resume, pieceIndex, data, valid)
+			if !report(pieceIndex, data, err) {
+				stopped.Store(true)
+			}
+		})
+		if err != nil {
+			hashing.Done()
+			report(pieceIndex, nil, err)
+			return
+		}
+	}
+}
+
+// downloadPiece downloads the piece at pieceIndex from the peer, continuing the blocks a previous attempt wrote to the
+// output file. The blocks are written to the file as they arrive. The data isn't verified yet. The download stops with
+// errPieceSettled once settled is closed, when another peer delivered the piece.
+func (t Torrent) downloadPiece(ctx context.Context, peer *workingPeer, resume *resumeFile, pieceIndex int, settled <-chan struct{}) ([]byte, error) {
+	c := t.getClient()
+	address := peer.address
+
+	pieceCtx, pieceSpan := c.tracer.startSpan(ctx, "piece")
+	pieceSpan.setAttribute("piece.index", pieceIndex)
+	pieceSpan.setAttribute("peer.address", address)
+	var err error
+	defer func() { pieceSpan.end(err) }()
+
+	c.logPiece(fmt.Sprintf("Downloading piece %d from peer %s", pieceIndex, address), "peer", address, "piece", pieceIndex)
+
+	// Get piece data, the worker already exchanged the initial messages: bitfield, interested, unchoke
+	_, transferSpan := c.tracer.startSpan(pieceCtx, "piece.download")
+	writeBlock := func(begin int, block []byte) {
+		resume.writeBlock(t, pieceIndex, begin, block)
+		t.progress.received(address, len(block))
+		t.stats.received(len(block))
+		peer.conn.metrics.received(len(block))
+	}
+	pieceData, err := t.resumePieceFromPeer(pieceCtx, peer.conn, pieceIndex, false, resume.prefix(t, pieceIndex), writeBlock, settled)
+	transferSpan.setAttribute("piece.bytes", len(pieceData))
+	transferSpan.end(err)
+	if errors.Is(err, ErrPieceSettled) {
+		c.logPiece(fmt.Sprintf("Piece %d was delivered by another peer, cancelled it on peer %s", pieceIndex, address),
+			"peer", address, "piece", pieceIndex)
+		return nil, err
+	}
+	if err != nil {
+		// The connection is closed once the download ends, the piece then came from another peer
+		select {
+		case <-settled:
+			err = ErrPieceSettled
+			return nil, err
+		default:
+		}
+
+		// The connection stopped in the middle of a message exchange, it can't be used anymore. The download reports
+		// its own cancellation
+		err = &PieceError{Piece: pieceIndex, Peer: address, Err: err}
+		if ctx.Err() == nil {
+			c.deadPeers.failed(address)
+			c.log.Warn(err.Error(), "peer", address, "piece", pieceIndex)
+		}
+		return nil, err
+	}
+
+	return pieceData, nil
+}
+
+// completePiece finishes the piece at pieceIndex downloaded from the peer once the hash pool verified it: valid pieces
+// are written whole to the output file of resume, the blocks of corrupt ones are discarded.
+func (t Torrent) completePiece(ctx context.Context, peer *workingPeer, resume *resumeFile, pieceIndex int, pieceData []byte, valid bool) ([]byte, error) {
+	c := t.getClient()
+	address := peer.address
+
+	var err error
+	pieceCtx, verifySpan := c.tracer.startSpan(ctx, "piece.verify")
+	verifySpan.setAttribute("piece.index", pieceIndex)
+	verifySpan.setAttribute("peer.address", address)
+	c.log.Debug("Verified piece", "peer", address, "piece", pieceIndex, "valid", valid)
+
+	if !valid {
+		resume.discard(pieceIndex)
+		c.deadPeers.failed(address)
+		err = &PieceError{Piece: pieceIndex, Peer: address, Err: ErrHashMismatch}
+		verifySpan.end(err)
+		c.log.Warn(err.Error(), "peer", address, "piece", pieceIndex)
+		t.publish(Event{Type: EVENT_HASH_FAIL, Piece: &pieceIndex, Peer: address, Error: err.Error()})
+		return nil, err
+	}
+	verifySpan.end(nil)
+	c.deadPeers.succeeded(address)
+
+	// The piece is discarded if the download was cancelled meanwhile
+	if ctx.Err() != nil {
+		err = ctx.Err()
+		return nil, err
+	}
+
+	err = t.publish(Event{Type: EVENT_PIECE_COMPLETE, Piece: &pieceIndex, Peer: address, Bytes: len(pieceData)})
+	if err != nil {
+		resume.discard(pieceIndex)
+		err = &PieceError{Piece: pieceIndex, Peer: address, Err: err}
+		c.log.Warn(err.Error(), "peer", address, "piece", pieceIndex)
+		return nil, err
+	}
+
+	// Written whole once verified, a block failing to be written as it arrived is written then
+	_, writeSpan := c.tracer.startSpan(pieceCtx, "disk.write")
+	writeSpan.setAttribute("piece.index", pieceIndex)
+	err = resume.writePiece(t, pieceIndex, pieceData)
+	writeSpan.end(err)
+	if err != nil {
+		resume.discard(pieceIndex)
+		return nil, err
+	}
+	peer.conn.metrics.delivered()
+
+	return pieceData, nil
+}
+
+// schedulePieces downloads the pieces missing from resume from the working peers, through a work queue with a worker
+// per peer writing them to the output file of resume. Pieces are only assigned to peers advertising them. Every
+// connected peer joins pool, the peers connecting to the listener of the client too, and a peer whose connection dies
+// leaves it. The peers are served the pieces we have meanwhile. The web seeds of the torrent download pieces along
+// them. The candidates of the pool, including the peers learned through peer exchange and the ones the trackers return
+// when session is due, are dialed while it isn't full. Returns once every piece is downloaded, or no worker is left.
+// Fails as soon as a piece fails MAX_PIECE_ATTEMPTS times, or the disk fails.
+func (t Torrent) schedulePieces(ctx context.Context, pool *peerPool, working []*workingPeer, session *trackerSession, resume *resumeFile) error {
+	c := t.getClient()
+
+	// Cancelled when a piece fails for good, the workers stop then
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failed error
+
+	var missing []int
+	for i := 0; i < t.info.nPieces; i++ {
+		if !resume.has(i) {
+			missing = append(missing, i)
+		}
+	}
+	queue := newPieceQueue(missing, t.info.nPieces, c.strategy)
+	pending := len(missing)
+
+	results := make(chan pieceResult)
+	done := make(chan struct{})
+	defer close(done)
+
+	// Workers hand the learned peers over before exiting, so the download doesn't end while they're dialed
+	learned := make(chan []string)
+	onPeers := func(peers []string) {
+		select {
+		case learned <- peers:
+		case <-done:
+		}
+	}
+	dialed := make(chan []*workingPeer)
+	joined := []*workingPeer{}
+	defer func() {
+		for _, peer := range joined {
+			peer.closer()
+		}
+	}()
+
+	// Peers connecting to us join the download too, while the pool isn't full
+	inbound := make(chan *workingPeer)
+	if c.listener != nil {
+		unregister := c.listener.register(t, inbound, done)
+		defer unregister()
+	}
+
+	// The peers of the workers are served the pieces we have while they download, tit-for-tat
+	uploads := newUploader(t, resume)
+
+	active, dialing := 0, 0 // Workers running, dials of new peers in progress
+	workers := make(chan string)
+	startWorker := func(peer *workingPeer) {
+		if !pool.join(peer.address) {
+			peer.closer()
+			return
+		}
+		active++
+		// Peers of private torrents come from the trackers only, BEP 27
+		if !t.info.private {
+			peer.conn.onPeers = onPeers
+		}
+		peer.conn.metrics = t.metrics.peer(peer.address)
+		peer.conn.upload = uploads.join(peer.conn)
+		go func() {
+			t.pieceWorker(ctx, peer, resume, queue, results, done)
+			select {
+			case workers <- peer.address:
+			case <-done:
+			}
+		}()
+	}
+	// refill dials the candidates of the pool while it isn't full
+	refill := func() {
+		candidates := pool.reserve()
+		if len(candidates) == 0 {
+			return
+		}
+		dialing++
+		go func() {
+			peers := t.dialWorkingSet(ctx, candidates, len(candidates))
+			pool.release(candidates)
+			select {
+			case dialed <- peers:
+			case <-done:
+				for _, peer := range peers {
+					peer.closer()
+				}
+			}
+		}()
+	}
+	// The trackers are announced again on their interval, one announce at a time
+	refreshed := make(chan []string)
+	reannounce, stopReannounce := c.clock.newTimer(session.untilNext())
+	defer func() { stopReannounce() }()
+
+	for _, peer := range working {
+		startWorker(peer)
+	}
+	// Web seeds take pieces like peers, they are not part of the pool
+	for _, seed := range t.webSeeds {
+		active++
+		go func() {
+			t.webSeedWorker(ctx, seed, resume, queue, results, done)
+			select {
+			case workers <- seed:
+			case <-done:
+			}
+		}()
+	}
+
+	// The peers that dropped are replaced on the next refill, and redialed once their backoff elapsed
+	refillTicker := time.NewTicker(PEER_POOL_REFILL_INTERVAL)
+	defer refillTicker.Stop()
+
+	rechokeTicker := time.NewTicker(RECHOKE_INTERVAL)
+	defer rechokeTicker.Stop()
+
+	// The transfer statistics of the peers are logged with --stats only
+	var reportTicks <-chan time.Time
+	if c.statsReport {
+		reportTicker := time.NewTicker(METRICS_REPORT_INTERVAL)
+		defer reportTicker.Stop()
+		reportTicks = reportTicker.C
+	}
+
+	for pending > 0 && (active > 0 || dialing > 0) {
+		select {
+		case r := <-results:
+			pending--
+			if (errors.Is(r.err, ErrPieceFailed) || errors.Is(r.err, ErrDiskFailure)) && failed == nil {
+				failed = r.err
+				cancel()
+			}
+			if r.err != nil {
+				continue
+			}
+
+			if err := resume.complete(r.index); err != nil {
+				c.log.Error(err.Error(), "piece", r.index)
+			}
+			uploads.have(r.index)
+			t.progress.verified(len(r.data))
+			t.stats.verified(len(r.data))
+			c.logPiece(fmt.Sprintf("Downloaded piece %d", r.index), "piece", r.index)
+		case address := <-workers:
+			active--
+			pool.leave(address)
+			t.metrics.remove(address)
+		case peers := <-learned:
+			if n := pool.add(peers); n > 0 {
+				c.log.Info(fmt.Sprintf("Learned %d new peers through peer exchange", n), "peers", n)
+				refill()
+			}
+		case <-refillTicker.C:
+			refill()
+		case now := <-rechokeTicker.C:
+			uploads.rechoke(now)
+		case now := <-reportTicks:
+			t.metrics.report(c.log, now)
+		case <-reannounce:
+			session.refresh(ctx, refreshed, done)
+		case peers := <-refreshed:
+			reannounce, stopReannounce = c.clock.newTimer(session.untilNext())
+			if n := pool.add(peers); n > 0 {
+				c.log.Info(fmt.Sprintf("Tracker returned %d new peers", n), "peers", n)
+				refill()
+			}
+		case peer := <-inbound:
+			joined = append(joined, peer)
+			startWorker(peer)
+		case peers := <-dialed:
+			dialing--
+			for _, peer := range peers {
+				joined = append(joined, peer)
+				startWorker(peer)
+			}
+		}
+	}
+
+	if failed != nil {
+		return failed
+	}
+	if pending > 0 && ctx.Err() == nil {
+		c.log.Warn(fmt.Sprintf("%s: %d pieces left that no working peer could deliver", ErrNoPeers, pending), "pieces", pending)
+	}
+
+	return nil
+}
@@ -0,0 +1,570 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of the torrents of a session
+const STATUS_STOPPED = "stopped"
+const STATUS_QUEUED = "queued"
+const STATUS_METADATA = "fetching metadata"
+const STATUS_DOWNLOADING = "downloading"
+const STATUS_STALLED = "stalled"
+const STATUS_COMPLETED = "completed"
+
+// Default amount of torrents downloading at the same time
+const DEFAULT_MAX_ACTIVE_TORRENTS = 5
+
+// Session holds many torrents downloading at the same time, the ones beyond maxActive queued by priority. They share
+// the client of the session: its listener, DHT node, peer ID and rate limits, and the budgets of the session: the
+// peers they are connected to together and the bytes they store on the disk together.
+type Session struct {
+	downloadDir string
+	client      *Client // Settings of the torrents added without a client of their own
+	events      *eventBus
+	maxActive   int         // Maximum amount of torrents downloading at the same time, 0 for no limit
+	peers       *peerBudget // Peers the torrents are connected to together, unlimited when nil
+	maxDisk     int         // Bytes of data the torrents store together at most, 0 for no limit
+	categories  map[string]CategoryConfig
+	identities  *identityStore // Peer IDs and keys of the torrents persisted across sessions, none when nil
+	clock       clock          // Times the downloads, simulated to run the queue deterministically
+
+	mu       sync.Mutex
+	nextId   int
+	torrents map[string]*SessionTorrent // Torrents of the session, keyed by hex info hash
+
+	ended chan *SessionTorrent // Receives the torrents whose download ended, when set
+}
+
+// SessionTorrent is a torrent of a session along with its download state.
+type SessionTorrent struct {
+	id          int
+	t           Torrent
+	downloadDir string
+	priority    int // Queued torrents with higher priority start first
+	labels      []string
+	category    string
+	addedAt     time.Time
+	startedAt   time.Time
+	doneAt      time.Time
+	cancel      context.CancelFunc // Cancels the download, set while running
+	done        chan struct{}      // Closed once the download exits, nil until the torrent is first started
+
+	status          string
+	piecesDone      int
+	downloaded      int
+	uploaded        int       // Bytes of the blocks sent to peers since the torrent was added
+	uploadedAtStart int       // Bytes uploaded when the torrent was last started
+	lastProgress    time.Time // Last time a piece was completed, used to detect stalled downloads
+	err             string
+}
+
+func newSession(c *Client, downloadDir string) *Session {
+	return &Session{
+		downloadDir: downloadDir,
+		client:      c,
+		events:      newEventBus(),
+		maxActive:   DEFAULT_MAX_ACTIVE_TORRENTS,
+		categories:  map[string]CategoryConfig{},
+		clock:       realClock,
+		nextId:      1,
+		torrents:    map[string]*SessionTorrent{},
+	}
+}
+
+// SessionLimits are the budgets shared by the torrents of a session, no limit when 0.
+type SessionLimits struct {
+	MaxPeers int // Peers the torrents are connected to together
+	MaxDisk  int // Bytes of data the torrents store together
+}
+
+// NewSession returns a session downloading its torrents into downloadDir with the client c, within limits.
+func NewSession(c *Client, downloadDir string, limits SessionLimits) *Session {
+	s := newSession(c, downloadDir)
+	s.setLimits(limits)
+
+	return s
+}
+
+// setLimits sets the budgets of the session. Must be called before its torrents are added.
+func (s *Session) setLimits(limits SessionLimits) {
+	if limits.MaxPeers > 0 {
+		s.peers = newPeerBudget(limits.MaxPeers)
+	}
+	s.maxDisk = limits.MaxDisk
+}
+
+// AddOptions holds the settings of a torrent being added to a session.
+type AddOptions struct {
+	DownloadDir string // Directory the torrent is downloaded into, the session download directory when empty
+	Priority    int    // Queued torrents with higher priority start first
+	Labels      []string
+	Category    string // Completed torrents are moved to the directory of their category, if any
+}
+
+// AddTorrent registers the torrent in the session and queues it for download. Returns the added torrent, or the
+// existing one along with an error if it was already added.
+func (s *Session) AddTorrent(t Torrent, opts AddOptions) (*SessionTorrent, error) {
+	hash := toHex(t.infoHash)
+	downloadDir := opts.DownloadDir
+	if downloadDir == "" {
+		downloadDir = s.downloadDir
+	}
+
+	labels, err := normalizeLabels(opts.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	existing, ok := s.torrents[hash]
+	s.mu.Unlock()
+	if ok {
+		return existing, fmt.Errorf("torrent %s already added", hash)
+	}
+
+	t.events = s.events
+	t.peerBudget = s.peers
+	if t.client == nil {
+		t.client = s.client
+	}
+
+	if s.identities != nil {
+		id, err := s.identities.get(hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := id.apply(&t); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hooks can refuse the torrent. They run without holding the lock, so the torrent may have been added meanwhile
+	if err := t.publish(Event{Type: EVENT_ADDED, Bytes: t.info.length}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.torrents[hash]; ok {
+		return existing, fmt.Errorf("torrent %s already added", hash)
+	}
+	if err := s.checkDiskLocked(t.info.length, nil); err != nil {
+		return nil, err
+	}
+
+	st := &SessionTorrent{
+		id:          s.nextId,
+		t:           t,
+		downloadDir: downloadDir,
+		priority:    opts.Priority,
+		labels:      labels,
+		category:    strings.TrimSpace(opts.Category),
+		addedAt:     s.clock.now(),
+		status:      STATUS_QUEUED,
+	}
+	s.nextId++
+	s.torrents[hash] = st
+	s.scheduleLocked()
+
+	return st, nil
+}
+
+// checkDiskLocked returns an error when storing length more bytes would exceed the disk budget, along with the data
+// of the torrents of the session other than except. Must be called holding the session lock.
+func (s *Session) checkDiskLocked(length int, except *SessionTorrent) error {
+	if s.maxDisk <= 0 {
+		return nil
+	}
+
+	used := 0
+	for _, st := range s.torrents {
+		if st != except {
+			used += st.t.info.length
+		}
+	}
+	if used+length > s.maxDisk {
+		return fmt.Errorf("%w: %d bytes with the %d bytes of the session, over its %d bytes", ErrDiskBudget, length, used,
+			s.maxDisk)
+	}
+
+	return nil
+}
+
+// startLocked starts downloading the torrent. Must be called holding the session lock.
+func (s *Session) startLocked(st *SessionTorrent) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	st.cancel = cancel
+	st.done = make(chan struct{})
+	st.status = STATUS_DOWNLOADING
+	st.startedAt = s.clock.now()
+	st.lastProgress = st.startedAt
+	st.piecesDone = 0
+	st.downloaded = 0
+	st.uploadedAtStart = st.uploaded
+	st.err = ""
+
+	go func(done chan struct{}) {
+		s.download(ctx, st)
+		close(done)
+
+		// The slot is given to the next queued torrent, which is the torrent itself when resumed while it was exiting
+		s.schedule()
+	}(st.done)
+}
+
+// download fetches the torrent metadata when missing, and downloads the torrent data. The torrent is stopped if the
+// download ends without completing.
+func (s *Session) download(ctx context.Context, st *SessionTorrent) {
+	if s.ended != nil {
+		defer func() { s.ended <- st }()
+	}
+
+	s.mu.Lock()
+	t := st.t
+	s.mu.Unlock()
+
+	if t.info.pieces == nil {
+		s.setStatus(st, STATUS_METADATA)
+
+		metadataCtx, span := s.client.tracer.startSpan(ctx, "metadata.fetch")
+		span.setAttribute("torrent.info_hash", toHex(t.infoHash))
+		err := t.MagnetInfo(metadataCtx)
+		span.end(err)
+
+		// The length of a magnet link is known once its metadata is, it's only then checked against the disk budget
+		s.mu.Lock()
+		if err == nil {
+			err = s.checkDiskLocked(t.info.length, st)
+		}
+		if err != nil {
+			st.err = err.Error()
+			st.status = STATUS_STOPPED
+			s.mu.Unlock()
+			return
+		}
+		st.t.info = t.info
+		if ctx.Err() == nil {
+			st.status = STATUS_DOWNLOADING
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	outputPath, err := st.dataPath()
+	if err != nil {
+		st.err = err.Error()
+		st.status = STATUS_STOPPED
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	err = t.DownloadFile(ctx, outputPath)
+
+	// Events are observed synchronously, so a completed download has already been marked
+	s.mu.Lock()
+	completed := st.status == STATUS_COMPLETED
+	if ctx.Err() == nil && !completed {
+		st.status = STATUS_STOPPED
+		if err != nil {
+			st.err = err.Error()
+		} else if st.err == "" {
+			st.err = "download did not complete"
+		}
+	}
+	s.mu.Unlock()
+
+	if completed {
+		if err := s.moveCompleted(st); err != nil {
+			s.mu.Lock()
+			st.err = err.Error()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Session) setStatus(st *SessionTorrent, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.status = status
+}
+
+// snapshot returns a copy of the torrent state, safe to read without holding the session lock.
+func (s *Session) snapshot(st *SessionTorrent) SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *st
+}
+
+// downloadRate returns the average download rate in bytes per second from the start of the torrent until now
+func (st *SessionTorrent) downloadRate(now time.Time) int {
+	return st.averageRate(st.downloaded, now)
+}
+
+// uploadRate returns the average upload rate in bytes per second from the start of the torrent until now
+func (st *SessionTorrent) uploadRate(now time.Time) int {
+	return st.averageRate(st.uploaded-st.uploadedAtStart, now)
+}
+
+// averageRate returns the rate in bytes per second of transferring n bytes from the start of the torrent until now,
+// 0 when it isn't running.
+func (st *SessionTorrent) averageRate(n int, now time.Time) int {
+	if !st.running() {
+		return 0
+	}
+
+	elapsed := now.Sub(st.startedAt).Seconds()
+	if elapsed < 1 {
+		return 0
+	}
+
+	return int(float64(n) / elapsed)
+}
+
+// running returns whether the torrent download is in progress
+func (st *SessionTorrent) running() bool {
+	return st.status == STATUS_DOWNLOADING || st.status == STATUS_METADATA || st.status == STATUS_STALLED
+}
+
+// exited returns whether the last download of the torrent exited, true when it was never started.
+func (st *SessionTorrent) exited() bool {
+	if st.done == nil {
+		return true
+	}
+
+	select {
+	case <-st.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// dataPath returns the location of the downloaded data of the torrent. Fails with errUnsafePath when it isn't inside
+// the download directory of the torrent.
+func (st *SessionTorrent) dataPath() (string, error) {
+	path := filepath.Join(st.downloadDir, st.t.info.name)
+	if !insideDir(st.downloadDir, path) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, path)
+	}
+
+	return path, nil
+}
+
+// Pause stops the download of the torrent, giving its slot to the next queued torrent, and returns once the download
+// exited. Completed torrents are left untouched.
+func (s *Session) Pause(hash string) error {
+	s.mu.Lock()
+	st, ok := s.torrents[hash]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+
+	if st.running() {
+		st.cancel()
+	}
+	if st.status != STATUS_COMPLETED {
+		st.status = STATUS_STOPPED
+	}
+	done := st.done
+	s.scheduleLocked()
+	s.mu.Unlock()
+
+	// The download takes the session lock to exit, it's waited for once released
+	if done != nil {
+		<-done
+	}
+
+	return nil
+}
+
+// Resume queues a paused torrent again. The download resumes from the pieces already in its data.
+func (s *Session) Resume(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.torrents[hash]
+	if !ok {
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+
+	if st.status == STATUS_STOPPED {
+		st.status = STATUS_QUEUED
+	}
+	s.scheduleLocked()
+
+	return nil
+}
+
+// RemoveTorrent stops the torrent and forgets it, optionally deleting the downloaded data once its download exited.
+func (s *Session) RemoveTorrent(hash string, deleteData bool) error {
+	s.mu.Lock()
+	st, ok := s.torrents[hash]
+	var done chan struct{}
+	if ok {
+		if st.running() {
+			st.cancel()
+		}
+		done = st.done
+		delete(s.torrents, hash)
+		s.scheduleLocked()
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %s not found", hash)
+	}
+
+	// The data is not deleted while the download may still write it
+	if done != nil {
+		<-done
+	}
+
+	snapshot := s.snapshot(st)
+	if deleteData && snapshot.t.info.name != "" {
+		path, err := snapshot.dataPath()
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list returns the torrents of the session, sorted by ID.
+func (s *Session) list() []*SessionTorrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	torrents := make([]*SessionTorrent, 0, len(s.torrents))
+	for _, st := range s.torrents {
+		torrents = append(torrents, st)
+	}
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].id < torrents[j].id })
+
+	return torrents
+}
+
+// track keeps the state of the torrents updated with the published events.
+func (s *Session) track(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.torrents[e.InfoHash]
+	if !ok {
+		return
+	}
+	switch e.Type {
+	case EVENT_PIECE_COMPLETE:
+		st.piecesDone++
+		st.downloaded += e.Bytes
+		st.lastProgress = e.Time
+		if st.status == STATUS_STALLED {
+			st.status = STATUS_DOWNLOADING
+		}
+	case EVENT_BLOCK_UPLOADED:
+		st.uploaded += e.Bytes
+	case EVENT_COMPLETED:
+		st.status = STATUS_COMPLETED
+		st.doneAt = e.Time
+		// Completed torrents yield their slot
+		s.scheduleLocked()
+	case EVENT_TRACKER_ERROR:
+		st.err = e.Error
+	}
+}
+
+// DownloadAll downloads the torrents of the given sources into the download directory at the same time, as the
+// torrents of the session without a limit on the active ones. Every torrent is loaded before any download starts, the metadata of magnet
+// links is fetched by their downloads. Returns once every download ended, with the errors of the ones that didn't
+// complete. Cancelling ctx stops the downloads, which resume from their output files the next time.
+func (s *Session) DownloadAll(ctx context.Context, sources []string, checksums ChecksumOptions) error {
+	torrents := make([]Torrent, len(sources))
+	for i, source := range sources {
+		t, err := s.client.LoadTorrent(source)
+		if err != nil {
+			return fmt.Errorf("could not load %s: %w", source, err)
+		}
+		torrents[i] = t
+	}
+
+	s.maxActive = 0
+	s.ended = make(chan *SessionTorrent, len(torrents))
+	s.events.observe(s.track)
+
+	var added []*SessionTorrent
+	var addErr error
+	for _, t := range torrents {
+		st, err := s.AddTorrent(t, AddOptions{})
+		if err != nil {
+			addErr = err
+			break
+		}
+		added = append(added, st)
+	}
+
+	// The downloads added before a failure, or an interruption, are paused and waited for
+	pause := func() {
+		for _, st := range added {
+			s.Pause(toHex(st.t.infoHash))
+		}
+	}
+	if addErr != nil {
+		pause()
+	}
+	interrupted := ctx.Done()
+	for remaining := len(added); remaining > 0; {
+		select {
+		case <-s.ended:
+			remaining--
+		case <-interrupted:
+			pause()
+			interrupted = nil
+		}
+	}
+	if addErr != nil {
+		return addErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var errs []error
+	for _, st := range added {
+		snapshot := s.snapshot(st)
+		name := snapshot.t.info.name
+		if name == "" {
+			name = toHex(snapshot.t.infoHash)
+		}
+		if snapshot.status != STATUS_COMPLETED {
+			errs = append(errs, fmt.Errorf("%s: %s", name, snapshot.err))
+			continue
+		}
+		outputPath, err := snapshot.dataPath()
+		if err == nil {
+			err = checksums.Check(snapshot.t, outputPath)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
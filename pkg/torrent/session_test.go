@@ -0,0 +1,209 @@
+package torrent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitSessionEnded waits for the downloads of n torrents of the session to end.
+func waitSessionEnded(t *testing.T, s *Session, n int) {
+	t.Helper()
+
+	timeout := time.After(HARNESS_SCENARIO_TIMEOUT)
+	for i := 0; i < n; i++ {
+		select {
+		case <-s.ended:
+		case <-timeout:
+			t.Fatalf("%d downloads still running", n-i)
+		}
+	}
+}
+
+// TestSessionPauseResume checks Pause returns once the download exited, a paused torrent is not started when a slot
+// frees up, and it downloads once resumed.
+func TestSessionPauseResume(t *testing.T) {
+	deadSwarm, err := newHarness(2*32_768, 32_768, SEEDER_SILENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadSwarm.close()
+	swarm, err := newHarness(2*32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer swarm.close()
+
+	s := newSession(NewClient(), t.TempDir())
+	s.maxActive = 1
+	s.ended = make(chan *SessionTorrent, 2)
+	s.events.observe(s.track)
+
+	deadTorrent, err := deadSwarm.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := s.AddTorrent(deadTorrent, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	swarmTorrent, err := swarm.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := s.AddTorrent(swarmTorrent, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Pause(toHex(swarmTorrent.infoHash)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pause(toHex(deadTorrent.infoHash)); err != nil {
+		t.Fatal(err)
+	}
+	if !dead.exited() {
+		t.Fatal("paused torrent is still downloading")
+	}
+	waitSessionEnded(t, s, 1)
+	if status := s.snapshot(queued).status; status != STATUS_STOPPED {
+		t.Fatalf("paused torrent is %s once a slot freed up", status)
+	}
+
+	if err := s.Resume(toHex(swarmTorrent.infoHash)); err != nil {
+		t.Fatal(err)
+	}
+	waitSessionEnded(t, s, 1)
+	if status := s.snapshot(queued).status; status != STATUS_COMPLETED {
+		t.Fatalf("resumed torrent is %s: %s", status, s.snapshot(queued).err)
+	}
+
+	if err := s.RemoveTorrent(toHex(swarmTorrent.infoHash), true); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.list()); n != 1 {
+		t.Fatalf("%d torrents left after removing one of 2", n)
+	}
+}
+
+// TestSessionRemoveEscapingName checks the data of a torrent whose name escapes the download directory is neither
+// deleted nor given a name from a magnet link.
+func TestSessionRemoveEscapingName(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "x")
+	if err := os.WriteFile(outside, []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSession(NewClient(), filepath.Join(root, "downloads"))
+	s.torrents["escaping"] = &SessionTorrent{t: Torrent{info: info{name: "../x"}}, downloadDir: s.downloadDir}
+	if err := s.RemoveTorrent("escaping", true); !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("data outside the download directory removed: %v", err)
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatal(err)
+	}
+
+	magnet, err := parseMagnetLink("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.info.name != "" {
+		t.Fatalf("magnet link named %q", magnet.info.name)
+	}
+}
+
+// TestSessionDiskBudget checks the torrents of a session are refused beyond its disk budget, when they are added or
+// once the metadata of a magnet link gives its length.
+func TestSessionDiskBudget(t *testing.T) {
+	h, err := newHarness(4*32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+
+	s := newSession(NewClient(), t.TempDir())
+	s.maxDisk = 3 * 32_768
+	s.ended = make(chan *SessionTorrent, 1)
+	s.events.observe(s.track)
+
+	tor, err := h.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddTorrent(tor, AddOptions{}); !errors.Is(err, ErrDiskBudget) {
+		t.Fatalf("torrent over the disk budget added: %v", err)
+	}
+
+	magnet, err := h.magnet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.AddTorrent(magnet, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitSessionEnded(t, s, 1)
+	if snapshot := s.snapshot(added); snapshot.status != STATUS_STOPPED || !strings.Contains(snapshot.err, ErrDiskBudget.Error()) {
+		t.Fatalf("magnet link over the disk budget is %s: %s", snapshot.status, snapshot.err)
+	}
+}
+
+// TestPeerBudget checks the pools of the downloads of a session connect to the peers of its budget at most together.
+func TestPeerBudget(t *testing.T) {
+	budget := newPeerBudget(2)
+	first := newPeerPool(5, newDeadPeers(realClock), budget)
+	second := newPeerPool(5, newDeadPeers(realClock), budget)
+
+	second.add([]string{"10.0.0.3:6881"})
+	if !first.join("10.0.0.1:6881") || !first.join("10.0.0.2:6881") {
+		t.Fatal("peers within the budget refused")
+	}
+	if reserved := second.reserve(); len(reserved) != 0 {
+		t.Fatalf("reserved %v beyond the budget", reserved)
+	}
+	if second.join("10.0.0.3:6881") {
+		t.Fatal("peer beyond the budget joined")
+	}
+
+	first.leave("10.0.0.1:6881")
+	first.leave("10.0.0.1:6881")
+	if reserved := second.reserve(); len(reserved) != 1 {
+		t.Fatalf("reserved %v once a peer left", reserved)
+	}
+	if !second.join("10.0.0.3:6881") {
+		t.Fatal("peer refused once a peer left")
+	}
+	if budget.free() != 0 {
+		t.Fatalf("%d peers free in the budget, expected 0", budget.free())
+	}
+}
+
+// TestSessionUploadRate checks the uploaded blocks count in the uploads of their torrent, and in its rate from the
+// start of its last download.
+func TestSessionUploadRate(t *testing.T) {
+	c := NewClient()
+	defer c.Close()
+	s := newSession(c, t.TempDir())
+
+	started := time.Now()
+	st := &SessionTorrent{status: STATUS_DOWNLOADING, startedAt: started, uploaded: 100, uploadedAtStart: 100}
+	s.torrents["aa"] = st
+	for range 2 {
+		s.track(Event{Type: EVENT_BLOCK_UPLOADED, InfoHash: "aa", Bytes: 32_768})
+	}
+
+	if st.uploaded != 100+2*32_768 {
+		t.Fatalf("uploaded %d bytes", st.uploaded)
+	}
+	if rate := st.uploadRate(started.Add(2 * time.Second)); rate != 32_768 {
+		t.Fatalf("upload rate %d", rate)
+	}
+	st.status = STATUS_STOPPED
+	if rate := st.uploadRate(started.Add(2 * time.Second)); rate != 0 {
+		t.Fatalf("upload rate %d once stopped", rate)
+	}
+}
@@ -0,0 +1,540 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Start of the simulated time, any fixed time makes the simulations reproducible
+var simulationEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const SIMULATION_WAIT_TIMEOUT = 5 * time.Second
+
+// TestStalledQueue checks a download without progress is marked as stalled after STALL_TIMEOUT, and gives its slot
+// to the next queued torrent. The stall timeout elapses in simulated time.
+func TestStalledQueue(t *testing.T) {
+	clock := newSimClock(simulationEpoch)
+
+	deadSwarm, err := newHarness(4*32_768, 32_768, SEEDER_SILENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadSwarm.close()
+
+	swarm, err := newHarness(4*32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer swarm.close()
+
+	d := newDaemon(NewClient(), t.TempDir())
+	d.clock = clock
+	d.events.clock = clock
+	d.maxActive = 1
+	d.ended = make(chan *SessionTorrent, 2)
+	d.events.observe(d.track)
+	defer waitEnded(t, d, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.watchStalled(ctx)
+
+	deadTorrent, err := deadSwarm.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stalled, err := d.AddTorrent(deadTorrent, AddOptions{Priority: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Pause(toHex(deadTorrent.infoHash))
+
+	swarmTorrent, err := swarm.torrent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := d.events.subscribe()
+	defer unsubscribe()
+	queued, err := d.AddTorrent(swarmTorrent, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := d.snapshot(queued).status; status != STATUS_QUEUED {
+		t.Fatalf("expected the second torrent to be queued, it is %s", status)
+	}
+
+	// Wait for the stall watcher to wait on its ticker before moving the time
+	if !clock.waitTimers(1, SIMULATION_WAIT_TIMEOUT) {
+		t.Fatal("stall watcher did not start")
+	}
+
+	clock.advance(STALL_TIMEOUT - STALL_CHECK_INTERVAL)
+	if status := d.snapshot(stalled).status; status != STATUS_DOWNLOADING {
+		t.Fatalf("expected the first torrent to be downloading before the timeout, it is %s", status)
+	}
+
+	clock.advance(2 * STALL_CHECK_INTERVAL)
+
+	// The daemon tracks the events before they are delivered, the torrent is completed once its event is received
+	timeout := time.After(SIMULATION_WAIT_TIMEOUT)
+	for completed := false; !completed; {
+		select {
+		case e := <-events:
+			completed = e.Type == EVENT_COMPLETED && e.InfoHash == toHex(swarmTorrent.infoHash)
+		case <-timeout:
+			t.Fatalf("expected the second torrent to complete, it is %s", d.snapshot(queued).status)
+		}
+	}
+
+	if status := d.snapshot(stalled).status; status != STATUS_STALLED {
+		t.Fatalf("expected the first torrent to be stalled, it is %s", status)
+	}
+}
+
+// waitEnded waits for n downloads of the daemon to end, so they no longer write into its download directory.
+func waitEnded(t *testing.T, d *Daemon, n int) {
+	t.Helper()
+
+	timeout := time.After(SIMULATION_WAIT_TIMEOUT)
+	for i := 0; i < n; i++ {
+		select {
+		case <-d.ended:
+		case <-timeout:
+			t.Errorf("%d downloads still running", n-i)
+			return
+		}
+	}
+}
+
+// TestRateLimit checks the throughput allowed by a rate limiter, transferring blocks through it in simulated time.
+func TestRateLimit(t *testing.T) {
+	const rate = 100_000
+	const total = 1_000_000
+	const blockSize = 16_384
+
+	clock := newSimClock(simulationEpoch)
+	limiter := newRateLimiter(rate, clock)
+
+	done := make(chan error, 1)
+	go func() {
+		for sent := 0; sent < total; sent += blockSize {
+			if err := limiter.wait(context.Background(), min(blockSize, total-sent)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Move the time to the next timer every time the transfer waits for tokens, until it's done
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The bucket starts full, the rest is transferred at the limited rate
+			elapsed := clock.now().Sub(simulationEpoch).Seconds()
+			expected := float64(total-rate) / rate
+			if math.Abs(elapsed-expected) > 0.01*expected {
+				t.Fatalf("transfer took %.2fs, expected %.2fs", elapsed, expected)
+			}
+
+			return
+		default:
+		}
+
+		if !clock.waitTimers(1, 10*time.Millisecond) {
+			continue
+		}
+		if d, ok := clock.next(); ok {
+			clock.advance(d)
+		}
+	}
+}
+
+// TestPeerBackoff checks failed peers are backed off exponentially up to PEER_BACKOFF_MAX, and forgotten after
+// PEER_BACKOFF_EXPIRY. The backoffs elapse in simulated time.
+func TestPeerBackoff(t *testing.T) {
+	clock := newSimClock(simulationEpoch)
+	peers := newDeadPeers(clock)
+	const address = "10.0.0.1:6881"
+
+	backoff := PEER_BACKOFF_INITIAL
+	for failure := 1; failure <= 8; failure++ {
+		peers.failed(address)
+		if peers.ready(address) {
+			t.Fatalf("peer ready right after failure %d", failure)
+		}
+
+		clock.advance(backoff - time.Second)
+		if peers.ready(address) {
+			t.Fatalf("peer ready before its backoff of %s elapsed, after failure %d", backoff, failure)
+		}
+		clock.advance(time.Second)
+		if !peers.ready(address) {
+			t.Fatalf("peer not ready after its backoff of %s, after failure %d", backoff, failure)
+		}
+
+		backoff = min(2*backoff, PEER_BACKOFF_MAX)
+	}
+
+	// The next failure starts over from the initial backoff once the peer is forgotten
+	clock.advance(PEER_BACKOFF_EXPIRY)
+	peers.failed(address)
+	clock.advance(PEER_BACKOFF_INITIAL)
+	if !peers.ready(address) {
+		t.Fatal("peer not forgotten after PEER_BACKOFF_EXPIRY")
+	}
+
+	// A ban is for the address, another client behind the same NAT is still dialed
+	peers.ban(address)
+	if peers.ready(address) || !peers.isBanned(address) {
+		t.Fatal("banned peer ready")
+	}
+	if !peers.ready("10.0.0.1:6882") || peers.isBanned("10.0.0.1:6882") {
+		t.Fatal("peer of the host of a banned peer not ready")
+	}
+}
+
+// TestWatchDir checks the torrent files dropped into a watch directory are added once they stopped changing, and
+// moved to the added or failed subdirectory. The scans are run directly rather than every WATCH_INTERVAL.
+func TestWatchDir(t *testing.T) {
+	swarm, err := newHarness(2*32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer swarm.close()
+
+	dir := t.TempDir()
+	d := newDaemon(swarm.client(), filepath.Join(dir, "watch-downloads"))
+	d.ended = make(chan *SessionTorrent, 1)
+	d.events.observe(d.track)
+	defer waitEnded(t, d, 1)
+	defer func() {
+		for _, st := range d.list() {
+			d.Pause(toHex(st.t.infoHash))
+		}
+	}()
+
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.MkdirAll(watchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"swarm.torrent":   swarm.torrentFile(),
+		"invalid.torrent": []byte("not a torrent"),
+		"notes.txt":       []byte("ignored"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(watchDir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The files are first seen, then added by the next scan
+	w := newDirWatcher(d, watchDir)
+	w.scan()
+	if n := len(d.list()); n != 0 {
+		t.Fatalf("expected no torrent added by the first scan, %d were", n)
+	}
+
+	// Still being written
+	partial := filepath.Join(watchDir, "partial.torrent")
+	if err := os.WriteFile(partial, files["swarm.torrent"][:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.scan()
+	if err := os.WriteFile(partial, files["swarm.torrent"], 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.scan()
+
+	if n := len(d.list()); n != 1 {
+		t.Fatalf("expected the torrent to be added, %d torrents were", n)
+	}
+	for _, path := range []string{
+		filepath.Join(watchDir, WATCH_ADDED_DIR, "swarm.torrent"),
+		filepath.Join(watchDir, WATCH_FAILED_DIR, "invalid.torrent"),
+		filepath.Join(watchDir, "notes.txt"),
+		partial,
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s: %v", path, err)
+		}
+	}
+
+	// The partial file is complete now, a duplicate of the added torrent
+	w.scan()
+	if _, err := os.Stat(filepath.Join(watchDir, WATCH_ADDED_DIR, "partial.torrent")); err != nil {
+		t.Fatalf("expected the duplicate to be moved: %v", err)
+	}
+}
+
+// simulationBitfield returns the bitfield of a peer having the given pieces of a torrent with nPieces pieces.
+func simulationBitfield(nPieces int, pieces ...int) peer.Bitfield {
+	b := make(peer.Bitfield, (nPieces+7)/8)
+	for _, index := range pieces {
+		b.Set(index)
+	}
+
+	return b
+}
+
+// takeAll takes the pieces of the queue a peer having available can get, until none is pending, settling each one.
+// Returns the pieces in the order they were taken.
+func takeAll(t *testing.T, queue *pieceQueue, available peer.Bitfield) []int {
+	t.Helper()
+
+	var taken []int
+	for !queue.endgame() {
+		index, _, ok := queue.take(context.Background(), available, nil)
+		if !ok {
+			t.Fatalf("no piece to take after %v", taken)
+		}
+		taken = append(taken, index)
+		if !queue.settle(index) {
+			t.Fatalf("piece %d was settled twice", index)
+		}
+	}
+
+	return taken
+}
+
+// TestPiecePicker checks the order each strategy assigns the pieces in, as peers join a swarm and announce pieces.
+func TestPiecePicker(t *testing.T) {
+	const nPieces = 8
+	all := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	seeder := simulationBitfield(nPieces, all...)
+
+	// Pieces 6 and 7 are only on the seeder, 4 and 5 on a second peer, the others on a third one too
+	swarm := []peer.Bitfield{seeder, simulationBitfield(nPieces, 0, 1, 2, 3, 4, 5), simulationBitfield(nPieces, 0, 1, 2, 3)}
+
+	t.Run("rarest", func(t *testing.T) {
+		queue := newPieceQueue(all, nPieces, STRATEGY_RAREST)
+		for _, peer := range swarm {
+			queue.addPeer(peer)
+		}
+		// Announced by the second peer, piece 7 is now as rare as 4 and 5
+		queue.have(7)
+
+		taken := takeAll(t, queue, seeder)
+		if expected := []int{6, 4, 5, 7, 0, 1, 2, 3}; !slices.Equal(taken, expected) {
+			t.Fatalf("took pieces %v, expected %v", taken, expected)
+		}
+	})
+
+	t.Run("rarest after departure", func(t *testing.T) {
+		queue := newPieceQueue(all, nPieces, STRATEGY_RAREST)
+		for _, peer := range swarm {
+			queue.addPeer(peer)
+		}
+		// Without the third peer, pieces 0 to 5 are on two peers
+		queue.removePeer(swarm[2])
+
+		taken := takeAll(t, queue, seeder)
+		if expected := []int{6, 7, 0, 1, 2, 3, 4, 5}; !slices.Equal(taken, expected) {
+			t.Fatalf("took pieces %v, expected %v", taken, expected)
+		}
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		queue := newPieceQueue(all, nPieces, STRATEGY_SEQUENTIAL)
+		for _, peer := range swarm {
+			queue.addPeer(peer)
+		}
+
+		// A failed piece is taken again before the next ones
+		first, _, _ := queue.take(context.Background(), seeder, nil)
+		second, _, _ := queue.take(context.Background(), seeder, nil)
+		if first != 0 || second != 1 {
+			t.Fatalf("took pieces %d and %d first, expected 0 and 1", first, second)
+		}
+		queue.put(first)
+		queue.settle(second)
+
+		taken := takeAll(t, queue, seeder)
+		if expected := []int{0, 2, 3, 4, 5, 6, 7}; !slices.Equal(taken, expected) {
+			t.Fatalf("took pieces %v, expected %v", taken, expected)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		queue := newPieceQueue(all, nPieces, STRATEGY_RANDOM)
+
+		taken := takeAll(t, queue, seeder)
+		slices.Sort(taken)
+		if !slices.Equal(taken, all) {
+			t.Fatalf("took pieces %v, expected each piece once", taken)
+		}
+	})
+
+	t.Run("partial peer", func(t *testing.T) {
+		queue := newPieceQueue(all, nPieces, STRATEGY_RAREST)
+		for _, peer := range swarm {
+			queue.addPeer(peer)
+		}
+
+		// The third peer only gets its pieces, then nothing is left for it as no other piece is being downloaded
+		var taken []int
+		for range 4 {
+			index, _, _ := queue.take(context.Background(), swarm[2], nil)
+			queue.settle(index)
+			taken = append(taken, index)
+		}
+		if expected := []int{0, 1, 2, 3}; !slices.Equal(taken, expected) {
+			t.Fatalf("took pieces %v, expected %v", taken, expected)
+		}
+		if index, _, ok := queue.take(context.Background(), swarm[2], nil); ok {
+			t.Fatalf("took piece %d the peer doesn't have", index)
+		}
+	})
+
+	t.Run("endgame", func(t *testing.T) {
+		queue := newPieceQueue([]int{0, 1}, nPieces, STRATEGY_RAREST)
+
+		first, settledFirst, _ := queue.take(context.Background(), seeder, nil)
+		second, _, _ := queue.take(context.Background(), seeder, nil)
+		if !queue.endgame() {
+			t.Fatal("expected the endgame once every piece is taken")
+		}
+
+		// Without pending pieces, the in-flight piece with the fewest workers is taken again
+		duplicate, _, ok := queue.take(context.Background(), seeder, nil)
+		if !ok || duplicate != first {
+			t.Fatalf("took piece %d in the endgame, expected %d", duplicate, first)
+		}
+		again, _, _ := queue.take(context.Background(), seeder, nil)
+		if again != second {
+			t.Fatalf("took piece %d in the endgame, expected %d", again, second)
+		}
+
+		// The first worker to deliver the piece settles it, the other one is stopped
+		if !queue.settle(duplicate) {
+			t.Fatal("expected the first delivery to settle the piece")
+		}
+		select {
+		case <-settledFirst:
+		default:
+			t.Fatal("expected the other worker to be stopped")
+		}
+		if queue.settle(first) {
+			t.Fatal("expected the second delivery to be discarded")
+		}
+	})
+
+	t.Run("exhausted piece", func(t *testing.T) {
+		queue := newPieceQueue([]int{0}, nPieces, STRATEGY_RAREST)
+
+		for attempt := 1; attempt <= MAX_PIECE_ATTEMPTS; attempt++ {
+			index, _, ok := queue.take(context.Background(), seeder, nil)
+			if !ok {
+				t.Fatalf("piece not taken for attempt %d", attempt)
+			}
+			if exhausted := queue.put(index); exhausted != (attempt == MAX_PIECE_ATTEMPTS) {
+				t.Fatalf("piece exhausted is %t after attempt %d", exhausted, attempt)
+			}
+		}
+		if index, _, ok := queue.take(context.Background(), seeder, nil); ok {
+			t.Fatalf("took piece %d after its last attempt", index)
+		}
+	})
+}
+
+// TestChoker checks the rounds of the uploader over simulated time: the peers uploading the most to us get the
+// UNCHOKE_SLOTS slots, an interested peer left choked gets the optimistic unchoke, kept for
+// OPTIMISTIC_UNCHOKE_INTERVAL, and uninterested peers stay choked.
+func TestChoker(t *testing.T) {
+	clock := newSimClock(simulationEpoch)
+	resume := &resumeFile{pieces: make(peer.Bitfield, 1)}
+	uploads := newUploader(Torrent{}, resume)
+
+	// Peer i uploads i blocks to us every round, the last one isn't interested
+	const nPeers = UNCHOKE_SLOTS + 4
+	peers := make([]*uploadPeer, nPeers)
+	for i := range peers {
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+
+		peers[i] = uploads.join(&peerConnection{peerAddress: fmt.Sprintf("10.0.0.%d:6881", i+1), connection: local,
+			metrics: &peerMetrics{}})
+		peers[i].interested = i < nPeers-1
+	}
+
+	unchoked := func() (regular []int, optimistic int) {
+		optimistic = -1
+		for i, p := range peers {
+			p.mu.Lock()
+			if p.unchoked {
+				if p == uploads.optimistic {
+					optimistic = i
+				} else {
+					regular = append(regular, i)
+				}
+			}
+			p.mu.Unlock()
+		}
+
+		return regular, optimistic
+	}
+	round := func(received func(i int) int64) {
+		for i, p := range peers {
+			p.conn.metrics.downloaded.Add(received(i) * BLOCK_SIZE)
+		}
+		clock.advance(RECHOKE_INTERVAL)
+		uploads.rechoke(clock.now())
+	}
+
+	// The best uploaders among the interested peers are unchoked, the optimistic unchoke goes to another one
+	round(func(i int) int64 { return int64(i) })
+	regular, optimistic := unchoked()
+	if expected := []int{3, 4, 5, 6}; !slices.Equal(regular, expected) {
+		t.Fatalf("unchoked peers %v, expected %v", regular, expected)
+	}
+	if optimistic < 0 || optimistic > 2 {
+		t.Fatalf("optimistic unchoke went to peer %d, expected a choked interested peer", optimistic)
+	}
+	rotatedAt := clock.now()
+
+	// The optimistic unchoke is kept until OPTIMISTIC_UNCHOKE_INTERVAL elapsed, then rotated
+	first := optimistic
+	for clock.now().Sub(rotatedAt) < OPTIMISTIC_UNCHOKE_INTERVAL-RECHOKE_INTERVAL {
+		round(func(i int) int64 { return int64(i) })
+		if _, optimistic = unchoked(); optimistic != first {
+			t.Fatalf("optimistic unchoke moved to peer %d before OPTIMISTIC_UNCHOKE_INTERVAL", optimistic)
+		}
+	}
+	round(func(i int) int64 { return int64(i) })
+	if _, optimistic = unchoked(); optimistic < 0 || optimistic > 2 || !uploads.optimisticTime.Equal(clock.now()) {
+		t.Fatalf("optimistic unchoke not rotated after OPTIMISTIC_UNCHOKE_INTERVAL, peer %d has it", optimistic)
+	}
+
+	// The rates reverse, the slots follow the uploads of the last round, the optimistic unchoke stays on a choked peer
+	round(func(i int) int64 { return int64(nPeers - i) })
+	regular, optimistic = unchoked()
+	if expected := []int{0, 1, 2, 3}; !slices.Equal(regular, expected) {
+		t.Fatalf("unchoked peers %v after the rates changed, expected %v", regular, expected)
+	}
+	if optimistic < UNCHOKE_SLOTS || optimistic == nPeers-1 {
+		t.Fatalf("optimistic unchoke went to peer %d, expected a choked interested peer", optimistic)
+	}
+
+	// A peer that lost interest loses its slot
+	peers[0].interested = false
+	round(func(i int) int64 { return int64(nPeers - i) })
+	if regular, _ = unchoked(); !slices.Equal(regular, []int{1, 2, 3, 4}) {
+		t.Fatalf("unchoked peers %v, expected the uninterested peer to be choked", regular)
+	}
+}
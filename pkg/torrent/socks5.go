@@ -0,0 +1,219 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Port of SOCKS proxies given without one
+const SOCKS5_DEFAULT_PORT = "1080"
+
+// Values of the SOCKS5 protocol, RFC 1928 and RFC 1929
+const SOCKS5_VERSION = 5
+const SOCKS5_AUTH_NONE = 0
+const SOCKS5_AUTH_PASSWORD = 2
+const SOCKS5_PASSWORD_VERSION = 1
+const SOCKS5_CONNECT = 1
+const SOCKS5_ATYP_IPV4 = 1
+const SOCKS5_ATYP_DOMAIN = 3
+const SOCKS5_ATYP_IPV6 = 4
+
+// Time allowed to the negotiation with the proxy when the context has no deadline
+const SOCKS5_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+// Replies of the proxy to a request, by code
+var socks5Replies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Socks5Dialer connects to peers through a SOCKS5 proxy, so they only see the address of the proxy. Only TCP is
+// proxied, as the client doesn't open UDP connections to peers.
+type Socks5Dialer struct {
+	proxyAddress string
+	username     string
+	password     string
+	dialer       net.Dialer
+}
+
+// ParseSocks5Proxy parses the URL of a SOCKS5 proxy, as socks5://[user:password@]host[:port]. The proxy is reached
+// from the local address ip, any when nil.
+func ParseSocks5Proxy(rawURL string, ip net.IP) (*Socks5Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", rawURL, err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("invalid proxy %q: only socks5:// proxies are supported", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %q: missing host", rawURL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = SOCKS5_DEFAULT_PORT
+	}
+
+	d := &Socks5Dialer{proxyAddress: net.JoinHostPort(u.Hostname(), port)}
+	if ip != nil {
+		d.dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if u.User != nil {
+		d.username = u.User.Username()
+		d.password, _ = u.User.Password()
+		if len(d.username) > 255 || len(d.password) > 255 {
+			return nil, fmt.Errorf("invalid proxy %q: credentials longer than 255 bytes", rawURL)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *Socks5Dialer) DialPeer(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(SOCKS5_HANDSHAKE_TIMEOUT)
+	}
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	err = d.handshake(conn, address)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// handshake authenticates with the proxy on conn and asks it to connect to address.
+func (d *Socks5Dialer) handshake(conn net.Conn, address string) error {
+	method := byte(SOCKS5_AUTH_NONE)
+	if d.username != "" {
+		method = SOCKS5_AUTH_PASSWORD
+	}
+	if _, err := conn.Write([]byte{SOCKS5_VERSION, 1, method}); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+	if reply[0] != SOCKS5_VERSION {
+		return fmt.Errorf("%w: not a SOCKS5 proxy", ErrProxyFailure)
+	}
+	if reply[1] != method {
+		return fmt.Errorf("%w: authentication method not accepted", ErrProxyFailure)
+	}
+
+	if method == SOCKS5_AUTH_PASSWORD {
+		request := []byte{SOCKS5_PASSWORD_VERSION, byte(len(d.username))}
+		request = append(request, d.username...)
+		request = append(request, byte(len(d.password)))
+		request = append(request, d.password...)
+		if _, err := conn.Write(request); err != nil {
+			return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: invalid username or password", ErrProxyFailure)
+		}
+	}
+
+	request, err := socks5ConnectRequest(address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+
+	// The reply ends with the address the proxy bound, whose length depends on its type
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+	if header[1] != 0 {
+		message, ok := socks5Replies[header[1]]
+		if !ok {
+			message = fmt.Sprintf("reply %d", header[1])
+		}
+		return fmt.Errorf("%w: connecting to %s: %s", ErrProxyFailure, address, message)
+	}
+
+	var rest int
+	switch header[3] {
+	case SOCKS5_ATYP_IPV4:
+		rest = net.IPv4len - 1 + 2
+	case SOCKS5_ATYP_IPV6:
+		rest = net.IPv6len - 1 + 2
+	case SOCKS5_ATYP_DOMAIN:
+		rest = int(header[4]) + 2
+	default:
+		return fmt.Errorf("%w: invalid address type %d in reply", ErrProxyFailure, header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, rest)); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxyFailure, err)
+	}
+
+	return nil
+}
+
+// socks5ConnectRequest builds the request asking the proxy to connect to address, given as host:port. Hosts that are
+// not IP addresses are resolved by the proxy.
+func socks5ConnectRequest(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in address %q", address)
+	}
+
+	request := []byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long in address %q", address)
+		}
+		request = append(request, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, SOCKS5_ATYP_IPV4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, SOCKS5_ATYP_IPV6)
+		request = append(request, ip...)
+	}
+
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socks5Exchange is what a fake proxy received from a dialer: its greeting, its credentials and its connect request.
+type socks5Exchange struct {
+	greeting    []byte
+	credentials []byte
+	request     []byte
+}
+
+// serveSocks5 serves a connection of a fake proxy on listener, answering the greeting with method, the credentials
+// with auth when it's not nil, and the connect request with connect. Once connected, "ok" is sent through the tunnel.
+func serveSocks5(listener net.Listener, method, auth, connect []byte) <-chan socks5Exchange {
+	exchanged := make(chan socks5Exchange, 1)
+	go func() {
+		var exchange socks5Exchange
+		defer func() { exchanged <- exchange }()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(HARNESS_SCENARIO_TIMEOUT))
+
+		// read reads a field of length n, or of the length given by its last byte read so far when n is negative
+		read := func(into *[]byte, n int) bool {
+			if n < 0 {
+				n = int((*into)[len(*into)-1])
+			}
+			field := make([]byte, n)
+			if _, err := io.ReadFull(conn, field); err != nil {
+				return false
+			}
+			*into = append(*into, field...)
+			return true
+		}
+
+		if !read(&exchange.greeting, 3) {
+			return
+		}
+		conn.Write(method)
+		if auth != nil {
+			if !read(&exchange.credentials, 2) || !read(&exchange.credentials, -1) ||
+				!read(&exchange.credentials, 1) || !read(&exchange.credentials, -1) {
+				return
+			}
+			conn.Write(auth)
+		}
+
+		if !read(&exchange.request, 4) {
+			return
+		}
+		switch exchange.request[3] {
+		case SOCKS5_ATYP_IPV4:
+			read(&exchange.request, net.IPv4len+2)
+		case SOCKS5_ATYP_IPV6:
+			read(&exchange.request, net.IPv6len+2)
+		case SOCKS5_ATYP_DOMAIN:
+			read(&exchange.request, 1)
+			read(&exchange.request, -1)
+			read(&exchange.request, 2)
+		}
+		conn.Write(append(connect, "ok"...))
+	}()
+
+	return exchanged
+}
+
+// TestSocks5Dialer checks the requests of the dialer to a proxy, with and without credentials and for every type of
+// address, and its handling of the replies of the proxy, bound addresses of every type and refusals.
+func TestSocks5Dialer(t *testing.T) {
+	accepted := []byte{SOCKS5_VERSION, 0, 0, SOCKS5_ATYP_IPV4, 10, 0, 0, 1, 0x1a, 0xe1}
+
+	for _, test := range []struct {
+		name        string
+		credentials string
+		address     string
+		method      []byte
+		auth        []byte
+		connect     []byte
+		request     []byte // Connect request the proxy expects, in full
+		err         string // Part of the error of the dialer, empty when it connects
+	}{
+		{name: "ipv4", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE}, connect: accepted,
+			request: []byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0, SOCKS5_ATYP_IPV4, 10, 0, 0, 2, 0x1a, 0xe1}},
+		{name: "ipv6", address: "[::1]:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: append(append([]byte{SOCKS5_VERSION, 0, 0, SOCKS5_ATYP_IPV6}, net.IPv6loopback...), 0x1a, 0xe1),
+			request: append(append([]byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0, SOCKS5_ATYP_IPV6}, net.IPv6loopback...),
+				0x1a, 0xe1)},
+		{name: "domain", address: "peer.example:80", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: append([]byte{SOCKS5_VERSION, 0, 0, SOCKS5_ATYP_DOMAIN, 5}, "proxy\x00\x50"...),
+			request: append([]byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0, SOCKS5_ATYP_DOMAIN, 12}, "peer.example\x00\x50"...)},
+		{name: "password", credentials: "user:secret@", address: "10.0.0.2:6881",
+			method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_PASSWORD}, auth: []byte{SOCKS5_PASSWORD_VERSION, 0}, connect: accepted,
+			request: []byte{SOCKS5_VERSION, SOCKS5_CONNECT, 0, SOCKS5_ATYP_IPV4, 10, 0, 0, 2, 0x1a, 0xe1}},
+		{name: "wrong password", credentials: "user:wrong@", address: "10.0.0.2:6881",
+			method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_PASSWORD}, auth: []byte{SOCKS5_PASSWORD_VERSION, 1},
+			err: "invalid username or password"},
+		{name: "not socks5", address: "10.0.0.2:6881", method: []byte{4, SOCKS5_AUTH_NONE}, err: "not a SOCKS5 proxy"},
+		{name: "method refused", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, 0xff},
+			err: "authentication method not accepted"},
+		{name: "refused", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: []byte{SOCKS5_VERSION, 5, 0, SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0},
+			err:     "connecting to 10.0.0.2:6881: connection refused"},
+		{name: "unknown reply", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: []byte{SOCKS5_VERSION, 42, 0, SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0}, err: "reply 42"},
+		{name: "invalid bound address", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: []byte{SOCKS5_VERSION, 0, 0, 9, 0, 0}, err: "invalid address type 9"},
+		{name: "short reply", address: "10.0.0.2:6881", method: []byte{SOCKS5_VERSION, SOCKS5_AUTH_NONE},
+			connect: []byte{SOCKS5_VERSION, 0, 0, SOCKS5_ATYP_DOMAIN, 20}, err: "unexpected EOF"},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchanged := serveSocks5(listener, test.method, test.auth, test.connect)
+
+		d, err := ParseSocks5Proxy("socks5://"+test.credentials+listener.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), HARNESS_SCENARIO_TIMEOUT)
+		conn, err := d.DialPeer(ctx, test.address)
+		cancel()
+		if test.err != "" {
+			if err == nil || !errors.Is(err, ErrProxyFailure) || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%s: %v, expected %q", test.name, err, test.err)
+			}
+			listener.Close()
+			<-exchanged
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		tunneled := make([]byte, 2)
+		_, err = io.ReadFull(conn, tunneled)
+		conn.Close()
+		listener.Close()
+		exchange := <-exchanged
+		if err != nil || string(tunneled) != "ok" {
+			t.Fatalf("%s: tunnel read %q: %v", test.name, tunneled, err)
+		}
+
+		method := byte(SOCKS5_AUTH_NONE)
+		if test.auth != nil {
+			method = SOCKS5_AUTH_PASSWORD
+		}
+		if !bytes.Equal(exchange.greeting, []byte{SOCKS5_VERSION, 1, method}) {
+			t.Fatalf("%s: greeting %v", test.name, exchange.greeting)
+		}
+		if test.auth != nil && string(exchange.credentials) != "\x01\x04user\x06secret" {
+			t.Fatalf("%s: credentials %q", test.name, exchange.credentials)
+		}
+		if !bytes.Equal(exchange.request, test.request) {
+			t.Fatalf("%s: connect request %v, expected %v", test.name, exchange.request, test.request)
+		}
+	}
+}
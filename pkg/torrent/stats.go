@@ -0,0 +1,254 @@
+package torrent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const STATS_FILE_NAME = "stats.json"
+
+// How often the statistics are flushed to disk while the daemon runs
+const STATS_FLUSH_INTERVAL = 30 * time.Second
+
+// Stats is the persisted representation of the transfer statistics.
+type Stats struct {
+	Downloaded    int                        `json:"downloaded"`
+	Uploaded      int                        `json:"uploaded"`
+	FilesAdded    int                        `json:"filesAdded"`
+	SessionCount  int                        `json:"sessionCount"`
+	SecondsActive int                        `json:"secondsActive"`
+	Torrents      map[string]*torrentHistory `json:"torrents,omitempty"` // Keyed by hex info hash
+}
+
+// torrentHistory holds the statistics of a single torrent across sessions.
+type torrentHistory struct {
+	Name        string    `json:"name"`
+	Size        int       `json:"size"`
+	Downloaded  int       `json:"downloaded"`
+	Uploaded    int       `json:"uploaded"`
+	AddedAt     time.Time `json:"addedAt"`
+	CompletedAt time.Time `json:"completedAt,omitempty"`
+}
+
+// statsStore keeps cumulative transfer statistics in a JSON file, so they survive restarts.
+type statsStore struct {
+	path string
+
+	mu           sync.Mutex
+	data         Stats
+	sessionStart time.Time // Start of the current session, not yet accounted in SecondsActive
+	session      Stats     // Statistics of the current session only
+
+	completed chan struct{} // Signalled when a torrent completes, to flush the statistics right away
+}
+
+// openStatsStore loads the statistics kept in stateDir. A missing file results in empty statistics.
+func openStatsStore(stateDir string) (*statsStore, error) {
+	s := &statsStore{
+		path:         filepath.Join(stateDir, STATS_FILE_NAME),
+		sessionStart: time.Now(),
+		completed:    make(chan struct{}, 1),
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &s.data); err != nil {
+			return nil, fmt.Errorf("corrupted statistics file %s: %w", s.path, err)
+		}
+	}
+
+	if s.data.Torrents == nil {
+		s.data.Torrents = map[string]*torrentHistory{}
+	}
+
+	return s, nil
+}
+
+// ReadStats returns the statistics kept in stateDir by the daemon.
+func ReadStats(stateDir string) (Stats, error) {
+	s, err := openStatsStore(stateDir)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return s.data, nil
+}
+
+// startSession accounts a new session of the daemon.
+func (s *statsStore) startSession() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.SessionCount++
+	s.session.SessionCount = 1
+	s.sessionStart = time.Now()
+}
+
+// record updates the statistics with the given event. Observes the events of the daemon, the statistics are flushed
+// by run.
+func (s *statsStore) record(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.data.Torrents[e.InfoHash]
+	if !ok {
+		history = &torrentHistory{AddedAt: e.Time}
+		s.data.Torrents[e.InfoHash] = history
+	}
+	if e.Name != "" {
+		history.Name = e.Name
+	}
+
+	switch e.Type {
+	case EVENT_ADDED:
+		if !ok {
+			s.data.FilesAdded++
+		}
+		s.session.FilesAdded++
+		// Size is unknown for magnet links until the metadata is fetched
+		if e.Bytes > 0 {
+			history.Size = e.Bytes
+		}
+	case EVENT_PIECE_COMPLETE:
+		history.Downloaded += e.Bytes
+		s.data.Downloaded += e.Bytes
+		s.session.Downloaded += e.Bytes
+	case EVENT_BLOCK_UPLOADED:
+		history.Uploaded += e.Bytes
+		s.data.Uploaded += e.Bytes
+		s.session.Uploaded += e.Bytes
+	case EVENT_COMPLETED:
+		history.CompletedAt = e.Time
+		history.Size = e.Bytes
+
+		select {
+		case s.completed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// totals returns the cumulative statistics, including the current session, and the statistics of the current
+// session only.
+func (s *statsStore) totals() (Stats, Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := int(time.Since(s.sessionStart).Seconds())
+
+	cumulative := s.data
+	cumulative.SecondsActive += active
+	cumulative.Torrents = make(map[string]*torrentHistory, len(s.data.Torrents))
+	for hash, history := range s.data.Torrents {
+		historyCopy := *history
+		cumulative.Torrents[hash] = &historyCopy
+	}
+
+	session := s.session
+	session.SecondsActive += active
+
+	return cumulative, session
+}
+
+// flush writes the statistics to disk. The file is replaced atomically so a crash never leaves it truncated.
+func (s *statsStore) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Move the active time of the session into the persisted counter
+	now := time.Now()
+	s.data.SecondsActive += int(now.Sub(s.sessionStart).Seconds())
+	s.session.SecondsActive += int(now.Sub(s.sessionStart).Seconds())
+	s.sessionStart = now
+
+	content, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0770); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0660); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// run flushes the statistics periodically and whenever a torrent completes, until ctx is done, when they are flushed
+// a last time. Failures are logged to log.
+func (s *statsStore) run(ctx context.Context, log *slog.Logger) {
+	ticker := time.NewTicker(STATS_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+		case <-s.completed:
+		case <-ticker.C:
+		}
+
+		if err := s.flush(); err != nil {
+			log.Warn(fmt.Sprintf("Could not save statistics: %s", err))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Ratio returns the share ratio of the given amounts, -1 when nothing was downloaded
+func Ratio(uploaded, downloaded int) float64 {
+	if downloaded == 0 {
+		return -1
+	}
+
+	return float64(uploaded) / float64(downloaded)
+}
+
+// String returns a human readable summary of the statistics
+func (data Stats) String() string {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "Downloaded: %d bytes\nUploaded: %d bytes\nRatio: %.2f\n", data.Downloaded, data.Uploaded,
+		Ratio(data.Uploaded, data.Downloaded))
+	fmt.Fprintf(&builder, "Torrents added: %d\nSessions: %d\nTime active: %s\n", data.FilesAdded, data.SessionCount,
+		time.Duration(data.SecondsActive)*time.Second)
+
+	hashes := make([]string, 0, len(data.Torrents))
+	for hash := range data.Torrents {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return data.Torrents[hashes[i]].AddedAt.Before(data.Torrents[hashes[j]].AddedAt) })
+
+	for _, hash := range hashes {
+		h := data.Torrents[hash]
+
+		completed := "-"
+		if !h.CompletedAt.IsZero() {
+			completed = h.CompletedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(&builder, "%s %s downloaded=%d uploaded=%d ratio=%.2f completed=%s\n", hash, h.Name,
+			h.Downloaded, h.Uploaded, Ratio(h.Uploaded, h.Downloaded), completed)
+	}
+
+	return strings.TrimSuffix(builder.String(), "\n")
+}
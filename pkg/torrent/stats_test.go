@@ -0,0 +1,41 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+)
+
+// TestStatsFlushedOnStop checks the recorded downloads and uploads are persisted once run stops.
+func TestStatsFlushedOnStop(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStatsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []Event{
+		{Type: EVENT_ADDED, InfoHash: "aa", Name: "file", Bytes: 100},
+		{Type: EVENT_PIECE_COMPLETE, InfoHash: "aa", Bytes: 64},
+		{Type: EVENT_BLOCK_UPLOADED, InfoHash: "aa", Bytes: 16},
+		{Type: EVENT_BLOCK_UPLOADED, InfoHash: "aa", Bytes: 16},
+	} {
+		s.record(e)
+	}
+
+	c := NewClient()
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.run(ctx, c.log)
+
+	data, err := ReadStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Downloaded != 64 || data.Uploaded != 32 || data.FilesAdded != 1 {
+		t.Fatalf("persisted statistics %+v", data)
+	}
+	if history := data.Torrents["aa"]; history == nil || history.Uploaded != 32 || history.Downloaded != 64 {
+		t.Fatalf("persisted history %+v", history)
+	}
+}
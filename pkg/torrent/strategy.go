@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"fmt"
+	mathRand "math/rand"
+	"slices"
+)
+
+// Orders in which the pieces of a download are assigned to the peers
+const STRATEGY_RAREST PieceStrategy = "rarest"         // The pieces the fewest connected peers have first, keeping rare pieces alive in the swarm
+const STRATEGY_SEQUENTIAL PieceStrategy = "sequential" // In the order of the file, so its beginning can be used while it downloads
+const STRATEGY_RANDOM PieceStrategy = "random"         // In a random order
+
+// PieceStrategy is the order in which the pieces of a download are assigned to the peers. It's the value of the
+// --strategy flag.
+type PieceStrategy string
+
+func (s *PieceStrategy) String() string {
+	return string(*s)
+}
+
+func (s *PieceStrategy) Set(value string) error {
+	switch strategy := PieceStrategy(value); strategy {
+	case STRATEGY_RAREST, STRATEGY_SEQUENTIAL, STRATEGY_RANDOM:
+		*s = strategy
+		return nil
+	}
+
+	return fmt.Errorf("invalid strategy %q, expected rarest, sequential or random", value)
+}
+
+// WithPieceStrategy sets the order in which the pieces of the downloads are assigned to the peers.
+func WithPieceStrategy(strategy PieceStrategy) Option {
+	return func(c *Client) {
+		c.strategy = strategy
+	}
+}
+
+// orderPieces returns the pieces in the order they are first considered with strategy. Pieces put back on the queue
+// are considered again by the same strategy.
+func orderPieces(pieces []int, strategy PieceStrategy) []int {
+	ordered := slices.Clone(pieces)
+	switch strategy {
+	case STRATEGY_RANDOM:
+		mathRand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	default:
+		slices.Sort(ordered)
+	}
+
+	return ordered
+}
@@ -0,0 +1,178 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pieceWaiter tracks the pieces of a download written to its output file, so readers can wait for the ones they need.
+type pieceWaiter struct {
+	mu      sync.Mutex
+	written []bool
+	err     error         // Why the download stopped before writing every piece, readers waiting for the rest fail with it
+	changed chan struct{} // Closed and replaced when a piece is written or the download stops
+}
+
+func newPieceWaiter(nPieces int) *pieceWaiter {
+	return &pieceWaiter{written: make([]bool, nPieces), changed: make(chan struct{})}
+}
+
+// done records the piece at index was verified and written to the output file. Does nothing on a nil waiter, when the
+// download isn't streamed.
+func (w *pieceWaiter) done(index int) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.written[index] = true
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// stop records the download stopped with err, failing the readers waiting for pieces.
+func (w *pieceWaiter) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		err = ErrIncomplete
+	}
+	w.err = err
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// wait blocks until the piece at index is written. Fails when the download stopped without it, or ctx is done.
+func (w *pieceWaiter) wait(ctx context.Context, index int) error {
+	for {
+		w.mu.Lock()
+		written, err, changed := w.written[index], w.err, w.changed
+		w.mu.Unlock()
+
+		switch {
+		case written:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// streamReader reads the output file of a download while it's written, blocking on the pieces not written yet. It's
+// the io.ReadSeeker of one HTTP response.
+type streamReader struct {
+	ctx    context.Context
+	t      Torrent
+	file   *os.File
+	offset int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	length := int64(r.t.info.length)
+	if r.offset >= length {
+		return 0, io.EOF
+	}
+
+	// Reads stop at the end of the piece, the next one may not be written yet
+	index := int(r.offset / int64(r.t.info.pieceLength))
+	if err := r.t.verified.wait(r.ctx, index); err != nil {
+		return 0, err
+	}
+	pieceEnd := min(int64(index+1)*int64(r.t.info.pieceLength), length)
+	if int64(len(p)) > pieceEnd-r.offset {
+		p = p[:pieceEnd-r.offset]
+	}
+
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(r.t.info.length)
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+
+	return offset, nil
+}
+
+// streamHandler serves the output file of the download of t, with Range support. Responses wait for the pieces they
+// cover to be written.
+func streamHandler(t Torrent, outputPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		file, err := os.Open(outputPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer file.Close()
+
+		name := t.info.name
+		if name == "" {
+			name = filepath.Base(outputPath)
+		}
+		http.ServeContent(w, req, name, time.Time{}, &streamReader{ctx: req.Context(), t: t, file: file})
+	})
+}
+
+// Stream downloads the torrent to output, serving the file over HTTP on address while it downloads, and keeps serving
+// it once complete until ctx is done. Only single file torrents can be streamed, best downloaded in order.
+func (t Torrent) Stream(ctx context.Context, output, address string) error {
+	c := t.getClient()
+
+	if t.info.files != nil {
+		return fmt.Errorf("%s has %d files, only single file torrents can be streamed", t.info.name, len(t.info.files))
+	}
+	t.verified = newPieceWaiter(t.info.nPieces)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: streamHandler(t, output)}
+	go server.Serve(listener)
+	defer server.Close()
+	c.log.Info(fmt.Sprintf("Streaming %s on http://%s/", t.info.name, listener.Addr()), "address", listener.Addr().String())
+
+	err = t.DownloadFile(ctx, output)
+	t.verified.stop(err)
+	if err != nil {
+		return err
+	}
+
+	c.log.Info("Download complete, still streaming until interrupted")
+	<-ctx.Done()
+
+	return nil
+}
@@ -0,0 +1,1334 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathRand "math/rand"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+type Torrent struct {
+	announce   string
+	info       info
+	infoHash   []byte           // SHA-1 of the info dictionary, the SHA-256 one truncated for v2 torrents that are not hybrid
+	events     *eventBus        // Optional bus where torrent and peer events are published
+	client     *Client          // Settings of the client the torrent belongs to, the default client when nil
+	peerId     []byte           // Peer ID of the torrent, the one of the client when nil
+	key        string           // Key sent to the trackers, none when empty
+	trackers   *trackerList     // Trackers of the announce-list, only announce is used when nil
+	peerHints  []string         // Peers given along a magnet link, tried before the ones of the trackers
+	webSeeds   []string         // HTTP servers of the file, BEP 19, downloaded from along the peers
+	progress   *progressTracker // Follows the download in progress, when the client reports progress
+	stats      *transferStats   // Bytes transferred by the download in progress, reported to the trackers
+	metrics    *metricsRegistry // Transfers with each peer of the download in progress
+	verified   *pieceWaiter     // Notified of the pieces written to the output file, when the download is streamed
+	peerBudget *peerBudget      // Peers shared with the other torrents of the session, unlimited when nil
+
+	// Optional fields of a torrent file, missing from magnet links
+	creationDate time.Time // Zero when unknown
+	comment      string
+	createdBy    string
+	encoding     string // Character encoding of the strings of the torrent file
+
+	infoHashV2 []byte // SHA-256 of the info dictionary of v2 and hybrid torrents
+}
+
+type info struct {
+	length      int
+	name        string
+	nPieces     int
+	pieceLength int
+	pieces      [][]byte
+	md5sum      string        // MD5 of the file given by the metainfo, usually missing
+	private     bool          // Peers are only to be found through the trackers, BEP 27
+	metaVersion int           // 2 for v2 and hybrid torrents, BEP 52, 1 for v1 ones
+	merkle      bool          // Whether the pieces are the SHA-256 merkle roots of their blocks, for v2 torrents that are not hybrid
+	piecesRoot  []byte        // Root of the merkle tree of the blocks of the file, for v2 and hybrid torrents
+	files       []torrentFile // Files of a multi-file torrent, in their order in the data, nil for a single file
+}
+
+// pieceLengthAt returns the length of the piece at index. Every piece has the piece length of the torrent, except the
+// last one, holding what's left of the data.
+func (i info) pieceLengthAt(index int) int {
+	if index == i.nPieces-1 {
+		return i.length - index*i.pieceLength
+	}
+
+	return i.pieceLength
+}
+
+// parseTorrentFile creates a torrent instance from the given filename
+func parseTorrentFile(filename string) (Torrent, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	defer file.Close()
+
+	fileContent, err := io.ReadAll(file)
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	return parseTorrent(fileContent)
+}
+
+// parseTorrent creates a torrent instance from the bencoded content of a torrent file
+func parseTorrent(fileContent []byte) (Torrent, error) {
+	t := Torrent{}
+
+	torrentDict, spans, _, err := bencode.DecodeDictionarySpans(fileContent)
+	if err != nil {
+		return t, err
+	}
+
+	infoDict, ok := torrentDict["info"].(map[string]any)
+	if !ok {
+		return t, errors.New("torrent has no info dictionary")
+	}
+	pieceLayers, _ := torrentDict["piece layers"].(map[string]any)
+	t.info, err = parseInfoDict(infoDict, pieceLayers)
+	if err != nil {
+		return t, err
+	}
+
+	// announce is optional when announce-list is present
+	announce, _ := torrentDict["announce"].([]byte)
+	t.announce = string(announce)
+	t.trackers = parseAnnounceList(torrentDict["announce-list"])
+	// The web seeds of a multi-file torrent serve each file at its own URL, which the client doesn't request
+	if t.info.files == nil {
+		t.webSeeds = parseUrlList(torrentDict["url-list"])
+	}
+	// Torrents without tracker nor web seed are trackerless, their peers are found in the DHT
+	if t.announce == "" && t.trackers != nil {
+		t.announce = t.trackers.tiers[0][0]
+	}
+
+	// Informational, ignored when malformed
+	if creationDate, ok := torrentDict["creation date"].(int); ok && creationDate > 0 {
+		t.creationDate = time.Unix(int64(creationDate), 0).UTC()
+	}
+	comment, _ := torrentDict["comment"].([]byte)
+	t.comment = string(comment)
+	createdBy, _ := torrentDict["created by"].([]byte)
+	t.createdBy = string(createdBy)
+	encoding, _ := torrentDict["encoding"].([]byte)
+	t.encoding = string(encoding)
+
+	// The info hash identifies the info dictionary as encoded in the file, which re-encoding the decoded dictionary
+	// may not reproduce, e.g. when its keys are not sorted
+	rawInfo, ok := spans["info"]
+	if !ok {
+		if rawInfo, err = bencode.Marshal(infoDict); err != nil {
+			return t, err
+		}
+	}
+	h := sha1.Sum(rawInfo)
+	t.infoHash = h[:]
+	if t.info.metaVersion == 2 {
+		h := sha256.Sum256(rawInfo)
+		t.infoHashV2 = h[:]
+		// Peers and trackers identify v2 torrents by their truncated info hash, hybrid ones by the v1 one as well
+		if t.info.merkle {
+			t.infoHash = t.infoHashV2[:20]
+		}
+	}
+
+	return t, nil
+}
+
+// parseInfoDict validates the decoded info dictionary of a torrent, either from a torrent file or received from a peer,
+// and builds its info. pieceLayers are the piece layers of the torrent file, which v2 torrents take their pieces from
+// unless they are hybrid, nil for metadata received from a peer.
+func parseInfoDict(infoDict map[string]any, pieceLayers map[string]any) (info, error) {
+	metaVersion, _ := infoDict["meta version"].(int)
+	if _, hybrid := infoDict["pieces"]; metaVersion == 2 && !hybrid {
+		return parseV2InfoDict(infoDict, pieceLayers)
+	}
+	if metaVersion > 2 {
+		return info{}, fmt.Errorf("info: unsupported meta version %d", metaVersion)
+	}
+
+	// A multi-file torrent has the list of its files instead of the length of its single file
+	var files []torrentFile
+	length, ok := infoDict["length"].(int)
+	if fileList, isList := infoDict["files"].([]any); !ok && isList {
+		var err error
+		files, err = parseFileList(fileList)
+		if err != nil {
+			return info{}, err
+		}
+		for _, f := range files {
+			length += f.length
+		}
+	}
+	if (!ok && files == nil) || length <= 0 {
+		return info{}, errors.New("info: missing or invalid length")
+	}
+	name, ok := infoDict["name"].([]byte)
+	if !ok || !validFileName(string(name)) {
+		return info{}, errors.New("info: missing name")
+	}
+	pieceLength, ok := infoDict["piece length"].(int)
+	if !ok || pieceLength <= 0 {
+		return info{}, errors.New("info: missing or invalid piece length")
+	}
+	piecesStr, ok := infoDict["pieces"].([]byte)
+	if !ok || len(piecesStr)%20 != 0 {
+		return info{}, errors.New("info: missing or invalid pieces")
+	}
+
+	n := len(piecesStr) / 20
+	if n != (length+pieceLength-1)/pieceLength {
+		return info{}, fmt.Errorf("info: %d pieces for a length of %d", n, length)
+	}
+
+	pieces := make([][]byte, n)
+
+	for i := 0; i < n; i++ {
+		// Copied, so the pieces don't hold on to the whole decoded content
+		pieces[i] = bytes.Clone(piecesStr[i*20 : (i+1)*20])
+	}
+
+	// Optional and not covered by the pieces, a malformed one is ignored
+	md5sumBytes, _ := infoDict["md5sum"].([]byte)
+	md5sum := string(md5sumBytes)
+	if _, err := hex.DecodeString(md5sum); err != nil || len(md5sum) != 2*md5.Size {
+		md5sum = ""
+	}
+	private, _ := infoDict["private"].(int)
+
+	// The v2 file of a hybrid torrent must be the v1 one, the client only downloads the v1 pieces
+	var piecesRoot []byte
+	if metaVersion == 2 && files != nil {
+		return info{}, errors.New("info: multi-file hybrid torrents are not supported")
+	}
+	if metaVersion == 2 {
+		file, err := parseSingleV2File(infoDict)
+		if err != nil {
+			return info{}, err
+		}
+		if file.length != length || file.path[0] != string(name) {
+			return info{}, errors.New("info: the v1 and v2 files of the hybrid torrent differ")
+		}
+		piecesRoot = file.piecesRoot
+	} else {
+		metaVersion = 1
+	}
+
+	return info{
+		length:      length,
+		name:        string(name),
+		nPieces:     n,
+		pieceLength: pieceLength,
+		pieces:      pieces,
+		md5sum:      md5sum,
+		private:     private == 1,
+		metaVersion: metaVersion,
+		piecesRoot:  piecesRoot,
+		files:       files,
+	}, nil
+}
+
+// parseMagnetLink creates a torrent instance from a magnet link. Every tracker of the link is tried in order, and the
+// peers of its x.pe parameters are tried along the peers of the trackers. The display name is optional, the name of
+// the metadata is used once fetched.
+func parseMagnetLink(link string) (Torrent, error) {
+	t := Torrent{}
+
+	// Example link: magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce
+	// Link starts with 'magnet:?', parse the link from there
+	if !strings.HasPrefix(link, "magnet:?") {
+		return t, fmt.Errorf("invalid magnet link: %s", link)
+	}
+	queryParameters, err := url.ParseQuery(link[8:])
+	if err != nil {
+		return t, err
+	}
+
+	// Links may have several exact topics, for other networks or hash types. xt starts with 'urn:btih:' for the v1 info
+	// hash, and 'urn:btmh:' for the v2 one, BEP 52, both given for hybrid torrents
+	for _, xt := range queryParameters["xt"] {
+		if encodedInfoHash, ok := strings.CutPrefix(xt, "urn:btih:"); ok && t.infoHash == nil {
+			t.infoHash, err = decodeMagnetInfoHash(encodedInfoHash)
+			if err != nil {
+				return t, err
+			}
+		}
+		if encodedInfoHash, ok := strings.CutPrefix(xt, "urn:btmh:"); ok && t.infoHashV2 == nil {
+			t.infoHashV2, err = decodeMagnetMultihash(encodedInfoHash)
+			if err != nil {
+				return t, err
+			}
+		}
+	}
+	if t.infoHash == nil && t.infoHashV2 == nil {
+		return t, errors.New("invalid magnet link: missing urn:btih or urn:btmh info hash")
+	}
+	// The swarm of a hybrid torrent is found by the v1 info hash, the one of a v2 torrent by its truncated v2 one
+	if t.infoHash == nil {
+		t.infoHash = t.infoHashV2[:20]
+	}
+
+	trackers := queryParameters["tr"]
+	if len(trackers) > 0 {
+		t.announce = trackers[0]
+	}
+	if len(trackers) > 1 {
+		t.trackers = newTrackerList(trackers)
+	}
+
+	for _, peer := range queryParameters["x.pe"] {
+		if _, _, err := net.SplitHostPort(peer); err == nil {
+			t.peerHints = append(t.peerHints, peer)
+		}
+	}
+
+	// The display name is optional, one that isn't a valid file name is ignored like a missing one
+	if name := queryParameters.Get("dn"); validFileName(name) {
+		t.info.name = name
+	}
+
+	return t, nil
+}
+
+// decodeMagnetInfoHash decodes the info hash of a magnet link, given as 40 hex characters or 32 base32 ones.
+func decodeMagnetInfoHash(encoded string) ([]byte, error) {
+	var infoHash []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		infoHash, err = hex.DecodeString(encoded)
+	case 32:
+		infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = fmt.Errorf("length %d is neither hex nor base32", len(encoded))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link info hash %s: %w", encoded, err)
+	}
+
+	return infoHash, nil
+}
+
+// decodeMagnetMultihash decodes the v2 info hash of a magnet link, given as a hex encoded multihash: the 0x12 code of
+// SHA-256, the 0x20 length of the hash, then the hash.
+func decodeMagnetMultihash(encoded string) ([]byte, error) {
+	multihash, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link info hash %s: %w", encoded, err)
+	}
+	if len(multihash) != 2+sha256.Size || multihash[0] != 0x12 || multihash[1] != sha256.Size {
+		return nil, fmt.Errorf("invalid magnet link info hash %s: not a SHA-256 multihash", encoded)
+	}
+
+	return multihash[2:], nil
+}
+
+// AnnounceURL returns the URL of the tracker of the torrent, empty when it has none.
+func (t Torrent) AnnounceURL() string {
+	return t.announce
+}
+
+// InfoHash returns the SHA-1 of the info dictionary of the torrent.
+func (t Torrent) InfoHash() []byte {
+	return t.infoHash
+}
+
+// InfoHashV2 returns the SHA-256 of the info dictionary of v2 and hybrid torrents, nil for the others.
+func (t Torrent) InfoHashV2() []byte {
+	return t.infoHashV2
+}
+
+// InfoString returns a string representing a summary of the torrent file
+func (t Torrent) InfoString() string {
+	hexInfoHash := toHex(t.infoHash)
+	hexPieceHashes := make([]string, len(t.info.pieces))
+
+	for i, pieceHash := range t.info.pieces {
+		hexPieceHashes[i] = toHex(pieceHash)
+	}
+	hashPiecesStr := strings.Join(hexPieceHashes, "\n")
+
+	// The optional fields come before the piece hashes, listed last, and only when the torrent has them
+	var optional strings.Builder
+	if !t.creationDate.IsZero() {
+		fmt.Fprintf(&optional, "Creation Date: %s\n", t.creationDate.Format(time.RFC3339))
+	}
+	if t.comment != "" {
+		fmt.Fprintf(&optional, "Comment: %s\n", t.comment)
+	}
+	if t.createdBy != "" {
+		fmt.Fprintf(&optional, "Created By: %s\n", t.createdBy)
+	}
+	if t.encoding != "" {
+		fmt.Fprintf(&optional, "Encoding: %s\n", t.encoding)
+	}
+	if t.info.private {
+		optional.WriteString("Private: yes\n")
+	}
+	if t.infoHashV2 != nil {
+		fmt.Fprintf(&optional, "Meta Version: %d\nInfo Hash v2: %s\n", t.info.metaVersion, toHex(t.infoHashV2))
+	}
+	if t.info.files != nil {
+		optional.WriteString("Files:\n")
+		for _, f := range t.info.files {
+			fmt.Fprintf(&optional, "%s (%d bytes)\n", strings.Join(f.path, "/"), f.length)
+		}
+	}
+
+	return fmt.Sprintf("Tracker URL: %s\nLength: %d\nInfo Hash: %s\nPiece Length: %d\n%sPiece Hashes:\n%s",
+		t.announce, t.info.length, hexInfoHash, t.info.pieceLength, optional.String(), hashPiecesStr)
+}
+
+// torrentDocument is the metainfo of a torrent as printed by info --json.
+type torrentDocument struct {
+	Name         string         `json:"name"`
+	InfoHash     string         `json:"infoHash"`
+	InfoHashV2   string         `json:"infoHashV2,omitempty"`
+	MetaVersion  int            `json:"metaVersion,omitempty"`
+	AnnounceList [][]string     `json:"announceList"` // Tiers of trackers
+	PieceLength  int            `json:"pieceLength"`
+	Pieces       int            `json:"pieces"`
+	TotalSize    int            `json:"totalSize"`
+	Files        []fileDocument `json:"files"`
+	Private      bool           `json:"private"`
+	CreationDate *time.Time     `json:"creationDate,omitempty"`
+	Comment      string         `json:"comment,omitempty"`
+	CreatedBy    string         `json:"createdBy,omitempty"`
+	Encoding     string         `json:"encoding,omitempty"`
+}
+
+// fileDocument is a file of a torrent as printed by info --json.
+type fileDocument struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+// fileDocuments returns the files of the torrent as printed by info --json: its single file, named after the torrent,
+// or the files of a multi-file torrent with their paths in its directory.
+func (i info) fileDocuments() []fileDocument {
+	if i.files == nil {
+		return []fileDocument{{Path: i.name, Length: i.length}}
+	}
+
+	files := make([]fileDocument, len(i.files))
+	for j, f := range i.files {
+		files[j] = fileDocument{Path: strings.Join(f.path, "/"), Length: f.length}
+	}
+
+	return files
+}
+
+// InfoJSON returns the metainfo of the torrent as a JSON document, for scripts.
+func (t Torrent) InfoJSON() ([]byte, error) {
+	announceList := [][]string{}
+	if t.trackers != nil {
+		announceList = t.trackers.tiers
+	} else if t.announce != "" {
+		announceList = [][]string{{t.announce}}
+	}
+
+	doc := torrentDocument{
+		Name:         t.info.name,
+		InfoHash:     toHex(t.infoHash),
+		InfoHashV2:   toHex(t.infoHashV2),
+		MetaVersion:  t.info.metaVersion,
+		AnnounceList: announceList,
+		PieceLength:  t.info.pieceLength,
+		Pieces:       t.info.nPieces,
+		TotalSize:    t.info.length,
+		Files:        t.info.fileDocuments(),
+		Private:      t.info.private,
+		Comment:      t.comment,
+		CreatedBy:    t.createdBy,
+		Encoding:     t.encoding,
+	}
+	if !t.creationDate.IsZero() {
+		doc.CreationDate = &t.creationDate
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Peers returns a slice of strings containing the peer addresses of torrent. This is done by requesting the tracker and parsing
+// the response to build IP and port for each peer. When the torrent has no tracker, or its trackers return no peers,
+// the peers are looked up in the DHT if the client joined it. The peers hinted by a magnet link come first, and are
+// returned even when no tracker responds.
+func (t Torrent) Peers(ctx context.Context) ([]string, error) {
+	res, err := t.announcePeers(ctx, tracker.ANNOUNCE_NONE)
+
+	return res.Peers, err
+}
+
+// announcePeers announces the torrent with one of the ANNOUNCE_ events and returns its peers, the way peers does.
+// Peers found in the DHT come without announce intervals.
+func (t Torrent) announcePeers(ctx context.Context, announceEvent string) (tracker.Response, error) {
+	res, err := t.discoverPeers(ctx, announceEvent)
+	if len(t.peerHints) == 0 || ctx.Err() != nil {
+		return res, err
+	}
+
+	hinted := append([]string{}, t.peerHints...)
+	for _, peer := range res.Peers {
+		if !slices.Contains(hinted, peer) {
+			hinted = append(hinted, peer)
+		}
+	}
+	res.Peers = hinted
+
+	return res, nil
+}
+
+// discoverPeers returns the peers of the torrent given by its trackers, or found in the DHT unless the torrent is
+// private.
+func (t Torrent) discoverPeers(ctx context.Context, announceEvent string) (tracker.Response, error) {
+	res, err := t.trackerPeers(ctx, announceEvent)
+
+	dht := t.getClient().dht
+	if dht == nil || t.info.private || (err == nil && len(res.Peers) > 0) || ctx.Err() != nil {
+		return res, err
+	}
+
+	dhtPeers, dhtErr := dht.getPeers(ctx, t.infoHash)
+	if dhtErr != nil {
+		if err != nil {
+			return tracker.Response{}, errors.Join(err, dhtErr)
+		}
+		return tracker.Response{}, dhtErr
+	}
+	t.publish(Event{Type: EVENT_TRACKER_ANNOUNCE, Tracker: "dht"})
+
+	// Other nodes find us for the next downloads of the torrent
+	dht.announcePeer(ctx, t.infoHash, t.getClient().port)
+
+	return tracker.Response{Peers: dhtPeers}, nil
+}
+
+// trackerPeers returns the peers of the torrent given by its trackers, announced with announceEvent.
+func (t Torrent) trackerPeers(ctx context.Context, announceEvent string) (tracker.Response, error) {
+	if t.trackers != nil {
+		return t.announceToList(ctx, announceEvent)
+	}
+	if t.announce == "" {
+		return tracker.Response{}, fmt.Errorf("%w: the torrent has no tracker, use --dht to find peers", tracker.ErrFailure)
+	}
+
+	c := t.getClient()
+	res, err := c.tracker.Announce(ctx, t.announceRequest(announceEvent))
+	if errors.Is(err, tracker.ErrFailure) {
+		t.publish(Event{Type: EVENT_TRACKER_ERROR, Tracker: t.announce, Error: err.Error()})
+		c.log.Debug(err.Error(), "tracker", t.announce, "event", announceEvent)
+	} else if err == nil {
+		t.logTrackerWarning(t.announce, res)
+		t.publish(Event{Type: EVENT_TRACKER_ANNOUNCE, Tracker: t.announce})
+		c.log.Debug(fmt.Sprintf("Announced to %s, %d peers returned", t.announce, len(res.Peers)), "tracker", t.announce,
+			"event", announceEvent, "peers", len(res.Peers))
+	}
+
+	return res, err
+}
+
+// handshake sends initial handshake message to the given peer. Returns the validated response of the peer
+func (t Torrent) handshake(ctx context.Context, conn *peerConnection, supportExtensions bool) (peer.HandshakeResponse, error) {
+	// Send handshake message
+	message := peer.BuildHandshakeMessage(t.localPeerId(), t.infoHash, supportExtensions)
+	_, err := conn.sendBytes(ctx, message)
+	if err != nil {
+		return peer.HandshakeResponse{}, err
+	}
+	conn.dump.record(conn.peerAddress, WIRE_SENT, "handshake", nil, len(message), message, nil)
+
+	// Receive handshake response
+	res, err := conn.receiveBytes(ctx, peer.HANDSHAKE_MESSAGE_LENGTH)
+	if err != nil {
+		return peer.HandshakeResponse{}, err
+	}
+	conn.dump.record(conn.peerAddress, WIRE_RECEIVED, "handshake", nil, len(res), res, nil)
+
+	return peer.ParseHandshake(res, t.infoHash)
+}
+
+// localPeerId returns the peer ID the torrent sends to trackers and peers: its own if it has one, or the client's.
+func (t Torrent) localPeerId() []byte {
+	if t.peerId != nil {
+		return t.peerId
+	}
+
+	return t.getClient().peerId
+}
+
+// PeerHandshake sends the initial message to a peer. Returns the hexadecimal representation of the response peer ID
+func (t Torrent) PeerHandshake(ctx context.Context, peer string, supportExtensions bool) (string, error) {
+	conn, closer, err := t.connect(ctx, peer)
+	if err != nil {
+		return "", err
+	}
+	defer closer()
+
+	res, err := t.handshake(ctx, conn, supportExtensions)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Received message has identical structure to the one sent
+	return toHex(res.PeerId), nil
+}
+
+// MagnetHandshake runs the handshakes with the peers of the torrent of a magnet link, trying the next peers while the
+// first ones are slow or fail. Returns the peer ID of the first peer completing them, and the ID it assigned to the
+// ut_metadata extension, 0 when it doesn't support extensions.
+func (t Torrent) MagnetHandshake(ctx context.Context) (string, int, error) {
+	peers, err := t.Peers(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(peers) == 0 {
+		return "", 0, ErrNoPeers
+	}
+
+	var mu sync.Mutex
+	var peerId string
+	var peerMetadataExtensionId int
+	err = t.firstPeer(ctx, peers, func(ctx context.Context, peer string) error {
+		id, extensionId, err := t.peerExtensions(ctx, peer)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peer, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if peerId == "" {
+			peerId, peerMetadataExtensionId = id, extensionId
+		}
+		return nil
+	})
+
+	return peerId, peerMetadataExtensionId, err
+}
+
+// peerExtensions runs the handshakes with the peer at address, the extension handshake included when it supports
+// extensions. Returns its peer ID and the ID it assigned to the ut_metadata extension.
+func (t Torrent) peerExtensions(ctx context.Context, address string) (string, int, error) {
+	var peerId string
+	var peerMetadataExtensionId int
+
+	conn, closer, err := t.connect(ctx, address)
+	if err != nil {
+		return peerId, peerMetadataExtensionId, err
+	}
+	defer closer()
+
+	// Traditional handshake
+	res, err := t.handshake(ctx, conn, true)
+	if err != nil {
+		return peerId, peerMetadataExtensionId, err
+	}
+
+	// Receive bitfield
+	_, err = conn.receivePeerMessage(ctx)
+	if err != nil {
+		return peerId, peerMetadataExtensionId, err
+	}
+
+	// Just as the handshake message sent, the received message has 8 reserved bytes
+	// If the peer supports extensions, the 6 byte is set to 16
+	peerSupportsExtensions := res.SupportsExtensions()
+	if peerSupportsExtensions {
+		// If the peer handles extensions, send extension handshake
+		extensionHandshake, err := t.getClient().buildExtensionHandshakeMessage(conn, map[string]int{"ut_metadata": METADATA_EXTENSION_ID})
+		if err != nil {
+			return peerId, peerMetadataExtensionId, err
+		}
+		_, err = conn.sendMessage(ctx, extensionHandshake)
+		if err != nil {
+			return peerId, peerMetadataExtensionId, err
+		}
+
+		// Receive extension handshake response
+		resHandshake, err := conn.receivePeerMessage(ctx)
+		if err != nil {
+			return peerId, peerMetadataExtensionId, err
+		}
+
+		conn.handshake, err = peer.ParseExtensionHandshake(resHandshake.Payload)
+		if err != nil {
+			return peerId, peerMetadataExtensionId, err
+		}
+
+		// Get the ID of the ut_metadata extension
+		peerMetadataExtensionId = conn.handshake.Extensions["ut_metadata"]
+	}
+
+	peerId = toHex(res.PeerId)
+	return peerId, peerMetadataExtensionId, nil
+}
+
+// MagnetInfo fetches the metadata of the torrent of a magnet link from its peers, trying the next peers while the
+// first ones are slow or fail, and sets the info of the torrent to the metadata of the first peer delivering it.
+func (t *Torrent) MagnetInfo(ctx context.Context) error {
+	peers, err := t.Peers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+
+	// The attempts run on a copy, the info is only set once they ended
+	magnet := *t
+	var mu sync.Mutex
+	var fetched *info
+	err = magnet.firstPeer(ctx, peers, func(ctx context.Context, peer string) error {
+		i, err := magnet.peerMetadata(ctx, peer)
+		if err != nil {
+			return fmt.Errorf("peer %s: %w", peer, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fetched == nil {
+			fetched = &i
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.info = *fetched
+	return nil
+}
+
+// peerMetadata fetches the metadata of the torrent from the peer at address, through the ut_metadata extension. The
+// metadata is checked against the info hash.
+func (t Torrent) peerMetadata(ctx context.Context, address string) (info, error) {
+	conn, closer, err := t.connect(ctx, address)
+	if err != nil {
+		return info{}, err
+	}
+	defer closer()
+
+	// Traditional handshake
+	handshakeResponse, err := t.handshake(ctx, conn, true)
+	if err != nil {
+		return info{}, err
+	}
+
+	// Receive bitfield
+	_, err = conn.receivePeerMessage(ctx)
+	if err != nil {
+		return info{}, err
+	}
+
+	// Just as the handshake message sent, the received message has 8 reserved bytes
+	// If the peer supports extensions, the 6 byte is set to 16
+	if !handshakeResponse.SupportsExtensions() {
+		return info{}, fmt.Errorf("%w: peer doesn't support extensions", ErrMetadataRejected)
+	}
+
+	// If the peer handles extensions, send extension handshake
+	extensionHandshake, err := t.getClient().buildExtensionHandshakeMessage(conn, map[string]int{"ut_metadata": METADATA_EXTENSION_ID})
+	if err != nil {
+		return info{}, err
+	}
+	_, err = conn.sendMessage(ctx, extensionHandshake)
+	if err != nil {
+		return info{}, err
+	}
+
+	// Receive extension handshake response
+	extensionHandshakeResponse, err := conn.receivePeerMessage(ctx)
+	if err != nil {
+		return info{}, err
+	}
+
+	conn.handshake, err = peer.ParseExtensionHandshake(extensionHandshakeResponse.Payload)
+	if err != nil {
+		return info{}, err
+	}
+
+	// Get the ID of the ut_metadata extension
+	peerMetadataExtensionId, ok := conn.handshake.Extensions["ut_metadata"]
+	if !ok {
+		return info{}, fmt.Errorf("%w: peer doesn't support ut_metadata", ErrMetadataRejected)
+	}
+
+	data, err := t.fetchMetadata(ctx, conn, peerMetadataExtensionId, conn.handshake.MetadataSize)
+	if err != nil {
+		return info{}, err
+	}
+
+	// The metadata is trusted only if it's the one identified by the info hashes
+	if !t.matchesMetadata(data) {
+		return info{}, fmt.Errorf("%w: metadata doesn't match the info hash", peer.ErrInvalidMessage)
+	}
+
+	metadata, _, err := bencode.DecodeDictionary(data)
+	if err != nil {
+		return info{}, fmt.Errorf("%w: metadata: %w", peer.ErrInvalidMessage, err)
+	}
+
+	return parseInfoDict(metadata, nil)
+}
+
+// matchesMetadata returns whether data is the info dictionary the torrent is identified by: it must have the v2 info
+// hash when the torrent has one, and the v1 info hash unless it's only known by its v2 one.
+func (t Torrent) matchesMetadata(data []byte) bool {
+	if t.infoHashV2 != nil {
+		if h := sha256.Sum256(data); !bytes.Equal(h[:], t.infoHashV2) {
+			return false
+		}
+		if bytes.Equal(t.infoHash, t.infoHashV2[:20]) {
+			return true
+		}
+	}
+
+	h := sha1.Sum(data)
+	return bytes.Equal(h[:], t.infoHash)
+}
+
+// fetchMetadata requests the pieces of the metadata one at a time, and returns them assembled. When the peer didn't
+// announce the size of the metadata, pieces are requested until a piece shorter than METADATA_PIECE_SIZE arrives.
+func (t Torrent) fetchMetadata(ctx context.Context, conn *peerConnection, metadataExtensionId int, metadataSize int) ([]byte, error) {
+	var metadata []byte
+	for pieceIndex := 0; metadataSize == 0 || len(metadata) < metadataSize; pieceIndex++ {
+		metadataRequestMessage, err := peer.BuildMetadataRequestMessage(metadataExtensionId, pieceIndex)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.sendMessage(ctx, metadataRequestMessage)
+		if err != nil {
+			return nil, err
+		}
+
+		// Receive metadata 'data' message
+		dataMessage, err := conn.receivePeerMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if dataMessage.Type != peer.EXTENSION_MESSAGE {
+			return nil, unexpectedMessageError(peer.EXTENSION_MESSAGE, dataMessage.Type)
+		}
+
+		msgType, piece, data, err := peer.ParseMetadataMessage(dataMessage.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if msgType == peer.METADATA_EXTENSION_REJECT {
+			return nil, ErrMetadataRejected
+		}
+		if msgType != peer.METADATA_EXTENSION_DATA {
+			return nil, fmt.Errorf("%w: unexpected metadata message type %d", peer.ErrInvalidMessage, msgType)
+		}
+		if piece != pieceIndex {
+			return nil, fmt.Errorf("%w: received metadata piece %d instead of %d", peer.ErrInvalidMessage, piece, pieceIndex)
+		}
+
+		// Every piece is full but the last one
+		expected := peer.METADATA_PIECE_SIZE
+		if metadataSize > 0 {
+			expected = min(peer.METADATA_PIECE_SIZE, metadataSize-len(metadata))
+		}
+		if len(data) > expected || metadataSize > 0 && len(data) < expected {
+			return nil, fmt.Errorf("%w: metadata piece %d has %d bytes", peer.ErrInvalidMessage, piece, len(data))
+		}
+
+		metadata = append(metadata, data...)
+		if metadataSize == 0 && (len(data) < peer.METADATA_PIECE_SIZE || len(metadata) > peer.MAX_METADATA_SIZE) {
+			break
+		}
+	}
+
+	return metadata, nil
+}
+
+// exchangeInterest receives the pieces the peer has, from its bitfield or have messages, then tells the peer we are
+// interested and waits to be unchoked. The pieces are kept in the available bitfield of conn, updated by the have
+// messages received until the unchoke. A peer choking us in response to our interest is not waited for.
+func (t Torrent) exchangeInterest(ctx context.Context, conn *peerConnection) error {
+	conn.available = make(peer.Bitfield, (t.info.nPieces+7)/8)
+
+	// Receive bitfield message, peers having few pieces may send have messages instead. Other messages, like the
+	// extension handshake, may come first
+	c := t.getClient()
+	c.log.Debug("Waiting for bitfield", "peer", conn.peerAddress)
+	first, err := conn.receiveMessage(ctx, t.info.nPieces, peer.BITFIELD, peer.HAVE)
+	if err != nil {
+		return err
+	}
+	switch first.Type {
+	case peer.BITFIELD:
+		conn.available, err = peer.ParseBitfield(first.Payload, t.info.nPieces)
+	case peer.HAVE:
+		err = conn.recordHave(first, t.info.nPieces)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Send interested message
+	interestedMessage := peer.BuildInterestedMessage()
+	if _, err := conn.sendMessage(ctx, interestedMessage); err != nil {
+		return err
+	}
+
+	// Receive unchoke message, unless the peer unchoked us already
+	c.log.Debug("Waiting for unchoke", "peer", conn.peerAddress)
+	if !conn.unchoked {
+		message, err := conn.receiveMessage(ctx, t.info.nPieces, peer.UNCHOKE, peer.CHOKE)
+		if err != nil {
+			return err
+		}
+		if message.Type == peer.CHOKE {
+			return unexpectedMessageError(peer.UNCHOKE, message.Type)
+		}
+		conn.unchoked = true
+	}
+
+	return nil
+}
+
+// getPieceFromPeer downloads the piece defined by pieceIndex
+func (t Torrent) getPieceFromPeer(ctx context.Context, conn *peerConnection, pieceIndex int, waitInitialMessages bool) ([]byte, error) {
+	return t.resumePieceFromPeer(ctx, conn, pieceIndex, waitInitialMessages, nil, nil, nil)
+}
+
+// resumePieceFromPeer downloads the piece defined by pieceIndex, requesting only the blocks after prefix, the start of
+// the piece already held. onBlock, when not nil, receives every downloaded block before the piece is verified. Once
+// settled is closed, the outstanding requests are cancelled and errPieceSettled is returned. When the peer chokes us,
+// requests pause until it unchokes us again, for up to CHOKED_TIMEOUT, and the ones it dropped are sent again.
+func (t Torrent) resumePieceFromPeer(ctx context.Context, conn *peerConnection, pieceIndex int, waitInitialMessages bool, prefix []byte, onBlock func(begin int, block []byte), settled <-chan struct{}) ([]byte, error) {
+	if waitInitialMessages {
+		if err := t.exchangeInterest(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+	if !conn.available.Has(pieceIndex) {
+		return nil, fmt.Errorf("peer doesn't have piece %d", pieceIndex)
+	}
+
+	// The last piece may be shorter than the others
+	pieceLength := t.info.pieceLengthAt(pieceIndex)
+
+	blockSize := BLOCK_SIZE
+	nBlocks := int(math.Ceil(float64(pieceLength) / float64(blockSize)))
+
+	// Buffer to keep all the piece data, starting with the whole blocks of the prefix
+	prefixBlocks := min(len(prefix), pieceLength) / blockSize
+	pieceData := make([]byte, pieceLength)
+	copy(pieceData, prefix[:prefixBlocks*blockSize])
+
+	c := t.getClient()
+	c.log.Debug(fmt.Sprintf("Piece %d is divided in %d blocks", pieceIndex, nBlocks), "peer", conn.peerAddress, "piece", pieceIndex)
+
+	// Up to depth requests are kept outstanding, so the peer sends the next blocks without waiting for a round trip. The
+	// depth is capped by the requests the peer said it takes outstanding.
+	// Blocks may arrive in any order, they are matched to their request by their offset.
+	depth := conn.requestDepth(c.pipelineDepth)
+	outstanding := map[int]int{} // Length of the requested blocks, keyed by offset
+	dropped := map[int]int{}     // Length of the requested blocks the peer dropped when choking us, keyed by offset
+	received := make([]bool, nBlocks)
+	nextRequest, nextDelivered := prefixBlocks, prefixBlocks
+	var chokedAt time.Time
+	defer conn.metrics.requesting(0)
+
+	for nextDelivered < nBlocks {
+		// The requests dropped by a choke come first
+		for begin, blockLength := range dropped {
+			if !conn.unchoked {
+				break
+			}
+			if _, err := conn.sendMessage(ctx, peer.BuildRequestMessage(pieceIndex, begin, blockLength)); err != nil {
+				return nil, err
+			}
+			outstanding[begin] = blockLength
+			delete(dropped, begin)
+		}
+
+		for conn.unchoked && nextRequest < nBlocks && len(outstanding) < depth {
+			begin := nextRequest * blockSize
+			// All message requests will ask for exactly blockSize bytes, except the last one which most likely ask for
+			// the remaining amount of bytes
+			blockLength := min(blockSize, pieceLength-begin)
+
+			requestMessage := peer.BuildRequestMessage(pieceIndex, begin, blockLength)
+			c.log.Debug(fmt.Sprintf("Requesting block %d with block length %d", nextRequest, blockLength), "peer", conn.peerAddress,
+				"piece", pieceIndex)
+			_, err := conn.sendMessage(ctx, requestMessage)
+			if err != nil {
+				return nil, err
+			}
+
+			outstanding[begin] = blockLength
+			nextRequest++
+		}
+
+		// Receive piece message, waiting for an unchoke no longer than CHOKED_TIMEOUT, and for a requested block no
+		// longer than the timeout of the connection
+		conn.metrics.requesting(len(outstanding))
+		receiveCtx, cancel := ctx, context.CancelFunc(func() {})
+		if !conn.unchoked {
+			receiveCtx, cancel = clockTimeout(ctx, conn.clock, chokedAt.Add(CHOKED_TIMEOUT).Sub(conn.now()))
+		} else if len(outstanding) > 0 {
+			receiveCtx, cancel = peerTimeoutContext(ctx, conn.clock, conn.timeout)
+		}
+		piece, err := conn.receiveMessage(receiveCtx, t.info.nPieces, peer.PIECE, peer.CHOKE, peer.UNCHOKE)
+		cancel()
+		if err != nil && ctx.Err() == nil && receiveCtx.Err() != nil {
+			if conn.unchoked {
+				return nil, fmt.Errorf("%w: no block received for %s", ErrPeerTimeout, conn.timeout)
+			}
+			return nil, fmt.Errorf("%w: not unchoked for %s", ErrPeerChoked, CHOKED_TIMEOUT)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Another peer delivered the piece meanwhile, the blocks still requested are not wanted anymore
+		select {
+		case <-settled:
+			for begin, blockLength := range outstanding {
+				if err := conn.cancelRequest(ctx, pieceIndex, begin, blockLength); err != nil {
+					return nil, err
+				}
+			}
+			return nil, ErrPieceSettled
+		default:
+		}
+
+		// A choking peer drops the requests it didn't answer, they're sent again once it unchokes us. Our interest is
+		// restated, so the peer knows we still want its pieces
+		if piece.Type == peer.CHOKE {
+			if conn.unchoked {
+				conn.unchoked = false
+				chokedAt = conn.now()
+				if _, err := conn.sendMessage(ctx, peer.BuildInterestedMessage()); err != nil {
+					return nil, err
+				}
+			}
+			for begin, blockLength := range outstanding {
+				dropped[begin] = blockLength
+			}
+			clear(outstanding)
+			continue
+		}
+		if piece.Type == peer.UNCHOKE {
+			conn.unchoked = true
+			continue
+		}
+
+		block, err := peer.ParsePiece(piece)
+		if err != nil {
+			return nil, err
+		}
+
+		// Blocks of cancelled requests may have been sent before the peer got the cancel
+		if conn.wasCancelled(block) {
+			continue
+		}
+
+		if block.Index != pieceIndex {
+			return nil, fmt.Errorf("%w: piece message doesn't match the requested piece", peer.ErrInvalidMessage)
+		}
+		begin := block.Begin
+		blockLength, ok := outstanding[begin]
+		if !ok {
+			// Peers may still answer requests sent before choking us
+			blockLength, ok = dropped[begin]
+		}
+		if !ok || len(block.Block) != blockLength {
+			return nil, fmt.Errorf("%w: piece message doesn't match a requested block", peer.ErrInvalidMessage)
+		}
+		delete(outstanding, begin)
+		delete(dropped, begin)
+
+		copy(pieceData[begin:], block.Block)
+		received[begin/blockSize] = true
+
+		// Blocks are handed to onBlock in order, once the ones before them arrived
+		for nextDelivered < nBlocks && received[nextDelivered] {
+			if onBlock != nil {
+				blockBegin := nextDelivered * blockSize
+				onBlock(blockBegin, pieceData[blockBegin:min(blockBegin+blockSize, pieceLength)])
+			}
+			nextDelivered++
+		}
+	}
+
+	return pieceData, nil
+}
+
+// downloadPieceFromRandomPeer downloads the piece at pieceIndex from a random peer of the torrent. Returns the address
+// of the peer, and the piece, not verified yet.
+func (t Torrent) downloadPieceFromRandomPeer(ctx context.Context, pieceIndex int) (string, []byte, error) {
+	peerAddresses, err := t.Peers(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(peerAddresses) == 0 {
+		return "", nil, ErrNoPeers
+	}
+
+	// Pick a random peer
+	address := peerAddresses[mathRand.Intn(len(peerAddresses))]
+
+	conn, closer, err := t.connect(ctx, address)
+	if err != nil {
+		return "", nil, err
+	}
+	defer closer() // Close peer connection
+
+	// Send handshake
+	_, err = t.handshake(ctx, conn, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Get piece data
+	pieceData, err := t.getPieceFromPeer(ctx, conn, pieceIndex, true)
+	if err != nil {
+		return "", nil, &PieceError{Piece: pieceIndex, Peer: address, Err: err}
+	}
+
+	return address, pieceData, nil
+}
+
+// DownloadPieceToFile downloads the piece at pieceIndex from a random peer of the torrent, or from nPeers peers at once
+// when more than one, and writes it to outputPath once verified.
+func (t Torrent) DownloadPieceToFile(ctx context.Context, outputPath string, pieceIndex int, nPeers int) error {
+	c := t.getClient()
+
+	var pieceData []byte
+	source := "" // Peer the piece came from, empty when from several peers
+	if nPeers > 1 {
+		var err error
+		pieceData, err = t.downloadPieceFromPeers(ctx, pieceIndex, nPeers)
+		if err != nil {
+			return err
+		}
+	} else {
+		address, data, err := t.downloadPieceFromRandomPeer(ctx, pieceIndex)
+		if err != nil {
+			return err
+		}
+		pieceData, source = data, address
+	}
+
+	expectedHash := toHex(t.info.pieces[pieceIndex])
+	c.log.Info(fmt.Sprintf("Expected piece hash: %s", expectedHash), "piece", pieceIndex)
+
+	writtenPieceHash := toHex(t.pieceHash(pieceIndex, pieceData))
+	c.log.Info(fmt.Sprintf("Written piece hash:  %s", writtenPieceHash), "piece", pieceIndex)
+
+	if expectedHash != writtenPieceHash {
+		if source == "" {
+			return fmt.Errorf("piece %d: %w", pieceIndex, ErrHashMismatch)
+		}
+		return &PieceError{Piece: pieceIndex, Peer: source, Err: ErrHashMismatch}
+	}
+
+	n, err := c.storage.WriteFile(outputPath, pieceData)
+	if err != nil {
+		return err
+	}
+	c.log.Info(fmt.Sprintf("Wrote %d bytes to %s", n, outputPath), "path", outputPath, "bytes", n)
+
+	return nil
+}
+
+// DownloadFile downloads all the pieces of the torrent and writes them to outputPath. Pieces are written to the file
+// as they arrive and recorded in its resume file, so a download cancelled through ctx, or missing pieces, continues
+// where it stopped when started again. Returns why the download didn't finish: ctx being done, a tracker or disk
+// failure, or the pieces no peer could deliver.
+func (t Torrent) DownloadFile(ctx context.Context, outputPath string) (err error) {
+	ctx, span := t.getClient().tracer.startSpan(ctx, "download")
+	span.setAttribute("torrent.info_hash", toHex(t.infoHash))
+	span.setAttribute("torrent.name", t.info.name)
+	span.setAttribute("torrent.length", t.info.length)
+	span.setAttribute("torrent.pieces", t.info.nPieces)
+	defer func() { span.end(err) }()
+
+	c := t.getClient()
+
+	// A previous download interrupted while writing the file may have left it complete
+	complete, err := t.recoverJournal(outputPath)
+	if err != nil {
+		return err
+	}
+	if complete {
+		c.log.Info(fmt.Sprintf("%s was completely written before the interruption", outputPath), "path", outputPath)
+		for i := 0; i < t.info.nPieces; i++ {
+			t.verified.done(i)
+		}
+		t.publish(Event{Type: EVENT_COMPLETED, Bytes: t.info.length})
+		return nil
+	}
+
+	// Pieces are written to the output file as they arrive, a previous download may have left some
+	resume, err := t.openResume(outputPath)
+	if err != nil {
+		return err
+	}
+	finished := false
+	defer func() { resume.close(finished) }()
+
+	restored, err := resume.restore(t)
+	if err != nil {
+		return err
+	}
+	if restored > 0 {
+		c.log.Info(fmt.Sprintf("Resuming download, %d of %d pieces already downloaded", restored, t.info.nPieces),
+			"pieces", restored)
+	}
+	t.progress = newProgressTracker(t)
+	restoredLength := 0
+	for i := 0; i < t.info.nPieces; i++ {
+		if resume.has(i) {
+			restoredLength += t.info.pieceLengthAt(i)
+			t.verified.done(i)
+		}
+	}
+	t.progress.restored(restored, restoredLength)
+	t.stats = newTransferStats(t.info.length, restoredLength)
+	t.metrics = newMetricsRegistry()
+	if restored == t.info.nPieces {
+		err = t.finishDownload(ctx, outputPath, resume)
+		finished = err == nil
+		return err
+	}
+
+	_, announceSpan := c.tracer.startSpan(ctx, "tracker.announce")
+	announceSpan.setAttribute("tracker.url", t.announce)
+	session, peers, err := t.startTrackerSession(ctx)
+	announceSpan.setAttribute("tracker.peers", len(peers))
+	announceSpan.end(err)
+	// The web seeds download the torrent without peers
+	webSeedsOnly := len(t.webSeeds) > 0 && len(peers) == 0
+	if err != nil && !webSeedsOnly {
+		return err
+	}
+	if err != nil {
+		c.log.Warn(fmt.Sprintf("%s, downloading from the web seeds only", err))
+	}
+	defer session.stop(ctx)
+	if len(peers) == 0 && !webSeedsOnly {
+		return ErrNoPeers
+	}
+
+	// Peers that failed recently are skipped until their backoff elapses
+	if ready := c.deadPeers.filter(peers); len(ready) > 0 || webSeedsOnly {
+		peers = ready
+	} else {
+		return fmt.Errorf("%w: all %d peers failed recently", ErrNoPeers, len(peers))
+	}
+
+	// Connect to the peers answering first, instead of waiting on slow ones. The others are dialed as the pool needs them
+	pool := newPeerPool(max(c.maxPeers, 1), c.deadPeers, t.peerBudget)
+	pool.add(peers)
+	working := t.dialWorkingSet(ctx, peers, min(WORKING_SET_SIZE, pool.max))
+	defer func() {
+		for _, peer := range working {
+			peer.closer()
+		}
+	}()
+	if len(working) == 0 && len(t.webSeeds) == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: no peer completed the handshake", ErrNoPeers)
+	}
+
+	err = t.schedulePieces(ctx, pool, working, session, resume)
+
+	if ctx.Err() != nil {
+		resume.save()
+		return ctx.Err()
+	}
+	if err != nil {
+		// The other pieces are kept for the next attempt
+		resume.save()
+		return err
+	}
+
+	missing := 0
+	for i := 0; i < t.info.nPieces; i++ {
+		if !resume.has(i) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		// The pieces written so far are kept for the next attempt
+		resume.save()
+		return fmt.Errorf("%w: %d of %d pieces missing, the download resumes when started again", ErrIncomplete, missing, t.info.nPieces)
+	}
+
+	err = t.finishDownload(ctx, outputPath, resume)
+	if err != nil {
+		return err
+	}
+	finished = true
+	session.completed(ctx)
+
+	return nil
+}
+
+// finishDownload flushes the output file of a download whose pieces are all written to outputPath.
+func (t Torrent) finishDownload(ctx context.Context, outputPath string, resume *resumeFile) error {
+	c := t.getClient()
+
+	_, syncSpan := c.tracer.startSpan(ctx, "disk.sync")
+	syncSpan.setAttribute("file.path", outputPath)
+	syncSpan.setAttribute("file.bytes", t.info.length)
+	err := resume.sync()
+	syncSpan.end(err)
+	if err != nil {
+		return err
+	}
+
+	c.log.Info(fmt.Sprintf("Wrote %d bytes to %s", t.info.length, outputPath), "path", outputPath, "bytes", t.info.length)
+	t.publish(Event{Type: EVENT_COMPLETED, Bytes: t.info.length})
+
+	return nil
+}
+
+// infoHash bencodes the info map and returns the SHA-1 hash string representation. Fails when the map holds a value
+// that can't be bencoded.
+func infoHash(info map[string]any) ([]byte, error) {
+	infoStr, err := bencode.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum(infoStr)
+
+	return h[:], nil
+}
+
+func toHex(b []byte) string {
+	return hex.EncodeToString(b)
+}
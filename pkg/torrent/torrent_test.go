@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestParseMagnetLink checks the info hashes of the magnet links, hex or base32 v1 ones and v2 multihashes, along with
+// their trackers, peer hints and name, and the links refused for a missing or malformed exact topic.
+func TestParseMagnetLink(t *testing.T) {
+	const hash = "ad42ce8109f54c99613ce38f9b4d87e70f24a165"
+	const hashV2 = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	for _, test := range []struct {
+		name     string
+		link     string
+		infoHash string // Hex info hash the link is parsed to, empty when it's refused
+		v2       bool   // Whether the link has a v2 info hash
+		trackers []string
+		peers    []string
+		dn       string
+	}{
+		{name: "hex", link: "magnet:?xt=urn:btih:" + hash + "&dn=file.gif&tr=http%3A%2F%2Ftracker%2Fannounce",
+			infoHash: hash, trackers: []string{"http://tracker/announce"}, dn: "file.gif"},
+		{name: "uppercase hex", link: "magnet:?xt=urn:btih:" + strings.ToUpper(hash), infoHash: hash},
+		{name: "base32", link: "magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILF", infoHash: hash},
+		{name: "lowercase base32", link: "magnet:?xt=urn:btih:vvbm5aij6vgjsyj44ohzwtmh44hsjilf", infoHash: hash},
+		{name: "trackers", link: "magnet:?xt=urn:btih:" + hash + "&tr=udp%3A%2F%2Fa%3A80&tr=http%3A%2F%2Fb%2Fannounce",
+			infoHash: hash, trackers: []string{"udp://a:80", "http://b/announce"}},
+		{name: "peer hints", link: "magnet:?xt=urn:btih:" + hash +
+			"&x.pe=10.0.0.1%3A6881&x.pe=nope&x.pe=%5B%3A%3A1%5D%3A51413",
+			infoHash: hash, peers: []string{"10.0.0.1:6881", "[::1]:51413"}},
+		{name: "v2", link: "magnet:?xt=urn:btmh:1220" + hashV2, infoHash: hashV2[:40], v2: true},
+		{name: "hybrid", link: "magnet:?xt=urn:btih:" + hash + "&xt=urn:btmh:1220" + hashV2, infoHash: hash, v2: true},
+		{name: "other networks", link: "magnet:?xt=urn:ed2k:0123&xt=urn:btih:" + hash, infoHash: hash},
+		{name: "escaping name", link: "magnet:?xt=urn:btih:" + hash + "&dn=..%2Fx", infoHash: hash},
+		{name: "not a magnet link", link: "http://example.com/?xt=urn:btih:" + hash},
+		{name: "missing topic", link: "magnet:?dn=file.gif"},
+		{name: "unknown topic", link: "magnet:?xt=urn:sha1:" + hash},
+		{name: "short hash", link: "magnet:?xt=urn:btih:" + hash[:39]},
+		{name: "invalid hex", link: "magnet:?xt=urn:btih:" + hash[:39] + "z"},
+		{name: "invalid base32", link: "magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJIL1"},
+		{name: "not SHA-256", link: "magnet:?xt=urn:btmh:1120" + hashV2},
+		{name: "short multihash", link: "magnet:?xt=urn:btmh:1220" + hashV2[:62]},
+		{name: "invalid query", link: "magnet:?xt=urn:btih:" + hash + "&dn=%zz"},
+	} {
+		tor, err := parseMagnetLink(test.link)
+		if test.infoHash == "" {
+			if err == nil {
+				t.Fatalf("%s: %s parsed", test.name, test.link)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if hex.EncodeToString(tor.infoHash) != test.infoHash || (tor.infoHashV2 != nil) != test.v2 {
+			t.Fatalf("%s: info hash %x, v2 %x", test.name, tor.infoHash, tor.infoHashV2)
+		}
+		if test.v2 && hex.EncodeToString(tor.infoHashV2) != hashV2 {
+			t.Fatalf("%s: v2 info hash %x", test.name, tor.infoHashV2)
+		}
+		var trackers []string
+		if tor.trackers != nil {
+			trackers = tor.trackers.ordered()
+		} else if tor.announce != "" {
+			trackers = []string{tor.announce}
+		}
+		if !slices.Equal(trackers, test.trackers) {
+			t.Fatalf("%s: trackers %q", test.name, trackers)
+		}
+		if !slices.Equal(tor.peerHints, test.peers) || tor.info.name != test.dn {
+			t.Fatalf("%s: peer hints %q, name %q", test.name, tor.peerHints, tor.info.name)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal tracing of download sessions, exported using the OpenTelemetry protocol (OTLP) over HTTP with JSON
+// encoding. See: https://opentelemetry.io/docs/specs/otlp/
+
+const TRACING_SERVICE_NAME = "mybittorrent"
+
+// Ended spans are exported in batches, when the batch is full or periodically
+const TRACING_BATCH_SIZE = 512
+const TRACING_EXPORT_INTERVAL = 5 * time.Second
+
+// Span status codes defined by OTLP
+const SPAN_STATUS_OK = 1
+const SPAN_STATUS_ERROR = 2
+
+// Span kind defined by OTLP for internal operations
+const SPAN_KIND_INTERNAL = 1
+
+// span represents a timed operation, part of a trace.
+type span struct {
+	traceId    [16]byte
+	spanId     [8]byte
+	parentId   [8]byte // Zero for root spans
+	name       string
+	start      time.Time
+	attributes map[string]any
+	tracer     *Tracer // Exports the span once ended
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span as a child of the span in ctx, if any. Returns the context holding the new span, which must
+// be ended by the caller. A nil tracer disables tracing: the returned span is nil, and all its methods are no-ops.
+func (t *Tracer) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		name:       name,
+		start:      time.Now(),
+		attributes: map[string]any{},
+		tracer:     t,
+	}
+	rand.Read(s.spanId[:])
+
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok && parent != nil {
+		s.traceId = parent.traceId
+		s.parentId = parent.spanId
+	} else {
+		rand.Read(s.traceId[:])
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// setAttribute adds a key-value pair describing the operation. Supported values are strings, integers, booleans and
+// floats.
+func (s *span) setAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.attributes[key] = value
+}
+
+// end finishes the span, marking it as failed when err is not nil, and queues it for export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	s.tracer.add(s.otlp(time.Now(), err))
+}
+
+// otlp returns the OTLP JSON representation of the span
+func (s *span) otlp(end time.Time, err error) map[string]any {
+	status := map[string]any{"code": SPAN_STATUS_OK}
+	if err != nil {
+		status = map[string]any{"code": SPAN_STATUS_ERROR, "message": err.Error()}
+	}
+
+	attributes := make([]map[string]any, 0, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes = append(attributes, otlpAttribute(key, value))
+	}
+
+	res := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceId[:]),
+		"spanId":            hex.EncodeToString(s.spanId[:]),
+		"name":              s.name,
+		"kind":              SPAN_KIND_INTERNAL,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attributes,
+		"status":            status,
+	}
+	if s.parentId != [8]byte{} {
+		res["parentSpanId"] = hex.EncodeToString(s.parentId[:])
+	}
+
+	return res
+}
+
+// otlpAttribute returns the OTLP JSON representation of an attribute
+func otlpAttribute(key string, value any) map[string]any {
+	var v map[string]any
+
+	switch value := value.(type) {
+	case int:
+		// 64 bit integers are encoded as strings in OTLP JSON
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+
+	return map[string]any{"key": key, "value": v}
+}
+
+// Tracer sends batches of the ended spans of the clients tracing with it to an OTLP/HTTP collector.
+type Tracer struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	spans    []map[string]any
+	closed   bool  // Whether the tracer was closed, the spans ended since are dropped
+	failures int   // Exports that failed, whose spans were dropped
+	err      error // Failure of the last failed export
+
+	flushCh chan struct{}
+	done    chan struct{}
+	stopped chan struct{} // Closed once the last export is done
+}
+
+// StartTracing starts a tracer exporting the spans to the OTLP/HTTP collector at endpoint (e.g.
+// http://localhost:4318). The tracer is stopped by Close.
+func StartTracing(endpoint string) *Tracer {
+	t := &Tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:  &http.Client{Timeout: 10 * time.Second},
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		t.run()
+		close(t.stopped)
+	}()
+
+	return t
+}
+
+// WithTracing traces the downloads of the client's torrents with t.
+func WithTracing(t *Tracer) Option {
+	return func(c *Client) {
+		c.tracer = t
+	}
+}
+
+// Close exports the pending spans and stops the tracer. Fails when some spans could not be exported.
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	closed := t.closed
+	t.closed = true
+	t.mu.Unlock()
+
+	if !closed {
+		close(t.done)
+	}
+	<-t.stopped
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures > 0 {
+		return fmt.Errorf("could not export spans %d times: %w", t.failures, t.err)
+	}
+	return nil
+}
+
+// add queues an ended span, triggering an export when the batch is full. Spans ended once the tracer is closed are
+// dropped.
+func (t *Tracer) add(s map[string]any) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.spans = append(t.spans, s)
+	full := len(t.spans) >= TRACING_BATCH_SIZE
+	t.mu.Unlock()
+
+	if full {
+		select {
+		case t.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the queued spans periodically, and one last time when the tracer is closed.
+func (t *Tracer) run() {
+	ticker := time.NewTicker(TRACING_EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			t.export()
+			return
+		case <-ticker.C:
+		case <-t.flushCh:
+		}
+
+		t.export()
+	}
+}
+
+// export sends the queued spans to the collector. Export failures are recorded and the spans are dropped.
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": []any{otlpAttribute("service.name", TRACING_SERVICE_NAME)},
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": TRACING_SERVICE_NAME},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	res, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.fail(errors.New(res.Status))
+	}
+}
+
+// fail records an export that failed.
+func (t *Tracer) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failures++
+	t.err = err
+}
@@ -0,0 +1,49 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestTracerClose checks the spans of a client tracing with a tracer are exported when it's closed, and the spans
+// ended once it's closed are dropped.
+func TestTracerClose(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	tracer := StartTracing(collector.URL)
+	c := NewClient(WithTracing(tracer))
+	defer c.Close()
+
+	_, s := c.tracer.startSpan(context.Background(), "exported")
+	s.end(nil)
+	_, late := c.tracer.startSpan(context.Background(), "dropped")
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	late.end(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], `"exported"`) || strings.Contains(bodies[0], `"dropped"`) {
+		t.Fatalf("exported %q", bodies)
+	}
+
+	untraced := NewClient()
+	defer untraced.Close()
+	if _, s := untraced.tracer.startSpan(context.Background(), "untraced"); s != nil {
+		t.Fatal("span started without a tracer")
+	}
+}
@@ -0,0 +1,340 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mathRand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// Time between the announces of a download when the tracker doesn't tell
+const DEFAULT_ANNOUNCE_INTERVAL = 30 * time.Minute
+
+// Time given to the last announce of a download, which runs once the download is over
+const STOPPED_ANNOUNCE_TIMEOUT = 5 * time.Second
+
+// trackerList is the tiered list of trackers of a torrent, BEP 12. Trackers are tried tier by tier, in order, and the
+// one that responds is moved to the front of its tier, so the following announces start with it.
+type trackerList struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// parseAnnounceList builds the tracker list from the decoded announce-list of a torrent file. Trackers are shuffled
+// within their tier, as the spec requires. Returns nil when the list is missing or has no tracker.
+func parseAnnounceList(announceList any) *trackerList {
+	decodedTiers, ok := announceList.([]any)
+	if !ok {
+		return nil
+	}
+
+	var tiers [][]string
+	for _, decodedTier := range decodedTiers {
+		decodedTier, ok := decodedTier.([]any)
+		if !ok {
+			continue
+		}
+
+		var tier []string
+		for _, tracker := range decodedTier {
+			if tracker, ok := tracker.([]byte); ok && len(tracker) > 0 {
+				tier = append(tier, string(tracker))
+			}
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		mathRand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		tiers = append(tiers, tier)
+	}
+
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	return &trackerList{tiers: tiers}
+}
+
+// newTrackerList builds a tracker list trying the trackers in the given order, each in a tier of its own.
+func newTrackerList(trackers []string) *trackerList {
+	tiers := make([][]string, len(trackers))
+	for i, tracker := range trackers {
+		tiers[i] = []string{tracker}
+	}
+
+	return &trackerList{tiers: tiers}
+}
+
+// ordered returns the trackers in the order they are tried.
+func (l *trackerList) ordered() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var trackers []string
+	for _, tier := range l.tiers {
+		trackers = append(trackers, tier...)
+	}
+
+	return trackers
+}
+
+// promote moves the tracker to the front of its tier, after it responded.
+func (l *trackerList) promote(tracker string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, tier := range l.tiers {
+		for i, t := range tier {
+			if t == tracker {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = tracker
+				return
+			}
+		}
+	}
+}
+
+// announceToList announces the torrent to the trackers of its list in order, until one responds. Failures are
+// published as tracker errors before trying the next tracker. Returns the error of the last tracker when none responds.
+func (t Torrent) announceToList(ctx context.Context, announceEvent string) (tracker.Response, error) {
+	var lastErr error
+	for _, announceURL := range t.trackers.ordered() {
+		announced := t
+		announced.announce = announceURL
+
+		res, err := t.getClient().tracker.Announce(ctx, announced.announceRequest(announceEvent))
+		if err == nil {
+			t.getClient().log.Debug(fmt.Sprintf("Announced to %s, %d peers returned", announceURL, len(res.Peers)), "tracker", announceURL,
+				"event", announceEvent, "peers", len(res.Peers))
+			t.logTrackerWarning(announceURL, res)
+			t.trackers.promote(announceURL)
+			t.publish(Event{Type: EVENT_TRACKER_ANNOUNCE, Tracker: announceURL})
+			return res, nil
+		}
+		if !errors.Is(err, tracker.ErrFailure) {
+			return tracker.Response{}, err
+		}
+
+		t.publish(Event{Type: EVENT_TRACKER_ERROR, Tracker: announceURL, Error: err.Error()})
+		t.getClient().log.Debug(err.Error(), "tracker", announceURL, "event", announceEvent)
+		lastErr = err
+	}
+
+	return tracker.Response{}, lastErr
+}
+
+// ScrapeResult is the answer of a tracker of a torrent to a scrape, or the error it failed with.
+type ScrapeResult struct {
+	Tracker  string
+	Response tracker.ScrapeResponse
+	Err      error
+}
+
+// Scrape scrapes every tracker of the torrent, without announcing it. The trackers that fail are returned with their
+// error. Fails when the tracker client of the torrent can't scrape, or the torrent has no tracker.
+func (t Torrent) Scrape(ctx context.Context) ([]ScrapeResult, error) {
+	scraper, ok := t.getClient().tracker.(tracker.Scraper)
+	if !ok {
+		return nil, fmt.Errorf("%w: the tracker client can't scrape", tracker.ErrFailure)
+	}
+
+	announceURLs := []string{t.announce}
+	if t.trackers != nil {
+		announceURLs = t.trackers.ordered()
+	}
+	if len(announceURLs) == 0 || announceURLs[0] == "" {
+		return nil, fmt.Errorf("%w: the torrent has no tracker", tracker.ErrFailure)
+	}
+
+	results := make([]ScrapeResult, len(announceURLs))
+	for i, announceURL := range announceURLs {
+		scraped := t
+		scraped.announce = announceURL
+
+		res, err := scraper.Scrape(ctx, scraped.announceRequest(tracker.ANNOUNCE_NONE))
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		results[i] = ScrapeResult{Tracker: announceURL, Response: res, Err: err}
+	}
+
+	return results, nil
+}
+
+// logTrackerWarning logs the warning message the tracker at announceURL answered with, if any.
+func (t Torrent) logTrackerWarning(announceURL string, res tracker.Response) {
+	if res.Warning != "" {
+		t.getClient().log.Warn(fmt.Sprintf("Tracker %s warns: %s", announceURL, res.Warning), "tracker", announceURL)
+	}
+}
+
+// trackerSession announces a download to the trackers of its torrent: started when it begins, again on the interval
+// the tracker asks for to refresh the peers, completed once every piece is downloaded, and stopped when it ends.
+type trackerSession struct {
+	t Torrent
+
+	mu   sync.Mutex
+	next time.Time // When the next announce is due
+}
+
+// startTrackerSession announces the start of the download of t. Returns the peers of the torrent, from the trackers
+// or the DHT, and the session following the download.
+func (t Torrent) startTrackerSession(ctx context.Context) (*trackerSession, []string, error) {
+	s := &trackerSession{t: t}
+	peers, err := s.announce(ctx, tracker.ANNOUNCE_STARTED)
+
+	return s, peers, err
+}
+
+// announce announces the download with event, and schedules the next announce after the interval of the tracker, or
+// its min interval when longer. A failed announce is tried again after DEFAULT_ANNOUNCE_INTERVAL.
+func (s *trackerSession) announce(ctx context.Context, announceEvent string) ([]string, error) {
+	res, err := s.t.announcePeers(ctx, announceEvent)
+
+	interval := max(res.Interval, res.MinInterval)
+	if interval == 0 {
+		interval = DEFAULT_ANNOUNCE_INTERVAL
+	}
+	s.mu.Lock()
+	s.next = s.t.getClient().clock.now().Add(interval)
+	s.mu.Unlock()
+
+	return res.Peers, err
+}
+
+// untilNext returns the time left before the next announce is due.
+func (s *trackerSession) untilNext() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.next.Sub(s.t.getClient().clock.now())
+}
+
+// refresh announces the download without event, to learn about new peers. The announce runs in the background, the
+// peers are sent to refreshed unless done is closed first.
+func (s *trackerSession) refresh(ctx context.Context, refreshed chan<- []string, done <-chan struct{}) {
+	go func() {
+		peers, err := s.announce(ctx, tracker.ANNOUNCE_NONE)
+		if err != nil {
+			s.t.getClient().log.Warn(err.Error(), "tracker", s.t.announce)
+		}
+
+		select {
+		case refreshed <- peers:
+		case <-done:
+		}
+	}()
+}
+
+// completed tells the trackers the download finished.
+func (s *trackerSession) completed(ctx context.Context) {
+	s.announce(ctx, tracker.ANNOUNCE_COMPLETED)
+}
+
+// stop tells the trackers the download stopped, so they stop handing its address to other peers. The announce is
+// sent even once ctx is done, within STOPPED_ANNOUNCE_TIMEOUT.
+func (s *trackerSession) stop(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), STOPPED_ANNOUNCE_TIMEOUT)
+	defer cancel()
+
+	s.announce(ctx, tracker.ANNOUNCE_STOPPED)
+}
+
+// transferStats counts the bytes a download transferred, reported to the trackers on every announce. A nil stats
+// ignores the updates, as the torrents announced outside of a download have nothing to report.
+type transferStats struct {
+	downloaded atomic.Int64 // Bytes received in blocks, including the ones of discarded pieces
+	uploaded   atomic.Int64 // Bytes sent in blocks
+	left       atomic.Int64 // Bytes of the pieces not verified yet
+}
+
+// newTransferStats returns the stats of a download of length bytes, restored of which were kept from a previous
+// attempt.
+func newTransferStats(length, restored int) *transferStats {
+	s := &transferStats{}
+	s.left.Store(int64(length - restored))
+
+	return s
+}
+
+// received counts a block of n bytes received from a peer.
+func (s *transferStats) received(n int) {
+	if s != nil {
+		s.downloaded.Add(int64(n))
+	}
+}
+
+// sent counts a block of n bytes sent to a peer.
+func (s *transferStats) sent(n int) {
+	if s != nil {
+		s.uploaded.Add(int64(n))
+	}
+}
+
+// verified counts a piece of n bytes that passed the hash check.
+func (s *transferStats) verified(n int) {
+	if s != nil {
+		s.left.Add(-int64(n))
+	}
+}
+
+// announceRequest returns the announce of the torrent to its tracker with event, reporting the transfers of its
+// download and identifying it with the settings of its client.
+func (t Torrent) announceRequest(event string) tracker.Request {
+	c := t.getClient()
+
+	return tracker.Request{
+		URL:        t.announce,
+		InfoHash:   t.infoHash,
+		PeerId:     t.announcedPeerId(),
+		Port:       c.port,
+		Uploaded:   announcedUploaded(t),
+		Downloaded: announcedDownloaded(t),
+		Left:       announcedLeft(t),
+		Event:      event,
+		Key:        t.announcedKey(),
+		IPv6:       c.announcedIPv6,
+		UserAgent:  c.userAgent,
+		Headers:    c.trackerHeaders,
+	}
+}
+
+// announcedLeft returns the bytes left to download reported to trackers: the length of the pieces not verified yet
+// during a download, the whole length otherwise. A magnet link announced before its metadata is fetched has an unknown
+// length, reported as 0 until the metadata gives it.
+func announcedLeft(t Torrent) int {
+	if t.info.length == 0 {
+		return 0
+	}
+	if t.stats != nil {
+		return int(t.stats.left.Load())
+	}
+
+	return t.info.length
+}
+
+// announcedDownloaded returns the bytes downloaded reported to trackers, since the download started.
+func announcedDownloaded(t Torrent) int {
+	if t.stats == nil {
+		return 0
+	}
+
+	return int(t.stats.downloaded.Load())
+}
+
+// announcedUploaded returns the bytes uploaded reported to trackers, since the download started.
+func announcedUploaded(t Torrent) int {
+	if t.stats == nil {
+		return 0
+	}
+
+	return int(t.stats.uploaded.Load())
+}
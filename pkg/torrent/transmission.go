@@ -0,0 +1,628 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Subset of the Transmission RPC protocol, so existing remotes can control the daemon.
+// See: https://github.com/transmission/transmission/blob/main/docs/rpc-spec.md
+
+const TRANSMISSION_SESSION_HEADER = "X-Transmission-Session-Id"
+const TRANSMISSION_RPC_VERSION = 17
+const TRANSMISSION_RPC_VERSION_MINIMUM = 14
+
+// Torrent status values defined by the protocol
+const TRANSMISSION_STATUS_STOPPED = 0
+const TRANSMISSION_STATUS_DOWNLOAD_WAIT = 3
+const TRANSMISSION_STATUS_DOWNLOAD = 4
+const TRANSMISSION_STATUS_SEED = 6
+
+// Bytes in a kB of the speeds of the protocol
+const TRANSMISSION_SPEED_UNIT = 1000
+
+// Largest torrent file fetched from the URL given to torrent-add, leaving room for the piece layers of v2 torrents
+// besides the largest metadata accepted from peers
+const TRANSMISSION_MAX_TORRENT_SIZE = 2 * peer.MAX_METADATA_SIZE
+
+// Torrent error values defined by the protocol
+const TRANSMISSION_ERROR_NONE = 0
+const TRANSMISSION_ERROR_TRACKER = 2
+const TRANSMISSION_ERROR_LOCAL = 3
+
+// transmissionRPC serves the Transmission RPC endpoint of a daemon.
+type transmissionRPC struct {
+	d *Daemon
+	// Session ID clients must echo in every request, protecting against CSRF
+	sessionId string
+
+	mu             sync.Mutex
+	speedLimitDown int // Speed limits of session-set in kB/s, kept while they are disabled
+	speedLimitUp   int
+}
+
+type transmissionRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       any             `json:"tag,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string `json:"result"`
+	Arguments any    `json:"arguments"`
+	Tag       any    `json:"tag,omitempty"`
+}
+
+func newTransmissionRPC(d *Daemon) *transmissionRPC {
+	id := make([]byte, 24)
+	rand.Read(id)
+
+	return &transmissionRPC{
+		d:         d,
+		sessionId: base64.RawURLEncoding.EncodeToString(id),
+	}
+}
+
+func (rpc *transmissionRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Clients learn the session ID from the 409 response and retry the request with it
+	if r.Header.Get(TRANSMISSION_SESSION_HEADER) != rpc.sessionId {
+		w.Header().Set(TRANSMISSION_SESSION_HEADER, rpc.sessionId)
+		http.Error(w, "invalid session ID", http.StatusConflict)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req transmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Arguments) == 0 {
+		req.Arguments = json.RawMessage("{}")
+	}
+
+	res := transmissionResponse{Result: "success", Arguments: map[string]any{}, Tag: req.Tag}
+
+	arguments, err := rpc.call(r.Context(), req.Method, req.Arguments)
+	if err != nil {
+		res.Result = err.Error()
+	} else if arguments != nil {
+		res.Arguments = arguments
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// call executes the given method. Returns the arguments of the response.
+func (rpc *transmissionRPC) call(ctx context.Context, method string, arguments json.RawMessage) (any, error) {
+	switch method {
+	case "session-get":
+		return rpc.sessionGet(), nil
+	case "session-set":
+		return nil, rpc.sessionSet(arguments)
+	case "session-stats":
+		return rpc.sessionStats(), nil
+	case "torrent-add":
+		return rpc.torrentAdd(ctx, arguments)
+	case "torrent-get":
+		return rpc.torrentGet(arguments)
+	case "torrent-remove":
+		return nil, rpc.torrentRemove(arguments)
+	case "torrent-start":
+		return nil, rpc.forEachTorrent(arguments, rpc.d.Resume)
+	case "torrent-stop":
+		return nil, rpc.forEachTorrent(arguments, rpc.d.Pause)
+	case "torrent-set":
+		return nil, rpc.torrentSet(arguments)
+	default:
+		return nil, fmt.Errorf("method name not recognized: %s", method)
+	}
+}
+
+func (rpc *transmissionRPC) sessionGet() map[string]any {
+	limits := rpc.d.bandwidth.get().Default
+
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	// Limits set through the bandwidth schedule are reported too
+	down, up := rpc.speedLimitDown, rpc.speedLimitUp
+	if limits.Download > 0 {
+		down = limits.Download / TRANSMISSION_SPEED_UNIT
+	}
+	if limits.Upload > 0 {
+		up = limits.Upload / TRANSMISSION_SPEED_UNIT
+	}
+
+	return map[string]any{
+		"version":                  "mybittorrent",
+		"rpc-version":              TRANSMISSION_RPC_VERSION,
+		"rpc-version-minimum":      TRANSMISSION_RPC_VERSION_MINIMUM,
+		"download-dir":             rpc.d.downloadDir,
+		"speed-limit-down":         down,
+		"speed-limit-down-enabled": limits.Download > 0,
+		"speed-limit-up":           up,
+		"speed-limit-up-enabled":   limits.Upload > 0,
+		"units": map[string]any{
+			"speed-units": []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes": TRANSMISSION_SPEED_UNIT,
+		},
+	}
+}
+
+// sessionSet changes the speed limits, the default limits of the bandwidth schedule. A limit is kept while disabled,
+// and applies again once enabled.
+func (rpc *transmissionRPC) sessionSet(arguments json.RawMessage) error {
+	var args struct {
+		SpeedLimitDown        *int  `json:"speed-limit-down"`
+		SpeedLimitDownEnabled *bool `json:"speed-limit-down-enabled"`
+		SpeedLimitUp          *int  `json:"speed-limit-up"`
+		SpeedLimitUpEnabled   *bool `json:"speed-limit-up-enabled"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+
+	schedule := rpc.d.bandwidth.get()
+
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	// The limit in bytes per second of the given settings, given its current one
+	limit := func(current int, kept *int, value *int, enabled *bool) (int, error) {
+		if value != nil {
+			if *value < 0 {
+				return 0, fmt.Errorf("invalid speed limit %d", *value)
+			}
+			*kept = *value
+		}
+		on := current > 0
+		if enabled != nil {
+			on = *enabled
+		}
+		switch {
+		case !on:
+			return 0, nil
+		case value == nil && current > 0:
+			return current, nil
+		}
+
+		return *kept * TRANSMISSION_SPEED_UNIT, nil
+	}
+
+	var err error
+	if schedule.Default.Download, err = limit(schedule.Default.Download, &rpc.speedLimitDown, args.SpeedLimitDown, args.SpeedLimitDownEnabled); err != nil {
+		return err
+	}
+	if schedule.Default.Upload, err = limit(schedule.Default.Upload, &rpc.speedLimitUp, args.SpeedLimitUp, args.SpeedLimitUpEnabled); err != nil {
+		return err
+	}
+
+	return rpc.d.bandwidth.set(schedule)
+}
+
+func (rpc *transmissionRPC) sessionStats() map[string]any {
+	active, paused, downloadSpeed, uploadSpeed := 0, 0, 0, 0
+
+	torrents := rpc.d.list()
+	for _, st := range torrents {
+		s := rpc.d.snapshot(st)
+
+		switch s.status {
+		case STATUS_DOWNLOADING, STATUS_METADATA:
+			active++
+		case STATUS_STOPPED:
+			paused++
+		}
+		downloadSpeed += s.downloadRate(rpc.d.clock.now())
+		uploadSpeed += s.uploadRate(rpc.d.clock.now())
+	}
+
+	cumulative, session := rpc.d.stats.totals()
+
+	return map[string]any{
+		"activeTorrentCount": active,
+		"pausedTorrentCount": paused,
+		"torrentCount":       len(torrents),
+		"downloadSpeed":      downloadSpeed,
+		"uploadSpeed":        uploadSpeed,
+		"cumulative-stats":   transmissionStats(cumulative),
+		"current-stats":      transmissionStats(session),
+	}
+}
+
+// transmissionStats returns the statistics using the field names of the protocol
+func transmissionStats(data Stats) map[string]any {
+	return map[string]any{
+		"uploadedBytes":   data.Uploaded,
+		"downloadedBytes": data.Downloaded,
+		"filesAdded":      data.FilesAdded,
+		"sessionCount":    data.SessionCount,
+		"secondsActive":   data.SecondsActive,
+	}
+}
+
+func (rpc *transmissionRPC) torrentAdd(ctx context.Context, arguments json.RawMessage) (any, error) {
+	var args struct {
+		Filename    string   `json:"filename"`
+		Metainfo    string   `json:"metainfo"`
+		DownloadDir string   `json:"download-dir"`
+		Priority    int      `json:"bandwidthPriority"`
+		Labels      []string `json:"labels"`
+		Category    string   `json:"category"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	var t Torrent
+	var err error
+
+	switch {
+	case args.Metainfo != "":
+		content, decodeErr := base64.StdEncoding.DecodeString(args.Metainfo)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		t, err = parseTorrent(content)
+	case strings.HasPrefix(args.Filename, "http://"), strings.HasPrefix(args.Filename, "https://"):
+		t, err = fetchTorrent(ctx, args.Filename)
+	case args.Filename != "":
+		t, err = loadTorrent(args.Filename)
+	default:
+		return nil, errors.New("no filename or metainfo specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := "torrent-added"
+	st, err := rpc.d.AddTorrent(t, AddOptions{
+		DownloadDir: args.DownloadDir,
+		Priority:    args.Priority,
+		Labels:      args.Labels,
+		Category:    args.Category,
+	})
+	if err != nil {
+		if st == nil {
+			return nil, err
+		}
+		key = "torrent-duplicate"
+	}
+
+	s := rpc.d.snapshot(st)
+	return map[string]any{
+		key: map[string]any{
+			"id":         s.id,
+			"name":       s.t.info.name,
+			"hashString": toHex(s.t.infoHash),
+		},
+	}, nil
+}
+
+// fetchTorrent downloads and parses the torrent file at the given URL, of TRANSMISSION_MAX_TORRENT_SIZE bytes at most
+func fetchTorrent(ctx context.Context, url string) (Torrent, error) {
+	client := &http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return Torrent{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Torrent{}, errors.New(res.Status)
+	}
+
+	// One byte past the limit tells a torrent file over it from one of its size
+	content, err := io.ReadAll(io.LimitReader(res.Body, TRANSMISSION_MAX_TORRENT_SIZE+1))
+	if err != nil {
+		return Torrent{}, err
+	}
+	if len(content) > TRANSMISSION_MAX_TORRENT_SIZE {
+		return Torrent{}, fmt.Errorf("torrent file larger than %d bytes", TRANSMISSION_MAX_TORRENT_SIZE)
+	}
+
+	return parseTorrent(content)
+}
+
+func (rpc *transmissionRPC) torrentGet(arguments json.RawMessage) (any, error) {
+	var args struct {
+		Ids    json.RawMessage `json:"ids"`
+		Fields []string        `json:"fields"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	selected, err := rpc.selectTorrents(args.Ids)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents := make([]map[string]any, 0, len(selected))
+	for _, st := range selected {
+		fields := transmissionFields(rpc.d.snapshot(st), rpc.d.clock.now())
+		fields["queuePosition"] = rpc.d.queuePosition(st)
+
+		torrentFields := make(map[string]any, len(args.Fields))
+		for _, f := range args.Fields {
+			if v, ok := fields[f]; ok {
+				torrentFields[f] = v
+			}
+		}
+		torrents = append(torrents, torrentFields)
+	}
+
+	return map[string]any{"torrents": torrents}, nil
+}
+
+func (rpc *transmissionRPC) torrentRemove(arguments json.RawMessage) error {
+	var args struct {
+		Ids             json.RawMessage `json:"ids"`
+		DeleteLocalData bool            `json:"delete-local-data"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+
+	selected, err := rpc.selectTorrents(args.Ids)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range selected {
+		if args.DeleteLocalData {
+			if err := rpc.checkRemovable(st); err != nil {
+				return err
+			}
+		}
+		if err := rpc.d.RemoveTorrent(toHex(st.t.infoHash), args.DeleteLocalData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkRemovable fails when the data of st is outside the download directory of the daemon and the directories of its
+// categories, so remote clients can't have other files deleted through a download directory of their choice.
+func (rpc *transmissionRPC) checkRemovable(st *SessionTorrent) error {
+	snapshot := rpc.d.snapshot(st)
+	if snapshot.t.info.name == "" {
+		return nil
+	}
+	path, err := snapshot.dataPath()
+	if err != nil {
+		return err
+	}
+
+	rpc.d.mu.Lock()
+	defer rpc.d.mu.Unlock()
+
+	if insideDir(rpc.d.downloadDir, path) {
+		return nil
+	}
+	for _, config := range rpc.d.categories {
+		if config.CompleteDir != "" && insideDir(config.CompleteDir, path) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnsafePath, path)
+}
+
+// torrentSet changes the settings of the selected torrents: the priority, which orders the queue, the labels and the
+// category.
+func (rpc *transmissionRPC) torrentSet(arguments json.RawMessage) error {
+	var args struct {
+		Priority *int     `json:"bandwidthPriority"`
+		Labels   []string `json:"labels"`
+		Category *string  `json:"category"`
+		// Not part of the Transmission protocol, gives the torrent a new peer ID and tracker key
+		RegenerateIdentity bool `json:"regenerate-identity"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+
+	return rpc.forEachTorrent(arguments, func(hash string) error {
+		if args.RegenerateIdentity {
+			if err := rpc.d.regenerateIdentity(hash); err != nil {
+				return err
+			}
+		}
+
+		if args.Priority != nil {
+			if err := rpc.d.setPriority(hash, *args.Priority); err != nil {
+				return err
+			}
+		}
+
+		if args.Labels != nil || args.Category != nil {
+			return rpc.d.setLabels(hash, args.Labels, args.Category)
+		}
+
+		return nil
+	})
+}
+
+// forEachTorrent calls fn with the hash of every torrent referenced by the ids argument
+func (rpc *transmissionRPC) forEachTorrent(arguments json.RawMessage, fn func(hash string) error) error {
+	var args struct {
+		Ids json.RawMessage `json:"ids"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+
+	selected, err := rpc.selectTorrents(args.Ids)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range selected {
+		if err := fn(toHex(st.t.infoHash)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// selectTorrents returns the torrents referenced by the ids argument: a single ID, a list of IDs or hash strings, or
+// every torrent when missing. Fails when a reference selects no torrent.
+func (rpc *transmissionRPC) selectTorrents(ids json.RawMessage) ([]*SessionTorrent, error) {
+	torrents := rpc.d.list()
+	if len(ids) == 0 {
+		return torrents, nil
+	}
+
+	var refs []any
+	if ids[0] == '[' {
+		if err := json.Unmarshal(ids, &refs); err != nil {
+			return nil, err
+		}
+	} else {
+		var ref any
+		if err := json.Unmarshal(ids, &ref); err != nil {
+			return nil, err
+		}
+
+		// "recently-active" selects all the torrents, there's no notion of activity yet
+		if ref == "recently-active" {
+			return torrents, nil
+		}
+		refs = []any{ref}
+	}
+
+	// Every reference must select a torrent, rather than silently acting on fewer torrents
+	selected := make([]*SessionTorrent, 0, len(refs))
+	for _, ref := range refs {
+		found := false
+		for _, st := range torrents {
+			switch ref := ref.(type) {
+			case float64:
+				found = int(ref) == st.id
+			case string:
+				found = strings.EqualFold(ref, toHex(st.t.infoHash))
+			}
+			if found {
+				if !slices.Contains(selected, st) {
+					selected = append(selected, st)
+				}
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("torrent %v not found", ref)
+		}
+	}
+
+	return selected, nil
+}
+
+// transmissionFields returns all the supported torrent fields of the protocol for the given torrent state at now.
+func transmissionFields(s SessionTorrent, now time.Time) map[string]any {
+	status := TRANSMISSION_STATUS_DOWNLOAD
+	switch s.status {
+	case STATUS_STOPPED:
+		status = TRANSMISSION_STATUS_STOPPED
+	case STATUS_QUEUED:
+		status = TRANSMISSION_STATUS_DOWNLOAD_WAIT
+	case STATUS_COMPLETED:
+		status = TRANSMISSION_STATUS_SEED
+	}
+
+	errorCode := TRANSMISSION_ERROR_NONE
+	if s.err != "" {
+		errorCode = TRANSMISSION_ERROR_TRACKER
+		if s.status == STATUS_STOPPED {
+			errorCode = TRANSMISSION_ERROR_LOCAL
+		}
+	}
+
+	size := s.t.info.length
+	left := max(size-s.downloaded, 0)
+
+	percentDone := 0.0
+	if s.t.info.nPieces > 0 {
+		percentDone = float64(s.piecesDone) / float64(s.t.info.nPieces)
+	}
+
+	metadataPercentComplete := 1.0
+	if s.t.info.pieces == nil {
+		metadataPercentComplete = 0
+	}
+
+	rate := s.downloadRate(now)
+	eta := -1
+	if rate > 0 {
+		eta = left / rate
+	}
+
+	doneDate := int64(0)
+	if !s.doneAt.IsZero() {
+		doneDate = s.doneAt.Unix()
+	}
+
+	labels := s.labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	return map[string]any{
+		"id":                      s.id,
+		"name":                    s.t.info.name,
+		"hashString":              toHex(s.t.infoHash),
+		"status":                  status,
+		"error":                   errorCode,
+		"errorString":             s.err,
+		"percentDone":             percentDone,
+		"metadataPercentComplete": metadataPercentComplete,
+		"totalSize":               size,
+		"sizeWhenDone":            size,
+		"leftUntilDone":           left,
+		"haveValid":               s.downloaded,
+		"downloadedEver":          s.downloaded,
+		"uploadedEver":            s.uploaded,
+		"rateDownload":            rate,
+		"rateUpload":              s.uploadRate(now),
+		"eta":                     eta,
+		"isFinished":              s.status == STATUS_COMPLETED,
+		"addedDate":               s.addedAt.Unix(),
+		"doneDate":                doneDate,
+		"downloadDir":             s.downloadDir,
+		"pieceCount":              s.t.info.nPieces,
+		"pieceSize":               s.t.info.pieceLength,
+		"bandwidthPriority":       s.priority,
+		"labels":                  labels,
+		"category":                s.category,
+		"peersConnected":          0,
+	}
+}
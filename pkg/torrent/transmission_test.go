@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// jsonSubset reports whether the decoded JSON value got holds want: the same values, where the objects of got may
+// have more members than the ones of want.
+func jsonSubset(got, want any) bool {
+	switch want := want.(type) {
+	case map[string]any:
+		got, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, value := range want {
+			if !jsonSubset(got[key], value) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		got, ok := got.([]any)
+		if !ok || len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !jsonSubset(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
+
+// TestTransmissionRPC checks the session ID handshake of the Transmission RPC endpoint, then the methods adding,
+// listing, changing and removing torrents, and describing the session, in the order a remote calls them.
+func TestTransmissionRPC(t *testing.T) {
+	h, err := newHarness(2*32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	other, err := newHarness(32_768, 32_768, SEEDER_NORMAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.close()
+	other.info["name"] = "other.bin"
+	other.infoHash = other.v1InfoHash()
+
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/other.torrent":
+			w.Write(other.torrentFile())
+		case "/large.torrent":
+			w.Write(make([]byte, TRANSMISSION_MAX_TORRENT_SIZE+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer files.Close()
+
+	downloadDir := t.TempDir()
+	c := h.client()
+	defer c.Close()
+	d, err := NewDaemon(c, DaemonOptions{DownloadDir: downloadDir, StateDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	// Requests without the session ID are refused with it
+	res, err := http.Post(server.URL+"/transmission/rpc", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	sessionId := res.Header.Get(TRANSMISSION_SESSION_HEADER)
+	if res.StatusCode != http.StatusConflict || sessionId == "" {
+		t.Fatalf("request without a session ID answered %s, session ID %q", res.Status, sessionId)
+	}
+
+	hash, otherHash := toHex(h.infoHash), toHex(other.infoHash)
+	metainfo := base64.StdEncoding.EncodeToString(h.torrentFile())
+	for _, test := range []struct {
+		method    string
+		arguments string
+		result    string // Result of the response, "success" when it succeeded
+		response  string // JSON arguments the response holds, along with others
+	}{
+		{method: "session-get", result: "success",
+			response: fmt.Sprintf(`{"rpc-version": %d, "download-dir": %q, "speed-limit-down-enabled": false}`,
+				TRANSMISSION_RPC_VERSION, downloadDir)},
+		{method: "torrent-add", arguments: fmt.Sprintf(`{"metainfo": %q, "labels": ["tv"]}`, metainfo), result: "success",
+			response: fmt.Sprintf(`{"torrent-added": {"id": 1, "name": "harness.bin", "hashString": %q}}`, hash)},
+		{method: "torrent-add", arguments: fmt.Sprintf(`{"metainfo": %q}`, metainfo), result: "success",
+			response: fmt.Sprintf(`{"torrent-duplicate": {"id": 1, "hashString": %q}}`, hash)},
+		{method: "torrent-add", arguments: fmt.Sprintf(`{"filename": %q}`, files.URL+"/other.torrent"), result: "success",
+			response: fmt.Sprintf(`{"torrent-added": {"id": 2, "name": "other.bin", "hashString": %q}}`, otherHash)},
+		{method: "torrent-add", arguments: fmt.Sprintf(`{"filename": %q}`, files.URL+"/large.torrent"),
+			result: fmt.Sprintf("torrent file larger than %d bytes", TRANSMISSION_MAX_TORRENT_SIZE)},
+		{method: "torrent-add", arguments: `{"metainfo": "!"}`, result: "illegal base64 data at input byte 0"},
+		{method: "torrent-add", result: "no filename or metainfo specified"},
+		{method: "torrent-get", arguments: `{"fields": ["id", "name", "labels", "bandwidthPriority"]}`, result: "success",
+			response: `{"torrents": [{"id": 1, "name": "harness.bin", "labels": ["tv"], "bandwidthPriority": 0},
+				{"id": 2, "name": "other.bin", "labels": [], "bandwidthPriority": 0}]}`},
+		{method: "torrent-get", arguments: fmt.Sprintf(`{"ids": [%q], "fields": ["id", "totalSize"]}`, otherHash),
+			result: "success", response: `{"torrents": [{"id": 2, "totalSize": 32768}]}`},
+		{method: "torrent-get", arguments: `{"ids": [1, 3], "fields": ["id"]}`, result: "torrent 3 not found"},
+		{method: "torrent-set", arguments: `{"ids": [2], "bandwidthPriority": 1, "labels": ["a", "b"]}`, result: "success"},
+		{method: "torrent-set", arguments: `{"ids": 3, "bandwidthPriority": 1}`, result: "torrent 3 not found"},
+		{method: "torrent-get", arguments: `{"ids": 2, "fields": ["labels", "bandwidthPriority"]}`, result: "success",
+			response: `{"torrents": [{"labels": ["a", "b"], "bandwidthPriority": 1}]}`},
+		{method: "torrent-remove", arguments: `{"ids": [1], "delete-local-data": true}`, result: "success"},
+		{method: "torrent-remove", arguments: `{"ids": [1]}`, result: "torrent 1 not found"},
+		{method: "torrent-get", arguments: `{"fields": ["id"]}`, result: "success", response: `{"torrents": [{"id": 2}]}`},
+		{method: "torrent-verify", result: "method name not recognized: torrent-verify"},
+	} {
+		arguments := json.RawMessage(test.arguments)
+		if len(arguments) == 0 {
+			arguments = json.RawMessage("{}")
+		}
+		body, err := json.Marshal(map[string]any{"method": test.method, "arguments": arguments, "tag": 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/transmission/rpc", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(TRANSMISSION_SESSION_HEADER, sessionId)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var response struct {
+			Result    string `json:"result"`
+			Arguments any    `json:"arguments"`
+			Tag       int    `json:"tag"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&response)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.arguments, err)
+		}
+		if response.Result != test.result || response.Tag != 7 {
+			t.Fatalf("%s %s: result %q, tag %d", test.method, test.arguments, response.Result, response.Tag)
+		}
+
+		if test.response == "" {
+			continue
+		}
+		var want any
+		if err := json.Unmarshal([]byte(test.response), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !jsonSubset(response.Arguments, want) {
+			t.Fatalf("%s %s: arguments %v, expected %s", test.method, test.arguments, response.Arguments, test.response)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(downloadDir, "harness.bin")); !os.IsNotExist(err) {
+		t.Fatalf("data of the removed torrent kept: %v", err)
+	}
+}
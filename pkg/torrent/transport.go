@@ -0,0 +1,105 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// PeerDialer opens connections to peers. The torrent engine dials through it, so the network can be replaced, e.g. by
+// in-memory peers.
+type PeerDialer interface {
+	DialPeer(ctx context.Context, address string) (net.Conn, error)
+}
+
+// tcpDialer dials peers over TCP.
+type tcpDialer struct {
+	dialer   net.Dialer
+	resolver *DnsResolver // Resolves the hostnames of peers, the system's resolver is used when nil
+}
+
+func (d *tcpDialer) DialPeer(ctx context.Context, address string) (net.Conn, error) {
+	if d.resolver != nil {
+		return d.resolver.dialContext(d.dialer.DialContext)(ctx, "tcp", address)
+	}
+
+	return d.dialer.DialContext(ctx, "tcp", address)
+}
+
+// Used by clients without a dialer or tracker client of their own
+var defaultPeerDialer PeerDialer = &tcpDialer{}
+var defaultTrackerClient tracker.Client = tracker.NewSchemeTracker(http.DefaultTransport.(*http.Transport),
+	(&net.Dialer{}).DialContext)
+
+// getClient returns the client the torrent belongs to
+func (t Torrent) getClient() *Client {
+	return t.client
+}
+
+// connect opens a connection to the peer at address, using the dialer, rate limits and encryption policy of the
+// torrent's client. Unless encryption is required, peers failing the encryption handshake are connected again in
+// plaintext. Peers that can't be connected are backed off, banned peers are not dialed.
+func (t Torrent) connect(ctx context.Context, address string) (*peerConnection, func(), error) {
+	c := t.getClient()
+
+	if c.deadPeers.isBanned(address) {
+		return nil, func() {}, fmt.Errorf("%w: %s", ErrPeerBanned, address)
+	}
+	if !c.deadPeers.ready(address) {
+		return nil, func() {}, fmt.Errorf("%w: %s", ErrPeerBackoff, address)
+	}
+
+	conn, closer, err := t.dial(ctx, address)
+	if err != nil {
+		if ctx.Err() == nil {
+			c.deadPeers.failed(address)
+		}
+		return conn, closer, err
+	}
+
+	if c.encryption != ENCRYPTION_DISABLE {
+		err = conn.encrypt(ctx, t.infoHash)
+		if err != nil {
+			closer()
+			if ctx.Err() != nil {
+				return nil, closer, fmt.Errorf("%w with %s: %w", ErrEncryptionFailed, address, err)
+			}
+			if c.encryption == ENCRYPTION_REQUIRE {
+				c.deadPeers.failed(address)
+				return nil, closer, fmt.Errorf("%w with %s: %w", ErrEncryptionFailed, address, err)
+			}
+
+			conn, closer, err = t.dial(ctx, address)
+			if err != nil {
+				c.deadPeers.failed(address)
+				return conn, closer, err
+			}
+		}
+	}
+
+	if err := t.publish(Event{Type: EVENT_PEER_CONNECTED, Peer: address}); err != nil {
+		closer()
+		return nil, closer, err
+	}
+
+	return conn, closer, nil
+}
+
+// dial opens a plaintext connection to the peer at address, limited by the global and per-peer rate limits of the
+// torrent's client
+func (t Torrent) dial(ctx context.Context, address string) (*peerConnection, func(), error) {
+	c := t.getClient()
+
+	conn, closer, err := newPeerConnection(ctx, c.dialer, address)
+	if err != nil {
+		return conn, closer, err
+	}
+	conn.downloadLimiter, conn.uploadLimiter = c.peerLimiters()
+	conn.dump = c.wireDump
+	conn.timeout, conn.clock = c.peerTimeout, c.clock
+
+	return conn, closer, nil
+}
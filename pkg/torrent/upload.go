@@ -0,0 +1,258 @@
+package torrent
+
+import (
+	"context"
+	mathRand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Peers unchoked for their upload rate to us, on top of the optimistic unchoke
+const UNCHOKE_SLOTS = 4
+
+// How often the unchoked peers are chosen again from their upload rates
+const RECHOKE_INTERVAL = 10 * time.Second
+
+// How often the optimistically unchoked peer changes, giving a chance to peers we don't download from yet
+const OPTIMISTIC_UNCHOKE_INTERVAL = 30 * time.Second
+
+// Largest block a peer may request, twice the usual length
+const MAX_REQUEST_LENGTH = 2 * BLOCK_SIZE
+
+// uploader serves the pieces of a download to its peers, announcing them as they are verified. Uploads are tit-for-tat:
+// every RECHOKE_INTERVAL, the UNCHOKE_SLOTS interested peers that uploaded the most to us since the previous round are
+// unchoked, along with one interested peer picked at random every OPTIMISTIC_UNCHOKE_INTERVAL. The other peers are
+// choked, their requests ignored.
+type uploader struct {
+	t      Torrent
+	resume *resumeFile
+
+	mu             sync.Mutex
+	peers          []*uploadPeer
+	optimistic     *uploadPeer
+	optimisticTime time.Time // When the optimistic unchoke was last rotated
+}
+
+// uploadPeer is the upload state of a peer of the download. The choking decisions of the uploader and the pieces we
+// have are sent by the goroutine reading the connection, its read interrupted when there is something to send.
+type uploadPeer struct {
+	u    *uploader
+	conn *peerConnection
+
+	mu         sync.Mutex
+	bitfield   peer.Bitfield // Pieces we had when the peer joined, sent first then cleared. Nothing is sent without any
+	haves      []int         // Pieces verified since, to announce with have messages
+	interested bool          // Whether the peer wants pieces from us
+	unchoked   bool          // Whether the uploader unchoked the peer
+	sentChoke  bool          // Whether the peer was last sent a choke, it starts choked
+	rechokedAt int64         // Bytes of the blocks the peer sent us by the last rechoke, from its metrics
+}
+
+func newUploader(t Torrent, resume *resumeFile) *uploader {
+	return &uploader{t: t, resume: resume}
+}
+
+// join starts serving the peer of conn, which is first sent the bitfield of the pieces we have.
+func (u *uploader) join(conn *peerConnection) *uploadPeer {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// A piece completed meanwhile may be announced twice, by the bitfield and a have message
+	p := &uploadPeer{u: u, conn: conn, bitfield: u.resume.verifiedPieces(), sentChoke: true}
+	u.peers = append(u.peers, p)
+
+	return p
+}
+
+// leave stops serving the peer, whose connection ended. Does nothing on a nil peer, when it isn't served.
+func (p *uploadPeer) leave() {
+	if p == nil {
+		return
+	}
+
+	u := p.u
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, peer := range u.peers {
+		if peer == p {
+			u.peers = append(u.peers[:i], u.peers[i+1:]...)
+			break
+		}
+	}
+	if u.optimistic == p {
+		u.optimistic = nil
+	}
+}
+
+// have announces the verified piece at index to every peer.
+func (u *uploader) have(index int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, p := range u.peers {
+		p.mu.Lock()
+		p.haves = append(p.haves, index)
+		p.mu.Unlock()
+		p.wake()
+	}
+}
+
+// rechoke unchokes the interested peers that uploaded the most to us since the previous round, and the optimistic
+// unchoke, rotated when due. Chokes the other peers.
+func (u *uploader) rechoke(now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	type candidate struct {
+		peer     *uploadPeer
+		received int64
+	}
+	var interested []candidate
+	for _, p := range u.peers {
+		downloaded := p.conn.metrics.downloadedBytes()
+		p.mu.Lock()
+		if p.interested {
+			interested = append(interested, candidate{p, downloaded - p.rechokedAt})
+		}
+		p.rechokedAt = downloaded
+		p.mu.Unlock()
+	}
+	sort.SliceStable(interested, func(i, j int) bool { return interested[i].received > interested[j].received })
+
+	unchoked := map[*uploadPeer]bool{}
+	for i := 0; i < len(interested) && i < UNCHOKE_SLOTS; i++ {
+		unchoked[interested[i].peer] = true
+	}
+
+	// The optimistic unchoke goes to one of the interested peers left choked
+	if u.optimistic == nil || now.Sub(u.optimisticTime) >= OPTIMISTIC_UNCHOKE_INTERVAL || unchoked[u.optimistic] {
+		u.optimistic = nil
+		var choked []*uploadPeer
+		for _, c := range interested {
+			if !unchoked[c.peer] {
+				choked = append(choked, c.peer)
+			}
+		}
+		if len(choked) > 0 {
+			u.optimistic = choked[mathRand.Intn(len(choked))]
+			u.optimisticTime = now
+		}
+	}
+	if u.optimistic != nil {
+		unchoked[u.optimistic] = true
+	}
+
+	for _, p := range u.peers {
+		p.mu.Lock()
+		p.unchoked = unchoked[p]
+		p.mu.Unlock()
+		if p.due() {
+			p.wake()
+		}
+	}
+}
+
+// wake interrupts the read of the connection of the peer, so what's due is sent.
+func (p *uploadPeer) wake() {
+	p.conn.connection.SetReadDeadline(time.Now())
+}
+
+// due returns whether the peer is yet to be sent our pieces, or the last decision of the uploader.
+func (p *uploadPeer) due() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.bitfield != nil || len(p.haves) > 0 || p.unchoked == p.sentChoke
+}
+
+// sync sends the peer of pc what's due: the bitfield of our pieces when it just joined, have messages for the pieces
+// verified since, and a choke or unchoke message when the decision of the uploader changed since the last one it was
+// sent.
+func (p *uploadPeer) sync(ctx context.Context, pc *peerConnection) error {
+	p.mu.Lock()
+	pieces, haves := p.bitfield, p.haves
+	p.bitfield, p.haves = nil, nil
+	choke := !p.unchoked
+	changed := choke != p.sentChoke
+	p.sentChoke = choke
+	p.mu.Unlock()
+
+	var messages []peer.Message
+	if pieces != nil {
+		messages = append(messages, pieces.Serialize())
+	}
+	for _, index := range haves {
+		messages = append(messages, peer.Have{Index: index}.Serialize())
+	}
+	if changed {
+		mType := peer.UNCHOKE
+		if choke {
+			mType = peer.CHOKE
+		}
+		messages = append(messages, peer.Message{Length: 1, Type: mType})
+	}
+
+	for _, message := range messages {
+		if _, err := pc.sendMessage(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handle processes a message of the peer of pc about our uploads. Returns false when the message is about the
+// download, to be handled by the caller.
+func (p *uploadPeer) handle(ctx context.Context, pc *peerConnection, message *peer.Message) (bool, error) {
+	switch message.Type {
+	case peer.INTERESTED, peer.NOT_INTERESTED:
+		p.mu.Lock()
+		p.interested = message.Type == peer.INTERESTED
+		p.mu.Unlock()
+		return true, nil
+	case peer.CANCEL:
+		// Requests are served as they arrive, there is nothing left to cancel
+		_, err := peer.ParseBlockRequest(message)
+		return true, err
+	case peer.REQUEST:
+		return true, p.serveRequest(ctx, pc, message)
+	}
+
+	return false, nil
+}
+
+// serveRequest sends the requested block to the peer of pc, if it's unchoked and we have the piece. Other requests
+// are ignored, the peer may have sent them before being choked.
+func (p *uploadPeer) serveRequest(ctx context.Context, pc *peerConnection, message *peer.Message) error {
+	r, err := peer.ParseBlockRequest(message)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	choked := p.sentChoke
+	p.mu.Unlock()
+
+	t := p.u.t
+	if choked || r.Index >= t.info.nPieces || r.Length == 0 || r.Length > MAX_REQUEST_LENGTH ||
+		r.Begin+r.Length > t.info.pieceLengthAt(r.Index) {
+		return nil
+	}
+	block, err := p.u.resume.readBlock(t, r.Index, r.Begin, r.Length)
+	if err != nil || block == nil {
+		return nil
+	}
+
+	if _, err := pc.sendMessage(ctx, peer.Piece{Index: r.Index, Begin: r.Begin, Block: block}.Serialize()); err != nil {
+		return err
+	}
+	pc.metrics.sent(r.Length)
+	t.stats.sent(r.Length)
+	t.publish(Event{Type: EVENT_BLOCK_UPLOADED, Peer: pc.peerAddress, Bytes: r.Length})
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+)
+
+// Length of the blocks hashed into the merkle trees of v2 torrents, BEP 52: the leaves of the trees
+const MERKLE_BLOCK_SIZE = 16_384
+
+// v2File is a file of the file tree of a v2 torrent.
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot []byte // Root of the merkle tree of the blocks of the file, missing for an empty file
+}
+
+// parseFileTree returns the files of the decoded file tree of a v2 torrent, in the order of their paths. Every
+// directory is a dictionary of its entries, and a file a dictionary holding its length and pieces root under an empty
+// key.
+func parseFileTree(tree map[string]any, dir []string) ([]v2File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var files []v2File
+	for _, name := range names {
+		entry, ok := tree[name].(map[string]any)
+		if !ok || name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("info: invalid file tree entry %q", strings.Join(append(dir, name), "/"))
+		}
+		path := append(slices.Clip(dir), name)
+
+		if properties, ok := entry[""].(map[string]any); ok {
+			file, err := parseV2File(properties, path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+			continue
+		}
+
+		nested, err := parseFileTree(entry, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, nested...)
+	}
+
+	return files, nil
+}
+
+// parseV2File validates the properties of the file at path of a file tree.
+func parseV2File(properties map[string]any, path []string) (v2File, error) {
+	length, ok := properties["length"].(int)
+	if !ok || length < 0 {
+		return v2File{}, fmt.Errorf("info: missing or invalid length of %s", strings.Join(path, "/"))
+	}
+	piecesRoot, _ := properties["pieces root"].([]byte)
+	if length > 0 && len(piecesRoot) != sha256.Size {
+		return v2File{}, fmt.Errorf("info: missing or invalid pieces root of %s", strings.Join(path, "/"))
+	}
+
+	return v2File{path: path, length: length, piecesRoot: bytes.Clone(piecesRoot)}, nil
+}
+
+// parseSingleV2File returns the file of the file tree of a v2 or hybrid info dictionary, which must hold a single one
+// like the v1 torrents the client downloads.
+func parseSingleV2File(infoDict map[string]any) (v2File, error) {
+	tree, ok := infoDict["file tree"].(map[string]any)
+	if !ok {
+		return v2File{}, errors.New("info: missing file tree")
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return v2File{}, err
+	}
+	if len(files) != 1 || len(files[0].path) != 1 {
+		return v2File{}, fmt.Errorf("info: %d files in the file tree, only single file torrents are supported", len(files))
+	}
+	if files[0].length == 0 {
+		return v2File{}, errors.New("info: empty file")
+	}
+
+	return files[0], nil
+}
+
+// parseV2InfoDict builds the info of a v2 torrent that isn't hybrid. The pieces are the hashes of the piece layer of
+// its file, from the piece layers of the torrent file, checked against the pieces root. A file of a single piece has no
+// piece layer, its pieces root is the hash of the piece.
+func parseV2InfoDict(infoDict map[string]any, pieceLayers map[string]any) (info, error) {
+	name, ok := infoDict["name"].([]byte)
+	if !ok || !validFileName(string(name)) {
+		return info{}, errors.New("info: missing name")
+	}
+	pieceLength, ok := infoDict["piece length"].(int)
+	if !ok || pieceLength < MERKLE_BLOCK_SIZE || bits.OnesCount(uint(pieceLength)) != 1 {
+		return info{}, errors.New("info: missing or invalid piece length")
+	}
+	file, err := parseSingleV2File(infoDict)
+	if err != nil {
+		return info{}, err
+	}
+
+	n := (file.length + pieceLength - 1) / pieceLength
+	pieces := [][]byte{file.piecesRoot}
+	if n > 1 {
+		layer, ok := pieceLayers[string(file.piecesRoot)].([]byte)
+		if !ok {
+			return info{}, errors.New("info: missing piece layer, fetching it from peers is not supported")
+		}
+		if len(layer) != n*sha256.Size {
+			return info{}, fmt.Errorf("info: piece layer of %d bytes for %d pieces", len(layer), n)
+		}
+
+		pieces = make([][]byte, n)
+		for i := range pieces {
+			pieces[i] = bytes.Clone(layer[i*sha256.Size : (i+1)*sha256.Size])
+		}
+
+		// The pieces root is the root of the tree of the piece layer, completed with the hashes of pieces of zeros
+		pad := merkleRoot(sha256Hasher, nil, pieceLength/MERKLE_BLOCK_SIZE, make([]byte, sha256.Size))
+		if !bytes.Equal(merkleRoot(sha256Hasher, pieces, nextPowerOfTwo(n), pad), file.piecesRoot) {
+			return info{}, errors.New("info: piece layer doesn't match the pieces root")
+		}
+	}
+
+	return info{
+		length:      file.length,
+		name:        string(name),
+		nPieces:     n,
+		pieceLength: pieceLength,
+		pieces:      pieces,
+		metaVersion: 2,
+		merkle:      true,
+		piecesRoot:  file.piecesRoot,
+	}, nil
+}
+
+// merkleRoot returns the root of the merkle tree of the given hashes completed with pad up to leaves hashes, a power of
+// two. The nodes are hashed with hasher, SHA-256.
+func merkleRoot(hasher pieceHasher, hashes [][]byte, leaves int, pad []byte) []byte {
+	layer := make([][]byte, leaves)
+	for i := range layer {
+		layer[i] = pad
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		}
+	}
+
+	for len(layer) > 1 {
+		parents := make([][]byte, len(layer)/2)
+		for i := range parents {
+			parents[i] = hasher.hash(slices.Concat(layer[2*i], layer[2*i+1]))
+		}
+		layer = parents
+	}
+
+	return layer[0]
+}
+
+// nextPowerOfTwo returns the smallest power of two at least n.
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+
+	return 1 << bits.Len(uint(n-1))
+}
+
+// merklePieceHash returns the hash of the piece at index of a v2 torrent: the root of the tree of the hashes of its
+// blocks, completed with zeros up to the blocks of a whole piece. The single piece of a file is completed up to the
+// next power of two instead, its hash being the pieces root of the file.
+func (i info) merklePieceHash(hasher pieceHasher, index int, data []byte) []byte {
+	var blocks [][]byte
+	for begin := 0; begin < len(data); begin += MERKLE_BLOCK_SIZE {
+		blocks = append(blocks, hasher.hash(data[begin:min(begin+MERKLE_BLOCK_SIZE, len(data))]))
+	}
+
+	leaves := i.pieceLength / MERKLE_BLOCK_SIZE
+	if i.nPieces == 1 {
+		leaves = nextPowerOfTwo(len(blocks))
+	}
+
+	return merkleRoot(hasher, blocks, leaves, make([]byte, sha256.Size))
+}
+
+// pieceHash returns the hash of the data of the piece at index, to compare with the one the torrent lists: SHA-1 for v1
+// and hybrid torrents, the root of the merkle tree of its blocks for v2 ones.
+func (t Torrent) pieceHash(index int, data []byte) []byte {
+	hasher := t.getClient().hashers[t.info.hashAlgorithm()]
+	if t.info.merkle {
+		return t.info.merklePieceHash(hasher, index, data)
+	}
+
+	return hasher.hash(data)
+}
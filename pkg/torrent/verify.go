@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// States of the pieces checked by Verify
+const PIECE_GOOD = "good"
+const PIECE_BAD = "bad"
+const PIECE_MISSING = "missing"
+
+// Verify checks the pieces of the data of the torrent downloaded at output: the downloaded file, or the directory
+// containing it. Returns the path of the data, and the state of every piece, one of the PIECE_ states.
+func (t Torrent) Verify(output string) (string, []string, error) {
+	dataPath := output
+	named := filepath.Join(dataPath, t.info.name)
+	if stat, err := os.Stat(dataPath); err == nil && stat.IsDir() && t.info.files == nil {
+		dataPath = named
+	} else if stat, err := os.Stat(named); err == nil && stat.IsDir() && t.info.files != nil {
+		dataPath = named
+	}
+
+	// A missing file has all its pieces missing
+	file, err := openDataFiles(t.info.dataLayout(dataPath), false)
+	if err != nil {
+		return dataPath, nil, err
+	}
+	defer file.Close()
+
+	indexes := make([]int, t.info.nPieces)
+	present := make([]bool, t.info.nPieces)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	valid, err := t.verifyPieces(indexes, func(i int) ([]byte, error) {
+		start := i * t.info.pieceLength
+		data := make([]byte, t.info.pieceLengthAt(i))
+		if _, err := file.ReadAt(data, int64(start)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		present[i] = true
+
+		return data, nil
+	})
+	if err != nil {
+		return dataPath, nil, err
+	}
+
+	states := make([]string, len(valid))
+	for i, ok := range valid {
+		switch {
+		case ok:
+			states[i] = PIECE_GOOD
+		case present[i]:
+			states[i] = PIECE_BAD
+		default:
+			states[i] = PIECE_MISSING
+		}
+	}
+
+	return dataPath, states, nil
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often the watch directory is scanned for new torrent files
+const WATCH_INTERVAL = 5 * time.Second
+
+// Subdirectories of the watch directory the torrent files are moved to once added, or when they can't be
+const WATCH_ADDED_DIR = "added"
+const WATCH_FAILED_DIR = "failed"
+
+// dirWatcher adds the torrent files dropped into a directory to a daemon, then moves them out of the way. A file is
+// only added once its size and modification time didn't change between two scans, so files still being written are
+// left alone.
+type dirWatcher struct {
+	d    *Daemon
+	dir  string
+	seen map[string]os.FileInfo // Torrent files of the previous scan, keyed by name
+}
+
+func newDirWatcher(d *Daemon, dir string) *dirWatcher {
+	return &dirWatcher{d: d, dir: dir, seen: map[string]os.FileInfo{}}
+}
+
+// run scans the directory every WATCH_INTERVAL until ctx is done.
+func (w *dirWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(WATCH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		w.scan()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan adds the torrent files unchanged since the previous scan. Added files, and torrents already added, are moved to
+// WATCH_ADDED_DIR. Files that are not valid torrents, or that the hooks refuse, are moved to WATCH_FAILED_DIR.
+func (w *dirWatcher) scan() {
+	log := w.d.client.log
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Could not scan the watch directory: %s", err))
+		return
+	}
+
+	seen := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.EqualFold(filepath.Ext(entry.Name()), ".torrent") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		previous, ok := w.seen[entry.Name()]
+		if !ok || previous.Size() != info.Size() || !previous.ModTime().Equal(info.ModTime()) {
+			seen[entry.Name()] = info
+			continue
+		}
+
+		path := filepath.Join(w.dir, entry.Name())
+		destination := WATCH_ADDED_DIR
+		if err := w.add(path); err != nil {
+			log.Warn(fmt.Sprintf("Could not add %s from the watch directory: %s", entry.Name(), err))
+			destination = WATCH_FAILED_DIR
+		} else {
+			log.Info(fmt.Sprintf("Added %s from the watch directory", entry.Name()))
+		}
+
+		// A file that can't be moved is left for the next scans, added again as a duplicate
+		if err := os.MkdirAll(filepath.Join(w.dir, destination), 0755); err == nil {
+			err = os.Rename(path, filepath.Join(w.dir, destination, entry.Name()))
+		}
+		if err != nil {
+			log.Warn(fmt.Sprintf("Could not move %s out of the watch directory: %s", entry.Name(), err))
+		}
+	}
+	w.seen = seen
+}
+
+// add adds the torrent file at path to the daemon. A torrent already added is not an error.
+func (w *dirWatcher) add(path string) error {
+	t, err := parseTorrentFile(path)
+	if err != nil {
+		return err
+	}
+
+	w.d.mu.Lock()
+	_, added := w.d.torrents[toHex(t.infoHash)]
+	w.d.mu.Unlock()
+	if added {
+		return nil
+	}
+
+	_, err = w.d.AddTorrent(t, AddOptions{})
+	return err
+}
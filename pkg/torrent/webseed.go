@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker"
+)
+
+// Bytes of a web seed response read at once, each read waiting on the download rate limit
+const WEB_SEED_READ_SIZE = 16_384
+
+// parseUrlList returns the web seeds of the decoded url-list of a torrent file, BEP 19: a single URL or a list of them.
+// URLs that are not HTTP or HTTPS are ignored.
+func parseUrlList(urlList any) []string {
+	var decoded []any
+	switch urlList := urlList.(type) {
+	case []byte:
+		decoded = []any{urlList}
+	case []any:
+		decoded = urlList
+	}
+
+	var seeds []string
+	for _, seed := range decoded {
+		seed, ok := seed.([]byte)
+		if !ok {
+			continue
+		}
+		if u, err := url.Parse(string(seed)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			seeds = append(seeds, string(seed))
+		}
+	}
+
+	return seeds
+}
+
+// webSeedURL returns the URL of the file of the torrent on the web seed: the seed itself, or the name of the torrent
+// appended when it ends with a slash.
+func (t Torrent) webSeedURL(seed string) string {
+	if strings.HasSuffix(seed, "/") {
+		return seed + url.PathEscape(t.info.name)
+	}
+
+	return seed
+}
+
+// webSeedWorker downloads pieces of the queue from a web seed, which has every piece, like a peer worker. A piece the
+// seed fails to deliver is put back on the queue for the peers and the worker stops, the seed being unreachable or
+// serving another file.
+func (t Torrent) webSeedWorker(ctx context.Context, seed string, resume *resumeFile, queue *pieceQueue, results chan<- pieceResult, done <-chan struct{}) {
+	c := t.getClient()
+
+	all := make(peer.Bitfield, (t.info.nPieces+7)/8)
+	for i := 0; i < t.info.nPieces; i++ {
+		all.Set(i)
+	}
+
+	for {
+		pieceIndex, settled, ok := queue.take(ctx, all, done)
+		if !ok {
+			return
+		}
+
+		data, err := t.downloadWebSeedPiece(ctx, seed, resume, pieceIndex)
+		select {
+		case <-settled:
+			// Delivered by a peer meanwhile
+			continue
+		default:
+		}
+
+		if err == nil || errors.Is(err, ErrVetoed) || errors.Is(err, ErrDiskFailure) {
+			if queue.settle(pieceIndex) {
+				results <- pieceResult{index: pieceIndex, data: data, err: err}
+			}
+			continue
+		}
+
+		if ctx.Err() == nil {
+			c.log.Warn(err.Error(), "peer", seed, "piece", pieceIndex)
+		}
+		if queue.put(pieceIndex) {
+			err = fmt.Errorf("%w: piece %d after %d attempts, the last one: %w", ErrPieceFailed, pieceIndex, queue.attempts(pieceIndex), err)
+			select {
+			case results <- pieceResult{index: pieceIndex, err: err}:
+			case <-done:
+			}
+		}
+		return
+	}
+}
+
+// downloadWebSeedPiece downloads the piece at pieceIndex from the web seed with a range request, verifies it and
+// writes it to the output file of resume.
+func (t Torrent) downloadWebSeedPiece(ctx context.Context, seed string, resume *resumeFile, pieceIndex int) ([]byte, error) {
+	c := t.getClient()
+	c.logPiece(fmt.Sprintf("Downloading piece %d from web seed %s", pieceIndex, seed), "peer", seed, "piece", pieceIndex)
+	metrics := t.metrics.peer(seed)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.webSeedURL(seed), nil)
+	if err != nil {
+		return nil, &PieceError{Piece: pieceIndex, Peer: seed, Err: err}
+	}
+	begin := pieceIndex * t.info.pieceLength
+	pieceLength := t.info.pieceLengthAt(pieceIndex)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, begin+pieceLength-1))
+	userAgent := c.userAgent
+	if userAgent == "" {
+		userAgent = tracker.DEFAULT_USER_AGENT
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	res, err := c.webClient.Do(req)
+	if err != nil {
+		return nil, &PieceError{Piece: pieceIndex, Peer: seed, Err: err}
+	}
+	defer res.Body.Close()
+
+	// A seed ignoring the range sends the whole file, only its first piece is usable then
+	if res.StatusCode != http.StatusPartialContent && (res.StatusCode != http.StatusOK || begin != 0) {
+		return nil, &PieceError{Piece: pieceIndex, Peer: seed, Err: fmt.Errorf("web seed answered %s", res.Status)}
+	}
+
+	data := make([]byte, 0, pieceLength)
+	for len(data) < pieceLength {
+		n := min(WEB_SEED_READ_SIZE, pieceLength-len(data))
+		if err := c.downloadLimiter.wait(ctx, n); err != nil {
+			return nil, err
+		}
+		read, err := io.ReadFull(res.Body, data[len(data):len(data)+n])
+		data = data[:len(data)+read]
+		t.progress.received(seed, read)
+		t.stats.received(read)
+		metrics.received(read)
+		if err != nil {
+			return nil, &PieceError{Piece: pieceIndex, Peer: seed, Err: err}
+		}
+	}
+
+	valid, err := c.hashes.verify(ctx, t, pieceIndex, data, seed)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		err := &PieceError{Piece: pieceIndex, Peer: seed, Err: ErrHashMismatch}
+		t.publish(Event{Type: EVENT_HASH_FAIL, Piece: &pieceIndex, Peer: seed, Error: err.Error()})
+		return nil, err
+	}
+
+	if err := t.publish(Event{Type: EVENT_PIECE_COMPLETE, Piece: &pieceIndex, Peer: seed, Bytes: len(data)}); err != nil {
+		return nil, &PieceError{Piece: pieceIndex, Peer: seed, Err: err}
+	}
+	if err := resume.writePiece(t, pieceIndex, data); err != nil {
+		return nil, err
+	}
+	metrics.delivered()
+
+	return data, nil
+}
@@ -0,0 +1,97 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Directions of the recorded messages
+const WIRE_SENT = "sent"
+const WIRE_RECEIVED = "received"
+
+// wireRecord is a message exchanged with a peer, as written to the wire dump.
+type wireRecord struct {
+	Time      time.Time `json:"time"`
+	Peer      string    `json:"peer"`
+	Direction string    `json:"direction"`
+	Kind      string    `json:"kind"`           // Name of the message type, "handshake" or "keep-alive"
+	Type      *uint8    `json:"type,omitempty"` // ID of the message type, missing for handshakes and keep-alives
+	Length    int       `json:"length"`         // Length announced by the length prefix, or of the handshake
+	Payload   string    `json:"payload,omitempty"`
+	Error     string    `json:"error,omitempty"` // Why a received message was rejected
+}
+
+// WireDump records the messages exchanged with peers as JSON lines, to analyze protocol issues offline. Payloads are
+// hex encoded, truncated to payloadBytes.
+type WireDump struct {
+	mu           sync.Mutex
+	w            io.WriteCloser
+	payloadBytes int
+}
+
+// OpenWireDump creates the file at path, where the messages are recorded.
+func OpenWireDump(path string, payloadBytes int) (*WireDump, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create wire dump: %w", err)
+	}
+
+	return &WireDump{w: file, payloadBytes: payloadBytes}, nil
+}
+
+// WithWireDump records the messages exchanged by the client's torrents in dump.
+func WithWireDump(dump *WireDump) Option {
+	return func(c *Client) {
+		c.wireDump = dump
+	}
+}
+
+// record writes a message exchanged with peer. Nothing is recorded by a nil dump.
+func (d *WireDump) record(peer, direction, kind string, mType *uint8, length int, payload []byte, err error) {
+	if d == nil {
+		return
+	}
+
+	r := wireRecord{Time: time.Now(), Peer: peer, Direction: direction, Kind: kind, Type: mType, Length: length}
+	if d.payloadBytes > 0 && len(payload) > 0 {
+		r.Payload = toHex(payload[:min(len(payload), d.payloadBytes)])
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	line, _ := json.Marshal(r)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.w.Write(append(line, '\n'))
+}
+
+// recordMessage writes a peer message exchanged with the peer at address.
+func (d *WireDump) recordMessage(address, direction string, m *peer.Message) {
+	kind, ok := peer.MessageNames[m.Type]
+	if !ok {
+		kind = "unknown"
+	}
+	mType := m.Type
+
+	d.record(address, direction, kind, &mType, int(m.Length), m.Payload, nil)
+}
+
+func (d *WireDump) Close() error {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.w.Close()
+}
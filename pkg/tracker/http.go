@@ -0,0 +1,170 @@
+package tracker
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// User-Agent of the tracker requests unless configured
+const DEFAULT_USER_AGENT = "mybittorrent/0001"
+
+// Timeout of a tracker request, redirects included
+const HTTP_TRACKER_TIMEOUT = 10 * time.Second
+
+// Redirects a tracker request follows at most
+const HTTP_TRACKER_MAX_REDIRECTS = 5
+
+// HttpTracker announces torrents to HTTP and HTTPS trackers. Requests carry the User-Agent and headers of the
+// announce, and accept gzip encoded responses. Redirects are followed, except from HTTPS to plain HTTP, which would
+// leak the announce.
+type HttpTracker struct {
+	client *http.Client
+}
+
+// NewHttpTracker returns an HTTP tracker client sending its requests through transport.
+func NewHttpTracker(transport http.RoundTripper) *HttpTracker {
+	return &HttpTracker{
+		client: &http.Client{
+			Timeout:       HTTP_TRACKER_TIMEOUT,
+			Transport:     transport,
+			CheckRedirect: checkRedirect,
+		},
+	}
+}
+
+// checkRedirect allows the redirects of a tracker request, up to HTTP_TRACKER_MAX_REDIRECTS, that don't downgrade
+// HTTPS to HTTP. The headers of the first request are kept by the redirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= HTTP_TRACKER_MAX_REDIRECTS {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrFailure, len(via))
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: redirect from HTTPS to %s refused", ErrFailure, req.URL.Redacted())
+	}
+
+	return nil
+}
+
+// Announce executes the tracker request and parses the peer addresses and announce intervals from the response
+func (c *HttpTracker) Announce(ctx context.Context, announce Request) (Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announce.URL, nil)
+	if err != nil {
+		return Response{}, err
+	}
+	req.URL.RawQuery = queryParams(req, announce)
+
+	decodedRes, err := c.get(ctx, announce, req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	peers, err := ParsePeers(decodedRes)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// Intervals are in seconds, invalid ones are ignored
+	interval, _ := decodedRes["interval"].(int)
+	minInterval, _ := decodedRes["min interval"].(int)
+	warning, _ := decodedRes["warning message"].([]byte)
+
+	return Response{
+		Peers:       peers,
+		Interval:    time.Duration(max(interval, 0)) * time.Second,
+		MinInterval: time.Duration(max(minInterval, 0)) * time.Second,
+		Warning:     string(warning),
+	}, nil
+}
+
+// queryParams builds the query parameters needed to execute the announce. Returns a string containing the URL encoded
+// query parameters
+func queryParams(req *http.Request, announce Request) string {
+	q := req.URL.Query()
+	q.Add("info_hash", string(announce.InfoHash))
+	q.Add("peer_id", announce.PeerId)
+	q.Add("port", strconv.Itoa(announce.Port))
+	q.Add("uploaded", strconv.Itoa(announce.Uploaded))
+	q.Add("downloaded", strconv.Itoa(announce.Downloaded))
+	q.Add("left", strconv.Itoa(announce.Left))
+	q.Add("compact", "1")
+	if announce.IPv6 != nil {
+		q.Add("ipv6", announce.IPv6.String())
+	}
+	if announce.Key != "" {
+		q.Add("key", announce.Key)
+	}
+	if announce.Event != ANNOUNCE_NONE {
+		q.Add("event", announce.Event)
+	}
+
+	return q.Encode()
+}
+
+// get sends the request to the tracker, with the User-Agent and headers of announce, and returns the decoded
+// dictionary of the response. Fails with ErrFailure when the tracker answers with a failure reason.
+func (c *HttpTracker) get(ctx context.Context, announce Request, req *http.Request) (map[string]any, error) {
+	for name, values := range announce.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	userAgent := announce.UserAgent
+	if userAgent == "" {
+		userAgent = DEFAULT_USER_AGENT
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// Asked explicitly, the response is then decoded here, since some trackers compress it whatever the request says
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		// A cancelled request says nothing about the tracker
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, ErrFailure) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrFailure, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrFailure, res.Status)
+	}
+
+	body := io.Reader(res.Body)
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid gzip response: %w", ErrFailure, err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	resContent, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailure, err)
+	}
+
+	decodedRes, _, err := bencode.DecodeDictionary(resContent)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid response: %w", ErrFailure, err)
+	}
+
+	if reason, ok := decodedRes["failure reason"].([]byte); ok {
+		return nil, fmt.Errorf("%w: %s", ErrFailure, reason)
+	}
+
+	return decodedRes, nil
+}
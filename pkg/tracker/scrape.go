@@ -0,0 +1,105 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Action of the UDP tracker scrape requests and responses
+const UDP_ACTION_SCRAPE = 2
+
+// Length of the fixed part of a UDP scrape response, followed by 12 bytes for every scraped info hash
+const UDP_SCRAPE_RESPONSE_LENGTH = 8
+
+// ScrapeResponse is the state of the swarm of a torrent reported by a tracker.
+type ScrapeResponse struct {
+	Seeders   int // Peers with the whole torrent
+	Leechers  int // Peers still downloading it
+	Completed int // Downloads the tracker saw completing
+}
+
+// Scraper is a tracker client also able to scrape the trackers of the torrents, without announcing them.
+type Scraper interface {
+	Scrape(ctx context.Context, req Request) (ScrapeResponse, error)
+}
+
+// ScrapeURL returns the scrape URL of an HTTP tracker, derived from its announce URL by the convention of the original
+// protocol: the last path segment starts with announce, replaced by scrape. Fails for trackers that can't be scraped.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid announce URL: %w", ErrFailure, err)
+	}
+
+	i := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("%w: %s doesn't support scrape", ErrFailure, announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+
+	return u.String(), nil
+}
+
+func (c *HttpTracker) Scrape(ctx context.Context, scrape Request) (ScrapeResponse, error) {
+	scrapeURL, err := ScrapeURL(scrape.URL)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL, nil)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+	q := req.URL.Query()
+	q.Add("info_hash", string(scrape.InfoHash))
+	req.URL.RawQuery = q.Encode()
+
+	decodedRes, err := c.get(ctx, scrape, req)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	files, _ := decodedRes["files"].(map[string]any)
+	file, ok := files[string(scrape.InfoHash)].(map[string]any)
+	if !ok {
+		return ScrapeResponse{}, fmt.Errorf("%w: torrent missing from the scrape response", ErrFailure)
+	}
+
+	seeders, _ := file["complete"].(int)
+	leechers, _ := file["incomplete"].(int)
+	completed, _ := file["downloaded"].(int)
+
+	return ScrapeResponse{Seeders: seeders, Leechers: leechers, Completed: completed}, nil
+}
+
+func (u *UdpTracker) Scrape(ctx context.Context, req Request) (ScrapeResponse, error) {
+	response, _, err := u.request(ctx, req.URL, UDP_ACTION_SCRAPE, req.InfoHash, UDP_SCRAPE_RESPONSE_LENGTH+12)
+	if err != nil {
+		return ScrapeResponse{}, err
+	}
+
+	counts := response[UDP_SCRAPE_RESPONSE_LENGTH:]
+	return ScrapeResponse{
+		Seeders:   int(binary.BigEndian.Uint32(counts[0:4])),
+		Completed: int(binary.BigEndian.Uint32(counts[4:8])),
+		Leechers:  int(binary.BigEndian.Uint32(counts[8:12])),
+	}, nil
+}
+
+func (s *SchemeTracker) Scrape(ctx context.Context, req Request) (ScrapeResponse, error) {
+	tracker := s.Http
+	if u, err := url.Parse(req.URL); err == nil && u.Scheme == "udp" {
+		tracker = s.Udp
+	}
+
+	scraper, ok := tracker.(Scraper)
+	if !ok {
+		return ScrapeResponse{}, fmt.Errorf("%w: %s can't be scraped", ErrFailure, req.URL)
+	}
+
+	return scraper.Scrape(ctx, req)
+}
@@ -0,0 +1,125 @@
+// Package tracker implements the announces and scrapes of BitTorrent trackers: HTTP trackers, BEP 3 with the compact
+// peers of BEP 23, the IPv6 peers of BEP 7 and the scrape convention, and UDP trackers, BEP 15. The statistics
+// announced come from the caller, which keeps track of its downloads.
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// ErrFailure is returned when a tracker can't be reached, or answers with a failure or an invalid response
+var ErrFailure = errors.New("tracker failure")
+
+// Events sent to the trackers along the announces of a download
+const ANNOUNCE_NONE = ""
+const ANNOUNCE_STARTED = "started"
+const ANNOUNCE_COMPLETED = "completed"
+const ANNOUNCE_STOPPED = "stopped"
+
+// Client announces torrents to their tracker, returning the addresses of the peers in the swarm and when to announce
+// again.
+type Client interface {
+	Announce(ctx context.Context, req Request) (Response, error)
+}
+
+// Request is an announce of a torrent to the tracker at URL. Scrapes only use the URL, info hash, User-Agent and
+// headers.
+type Request struct {
+	URL        string
+	InfoHash   []byte
+	PeerId     string
+	Port       int // Port the peers connect to
+	Uploaded   int // Bytes uploaded since the download started
+	Downloaded int // Bytes downloaded since the download started
+	Left       int // Bytes left to download
+	Event      string
+	Key        string      // Hex encoded 4 bytes recognizing the client when its address changes, none when empty
+	IPv6       net.IP      // Announced for IPv6 peers to connect to, along with the address of the request, when set
+	UserAgent  string      // User-Agent of HTTP requests, DEFAULT_USER_AGENT when empty
+	Headers    http.Header // Added to HTTP requests, like the cookies of private trackers
+}
+
+// Response is the answer of a tracker to an announce.
+type Response struct {
+	Peers       []string
+	Interval    time.Duration // Time the tracker asks to wait before the next announce, unknown when 0
+	MinInterval time.Duration // Announces must not be more frequent than this, no minimum when 0
+	Warning     string        // Warning message of the tracker, the announce succeeded anyway
+}
+
+// SchemeTracker announces torrents to HTTP or UDP trackers, depending on the scheme of their announce URL.
+type SchemeTracker struct {
+	Http Client
+	Udp  Client
+}
+
+// NewSchemeTracker returns a client announcing to HTTP trackers through transport, and to UDP trackers opening its
+// sockets with dial.
+func NewSchemeTracker(transport http.RoundTripper, dial func(ctx context.Context, network, address string) (net.Conn, error)) *SchemeTracker {
+	return &SchemeTracker{Http: NewHttpTracker(transport), Udp: NewUdpTracker(dial)}
+}
+
+func (s *SchemeTracker) Announce(ctx context.Context, req Request) (Response, error) {
+	announceURL, err := url.Parse(req.URL)
+	if err != nil {
+		return Response{}, fmt.Errorf("%w: invalid announce URL: %w", ErrFailure, err)
+	}
+
+	if announceURL.Scheme == "udp" {
+		return s.Udp.Announce(ctx, req)
+	}
+
+	return s.Http.Announce(ctx, req)
+}
+
+// ParsePeers returns the peers of a tracker response: the compact IPv4 peers string, or the list of peer
+// dictionaries of the original model with their ip and port, followed by the compact IPv6 peers of peers6, BEP 7.
+// Invalid peer dictionaries are skipped.
+func ParsePeers(res map[string]any) ([]string, error) {
+	var peers []string
+	switch p := res["peers"].(type) {
+	case []byte:
+		// Each peer is represented using 6 bytes. 4 bytes for the IP, and 2 for the port
+		peers = peer.ParseCompact(string(p), peer.COMPACT_IPV4_LENGTH)
+	case []any:
+		for _, entry := range p {
+			dict, ok := entry.(map[string]any)
+			if !ok {
+				continue
+			}
+			host, _ := dict["ip"].([]byte)
+			port, _ := dict["port"].(int)
+			if len(host) == 0 || port <= 0 || port > 65535 {
+				continue
+			}
+
+			// The ip may also be a DNS name
+			if ip := net.ParseIP(string(host)); ip != nil {
+				peers = append(peers, peer.FormatAddress(ip, port))
+			} else {
+				peers = append(peers, net.JoinHostPort(string(host), strconv.Itoa(port)))
+			}
+		}
+	case nil:
+		if _, ok := res["peers6"]; !ok {
+			return nil, fmt.Errorf("%w: response body has no 'peers'", ErrFailure)
+		}
+	default:
+		return nil, fmt.Errorf("%w: in response body 'peers' must be a string or a list", ErrFailure)
+	}
+
+	if peers6, ok := res["peers6"].([]byte); ok {
+		peers = append(peers, peer.ParseCompact(string(peers6), peer.COMPACT_IPV6_LENGTH)...)
+	}
+
+	return peers, nil
+}
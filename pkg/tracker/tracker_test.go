@@ -0,0 +1,246 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// TestScrapeURL checks the scrape URLs derived from the announce URLs, and the trackers refused for not following the
+// convention.
+func TestScrapeURL(t *testing.T) {
+	for _, test := range []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce.php?passkey=1", "http://example.com/x/scrape.php?passkey=1"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+	} {
+		scrape, err := ScrapeURL(test.announce)
+		if test.scrape == "" {
+			if !errors.Is(err, ErrFailure) {
+				t.Fatalf("%s scraped at %s: %v", test.announce, scrape, err)
+			}
+			continue
+		}
+		if err != nil || scrape != test.scrape {
+			t.Fatalf("%s scraped at %s, expected %s: %v", test.announce, scrape, test.scrape, err)
+		}
+	}
+}
+
+// TestHttpTrackerAnnounce checks an HTTP announce sends the parameters and headers of the request, and returns the
+// peers and intervals of the response, or its failure reason.
+func TestHttpTrackerAnnounce(t *testing.T) {
+	var query map[string]string
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = map[string]string{}
+		for name := range r.URL.Query() {
+			query[name] = r.URL.Query().Get(name)
+		}
+		userAgent = r.Header.Get("User-Agent")
+
+		response := map[string]any{"interval": 60, "min interval": 30, "peers": "\x7f\x00\x00\x01\x1a\xe1"}
+		if r.URL.Query().Get("event") == ANNOUNCE_STOPPED {
+			response = map[string]any{"failure reason": "unregistered torrent"}
+		}
+		body, _ := bencode.Marshal(response)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	tracker := NewHttpTracker(http.DefaultTransport)
+	req := Request{
+		URL:      server.URL + "/announce",
+		InfoHash: []byte("01234567890123456789"),
+		PeerId:   "-MB0001-012345678901",
+		Port:     6881,
+		Left:     1_000,
+		Event:    ANNOUNCE_STARTED,
+		Key:      "0a0b0c0d",
+	}
+	res, err := tracker.Announce(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(res.Peers, []string{"127.0.0.1:6881"}) || res.Interval != time.Minute || res.MinInterval != 30*time.Second {
+		t.Fatalf("announce response %+v", res)
+	}
+	for name, value := range map[string]string{"info_hash": string(req.InfoHash), "peer_id": req.PeerId, "port": "6881",
+		"left": "1000", "event": ANNOUNCE_STARTED, "key": "0a0b0c0d", "compact": "1"} {
+		if query[name] != value {
+			t.Fatalf("announce sent %s=%q, expected %q", name, query[name], value)
+		}
+	}
+	if userAgent != DEFAULT_USER_AGENT {
+		t.Fatalf("announce sent User-Agent %q", userAgent)
+	}
+
+	req.Event = ANNOUNCE_STOPPED
+	if _, err := tracker.Announce(context.Background(), req); !errors.Is(err, ErrFailure) {
+		t.Fatalf("failure reason answered with %v", err)
+	}
+}
+
+// udpTrackerReply answers a request received by a fake UDP tracker, the attempt-th with the same action. Returns the
+// datagrams sent back, none to drop the request.
+type udpTrackerReply func(t *testing.T, action uint32, attempt int, request []byte) [][]byte
+
+// serveUdpTracker runs a fake UDP tracker answering the requests with reply, until the test ends. Returns its address.
+func serveUdpTracker(t *testing.T, reply udpTrackerReply) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		attempts := map[uint32]int{}
+		buffer := make([]byte, 1_500)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request := slices.Clone(buffer[:n])
+			action := binary.BigEndian.Uint32(request[8:12])
+			for _, response := range reply(t, action, attempts[action], request) {
+				conn.WriteTo(response, addr)
+			}
+			attempts[action]++
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// udpResponse returns a response to request with action, echoing its transaction ID, followed by body.
+func udpResponse(action uint32, request []byte, body ...byte) []byte {
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, request[12:16]...)
+
+	return append(response, body...)
+}
+
+// TestUdpTrackerAnnounce checks the framing of the connect and announce requests of a UDP announce, and how the
+// responses are handled: retried when lost, skipped for other transactions, and failing on errors or short bodies.
+func TestUdpTrackerAnnounce(t *testing.T) {
+	const connectionId = 0x0102030405060708
+	connect := func(t *testing.T, request []byte) []byte {
+		if len(request) != 16 || binary.BigEndian.Uint64(request[0:8]) != UDP_TRACKER_PROTOCOL_ID {
+			t.Errorf("connect request %x", request)
+		}
+		return udpResponse(UDP_ACTION_CONNECT, request, binary.BigEndian.AppendUint64(nil, connectionId)...)
+	}
+	announce := func(request []byte, peers ...byte) []byte {
+		body := binary.BigEndian.AppendUint32(nil, 60) // Interval
+		body = binary.BigEndian.AppendUint32(body, 1)  // Leechers
+		body = binary.BigEndian.AppendUint32(body, 2)  // Seeders
+		return udpResponse(UDP_ACTION_ANNOUNCE, request, append(body, peers...)...)
+	}
+	peer := []byte{127, 0, 0, 1, 0x1a, 0xe1}
+
+	for _, test := range []struct {
+		name  string
+		reply udpTrackerReply
+		peers []string
+		err   string
+	}{
+		{name: "announce", reply: func(t *testing.T, action uint32, _ int, request []byte) [][]byte {
+			if action == UDP_ACTION_CONNECT {
+				return [][]byte{connect(t, request)}
+			}
+			return [][]byte{announce(request, peer...)}
+		}, peers: []string{"127.0.0.1:6881"}},
+		{name: "lost requests", reply: func(t *testing.T, action uint32, attempt int, request []byte) [][]byte {
+			if attempt == 0 {
+				return nil
+			}
+			if action == UDP_ACTION_CONNECT {
+				return [][]byte{connect(t, request)}
+			}
+			return [][]byte{announce(request, peer...)}
+		}, peers: []string{"127.0.0.1:6881"}},
+		{name: "other transaction", reply: func(t *testing.T, action uint32, _ int, request []byte) [][]byte {
+			if action == UDP_ACTION_CONNECT {
+				return [][]byte{connect(t, request)}
+			}
+			other := slices.Clone(request)
+			other[12] ^= 0xff
+			return [][]byte{announce(other), announce(request, peer...)}
+		}, peers: []string{"127.0.0.1:6881"}},
+		{name: "error", reply: func(t *testing.T, action uint32, _ int, request []byte) [][]byte {
+			if action == UDP_ACTION_CONNECT {
+				return [][]byte{connect(t, request)}
+			}
+			return [][]byte{udpResponse(UDP_ACTION_ERROR, request, []byte("unregistered torrent")...)}
+		}, err: "unregistered torrent"},
+		{name: "short announce", reply: func(t *testing.T, action uint32, _ int, request []byte) [][]byte {
+			if action == UDP_ACTION_CONNECT {
+				return [][]byte{connect(t, request)}
+			}
+			return [][]byte{udpResponse(UDP_ACTION_ANNOUNCE, request, 0, 0, 0, 60)}
+		}, err: "invalid response"},
+	} {
+		var mu sync.Mutex
+		var announced []byte
+		address := serveUdpTracker(t, func(t *testing.T, action uint32, attempt int, request []byte) [][]byte {
+			if action == UDP_ACTION_ANNOUNCE {
+				mu.Lock()
+				announced = request
+				mu.Unlock()
+			}
+			return test.reply(t, action, attempt, request)
+		})
+
+		tracker := NewUdpTracker((&net.Dialer{}).DialContext)
+		tracker.timeout = 50 * time.Millisecond
+		req := Request{
+			URL:      "udp://" + address + "/announce",
+			InfoHash: []byte("01234567890123456789"),
+			PeerId:   "-MB0001-012345678901",
+			Port:     6881,
+			Left:     1_000,
+			Event:    ANNOUNCE_STARTED,
+			Key:      "0a0b0c0d",
+		}
+		res, err := tracker.Announce(context.Background(), req)
+		if test.err != "" {
+			if !errors.Is(err, ErrFailure) || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("%s: announce failed with %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !slices.Equal(res.Peers, test.peers) || res.Interval != time.Minute {
+			t.Fatalf("%s: announce response %+v", test.name, res)
+		}
+
+		// Connection ID, action, transaction ID, then the announce body of BEP 15
+		mu.Lock()
+		request := announced
+		mu.Unlock()
+		if len(request) != 98 || binary.BigEndian.Uint64(request[0:8]) != connectionId ||
+			string(request[16:36]) != string(req.InfoHash) || string(request[36:56]) != req.PeerId ||
+			binary.BigEndian.Uint64(request[64:72]) != 1_000 || binary.BigEndian.Uint32(request[80:84]) != 2 ||
+			binary.BigEndian.Uint32(request[88:92]) != 0x0a0b0c0d || binary.BigEndian.Uint16(request[96:98]) != 6881 {
+			t.Fatalf("%s: announce request %x", test.name, request)
+		}
+	}
+}
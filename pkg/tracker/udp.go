@@ -0,0 +1,207 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/peer"
+)
+
+// Magic constant starting the connect requests of BEP 15
+const UDP_TRACKER_PROTOCOL_ID = 0x41727101980
+
+// Actions of the UDP tracker requests and responses
+const UDP_ACTION_CONNECT = 0
+const UDP_ACTION_ANNOUNCE = 1
+const UDP_ACTION_ERROR = 3
+
+// Wait for the first response, doubled on every retry. BEP 15 waits 15 seconds, shortened as commands are interactive
+const UDP_TRACKER_TIMEOUT = 2 * time.Second
+
+// Requests sent before giving up on a tracker, 2+4+8+16 seconds with the default timeout
+const UDP_TRACKER_ATTEMPTS = 4
+
+// How long a connection ID can be used in announces, after which the tracker requires a new connect
+const UDP_CONNECTION_ID_LIFETIME = time.Minute
+
+// Length of the fixed part of the responses, before the peers of announces
+const UDP_CONNECT_RESPONSE_LENGTH = 16
+const UDP_ANNOUNCE_RESPONSE_LENGTH = 20
+
+// Codes of the announce events in UDP announces, none is 0
+var udpAnnounceEvents = map[string]uint32{
+	ANNOUNCE_COMPLETED: 1,
+	ANNOUNCE_STARTED:   2,
+	ANNOUNCE_STOPPED:   3,
+}
+
+// UdpTracker announces torrents to UDP trackers, BEP 15: a connect request obtains a connection ID, used by the
+// announce request. Unanswered requests are sent again with an exponentially growing timeout.
+type UdpTracker struct {
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	timeout  time.Duration
+	attempts int
+}
+
+// NewUdpTracker creates a UDP tracker client opening its sockets with dial.
+func NewUdpTracker(dial func(ctx context.Context, network, address string) (net.Conn, error)) *UdpTracker {
+	return &UdpTracker{dial: dial, timeout: UDP_TRACKER_TIMEOUT, attempts: UDP_TRACKER_ATTEMPTS}
+}
+
+// errUdpTimeout is returned by an exchange whose response didn't arrive in time, to be retried.
+var errUdpTimeout = errors.New("no response")
+
+func (u *UdpTracker) Announce(ctx context.Context, req Request) (Response, error) {
+	response, ipv6, err := u.request(ctx, req.URL, UDP_ACTION_ANNOUNCE, announceBody(req), UDP_ANNOUNCE_RESPONSE_LENGTH)
+	if err != nil {
+		return Response{}, err
+	}
+
+	// IPv6 trackers answer with IPv6 peers
+	peerLength := peer.COMPACT_IPV4_LENGTH
+	if ipv6 {
+		peerLength = peer.COMPACT_IPV6_LENGTH
+	}
+
+	return Response{
+		Peers:    peer.ParseCompact(string(response[UDP_ANNOUNCE_RESPONSE_LENGTH:]), peerLength),
+		Interval: time.Duration(binary.BigEndian.Uint32(response[8:12])) * time.Second,
+	}, nil
+}
+
+// request sends the request of action with body to the UDP tracker at trackerURL, after a connect request obtaining
+// the connection ID, and returns the response of at least minLength bytes. Also returns whether the tracker was
+// reached over IPv6.
+func (u *UdpTracker) request(ctx context.Context, trackerURL string, action uint32, body []byte, minLength int) ([]byte, bool, error) {
+	parsedURL, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, false, err
+	}
+	if parsedURL.Port() == "" {
+		return nil, false, fmt.Errorf("%w: missing port in %s", ErrFailure, trackerURL)
+	}
+
+	conn, err := u.dial(ctx, "udp", parsedURL.Host)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrFailure, err)
+	}
+	defer conn.Close()
+
+	// Unblock the reads once the request is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	ipv6 := false
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var connectionId uint64
+	var connectedAt time.Time
+	for attempt := 0; attempt < u.attempts; attempt++ {
+		timeout := u.timeout << attempt
+
+		if connectionId == 0 || time.Since(connectedAt) > UDP_CONNECTION_ID_LIFETIME {
+			response, err := u.exchange(ctx, conn, UDP_TRACKER_PROTOCOL_ID, UDP_ACTION_CONNECT, nil, UDP_CONNECT_RESPONSE_LENGTH, timeout)
+			if errors.Is(err, errUdpTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, false, err
+			}
+
+			connectionId = binary.BigEndian.Uint64(response[8:16])
+			connectedAt = time.Now()
+		}
+
+		response, err := u.exchange(ctx, conn, connectionId, action, body, minLength, timeout)
+		if errors.Is(err, errUdpTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		return response, ipv6, nil
+	}
+
+	return nil, false, fmt.Errorf("%w: no response from %s after %d attempts", ErrFailure, parsedURL.Host, u.attempts)
+}
+
+// exchange sends a request and returns the response with the same transaction ID, skipping responses to previous
+// requests. Requests start with connectionId, the protocol ID for connects, then the action and a new transaction ID,
+// followed by body. Returns errUdpTimeout when no response arrives within timeout.
+func (u *UdpTracker) exchange(ctx context.Context, conn net.Conn, connectionId uint64, action uint32, body []byte, minLength int, timeout time.Duration) ([]byte, error) {
+	transactionId := make([]byte, 4)
+	if _, err := rand.Read(transactionId); err != nil {
+		return nil, err
+	}
+
+	request := binary.BigEndian.AppendUint64(nil, connectionId)
+	request = binary.BigEndian.AppendUint32(request, action)
+	request = append(request, transactionId...)
+	request = append(request, body...)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFailure, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buffer := make([]byte, 65507)
+	for {
+		n, err := conn.Read(buffer)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errUdpTimeout
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFailure, err)
+		}
+
+		response := buffer[:n]
+		if n < 8 || string(response[4:8]) != string(transactionId) {
+			continue
+		}
+
+		responseAction := binary.BigEndian.Uint32(response[0:4])
+		if responseAction == UDP_ACTION_ERROR {
+			return nil, fmt.Errorf("%w: %s", ErrFailure, response[8:])
+		}
+		if responseAction != action || n < minLength {
+			return nil, fmt.Errorf("%w: invalid response", ErrFailure)
+		}
+
+		return response, nil
+	}
+}
+
+// announceBody returns the body of the announce request of req, following the transaction ID.
+func announceBody(req Request) []byte {
+	var key uint32
+	if k, err := hex.DecodeString(req.Key); err == nil && len(k) == 4 {
+		key = binary.BigEndian.Uint32(k)
+	}
+
+	request := append([]byte{}, req.InfoHash...)
+	request = append(request, req.PeerId...)
+	request = binary.BigEndian.AppendUint64(request, uint64(req.Downloaded))
+	request = binary.BigEndian.AppendUint64(request, uint64(req.Left))
+	request = binary.BigEndian.AppendUint64(request, uint64(req.Uploaded))
+	request = binary.BigEndian.AppendUint32(request, udpAnnounceEvents[req.Event])
+	request = binary.BigEndian.AppendUint32(request, 0) // IP: the sender's
+	request = binary.BigEndian.AppendUint32(request, key)
+	request = binary.BigEndian.AppendUint32(request, 0xffffffff) // Peers wanted: the tracker's default
+	request = binary.BigEndian.AppendUint16(request, uint16(req.Port))
+
+	return request
+}